@@ -2,6 +2,7 @@ package styx
 
 import (
 	"io"
+	"net"
 
 	"context"
 )
@@ -42,3 +43,62 @@ func (ch *Channel) Conn() interface{} {
 //
 // Existing AuthFunc implementations can be found in the styxauth package.
 type AuthFunc func(rwc *Channel, user, access string) error
+
+// Auth calls fn with a Channel made from ctx and rwc, so that an
+// AuthFunc may be used as an Authenticator.
+func (fn AuthFunc) Auth(ctx context.Context, rwc io.ReadWriteCloser, user, access string) error {
+	return fn(&Channel{ctx, rwc}, user, access)
+}
+
+// An Authenticator authenticates users to a 9P server, as an
+// AuthFunc does, but is better suited to protocols with several
+// rounds of messages between client and server, such as p9sk1.
+//
+// When a client sends a Tauth request, Auth is called in its own
+// goroutine, and may read from and write to rwc, which is connected
+// to the auth file the client opened, for as long as the exchange
+// needs. user and access are the uname and aname fields of the
+// Tauth request. ctx is cancelled when Auth returns, when the
+// client clunks the auth file, or when the connection is closed,
+// and may be passed to RemoteAddr to find the client's address.
+// The result of Auth decides the client's Tattach requests, as
+// described for AuthFunc. Any number of Tattach requests may use
+// the auth file's fid, until it is clunked; each starts a session
+// as the same user, and may name a different file tree from the
+// one given to Auth. Server.Attach can be used to restrict the
+// file trees a user may attach to.
+//
+// If Server.OpenAuth is set, rwc is nil, and Auth is instead
+// called for each Tattach request, to check with the external
+// agent that OpenAuth connects to.
+type Authenticator interface {
+	Auth(ctx context.Context, rwc io.ReadWriteCloser, user, access string) error
+}
+
+// RemoteAddr returns the network address of the client whose
+// connection ctx belongs to, for a Context given to an
+// Authenticator or carried by a Request. It returns nil if the
+// address is not known, such as when the connection is not a
+// net.Conn.
+func RemoteAddr(ctx context.Context) net.Addr {
+	if nc, ok := ctx.Value("conn").(net.Conn); ok {
+		return nc.RemoteAddr()
+	}
+	return nil
+}
+
+// An AttachFunc is called when a client attaches to a file tree
+// with a Tattach message, after any authentication has succeeded.
+// It receives the user name and file tree the client asked for, and
+// returns the name of the user to establish the session as, which
+// becomes the Session's User. An AttachFunc may use this to derive
+// the user from credentials that are not verified with Tauth, such
+// as a pre-shared token passed in the aname. The Conn method of the
+// Channel can be used to find the address of the client. The Channel
+// cannot be read from or written to.
+//
+// If an AttachFunc returns a non-nil error, the attach is rejected,
+// and the error is sent to the client; it should not contain any
+// sensitive information. If it returns an empty user name, the user
+// name given by the client is kept.
+type AttachFunc func(ch *Channel, user, access string) (string, error)
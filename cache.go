@@ -0,0 +1,182 @@
+package styx
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Cache returns a Handler that remembers the results of Twalk and
+// Tstat requests answered by h, and answers later Twalk and Tstat
+// requests for the same paths itself, for the duration ttl. It is
+// meant for handlers whose files are expensive to look up, such as
+// those backed by a remote service, as clients like v9fs stat the
+// same files many times over.
+//
+// A path is forgotten when it is changed through the Cache: when a
+// file is written to, truncated, or has its attributes changed, and
+// when a file is created in, removed from, or renamed within its
+// directory, for the file and the directory both. Changes made by
+// other means are seen once ttl has passed. Qids are kept by the
+// Server, as without a Cache; with QidVersionMtime, the version of
+// a changed file's Qid comes from the modification time h gives it
+// once it has been forgotten.
+//
+// Only successful results are remembered, and directory listings
+// are not. The results are shared by every session, so h should
+// show every user the same files. Times are taken from the
+// Server's Clock. If ttl is not positive, Cache returns h.
+func Cache(h Handler, ttl time.Duration) Handler {
+	if ttl <= 0 {
+		return h
+	}
+	c := &statCache{ttl: ttl, entries: make(map[string]cacheEntry)}
+	return Stack(c, h)
+}
+
+type statCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	swept   time.Time // when expired entries were last removed
+
+	// Incremented whenever entries are forgotten. A result is
+	// only remembered if gen has not changed since its request
+	// was passed on, as it may predate the change.
+	gen uint64
+}
+
+type cacheEntry struct {
+	info    os.FileInfo
+	expires time.Time
+}
+
+// The Context value of a request passed on by a Cache, for its
+// response to be remembered. See reqInfo.cacheStat.
+type cacheKey struct{}
+
+type cacheReq struct {
+	cache *statCache
+	gen   uint64
+}
+
+func (c *statCache) Serve9P(s *Session) {
+	clock := s.conn.srv.clock()
+	for s.Next() {
+		switch req := s.Request().(type) {
+		case Twalk:
+			if info, ok := c.get(req.Path(), clock.Now()); ok {
+				req.Rwalk(info, nil)
+			} else {
+				c.passOn(s, req)
+			}
+		case Tstat:
+			if info, ok := c.get(req.Path(), clock.Now()); ok {
+				req.Rstat(info, nil)
+			} else {
+				c.passOn(s, req)
+			}
+		case Topen:
+			// So that writes to the file are seen.
+			c.passOn(s, req)
+		case Tcreate:
+			c.change(req, req.Path(), req.NewPath())
+			c.passOn(s, req)
+		case Tremove:
+			c.change(req, req.Path(), path.Dir(req.Path()))
+		case Trename:
+			c.change(req, req.OldPath, req.NewPath, path.Dir(req.OldPath))
+		case Tchmod:
+			c.change(req, req.Path())
+		case Tchown:
+			c.change(req, req.Path())
+		case Tutimes:
+			c.change(req, req.Path())
+		case Ttruncate:
+			c.change(req, req.Path())
+		}
+	}
+}
+
+// passOn marks req for its response to be remembered, and passes
+// it to the next handler.
+func (c *statCache) passOn(s *Session, req Request) {
+	c.mu.Lock()
+	gen := c.gen
+	c.mu.Unlock()
+	ctx := context.WithValue(req.Context(), cacheKey{}, cacheReq{c, gen})
+	s.UpdateRequest(req.WithContext(ctx))
+}
+
+// change forgets the files names, which req may change, both now
+// and once req has been answered.
+func (c *statCache) change(req Request, names ...string) {
+	c.forget(names...)
+	go func() {
+		<-req.Context().Done()
+		c.forget(names...)
+	}()
+}
+
+func (c *statCache) forget(names ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, name := range names {
+		delete(c.entries, name)
+	}
+}
+
+func (c *statCache) get(name string, now time.Time) (os.FileInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(e.expires) {
+		delete(c.entries, name)
+		return nil, false
+	}
+	return e.info, true
+}
+
+// put remembers info for the file name, unless files have been
+// forgotten since gen.
+func (c *statCache) put(name string, info os.FileInfo, gen uint64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if now.Sub(c.swept) >= c.ttl {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.swept = now
+	}
+	c.entries[name] = cacheEntry{info, now.Add(c.ttl)}
+}
+
+// cacheStat remembers info, given in a response to t, if t was
+// passed on by a Cache.
+func (t reqInfo) cacheStat(info os.FileInfo) {
+	if r, ok := t.ctx.Value(cacheKey{}).(cacheReq); ok {
+		r.cache.put(t.Path(), info, r.gen, t.session.conn.srv.clock().Now())
+	}
+}
+
+// cacheWrite returns a function to be called after each write to
+// a file opened by t, if t was passed on by a Cache, or nil.
+func (t reqInfo) cacheWrite(name string) func() {
+	r, ok := t.ctx.Value(cacheKey{}).(cacheReq)
+	if !ok {
+		return nil
+	}
+	return func() { r.cache.forget(name) }
+}
@@ -0,0 +1,124 @@
+package styx
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+// A remoteFile is a file whose lookups are counted, like one
+// that is expensive to look up.
+type remoteFile struct {
+	mu      sync.Mutex
+	data    []byte
+	lookups int
+}
+
+func (f *remoteFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off >= int64(len(f.data)) {
+		return 0, nil
+	}
+	return copy(p, f.data[off:]), nil
+}
+
+func (f *remoteFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end := int(off) + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+// lookup returns the file's attributes, as a backend would.
+func (f *remoteFile) lookup() os.FileInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookups++
+	return sizedFile{ownedFile{"file", 0666, "", ""}, int64(len(f.data))}
+}
+
+func (f *remoteFile) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lookups
+}
+
+type sizedFile struct {
+	ownedFile
+	size int64
+}
+
+func (f sizedFile) Size() int64 { return f.size }
+
+func TestCache(t *testing.T) {
+	const ttl = time.Minute
+	file := new(remoteFile)
+	clock := newFakeClock()
+	c := testClient(t, &Server{
+		Clock: clock,
+		Handler: Cache(HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(file.lookup(), nil)
+				case Tstat:
+					req.Rstat(file.lookup(), nil)
+				case Topen:
+					req.Ropen(file, nil)
+				}
+			}
+		}), ttl),
+	})
+	ctx := context.Background()
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, _, err := c.Walk(ctx, root, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := func(wantSize int64, wantLookups int) {
+		t.Helper()
+		st, err := c.Stat(ctx, fid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Length() != wantSize {
+			t.Errorf("stat reports length %d, wanted %d", st.Length(), wantSize)
+		}
+		if n := file.count(); n != wantLookups {
+			t.Errorf("handler looked up the file %d times, wanted %d", n, wantLookups)
+		}
+	}
+
+	// The walk's result is used for both stats.
+	stat(0, 1)
+	stat(0, 1)
+
+	// An open file is stat'ed by the server, so the file is
+	// written through another fid, which is also walked to
+	// from the cache.
+	wfid, _, err := c.Walk(ctx, root, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Open(ctx, wfid, styxproto.ORDWR); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(ctx, wfid, []byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	stat(5, 2)
+	stat(5, 2)
+
+	clock.Advance(ttl)
+	stat(5, 3)
+}
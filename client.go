@@ -0,0 +1,466 @@
+package styx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"context"
+
+	"aqwari.net/net/styx/internal/pool"
+	"aqwari.net/net/styx/styxproto"
+)
+
+var (
+	errClientClosed = errors.New("9p client closed")
+	errTooManyTags  = errors.New("too many outstanding requests")
+	errTooManyFids  = errors.New("too many open fids")
+)
+
+// A Client is a connection to a 9P server. A Client manages the
+// tags and fids used in its requests; fids are handed to the
+// caller as plain integers, and must be released with Clunk once
+// they are no longer needed. A Client is safe for concurrent use
+// by multiple goroutines.
+//
+// Every method takes a Context. If the Context is cancelled before
+// the server responds, the Client sends a Tflush for the request
+// and returns the Context's error once the server acknowledges it.
+type Client struct {
+	rwc     io.ReadWriteCloser
+	enc     *styxproto.Encoder
+	dec     *styxproto.Decoder
+	msize   int64
+	version string
+
+	tags pool.TagPool
+	fids pool.FidPool
+
+	// Responses are handed to the goroutine waiting on their
+	// tag. Because a message is only valid until the next call
+	// to the Decoder's Next method, the receiver must send on
+	// ack once it is done with the message.
+	mu      sync.Mutex
+	pending map[uint16]chan styxproto.Msg
+	ack     chan struct{}
+
+	// closed when the connection is no longer usable. err
+	// holds the reason.
+	done chan struct{}
+	err  error
+}
+
+// Dial connects to the 9P server at addr on the named network,
+// and negotiates the protocol version, as in NewClient.
+func Dial(ctx context.Context, network, addr string) (*Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient starts a 9P client session over rwc. NewClient sends
+// a Tversion request for the 9P2000 protocol and returns an error
+// if the server does not accept it.
+func NewClient(ctx context.Context, rwc io.ReadWriteCloser) (*Client, error) {
+	c := &Client{
+		rwc:     rwc,
+		enc:     styxproto.NewEncoder(rwc),
+		dec:     styxproto.NewDecoder(rwc),
+		msize:   styxproto.DefaultMaxSize,
+		pending: make(map[uint16]chan styxproto.Msg),
+		ack:     make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := c.negotiate(ctx); err != nil {
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// The version exchange happens before any other request, so
+// it is done synchronously.
+func (c *Client) negotiate(ctx context.Context) error {
+	if t, ok := ctx.Deadline(); ok {
+		if nc, ok := c.rwc.(net.Conn); ok {
+			nc.SetDeadline(t)
+			defer nc.SetDeadline(time.Time{})
+		}
+	}
+	c.enc.Tversion(uint32(c.msize), "9P2000")
+	if err := c.enc.Flush(); err != nil {
+		return err
+	}
+	if !c.dec.Next() {
+		if err := c.dec.Err(); err != nil {
+			return err
+		}
+		return io.ErrUnexpectedEOF
+	}
+	switch m := c.dec.Msg().(type) {
+	case styxproto.Rversion:
+		if string(m.Version()) != "9P2000" {
+			return fmt.Errorf("server does not support 9P2000 (%q)", m.Version())
+		}
+		if m.Msize() < c.msize {
+			c.msize = m.Msize()
+		}
+		c.version = string(m.Version())
+	case styxproto.Rerror:
+		return m.Err()
+	default:
+		return fmt.Errorf("unexpected %T response to Tversion", m)
+	}
+	c.enc.MaxSize = c.msize
+	c.dec.MaxSize = c.msize
+	return nil
+}
+
+// Msize returns the maximum message size negotiated with the
+// server.
+func (c *Client) Msize() int64 {
+	return c.msize
+}
+
+// Close closes the connection to the server. Any requests still
+// waiting for a response return an error.
+func (c *Client) Close() error {
+	return c.rwc.Close()
+}
+
+func (c *Client) readLoop() {
+	for c.dec.Next() {
+		m := c.dec.Msg()
+		c.mu.Lock()
+		ch, ok := c.pending[m.Tag()]
+		delete(c.pending, m.Tag())
+		c.mu.Unlock()
+
+		// No one is waiting for a response to flushed
+		// requests.
+		if !ok {
+			continue
+		}
+		ch <- m
+		<-c.ack
+	}
+	c.err = c.dec.Err()
+	if c.err == nil {
+		c.err = errClientClosed
+	}
+	close(c.done)
+}
+
+func (c *Client) register(tag uint16) chan styxproto.Msg {
+	ch := make(chan styxproto.Msg)
+	c.mu.Lock()
+	c.pending[tag] = ch
+	c.mu.Unlock()
+	return ch
+}
+
+func (c *Client) unregister(tag uint16) {
+	c.mu.Lock()
+	delete(c.pending, tag)
+	c.mu.Unlock()
+}
+
+// rpc sends a request with send, and passes the response to
+// recv. The response is only valid for the duration of the call to
+// recv. Rerror responses are converted into errors and not
+// passed to recv.
+func (c *Client) rpc(ctx context.Context, send func(tag uint16) error, recv func(styxproto.Msg) error) error {
+	tag, ok := c.tags.Get()
+	if !ok {
+		return errTooManyTags
+	}
+	// If a flushed request's tag cannot be confirmed free, it
+	// stays out of the pool for good.
+	leak := false
+	defer func() {
+		if !leak {
+			c.tags.Free(tag)
+		}
+	}()
+
+	ch := c.register(tag)
+	if err := send(tag); err != nil {
+		c.unregister(tag)
+		return err
+	}
+	if err := c.enc.Flush(); err != nil {
+		c.unregister(tag)
+		return err
+	}
+
+	select {
+	case m := <-ch:
+		defer func() { c.ack <- struct{}{} }()
+		if rerror, ok := m.(styxproto.Rerror); ok {
+			return rerror.Err()
+		}
+		return recv(m)
+	case <-ctx.Done():
+		leak = !c.flush(tag, ch)
+		return ctx.Err()
+	case <-c.done:
+		return c.err
+	}
+}
+
+// flush cancels the request with the given tag, waiting until the
+// server acknowledges the Tflush. See flush(5). flush reports
+// whether the server is known to be done with oldtag; if it is not,
+// oldtag must not be reused.
+func (c *Client) flush(oldtag uint16, old chan styxproto.Msg) bool {
+	tag, ok := c.tags.Get()
+	if !ok {
+		c.unregister(oldtag)
+		return false
+	}
+	defer c.tags.Free(tag)
+
+	ch := c.register(tag)
+	c.enc.Tflush(tag, oldtag)
+	if c.enc.Flush() != nil {
+		c.unregister(tag)
+		c.unregister(oldtag)
+		return false
+	}
+	for {
+		select {
+		case <-old:
+			// The response beat the Tflush; it is
+			// discarded.
+			c.ack <- struct{}{}
+		case <-ch:
+			c.ack <- struct{}{}
+			c.unregister(oldtag)
+			return true
+		case <-c.done:
+			return false
+		}
+	}
+}
+
+func unexpected(m styxproto.Msg) error {
+	return fmt.Errorf("unexpected %T response", m)
+}
+
+func copyQid(qid styxproto.Qid) styxproto.Qid {
+	return append(styxproto.Qid(nil), qid...)
+}
+
+// Auth allocates a new fid for authenticating uname's access to the
+// file tree aname. If the server requires authentication, the
+// returned fid can be read and written with the Read and Write methods
+// to carry out the authentication protocol, then passed to Attach.
+func (c *Client) Auth(ctx context.Context, uname, aname string) (afid uint32, aqid styxproto.Qid, err error) {
+	afid, ok := c.fids.Get()
+	if !ok {
+		return styxproto.NoFid, nil, errTooManyFids
+	}
+	err = c.rpc(ctx, func(tag uint16) error {
+		c.enc.Tauth(tag, afid, uname, aname)
+		return nil
+	}, func(m styxproto.Msg) error {
+		r, ok := m.(styxproto.Rauth)
+		if !ok {
+			return unexpected(m)
+		}
+		aqid = copyQid(r.Aqid())
+		return nil
+	})
+	if err != nil {
+		c.fids.Free(afid)
+		return styxproto.NoFid, nil, err
+	}
+	return afid, aqid, nil
+}
+
+// Attach starts a new session as the user uname, on the file tree
+// aname. afid should be styxproto.NoFid, or a fid returned by Auth
+// that has completed authentication. Attach returns a fid for the
+// root of the file tree.
+func (c *Client) Attach(ctx context.Context, afid uint32, uname, aname string) (fid uint32, qid styxproto.Qid, err error) {
+	fid, ok := c.fids.Get()
+	if !ok {
+		return styxproto.NoFid, nil, errTooManyFids
+	}
+	err = c.rpc(ctx, func(tag uint16) error {
+		c.enc.Tattach(tag, fid, afid, uname, aname)
+		return nil
+	}, func(m styxproto.Msg) error {
+		r, ok := m.(styxproto.Rattach)
+		if !ok {
+			return unexpected(m)
+		}
+		qid = copyQid(r.Qid())
+		return nil
+	})
+	if err != nil {
+		c.fids.Free(fid)
+		return styxproto.NoFid, nil, err
+	}
+	return fid, qid, nil
+}
+
+// Walk walks from fid through each element of names, returning a new
+// fid for the resulting file and the Qids of each element walked.
+// If names is empty, the new fid is a clone of fid. If the walk does
+// not reach the last element, Walk returns an error, along with the Qids
+// of the elements that were found, and no new fid is allocated.
+func (c *Client) Walk(ctx context.Context, fid uint32, names ...string) (newfid uint32, qids []styxproto.Qid, err error) {
+	if len(names) > styxproto.MaxWElem {
+		return styxproto.NoFid, nil, fmt.Errorf("cannot walk more than %d elements at once", styxproto.MaxWElem)
+	}
+	newfid, ok := c.fids.Get()
+	if !ok {
+		return styxproto.NoFid, nil, errTooManyFids
+	}
+	err = c.rpc(ctx, func(tag uint16) error {
+		return c.enc.Twalk(tag, fid, newfid, names...)
+	}, func(m styxproto.Msg) error {
+		r, ok := m.(styxproto.Rwalk)
+		if !ok {
+			return unexpected(m)
+		}
+		for i := 0; i < r.Nwqid(); i++ {
+			qids = append(qids, copyQid(r.Wqid(i)))
+		}
+		if len(qids) < len(names) {
+			return fmt.Errorf("%s: file does not exist", names[len(qids)])
+		}
+		return nil
+	})
+	if err != nil {
+		c.fids.Free(newfid)
+		return styxproto.NoFid, qids, err
+	}
+	return newfid, qids, nil
+}
+
+// Open prepares fid for I/O. mode is one of the open modes in the styxproto
+// package, such as styxproto.OREAD, optionally combined with
+// styxproto.OTRUNC or styxproto.ORCLOSE.
+func (c *Client) Open(ctx context.Context, fid uint32, mode uint8) (qid styxproto.Qid, iounit int64, err error) {
+	err = c.rpc(ctx, func(tag uint16) error {
+		c.enc.Topen(tag, fid, mode)
+		return nil
+	}, func(m styxproto.Msg) error {
+		r, ok := m.(styxproto.Ropen)
+		if !ok {
+			return unexpected(m)
+		}
+		qid, iounit = copyQid(r.Qid()), r.IOunit()
+		return nil
+	})
+	return qid, iounit, err
+}
+
+// maximum amount of data that fits in a single Tread or Twrite.
+func (c *Client) iounit() int {
+	return int(c.msize - styxproto.IOHeaderSize)
+}
+
+// Read reads up to len(p) bytes from the open fid, starting at offset.
+// Read sends a single Tread request, so it may return fewer bytes than
+// requested. At the end of the file, Read returns 0, io.EOF.
+func (c *Client) Read(ctx context.Context, fid uint32, p []byte, offset int64) (n int, err error) {
+	if len(p) > c.iounit() {
+		p = p[:c.iounit()]
+	}
+	err = c.rpc(ctx, func(tag uint16) error {
+		return c.enc.Tread(tag, fid, offset, int64(len(p)))
+	}, func(m styxproto.Msg) error {
+		r, ok := m.(styxproto.Rread)
+		if !ok {
+			return unexpected(m)
+		}
+		if r.Count() > int64(len(p)) {
+			return fmt.Errorf("server returned %d bytes for %d byte read", r.Count(), len(p))
+		}
+		n, err = io.ReadFull(r, p[:r.Count()])
+		return err
+	})
+	if err == nil && n == 0 && len(p) > 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Write writes p to the open fid at offset, splitting it into multiple
+// Twrite requests if necessary. Write returns the number of bytes
+// written, and an error if fewer than len(p) bytes were written.
+func (c *Client) Write(ctx context.Context, fid uint32, p []byte, offset int64) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > c.iounit() {
+			chunk = chunk[:c.iounit()]
+		}
+		var count int
+		err = c.rpc(ctx, func(tag uint16) error {
+			_, err := c.enc.Twrite(tag, fid, offset, chunk)
+			return err
+		}, func(m styxproto.Msg) error {
+			r, ok := m.(styxproto.Rwrite)
+			if !ok {
+				return unexpected(m)
+			}
+			count = int(r.Count())
+			return nil
+		})
+		n += count
+		offset += int64(count)
+		p = p[count:]
+		if err != nil {
+			return n, err
+		}
+		if count < len(chunk) {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// Stat retrieves the metadata of the file referred to by fid.
+func (c *Client) Stat(ctx context.Context, fid uint32) (stat styxproto.Stat, err error) {
+	err = c.rpc(ctx, func(tag uint16) error {
+		c.enc.Tstat(tag, fid)
+		return nil
+	}, func(m styxproto.Msg) error {
+		r, ok := m.(styxproto.Rstat)
+		if !ok {
+			return unexpected(m)
+		}
+		stat = append(styxproto.Stat(nil), r.Stat()...)
+		return nil
+	})
+	return stat, err
+}
+
+// Clunk releases fid. The fid is released whether or not the server
+// reports an error.
+func (c *Client) Clunk(ctx context.Context, fid uint32) error {
+	defer c.fids.Free(fid)
+	return c.rpc(ctx, func(tag uint16) error {
+		c.enc.Tclunk(tag, fid)
+		return nil
+	}, func(m styxproto.Msg) error {
+		if _, ok := m.(styxproto.Rclunk); !ok {
+			return unexpected(m)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,474 @@
+package styx
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"context"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+type memFile struct {
+	name string
+	*bytes.Reader
+}
+
+func (f memFile) Name() string       { return f.name }
+func (f memFile) Mode() os.FileMode  { return 0444 }
+func (f memFile) IsDir() bool        { return false }
+func (f memFile) ModTime() time.Time { return time.Time{} }
+func (f memFile) Sys() interface{}   { return nil }
+
+// starts a Server on an in-memory listener and returns a Client
+// connected to it.
+func testClient(t *testing.T, srv *Server) *Client {
+	conn := serveConn(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, err := NewClient(ctx, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClient(t *testing.T) {
+	const contents = "hello, world!"
+	newFile := func() memFile {
+		return memFile{"hello", bytes.NewReader([]byte(contents))}
+	}
+	c := testClient(t, &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					if req.Path() == "/hello" {
+						req.Rwalk(newFile(), nil)
+					}
+				case Topen:
+					req.Ropen(newFile(), nil)
+				case Tstat:
+					if req.Path() == "/hello" {
+						req.Rstat(newFile(), nil)
+					}
+				}
+			}
+		}),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	root, qid, err := c.Attach(ctx, styxproto.NoFid, "gopher", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qid.Type()&styxproto.QTDIR == 0 {
+		t.Errorf("root qid %s is not a directory", qid)
+	}
+	if _, _, err := c.Walk(ctx, root, "missing"); err == nil {
+		t.Error("walk to missing file succeeded")
+	}
+	fid, qids, err := c.Walk(ctx, root, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(qids) != 1 {
+		t.Fatalf("got %d qids for 1 element walk", len(qids))
+	}
+	stat, err := c.Stat(ctx, fid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stat.Name()) != "hello" || stat.Length() != int64(len(contents)) {
+		t.Errorf("unexpected stat %s", stat)
+	}
+	if _, _, err := c.Open(ctx, fid, styxproto.OREAD); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, err := c.Read(ctx, fid, buf, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != contents[7:] {
+		t.Errorf("read %q, want %q", got, contents[7:])
+	}
+	if _, err := c.Read(ctx, fid, buf, int64(len(contents))); err != io.EOF {
+		t.Errorf("read at EOF returned %v, want io.EOF", err)
+	}
+	if _, err := c.Write(ctx, fid, []byte("x"), 0); err == nil {
+		t.Error("write to read-only file succeeded")
+	}
+	if err := c.Clunk(ctx, fid); err != nil {
+		t.Error(err)
+	}
+	if _, err := c.Stat(ctx, fid); err == nil || !strings.Contains(err.Error(), "fid") {
+		t.Errorf("stat of clunked fid returned %v", err)
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	c := testClient(t, &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Tstat:
+					<-req.Context().Done()
+				}
+			}
+		}),
+	})
+	root, _, err := c.Attach(context.Background(), styxproto.NoFid, "gopher", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := c.Stat(ctx, root); err != context.DeadlineExceeded {
+		t.Errorf("cancelled Tstat returned %v", err)
+	}
+}
+
+// If a Tflush cannot be sent, the flushed request's tag must not
+// be handed out again, since the server may still answer it.
+func TestClientFlushLeak(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		d := styxproto.NewDecoder(server)
+		e := styxproto.NewEncoder(server)
+		for d.Next() {
+			// answer Tversion, ignore everything else
+			if m, ok := d.Msg().(styxproto.Tversion); ok {
+				e.Rversion(uint32(m.Msize()), "9P2000")
+				e.Flush()
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c, err := NewClient(ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Leave exactly one tag, so there is none left for a Tflush.
+	var last uint16
+	for {
+		tag, ok := c.tags.Get()
+		if !ok {
+			break
+		}
+		last = tag
+	}
+	c.tags.Free(last)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Stat(ctx, 0); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, wanted %v", err, context.DeadlineExceeded)
+	}
+	if tag, ok := c.tags.Get(); ok {
+		t.Errorf("tag %d was reused after an unconfirmed flush", tag)
+	}
+}
+
+// Asks the client to reverse a challenge. Users named "slow"
+// never get a challenge, and wait to be cancelled instead.
+type reverseAuth struct {
+	cancelled chan string
+}
+
+func (a reverseAuth) Auth(ctx context.Context, rwc io.ReadWriteCloser, user, access string) error {
+	if RemoteAddr(ctx) == nil {
+		return errors.New("no remote address")
+	}
+	if user == "slow" {
+		<-ctx.Done()
+		a.cancelled <- user
+		return ctx.Err()
+	}
+	const challenge = "challenge"
+	if _, err := io.WriteString(rwc, challenge); err != nil {
+		return err
+	}
+	buf := make([]byte, len(challenge))
+	if _, err := io.ReadFull(rwc, buf); err != nil {
+		return err
+	}
+	for i := range buf {
+		if buf[i] != challenge[len(challenge)-1-i] {
+			return errors.New("wrong response")
+		}
+	}
+	return nil
+}
+
+func TestAuthenticator(t *testing.T) {
+	auth := reverseAuth{cancelled: make(chan string, 1)}
+	c := testClient(t, &Server{Authenticator: auth})
+	ctx := context.Background()
+
+	login := func(user, response string) error {
+		afid, _, err := c.Auth(ctx, user, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The auth file is a stream; reads and writes must
+		// follow one another without gaps.
+		buf := make([]byte, len("challenge"))
+		n, err := c.Read(ctx, afid, buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "challenge" {
+			t.Fatalf("read %q from afid", buf[:n])
+		}
+		if _, err := c.Write(ctx, afid, []byte(response), int64(n)); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = c.Attach(ctx, afid, user, "")
+		return err
+	}
+	if err := login("glenda", "egnellahc"); err != nil {
+		t.Errorf("attach failed after correct response: %s", err)
+	}
+	if err := login("mallory", "challenge"); err == nil {
+		t.Error("attach succeeded after wrong response")
+	}
+
+	afid, _, err := c.Auth(ctx, "slow", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Clunk(ctx, afid); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-auth.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("Authenticator context not cancelled when afid was clunked")
+	}
+}
+
+func TestAuthMultipleAttach(t *testing.T) {
+	sessions := make(chan string, 10)
+	c := testClient(t, &Server{
+		Authenticator: reverseAuth{cancelled: make(chan string, 1)},
+		Handler: HandlerFunc(func(s *Session) {
+			sessions <- s.User + " " + s.Access
+			for s.Next() {
+			}
+		}),
+	})
+	ctx := context.Background()
+	auth := func(user, response string) uint32 {
+		afid, _, err := c.Auth(ctx, user, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len("challenge"))
+		n, err := c.Read(ctx, afid, buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write(ctx, afid, []byte(response), int64(n)); err != nil {
+			t.Fatal(err)
+		}
+		return afid
+	}
+
+	afid := auth("glenda", "egnellahc")
+	for _, aname := range []string{"a", "b"} {
+		if _, _, err := c.Attach(ctx, afid, "glenda", aname); err != nil {
+			t.Fatalf("attach to %q: %s", aname, err)
+		}
+		if got, want := <-sessions, "glenda "+aname; got != want {
+			t.Errorf("started session %q, wanted %q", got, want)
+		}
+	}
+	if _, _, err := c.Attach(ctx, afid, "mallory", "a"); err == nil {
+		t.Error("attached as another user with glenda's afid")
+	}
+	if err := c.Clunk(ctx, afid); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Attach(ctx, afid, "glenda", "c"); err == nil {
+		t.Error("attached with a clunked afid")
+	}
+
+	// A failed authentication stays failed.
+	afid = auth("mallory", "challenge")
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.Attach(ctx, afid, "mallory", ""); err == nil {
+			t.Errorf("attach %d succeeded after wrong response", i+1)
+		}
+	}
+}
+
+func TestAttachAfid(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := testClient(t, &Server{Authenticator: reverseAuth{cancelled: make(chan string, 1)}})
+	if _, _, err := c.Attach(ctx, styxproto.NoFid, "glenda", ""); err == nil {
+		t.Error("attached without authenticating")
+	}
+	afid, _, err := c.Auth(ctx, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("challenge"))
+	n, err := c.Read(ctx, afid, buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(ctx, afid, []byte("egnellahc"), int64(n)); err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := c.Attach(ctx, afid, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, _, err := c.Walk(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []uint32{root, fid, 31415} {
+		if _, _, err := c.Attach(ctx, bad, "glenda", ""); err == nil {
+			t.Errorf("attached with afid %d, which is not an auth file", bad)
+		}
+	}
+
+	// Without authentication, there are no auth files.
+	c = testClient(t, &Server{})
+	root, _, err = c.Attach(ctx, styxproto.NoFid, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []uint32{root, 31415} {
+		if _, _, err := c.Attach(ctx, bad, "glenda", ""); err == nil {
+			t.Errorf("attached with afid %d to a server without authentication", bad)
+		}
+	}
+}
+
+func TestAuthStat(t *testing.T) {
+	c := testClient(t, &Server{Authenticator: reverseAuth{cancelled: make(chan string, 1)}})
+	ctx := context.Background()
+	afid, aqid, err := c.Auth(ctx, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client's Decoder rejects malformed stats.
+	stat, err := c.Stat(ctx, afid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Qid().Type()&styxproto.QTAUTH == 0 {
+		t.Errorf("QTAUTH not set in %s", stat)
+	}
+	if !stat.Qid().Equal(aqid) {
+		t.Errorf("stat has qid %s, Rauth had %s", stat.Qid(), aqid)
+	}
+	if stat.Mode()&styxproto.DMAUTH == 0 {
+		t.Errorf("DMAUTH not set in %s", stat)
+	}
+	if string(stat.Name()) != "auth" || string(stat.Uid()) != "glenda" {
+		t.Errorf("got stat %s, wanted auth file owned by glenda", stat)
+	}
+}
+
+func TestAuthFunc(t *testing.T) {
+	srv := &Server{
+		Auth: func(ch *Channel, user, access string) error {
+			if ch.Conn() == nil {
+				return errors.New("no connection")
+			}
+			if user != "glenda" {
+				return errors.New("unknown user")
+			}
+			return nil
+		},
+	}
+	c := testClient(t, srv)
+	ctx := context.Background()
+	for user, ok := range map[string]bool{"glenda": true, "mallory": false} {
+		afid, _, err := c.Auth(ctx, user, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.Attach(ctx, afid, user, ""); (err == nil) != ok {
+			t.Errorf("attach as %s: got error %v", user, err)
+		}
+	}
+}
+
+func TestSessionState(t *testing.T) {
+	type state struct {
+		attached, draining, clunked bool
+	}
+	states := make(chan state, 1)
+	srv := &Server{
+		Authenticator: reverseAuth{cancelled: make(chan string, 1)},
+		Handler: Stack(HandlerFunc(func(s *Session) {
+			for s.Next() {
+			}
+		}), HandlerFunc(func(s *Session) {
+			for s.Next() {
+				st := state{attached: s.Attached(), draining: s.Draining()}
+				s.ClunkAll()
+				st.clunked = s.Draining()
+				states <- st
+			}
+		})),
+	}
+	c := testClient(t, srv)
+	ctx := context.Background()
+
+	afid, _, err := c.Auth(ctx, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := srv.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("server has %d sessions, wanted 1", len(sessions))
+	}
+	s := sessions[0]
+	if s.Attached() || s.Draining() {
+		t.Errorf("auth session has Attached %v, Draining %v", s.Attached(), s.Draining())
+	}
+	if s.Protocol() != "9P2000" || s.Msize() != c.Msize() {
+		t.Errorf("session has protocol %q, msize %d; client has msize %d",
+			s.Protocol(), s.Msize(), c.Msize())
+	}
+
+	buf := make([]byte, len("challenge"))
+	n, err := c.Read(ctx, afid, buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(ctx, afid, []byte("egnellahc"), int64(n)); err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := c.Attach(ctx, afid, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Walk(ctx, root, "file")
+	st := <-states
+	if !st.attached || st.draining {
+		t.Errorf("attached session has Attached %v, Draining %v", st.attached, st.draining)
+	}
+	if !st.clunked {
+		t.Error("Draining is false after ClunkAll")
+	}
+}
@@ -0,0 +1,30 @@
+package styx
+
+import "time"
+
+// A Clock tells the time, and waits for it to pass. A Server
+// consults its Clock to enforce IdleTimeout and the ReadLimit
+// and WriteLimit rates, and to time requests in its logs. Tests
+// may supply a Clock they control, to check this behavior
+// without waiting for real time to pass.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends
+	// the current time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock used when Server.Clock is nil.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (srv *Server) clock() Clock {
+	if srv.Clock == nil {
+		return realClock{}
+	}
+	return srv.Clock
+}
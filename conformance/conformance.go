@@ -0,0 +1,197 @@
+/*
+Package conformance checks a 9P server's handling of the messages
+sent by real clients.
+
+Each Scenario is a short exchange: the exact bytes a client sends,
+and the exact bytes the styx package is expected to send back.
+Most of the requests are taken from a capture of the Linux v9fs
+client mounting a styx server, found in the styxproto package's
+testdata/v9fs.client.9p, and are sent with the same tags and fids.
+The capture has no Twrite or Tflush requests, so the scenarios for
+those were written by hand, in the same style.
+
+The responses are those of a styx Server with no options set,
+serving the file tree returned by Tree. They document how such a
+server answers, and guard against changes to it; a change in the
+responses is not necessarily a bug, but should be deliberate.
+*/
+package conformance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"aqwari.net/net/styx"
+	"aqwari.net/net/styx/styxproto"
+)
+
+// A Scenario is an exchange of 9P messages between a client and
+// a server.
+type Scenario struct {
+	// A short name for the scenario, such as "walk".
+	Name string
+
+	// The messages sent by the client, as they appear on the
+	// wire. The first is always a Tversion request.
+	Requests []byte
+
+	// The messages the server is expected to send in response,
+	// in order, as they appear on the wire.
+	Responses []byte
+}
+
+// How long Run waits for each response.
+const responseTimeout = 5 * time.Second
+
+// Run serves the requests of s with srv, over a connection made
+// with net.Pipe, and reports the first response that differs from
+// those in s.Responses. Like the clients they were captured from,
+// Run sends requests as soon as it can, but waits for the response
+// to a request before reusing its tag. For the responses to match,
+// srv should have no options set, and its Handler should be a new
+// Tree.
+func (s Scenario) Run(srv *styx.Server) error {
+	requests, err := split(s.Requests)
+	if err != nil {
+		return fmt.Errorf("%s: bad request: %v", s.Name, err)
+	}
+	want, err := split(s.Responses)
+	if err != nil {
+		return fmt.Errorf("%s: bad response: %v", s.Name, err)
+	}
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		srv.ServeConn(server)
+		close(done)
+	}()
+	defer func() {
+		client.Close()
+		<-done
+	}()
+
+	// Responses are read as they arrive, so that the server is
+	// never blocked writing one while we write a request.
+	responses := make(chan []byte, len(want)+1)
+	go func() {
+		defer close(responses)
+		for {
+			msg, err := readMsg(client)
+			if err != nil {
+				return
+			}
+			responses <- msg
+		}
+	}()
+
+	var (
+		got     int
+		pending = make(map[uint16]bool)
+	)
+	expect := func() error {
+		var msg []byte
+		select {
+		case m, ok := <-responses:
+			if !ok {
+				return fmt.Errorf("connection closed after %d responses", got)
+			}
+			msg = m
+		case <-time.After(responseTimeout):
+			return fmt.Errorf("timed out waiting for response %d", got)
+		}
+		if got >= len(want) {
+			return fmt.Errorf("unexpected response %s", describe(msg))
+		}
+		if !bytes.Equal(msg, want[got]) {
+			return fmt.Errorf("response %d is %s, want %s", got, describe(msg), describe(want[got]))
+		}
+		got++
+		delete(pending, tag(msg))
+		return nil
+	}
+	for _, req := range requests {
+		for pending[tag(req)] {
+			if err := expect(); err != nil {
+				return fmt.Errorf("%s: %v", s.Name, err)
+			}
+		}
+		if _, err := client.Write(req); err != nil {
+			return fmt.Errorf("%s: sending %s: %v", s.Name, describe(req), err)
+		}
+		pending[tag(req)] = true
+	}
+	for got < len(want) {
+		if err := expect(); err != nil {
+			return fmt.Errorf("%s: %v", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// split divides a sequence of 9P messages into single messages.
+func split(data []byte) ([][]byte, error) {
+	var msgs [][]byte
+	for len(data) > 0 {
+		msg, err := readMsg(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+		data = data[len(msg):]
+	}
+	return msgs, nil
+}
+
+// readMsg reads one 9P message from r, by its size field.
+func readMsg(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n < 7 || n > styxproto.DefaultMaxSize {
+		return nil, fmt.Errorf("bad message size %d", n)
+	}
+	msg := make([]byte, n)
+	copy(msg, size[:])
+	if _, err := io.ReadFull(r, msg[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+func tag(msg []byte) uint16 {
+	return binary.LittleEndian.Uint16(msg[5:7])
+}
+
+// describe formats msg for an error message.
+func describe(msg []byte) string {
+	if m, err := styxproto.Unmarshal(msg); err == nil {
+		return fmt.Sprintf("%q (%x)", fmt.Sprint(m), msg)
+	}
+	return fmt.Sprintf("%x", msg)
+}
+
+// msgs decodes messages written in hexadecimal, one per string.
+// Spaces are ignored.
+func msgs(hexMsgs ...string) []byte {
+	var buf []byte
+	for _, s := range hexMsgs {
+		b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+		if err != nil {
+			panic(err)
+		}
+		buf = append(buf, b...)
+	}
+	return buf
+}
@@ -0,0 +1,29 @@
+package conformance
+
+import (
+	"testing"
+
+	"aqwari.net/net/styx"
+)
+
+func TestScenarios(t *testing.T) {
+	for _, s := range Scenarios {
+		if err := s.Run(&styx.Server{Handler: Tree()}); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// A Scenario reports responses that differ from the ones it expects.
+func TestMismatch(t *testing.T) {
+	s := Scenarios[0]
+	s.Responses = append([]byte(nil), s.Responses...)
+	s.Responses[len(s.Responses)-1]++
+	if err := s.Run(&styx.Server{Handler: Tree()}); err == nil {
+		t.Error("no error for a changed response")
+	}
+	s.Responses = append(s.Responses, s.Responses...)
+	if err := s.Run(&styx.Server{Handler: Tree()}); err == nil {
+		t.Error("no error for a missing response")
+	}
+}
@@ -0,0 +1,419 @@
+package conformance
+
+// Scenarios are the exchanges checked by this package. Requests
+// taken from the v9fs capture are sent unchanged; those of the
+// "version-9P2000.L", "version-unknown", "write", and "flush"
+// scenarios were written by hand.
+var Scenarios = []Scenario{
+	// Version negotiation, as v9fs does it with -o version=9p2000.
+	{
+		Name: "version",
+		Requests: msgs(
+			// Tversion msize=8192 version="9P2000"
+			"13000000 64 ffff 0020000006003950 32303030",
+		),
+		Responses: msgs(
+			// Rversion msize=8192 version="9P2000"
+			"13000000 65 ffff 0020000006003950 32303030",
+		),
+	},
+	// Written by hand: a client asking for 9P2000.L, as v9fs does by
+	// default, is offered 9P2000.
+	{
+		Name: "version-9P2000.L",
+		Requests: msgs(
+			// Tversion msize=8192 version="9P2000.L"
+			"15000000 64 ffff 0020000008003950 323030302e4c",
+		),
+		Responses: msgs(
+			// Rversion msize=8192 version="9P2000"
+			"13000000 65 ffff 0020000006003950 32303030",
+		),
+	},
+	// Written by hand: a version that is not a 9P2000 dialect is
+	// declined.
+	{
+		Name: "version-unknown",
+		Requests: msgs(
+			// Tversion msize=8192 version="9P3000"
+			"13000000 64 ffff 0020000006003950 33303030",
+		),
+		Responses: msgs(
+			// Rversion msize=8192 version="unknown"
+			"14000000 65 ffff 002000000700756e 6b6e6f776e",
+		),
+	},
+	// The client attaches, and stats the root twice, as v9fs does when
+	// mounting, and once more before unmounting.
+	{
+		Name: "attach",
+		Requests: msgs(
+			// Tversion msize=8192 version="9P2000"
+			"13000000 64 ffff 0020000006003950 32303030",
+			// Tattach fid=0 afid=NOFID uname="nobody" aname=""
+			"19000000 68 0100 00000000ffffffff 06006e6f626f6479 0000",
+			"0b000000 7c 0100 00000000", // Tstat fid=0
+			"0b000000 7c 0100 00000000", // Tstat fid=0
+			"0b000000 7c 0100 00000000", // Tstat fid=0
+			"0b000000 78 0100 00000000", // Tclunk fid=0
+		),
+		Responses: msgs(
+			// Rversion msize=8192 version="9P2000"
+			"13000000 65 ffff 0020000006003950 32303030",
+			// Rattach qid="type=128 ver=0 path=1"
+			"14000000 69 0100 8000000000010000 0000000000",
+			// Rstat type=0 dev=0 qid="type=128 ver=0 path=1" mode=20000000775
+			// 	atime=1472096970 mtime=1472096970 length=0 name="." uid="droyo"
+			// 	gid="" muid="droyo"
+			"45000000 7d 0100 3c003a0000000000 0000800000000001 "+
+				"00000000000000fd 010080ca6abe57ca 6abe570000000000 "+
+				"00000001002e0500 64726f796f000005 0064726f796f",
+			// Rstat type=0 dev=0 qid="type=128 ver=0 path=1" mode=20000000775
+			// 	atime=1472096970 mtime=1472096970 length=0 name="." uid="droyo"
+			// 	gid="" muid="droyo"
+			"45000000 7d 0100 3c003a0000000000 0000800000000001 "+
+				"00000000000000fd 010080ca6abe57ca 6abe570000000000 "+
+				"00000001002e0500 64726f796f000005 0064726f796f",
+			// Rstat type=0 dev=0 qid="type=128 ver=0 path=1" mode=20000000775
+			// 	atime=1472096970 mtime=1472096970 length=0 name="." uid="droyo"
+			// 	gid="" muid="droyo"
+			"45000000 7d 0100 3c003a0000000000 0000800000000001 "+
+				"00000000000000fd 010080ca6abe57ca 6abe570000000000 "+
+				"00000001002e0500 64726f796f000005 0064726f796f",
+			"07000000 79 0100", // Rclunk
+		),
+	},
+	// Walks to an existing file, to a missing one, and a clone of the root.
+	{
+		Name: "walk",
+		Requests: msgs(
+			// Tversion msize=8192 version="9P2000"
+			"13000000 64 ffff 0020000006003950 32303030",
+			// Tattach fid=0 afid=NOFID uname="nobody" aname=""
+			"19000000 68 0100 00000000ffffffff 06006e6f626f6479 0000",
+			// Twalk fid=0 newfid=2 "bye"
+			"16000000 6e 0100 0000000002000000 01000300627965",
+			"0b000000 7c 0100 02000000", // Tstat fid=2
+			"0b000000 78 0100 02000000", // Tclunk fid=2
+			// Twalk fid=0 newfid=1 "foo"
+			"16000000 6e 0100 0000000001000000 01000300666f6f",
+			// Twalk fid=0 newfid=1 "foo"
+			"16000000 6e 0100 0000000001000000 01000300666f6f",
+			"11000000 6e 0100 0000000001000000 0000", // Twalk fid=0 newfid=1 ""
+			"0b000000 78 0100 01000000",              // Tclunk fid=1
+		),
+		Responses: msgs(
+			// Rversion msize=8192 version="9P2000"
+			"13000000 65 ffff 0020000006003950 32303030",
+			// Rattach qid="type=128 ver=0 path=1"
+			"14000000 69 0100 8000000000010000 0000000000",
+			// Rwalk wqid="type=0 ver=0 path=2"
+			"16000000 6f 0100 0100000000000002 00000000000000",
+			// Rstat type=0 dev=0 qid="type=0 ver=0 path=2" mode=644
+			// 	atime=1472096970 mtime=1472096970 length=0 name="bye"
+			// 	uid="droyo" gid="" muid="droyo"
+			"47000000 7d 0100 3e003c0000000000 0000000000000002 "+
+				"00000000000000a4 010000ca6abe57ca 6abe570000000000 "+
+				"0000000300627965 050064726f796f00 00050064726f796f",
+			"07000000 79 0100", // Rclunk
+			// Rerror ename="file does not exist"
+			"1c000000 6b 0100 130066696c652064 6f6573206e6f7420 "+
+				"6578697374",
+			// Rerror ename="file does not exist"
+			"1c000000 6b 0100 130066696c652064 6f6573206e6f7420 "+
+				"6578697374",
+			"09000000 6f 0100 0000", // Rwalk wqid=""
+			"07000000 79 0100",      // Rclunk
+		),
+	},
+	// The root is listed. v9fs reads again at the offset of the
+	// end of the listing until it gets nothing back.
+	{
+		Name: "dirread",
+		Requests: msgs(
+			// Tversion msize=8192 version="9P2000"
+			"13000000 64 ffff 0020000006003950 32303030",
+			// Tattach fid=0 afid=NOFID uname="nobody" aname=""
+			"19000000 68 0100 00000000ffffffff 06006e6f626f6479 0000",
+			"11000000 6e 0100 0000000001000000 0000", // Twalk fid=0 newfid=1 ""
+			"0c000000 70 0100 0100000000",            // Topen fid=1 mode=0
+			"0b000000 7c 0100 00000000",              // Tstat fid=0
+			// Tread fid=1 offset=0 count=8168
+			"17000000 74 0100 0100000000000000 00000000e81f0000",
+			// Tread fid=1 offset=126 count=8042
+			"17000000 74 0100 010000007e000000 000000006a1f0000",
+			// Tread fid=1 offset=126 count=8168
+			"17000000 74 0100 010000007e000000 00000000e81f0000",
+			"0b000000 78 0100 01000000", // Tclunk fid=1
+		),
+		Responses: msgs(
+			// Rversion msize=8192 version="9P2000"
+			"13000000 65 ffff 0020000006003950 32303030",
+			// Rattach qid="type=128 ver=0 path=1"
+			"14000000 69 0100 8000000000010000 0000000000",
+			"09000000 6f 0100 0000", // Rwalk wqid=""
+			// Ropen qid="type=128 ver=0 path=1" iounit=0
+			"18000000 71 0100 8000000000010000 0000000000000000 00",
+			// Rstat type=0 dev=0 qid="type=128 ver=0 path=1" mode=20000000775
+			// 	atime=1472096970 mtime=1472096970 length=0 name="." uid="droyo"
+			// 	gid="" muid="droyo"
+			"45000000 7d 0100 3c003a0000000000 0000800000000001 "+
+				"00000000000000fd 010080ca6abe57ca 6abe570000000000 "+
+				"00000001002e0500 64726f796f000005 0064726f796f",
+			// Rread count=126
+			"89000000 75 0100 7e0000003c000000 0000000000000000 "+
+				"0005000000000000 00a4010000ca6abe 57ca6abe57000000 "+
+				"0000000000030062 7965050064726f79 6f0000050064726f "+
+				"796f3e0000000000 0000000000000006 00000000000000b4 "+
+				"010000ca6abe57ca 6abe570000000000 000000050068656c "+
+				"6c6f050064726f79 6f0000050064726f 796f",
+			"0b000000 75 0100 00000000", // Rread count=0
+			"0b000000 75 0100 00000000", // Rread count=0
+			"07000000 79 0100",          // Rclunk
+		),
+	},
+	// Stats of a file through its own fid.
+	{
+		Name: "stat",
+		Requests: msgs(
+			// Tversion msize=8192 version="9P2000"
+			"13000000 64 ffff 0020000006003950 32303030",
+			// Tattach fid=0 afid=NOFID uname="nobody" aname=""
+			"19000000 68 0100 00000000ffffffff 06006e6f626f6479 0000",
+			// Twalk fid=0 newfid=2 "hello"
+			"18000000 6e 0100 0000000002000000 0100050068656c6c 6f",
+			"0b000000 7c 0100 02000000", // Tstat fid=2
+			"0b000000 7c 0100 02000000", // Tstat fid=2
+			"0b000000 78 0100 02000000", // Tclunk fid=2
+		),
+		Responses: msgs(
+			// Rversion msize=8192 version="9P2000"
+			"13000000 65 ffff 0020000006003950 32303030",
+			// Rattach qid="type=128 ver=0 path=1"
+			"14000000 69 0100 8000000000010000 0000000000",
+			// Rwalk wqid="type=0 ver=0 path=2"
+			"16000000 6f 0100 0100000000000002 00000000000000",
+			// Rstat type=0 dev=0 qid="type=0 ver=0 path=2" mode=664
+			// 	atime=1472096970 mtime=1472096970 length=0 name="hello"
+			// 	uid="droyo" gid="" muid="droyo"
+			"49000000 7d 0100 40003e0000000000 0000000000000002 "+
+				"00000000000000b4 010000ca6abe57ca 6abe570000000000 "+
+				"000000050068656c 6c6f050064726f79 6f0000050064726f 796f",
+			// Rstat type=0 dev=0 qid="type=0 ver=0 path=2" mode=664
+			// 	atime=1472096970 mtime=1472096970 length=0 name="hello"
+			// 	uid="droyo" gid="" muid="droyo"
+			"49000000 7d 0100 40003e0000000000 0000000000000002 "+
+				"00000000000000b4 010000ca6abe57ca 6abe570000000000 "+
+				"000000050068656c 6c6f050064726f79 6f0000050064726f 796f",
+			"07000000 79 0100", // Rclunk
+		),
+	},
+	// A file is created, and its modification time set, as by touch(1).
+	{
+		Name: "create",
+		Requests: msgs(
+			// Tversion msize=8192 version="9P2000"
+			"13000000 64 ffff 0020000006003950 32303030",
+			// Tattach fid=0 afid=NOFID uname="nobody" aname=""
+			"19000000 68 0100 00000000ffffffff 06006e6f626f6479 0000",
+			"11000000 6e 0100 0000000001000000 0000", // Twalk fid=0 newfid=1 ""
+			// Tcreate fid=1 name="foo" perm=644 mode=01
+			"15000000 72 0100 010000000300666f 6fa401000001",
+			// Twalk fid=0 newfid=2 "foo"
+			"16000000 6e 0100 0000000002000000 01000300666f6f",
+			"0b000000 7c 0100 02000000", // Tstat fid=2
+			// Twstat fid=2 stat="type=ffff dev=ffffffff qid=\"type=255
+			// 	ver=4294967295 path=ffffffffffffffff\" mode=37777777777
+			// 	atime=1472097260 mtime=1472097260 length=-1 name=\"\" uid=\"\"
+			// 	gid=\"\" muid=\"\""
+			"3e000000 7e 0100 0200000031002f00 ffffffffffffffff "+
+				"ffffffffffffffff ffffffffffffffec 6bbe57ec6bbe57ff "+
+				"ffffffffffffff00 00000000000000",
+			"0b000000 78 0100 01000000", // Tclunk fid=1
+			"0b000000 78 0100 02000000", // Tclunk fid=2
+		),
+		Responses: msgs(
+			// Rversion msize=8192 version="9P2000"
+			"13000000 65 ffff 0020000006003950 32303030",
+			// Rattach qid="type=128 ver=0 path=1"
+			"14000000 69 0100 8000000000010000 0000000000",
+			"09000000 6f 0100 0000", // Rwalk wqid=""
+			// Rcreate qid="type=0 ver=0 path=3" iounit=0
+			"18000000 73 0100 0000000000030000 0000000000000000 00",
+			// Rwalk wqid="type=0 ver=0 path=3"
+			"16000000 6f 0100 0100000000000003 00000000000000",
+			// Rstat type=0 dev=0 qid="type=0 ver=0 path=3" mode=644
+			// 	atime=1472096970 mtime=1472096970 length=0 name="foo"
+			// 	uid="droyo" gid="" muid="droyo"
+			"47000000 7d 0100 3e003c0000000000 0000000000000003 "+
+				"00000000000000a4 010000ca6abe57ca 6abe570000000000 "+
+				"0000000300666f6f 050064726f796f00 00050064726f796f",
+			"07000000 7f 0100", // Rwstat
+			"07000000 79 0100", // Rclunk
+			"07000000 79 0100", // Rclunk
+		),
+	},
+	// A file is removed through a clone of its fid, as by rm(1). It
+	// cannot be walked to afterwards.
+	{
+		Name: "remove",
+		Requests: msgs(
+			// Tversion msize=8192 version="9P2000"
+			"13000000 64 ffff 0020000006003950 32303030",
+			// Tattach fid=0 afid=NOFID uname="nobody" aname=""
+			"19000000 68 0100 00000000ffffffff 06006e6f626f6479 0000",
+			// Twalk fid=0 newfid=1 "hello"
+			"18000000 6e 0100 0000000001000000 0100050068656c6c 6f",
+			"0b000000 7c 0100 01000000",              // Tstat fid=1
+			"11000000 6e 0100 0100000002000000 0000", // Twalk fid=1 newfid=2 ""
+			"0b000000 7a 0100 02000000",              // Tremove fid=2
+			"0b000000 78 0100 01000000",              // Tclunk fid=1
+			// Twalk fid=0 newfid=1 "hello"
+			"18000000 6e 0100 0000000001000000 0100050068656c6c 6f",
+		),
+		Responses: msgs(
+			// Rversion msize=8192 version="9P2000"
+			"13000000 65 ffff 0020000006003950 32303030",
+			// Rattach qid="type=128 ver=0 path=1"
+			"14000000 69 0100 8000000000010000 0000000000",
+			// Rwalk wqid="type=0 ver=0 path=2"
+			"16000000 6f 0100 0100000000000002 00000000000000",
+			// Rstat type=0 dev=0 qid="type=0 ver=0 path=2" mode=664
+			// 	atime=1472096970 mtime=1472096970 length=0 name="hello"
+			// 	uid="droyo" gid="" muid="droyo"
+			"49000000 7d 0100 40003e0000000000 0000000000000002 "+
+				"00000000000000b4 010000ca6abe57ca 6abe570000000000 "+
+				"000000050068656c 6c6f050064726f79 6f0000050064726f 796f",
+			"09000000 6f 0100 0000", // Rwalk wqid=""
+			"07000000 7b 0100",      // Rremove
+			"07000000 79 0100",      // Rclunk
+			// Rerror ename="file does not exist"
+			"1c000000 6b 0100 130066696c652064 6f6573206e6f7420 "+
+				"6578697374",
+		),
+	},
+	// A file is opened for writing, and its modification time set, as
+	// by touch(1) on an existing file.
+	{
+		Name: "open-write",
+		Requests: msgs(
+			// Tversion msize=8192 version="9P2000"
+			"13000000 64 ffff 0020000006003950 32303030",
+			// Tattach fid=0 afid=NOFID uname="nobody" aname=""
+			"19000000 68 0100 00000000ffffffff 06006e6f626f6479 0000",
+			// Twalk fid=0 newfid=1 "bye"
+			"16000000 6e 0100 0000000001000000 01000300627965",
+			"0b000000 7c 0100 01000000",              // Tstat fid=1
+			"11000000 6e 0100 0100000002000000 0000", // Twalk fid=1 newfid=2 ""
+			"0c000000 70 0100 0200000001",            // Topen fid=2 mode=01
+			// Twstat fid=1 stat="type=ffff dev=ffffffff qid=\"type=255
+			// 	ver=4294967295 path=ffffffffffffffff\" mode=37777777777
+			// 	atime=1472097271 mtime=1472097271 length=-1 name=\"\" uid=\"\"
+			// 	gid=\"\" muid=\"\""
+			"3e000000 7e 0100 0100000031002f00 ffffffffffffffff "+
+				"ffffffffffffffff fffffffffffffff7 6bbe57f76bbe57ff "+
+				"ffffffffffffff00 00000000000000",
+			"0b000000 78 0100 02000000", // Tclunk fid=2
+			"0b000000 78 0100 01000000", // Tclunk fid=1
+		),
+		Responses: msgs(
+			// Rversion msize=8192 version="9P2000"
+			"13000000 65 ffff 0020000006003950 32303030",
+			// Rattach qid="type=128 ver=0 path=1"
+			"14000000 69 0100 8000000000010000 0000000000",
+			// Rwalk wqid="type=0 ver=0 path=2"
+			"16000000 6f 0100 0100000000000002 00000000000000",
+			// Rstat type=0 dev=0 qid="type=0 ver=0 path=2" mode=644
+			// 	atime=1472096970 mtime=1472096970 length=0 name="bye"
+			// 	uid="droyo" gid="" muid="droyo"
+			"47000000 7d 0100 3e003c0000000000 0000000000000002 "+
+				"00000000000000a4 010000ca6abe57ca 6abe570000000000 "+
+				"0000000300627965 050064726f796f00 00050064726f796f",
+			"09000000 6f 0100 0000", // Rwalk wqid=""
+			// Ropen qid="type=0 ver=0 path=2" iounit=0
+			"18000000 71 0100 0000000000020000 0000000000000000 00",
+			"07000000 7f 0100", // Rwstat
+			"07000000 79 0100", // Rclunk
+			"07000000 79 0100", // Rclunk
+		),
+	},
+	// Written by hand: a file is truncated and written, then read back.
+	{
+		Name: "write",
+		Requests: msgs(
+			// Tversion msize=8192 version="9P2000"
+			"13000000 64 ffff 0020000006003950 32303030",
+			// Tattach fid=0 afid=NOFID uname="nobody" aname=""
+			"19000000 68 0100 00000000ffffffff 06006e6f626f6479 0000",
+			// Twalk fid=0 newfid=1 "hello"
+			"18000000 6e 0100 0000000001000000 0100050068656c6c 6f",
+			"0c000000 70 0100 0100000011", // Topen fid=1 mode=021
+			// Twrite fid=1 offset=0 count=13
+			"24000000 76 0100 0100000000000000 000000000d000000 "+
+				"68656c6c6f2c2077 6f726c640a",
+			"0b000000 78 0100 01000000", // Tclunk fid=1
+			// Twalk fid=0 newfid=1 "hello"
+			"18000000 6e 0100 0000000001000000 0100050068656c6c 6f",
+			"0c000000 70 0100 0100000000", // Topen fid=1 mode=0
+			// Tread fid=1 offset=0 count=8168
+			"17000000 74 0100 0100000000000000 00000000e81f0000",
+			// Tread fid=1 offset=13 count=8168
+			"17000000 74 0100 010000000d000000 00000000e81f0000",
+			"0b000000 7c 0100 01000000", // Tstat fid=1
+			"0b000000 78 0100 01000000", // Tclunk fid=1
+		),
+		Responses: msgs(
+			// Rversion msize=8192 version="9P2000"
+			"13000000 65 ffff 0020000006003950 32303030",
+			// Rattach qid="type=128 ver=0 path=1"
+			"14000000 69 0100 8000000000010000 0000000000",
+			// Rwalk wqid="type=0 ver=0 path=2"
+			"16000000 6f 0100 0100000000000002 00000000000000",
+			// Ropen qid="type=0 ver=0 path=2" iounit=0
+			"18000000 71 0100 0000000000020000 0000000000000000 00",
+			"0b000000 77 0100 0d000000", // Rwrite count=13
+			"07000000 79 0100",          // Rclunk
+			// Rwalk wqid="type=0 ver=0 path=2"
+			"16000000 6f 0100 0100000000000002 00000000000000",
+			// Ropen qid="type=0 ver=0 path=2" iounit=0
+			"18000000 71 0100 0000000000020000 0000000000000000 00",
+			"18000000 75 0100 0d00000068656c6c 6f2c20776f726c64 0a", // Rread count=13
+			"0b000000 75 0100 00000000",                             // Rread count=0
+			// Rstat type=0 dev=0 qid="type=0 ver=0 path=2" mode=664
+			// 	atime=1472096970 mtime=1472096970 length=13 name="hello"
+			// 	uid="droyo" gid="" muid="droyo"
+			"49000000 7d 0100 40003e0000000000 0000000000000002 "+
+				"00000000000000b4 010000ca6abe57ca 6abe570d00000000 "+
+				"000000050068656c 6c6f050064726f79 6f0000050064726f 796f",
+			"07000000 79 0100", // Rclunk
+		),
+	},
+	// Written by hand: Tflush requests for tags with no request in
+	// progress, which are answered at once.
+	{
+		Name: "flush",
+		Requests: msgs(
+			// Tversion msize=8192 version="9P2000"
+			"13000000 64 ffff 0020000006003950 32303030",
+			// Tattach fid=0 afid=NOFID uname="nobody" aname=""
+			"19000000 68 0100 00000000ffffffff 06006e6f626f6479 0000",
+			"09000000 6c 0100 0500",     // Tflush oldtag=5
+			"0b000000 7c 0100 00000000", // Tstat fid=0
+			"09000000 6c 0100 0200",     // Tflush oldtag=2
+		),
+		Responses: msgs(
+			// Rversion msize=8192 version="9P2000"
+			"13000000 65 ffff 0020000006003950 32303030",
+			// Rattach qid="type=128 ver=0 path=1"
+			"14000000 69 0100 8000000000010000 0000000000",
+			"07000000 6d 0100", // Rflush
+			// Rstat type=0 dev=0 qid="type=128 ver=0 path=1" mode=20000000775
+			// 	atime=1472096970 mtime=1472096970 length=0 name="." uid="droyo"
+			// 	gid="" muid="droyo"
+			"45000000 7d 0100 3c003a0000000000 0000800000000001 "+
+				"00000000000000fd 010080ca6abe57ca 6abe570000000000 "+
+				"00000001002e0500 64726f796f000005 0064726f796f",
+			"07000000 6d 0100", // Rflush
+		),
+	},
+}
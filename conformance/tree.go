@@ -0,0 +1,218 @@
+package conformance
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"aqwari.net/net/styx"
+)
+
+// The time given to every file in the tree, until a client
+// changes it. It is the time of the v9fs capture.
+var epoch = time.Unix(1472096970, 0)
+
+// Tree returns a Handler serving the file tree that the Scenarios
+// expect. Its root holds two empty files, "bye" and "hello", as the
+// directory did when the v9fs capture was made. Clients may read,
+// write, create, and remove files, and change their modification
+// times. Changes are seen by every connection to the Handler, so
+// each Scenario should be run with a new Tree. Files are owned by
+// the user "droyo", and have no group.
+func Tree() styx.Handler {
+	t := &tree{files: make(map[string]*node)}
+	t.files["/"] = &node{name: "/", mode: os.ModeDir | 0775, mtime: epoch}
+	t.files["/bye"] = &node{name: "bye", mode: 0644, mtime: epoch}
+	t.files["/hello"] = &node{name: "hello", mode: 0664, mtime: epoch}
+	return t
+}
+
+type tree struct {
+	mu    sync.Mutex
+	files map[string]*node
+}
+
+// A node is a file in a tree. Its fields are guarded by the
+// tree's mutex; the copies of a node that are passed to the
+// styx package are taken with it held.
+type node struct {
+	name  string
+	mode  os.FileMode
+	mtime time.Time
+	data  []byte
+}
+
+// os.FileInfo
+func (n *node) Name() string       { return n.name }
+func (n *node) Size() int64        { return int64(len(n.data)) }
+func (n *node) Mode() os.FileMode  { return n.mode }
+func (n *node) ModTime() time.Time { return n.mtime }
+func (n *node) IsDir() bool        { return n.mode.IsDir() }
+func (n *node) Sys() interface{}   { return nil }
+
+// styx.OwnerInfo
+func (n *node) Uid() string  { return "droyo" }
+func (n *node) Gid() string  { return "" }
+func (n *node) Muid() string { return "droyo" }
+
+// stat returns a copy of the node at name, if there is one.
+func (t *tree) stat(name string) (*node, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, ok := t.files[name]
+	if !ok {
+		return nil, false
+	}
+	c := *n
+	return &c, true
+}
+
+// children returns copies of the nodes in the directory dir,
+// sorted by name.
+func (t *tree) children(dir string) []os.FileInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var names []string
+	for name := range t.files {
+		if name != "/" && path.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	files := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		c := *t.files[name]
+		files = append(files, &c)
+	}
+	return files
+}
+
+// An openFile is a regular file opened by a client.
+type openFile struct {
+	t    *tree
+	name string
+}
+
+func (f openFile) ReadAt(p []byte, off int64) (int, error) {
+	f.t.mu.Lock()
+	defer f.t.mu.Unlock()
+	n, ok := f.t.files[f.name]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	if off >= int64(len(n.data)) {
+		return 0, io.EOF
+	}
+	return copy(p, n.data[off:]), nil
+}
+
+func (f openFile) WriteAt(p []byte, off int64) (int, error) {
+	f.t.mu.Lock()
+	defer f.t.mu.Unlock()
+	n, ok := f.t.files[f.name]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	if end := off + int64(len(p)); end > int64(len(n.data)) {
+		n.data = resize(n.data, end)
+	}
+	return copy(n.data[off:], p), nil
+}
+
+// resize returns data, cut short or padded with zeros to size
+// bytes.
+func resize(data []byte, size int64) []byte {
+	if size <= int64(len(data)) {
+		return data[:size]
+	}
+	return append(data, make([]byte, size-int64(len(data)))...)
+}
+
+func (f openFile) Stat() (os.FileInfo, error) {
+	if n, ok := f.t.stat(f.name); ok {
+		return n, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// An openDir lists the entries of a directory as they were
+// when it was opened.
+type openDir struct {
+	entries []os.FileInfo
+}
+
+func (d *openDir) Readdir(n int) ([]os.FileInfo, error) {
+	if n <= 0 || n > len(d.entries) {
+		n = len(d.entries)
+	}
+	files := d.entries[:n]
+	d.entries = d.entries[n:]
+	if len(d.entries) == 0 {
+		return files, io.EOF
+	}
+	return files, nil
+}
+
+func (t *tree) Serve9P(s *styx.Session) {
+	for s.Next() {
+		req := s.Request()
+		n, ok := t.stat(req.Path())
+		if walk, isWalk := req.(styx.Twalk); isWalk && !ok {
+			walk.Rwalk(nil, os.ErrNotExist)
+			continue
+		} else if !ok {
+			// The file was removed through another fid.
+			req.Rerror("file does not exist")
+			continue
+		}
+		switch req := req.(type) {
+		case styx.Twalk:
+			req.Rwalk(n, nil)
+		case styx.Tstat:
+			req.Rstat(n, nil)
+		case styx.Topen:
+			if n.IsDir() {
+				req.Ropen(&openDir{t.children(req.Path())}, nil)
+			} else {
+				req.Ropen(openFile{t, req.Path()}, nil)
+			}
+		case styx.Ttruncate:
+			t.mu.Lock()
+			if f, ok := t.files[req.Path()]; ok {
+				f.data = resize(f.data, req.Size)
+			}
+			t.mu.Unlock()
+			req.Rtruncate(nil)
+		case styx.Tutimes:
+			t.mu.Lock()
+			if f, ok := t.files[req.Path()]; ok {
+				f.mtime = req.Mtime
+			}
+			t.mu.Unlock()
+			req.Rutimes(nil)
+		case styx.Tcreate:
+			name := req.NewPath()
+			t.mu.Lock()
+			_, exists := t.files[name]
+			if !exists {
+				t.files[name] = &node{name: req.Name, mode: req.Mode, mtime: epoch}
+			}
+			t.mu.Unlock()
+			if exists {
+				req.Rcreate(nil, os.ErrExist)
+			} else if req.Mode.IsDir() {
+				req.Rcreate(&openDir{}, nil)
+			} else {
+				req.Rcreate(openFile{t, name}, nil)
+			}
+		case styx.Tremove:
+			t.mu.Lock()
+			delete(t.files, req.Path())
+			t.mu.Unlock()
+			req.Rremove(nil)
+		}
+	}
+}
@@ -6,9 +6,17 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"aqwari.net/net/styx/internal/qidpool"
+	"aqwari.net/net/styx/internal/ratelimit"
 	"aqwari.net/net/styx/internal/styxfile"
+	"aqwari.net/net/styx/internal/sys"
 	"aqwari.net/net/styx/internal/threadsafe"
 	"aqwari.net/net/styx/internal/tracing"
 	"aqwari.net/net/styx/styxproto"
@@ -17,10 +25,16 @@ import (
 )
 
 var (
-	errFidInUse     = errors.New("fid already in use")
-	errTagInUse     = errors.New("tag in use")
-	errNoFid        = errors.New("no such fid")
-	errNotSupported = errors.New("not supported")
+	errFidInUse      = errors.New("fid already in use")
+	errTagInUse      = errors.New("tag in use")
+	errNoFid         = errors.New("no such fid")
+	errNotSupported  = errors.New("not supported")
+	errNoVersion     = errors.New("must negotiate version first")
+	errIdleTimeout   = errors.New("idle timeout")
+	errSessionClosed = errors.New("session closed")
+	errNoAuth        = errors.New("authentication not required")
+	errNotAuthFid    = errors.New("afid is not an auth file")
+	errNotEmpty      = errors.New("directory not empty")
 )
 
 type fcall interface {
@@ -56,14 +70,20 @@ type conn struct {
 	rwc io.ReadWriteCloser
 
 	// This serves as the parent context for the context attached to all
-	// requests.
-	ctx context.Context
+	// requests. It is cancelled when the connection is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	// While srv.MaxSize holds the *desired* 9P protocol message
 	// size, msize will contain the actual maximum negotiated with
 	// the client, through a Tversion/Rversion exchange.
 	msize int64
 
+	// The protocol version negotiated with the client, and
+	// true if it is 9P2000.u.
+	version string
+	dotu    bool
+
 	// There is no "session id" in 9P. However, because all fids
 	// for a connection must be derived from the fid established
 	// in a Tattach call, any message that contains a fid can be
@@ -73,9 +93,56 @@ type conn struct {
 	// Qids for the file tree, added on-demand.
 	qidpool *qidpool.Pool
 
+	// The permissions of files, as reported to Rwalk and Rstat,
+	// if srv.EnforceRemovePerm is set. nil otherwise.
+	perms *threadsafe.Map
+
 	// used to implement request cancellation when a Tflush
 	// message is received.
 	pendingReq *threadsafe.Map
+
+	// Requests whose tags have been cleared, but whose responses
+	// have not yet been written, mapped to a channel that is
+	// closed once they are. tagMu is held while a tag moves from
+	// pendingReq to answering, so that a Tflush sees it in one or
+	// the other. See flushTag.
+	tagMu     sync.Mutex
+	answering map[uint16]chan struct{}
+
+	// The state last reported to Server.ConnState, or -1
+	// before the first report.
+	stateMu sync.Mutex
+	state   ConnState
+
+	// If srv.MaxInflight is set, the number of requests holding
+	// a slot, and the requests waiting for one. A value is sent
+	// on slotFreed whenever a slot is released. See hold.
+	slotMu    sync.Mutex
+	active    int
+	queue     []queuedMsg
+	slotFreed chan struct{}
+
+	// Throttle file I/O if srv.ReadLimit or srv.WriteLimit are
+	// set. nil otherwise.
+	readLimit, writeLimit *ratelimit.Limiter
+
+	// If srv.TraceLog or srv.AccessLog is set, or Server.Vars
+	// has been called, used to log and count each completed
+	// request.
+	tracer *requestTracer
+
+	// Counters for Server.Vars, or nil.
+	vars *serverVars
+
+	// Closed when a handler aborts the connection. See
+	// CloseOnError.
+	aborted   chan struct{}
+	abortOnce sync.Once
+
+	// The first error that caused the connection to end, if
+	// any. See Session.Err.
+	errMu sync.Mutex
+	err   error
 }
 
 func (c *conn) remoteAddr() net.Addr {
@@ -119,6 +186,14 @@ func (c *conn) close() error {
 		}
 	})
 
+	// Requests that were never answered are not logged, but
+	// those that were should not wait for another connection
+	// to go idle.
+	if c.tracer != nil && c.tracer.access != nil {
+		c.tracer.access.flush()
+	}
+
+	c.cancel()
 	return c.rwc.Close()
 }
 
@@ -131,47 +206,597 @@ func newConn(srv *Server, rwc io.ReadWriteCloser) *conn {
 			msize = styxproto.MinBufSize
 		}
 	}
-	var enc *styxproto.Encoder
-	var dec *styxproto.Decoder
-	if srv.TraceLog != nil {
-		enc = tracing.Encoder(rwc, func(m styxproto.Msg) {
-			srv.TraceLog.Printf("← %03d %s", m.Tag(), m)
-		})
-		dec = tracing.Decoder(rwc, func(m styxproto.Msg) {
-			srv.TraceLog.Printf("→ %03d %s", m.Tag(), m)
+	var (
+		tracer *requestTracer
+		r      io.Reader = rwc
+		w      io.Writer = rwc
+	)
+	vars := srv.serverVars()
+	if vars != nil {
+		r = countReader{rwc, vars.bytesRead}
+		w = countWriter{rwc, vars.bytesWritten}
+	}
+	enc := styxproto.NewEncoder(w)
+	dec := styxproto.NewDecoder(r)
+	if srv.TraceLog != nil || srv.AccessLog != nil || vars != nil {
+		var remote net.Addr
+		if nc, ok := rwc.(net.Conn); ok {
+			remote = nc.RemoteAddr()
+		}
+		tracer = newRequestTracer(srv.TraceLog, srv.accessLog(), remote, srv.clock())
+		tracer.vars = vars
+		enc = tracing.Encoder(w, func(m styxproto.Msg) {
+			if srv.TraceMessages && srv.TraceLog != nil {
+				srv.TraceLog.Printf("← %03d %s", m.Tag(), m)
+			}
+			tracer.response(m)
 		})
-	} else {
-		enc = styxproto.NewEncoder(rwc)
-		dec = styxproto.NewDecoder(rwc)
+		if srv.TraceMessages && srv.TraceLog != nil {
+			dec = tracing.Decoder(r, func(m styxproto.Msg) {
+				srv.TraceLog.Printf("→ %03d %s", m.Tag(), m)
+			})
+		}
 	}
-	return &conn{
+	c := &conn{
 		Decoder:    dec,
 		Encoder:    enc,
 		srv:        srv,
 		rwc:        rwc,
-		ctx:        context.Background(),
 		msize:      msize,
 		sessionFid: threadsafe.NewMap(),
 		pendingReq: threadsafe.NewMap(),
+		answering:  make(map[uint16]chan struct{}),
+		state:      -1,
 		qidpool:    qidpool.New(),
+		tracer:     tracer,
+		vars:       vars,
+		aborted:    make(chan struct{}),
+		readLimit:  ratelimit.New(srv.ReadLimit, srv.clock()),
+		writeLimit: ratelimit.New(srv.WriteLimit, srv.clock()),
+		slotFreed:  make(chan struct{}, 1),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.WithValue(context.Background(), "conn", rwc))
+	if srv.EnforceRemovePerm {
+		c.perms = threadsafe.NewMap()
+	}
+	return c
+}
+
+// The owner and mode of a file, for checking permissions.
+type filePerm struct {
+	uid  string
+	mode os.FileMode
+}
+
+// notePerm records the permissions of the file name, from the
+// info given to Rwalk or Rstat. See Server.EnforceRemovePerm.
+func (c *conn) notePerm(name string, info os.FileInfo) {
+	if c.perms == nil {
+		return
+	}
+	uid, _, _ := sys.FileOwner(info)
+	if uid == "" {
+		uid = c.srv.DefaultUid
+	}
+	mode := info.Mode()
+	if mode&os.ModePerm == 0 {
+		mode |= c.srv.DefaultMode & os.ModePerm
+	}
+	c.perms.Put(name, filePerm{uid, mode})
+}
+
+// noteCreated records the permissions of the file name, created
+// by user with the given mode, so that files can be created in a
+// new directory. info, if not nil, is the one given to RcreateInfo.
+func (c *conn) noteCreated(name, user string, info os.FileInfo, mode os.FileMode) {
+	if c.perms == nil {
+		return
+	}
+	if info != nil {
+		c.notePerm(name, info)
+		return
+	}
+	c.perms.Put(name, filePerm{user, mode})
+}
+
+// canRemove reports whether user may remove the file name, based
+// on what is known of the permissions of its parent directory.
+// Group membership is not known, so the group write bit is taken
+// to apply to everyone.
+func (c *conn) canRemove(name, user string) bool {
+	var perm filePerm
+	if c.perms == nil || !c.perms.Fetch(path.Dir(name), &perm) {
+		return true
+	}
+	if perm.uid == user && perm.mode&0200 != 0 {
+		return true
+	}
+	return perm.mode&0022 != 0
+}
+
+// createPerm masks the permissions of mode, requested for a new
+// file in the directory dir, by those of dir, as described in
+// open(5). If the permissions of dir are not known, mode is
+// returned unchanged.
+func (c *conn) createPerm(dir string, mode os.FileMode) os.FileMode {
+	var perm filePerm
+	if c.perms == nil || !c.perms.Fetch(dir, &perm) {
+		return mode
+	}
+	mask := os.FileMode(0666)
+	if mode.IsDir() {
+		mask = 0777
 	}
+	return mode &^ (mask &^ perm.mode)
 }
 
 func (c *conn) qid(name string, qtype uint8) styxproto.Qid {
 	return c.qidpool.Put(name, qtype)
 }
 
+// qidMtime is like qid, but, if Server.QidVersion is
+// QidVersionMtime, sets the Qid's version to mtime.
+func (c *conn) qidMtime(name string, qtype uint8, mtime time.Time) styxproto.Qid {
+	qid := c.qid(name, qtype)
+	if c.srv.QidVersion != QidVersionMtime {
+		return qid
+	}
+	if v := uint32(mtime.Unix()); v != qid.Version() {
+		qid, _ = c.qidpool.SetVersion(name, v)
+	}
+	return qid
+}
+
+// Records a successful write or truncate of the file name. See
+// QidVersionWrite.
+func (c *conn) modified(name string) {
+	if c.srv.QidVersion == QidVersionWrite {
+		c.qidpool.IncVersion(name)
+	}
+}
+
 // All request contexts must have their cancel functions
 // called, to free up resources in the context. Returns false
-// if the tag is already cancelled
+// if the tag is already cancelled. A true result obliges the
+// caller to send a response with the tag.
 func (c *conn) clearTag(tag uint16) bool {
 	var cancel context.CancelFunc
+	c.tagMu.Lock()
 	if c.pendingReq.Fetch(tag, &cancel) {
-		cancel()
 		c.pendingReq.Del(tag)
+		c.answering[tag] = make(chan struct{})
+	}
+	c.tagMu.Unlock()
+	if cancel == nil {
+		return false
+	}
+	cancel()
+	return true
+}
+
+// flushTag cancels the request with the given tag, so that no
+// response is sent for it. If its response is already being
+// sent, flushTag instead returns a channel that is closed once
+// the response has been written. See flush(5): if a response
+// to the flushed request is sent, it must precede the Rflush.
+func (c *conn) flushTag(tag uint16) <-chan struct{} {
+	var cancel context.CancelFunc
+	c.tagMu.Lock()
+	defer c.tagMu.Unlock()
+	if c.pendingReq.Fetch(tag, &cancel) {
+		c.pendingReq.Del(tag)
+		cancel()
+		return nil
+	}
+	if ch, ok := c.answering[tag]; ok {
+		return ch
+	}
+	return nil
+}
+
+// dropTag clears the tag of a request that will not be
+// answered, such as one cut short by a broken connection.
+func (c *conn) dropTag(tag uint16) {
+	if c.clearTag(tag) {
+		c.answered(tag)
+	}
+}
+
+// answered is called after the response for tag is written.
+func (c *conn) answered(tag uint16) {
+	c.tagMu.Lock()
+	if ch, ok := c.answering[tag]; ok {
+		close(ch)
+		delete(c.answering, tag)
+	}
+	c.tagMu.Unlock()
+	c.checkIdle()
+}
+
+// setState reports a change in the connection's state to
+// Server.ConnState. Nothing is reported after StateClosed.
+func (c *conn) setState(state ConnState) {
+	if c.srv.ConnState == nil {
+		return
+	}
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.setStateLocked(state)
+}
+
+func (c *conn) setStateLocked(state ConnState) {
+	if c.state == state || c.state == StateClosed {
+		return
+	}
+	c.state = state
+	nc, _ := c.rwc.(net.Conn)
+	c.srv.ConnState(nc, state)
+}
+
+// checkIdle moves an active connection to StateIdle, if it
+// has no requests left to answer. A request's tag is in
+// pendingReq before the connection is marked active, so a
+// request that has just arrived is never missed.
+func (c *conn) checkIdle() {
+	if c.srv.ConnState == nil {
+		return
+	}
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state != StateActive {
+		return
+	}
+	c.tagMu.Lock()
+	answering := len(c.answering)
+	c.tagMu.Unlock()
+	if answering == 0 && c.idle() {
+		c.setStateLocked(StateIdle)
+	}
+}
+
+// The response methods below shadow those of the embedded
+// Encoder, to record when each response is written. See
+// flushTag.
+
+func (c *conn) Rauth(tag uint16, qid styxproto.Qid) {
+	defer c.answered(tag)
+	c.Encoder.Rauth(tag, qid)
+}
+
+func (c *conn) Rattach(tag uint16, qid styxproto.Qid) {
+	defer c.answered(tag)
+	c.Encoder.Rattach(tag, qid)
+}
+
+func (c *conn) Rflush(tag uint16) {
+	defer c.answered(tag)
+	c.Encoder.Rflush(tag)
+}
+
+func (c *conn) Rwalk(tag uint16, wqid ...styxproto.Qid) error {
+	defer c.answered(tag)
+	return c.Encoder.Rwalk(tag, wqid...)
+}
+
+func (c *conn) Ropen(tag uint16, qid styxproto.Qid, iounit uint32) {
+	defer c.answered(tag)
+	c.Encoder.Ropen(tag, qid, iounit)
+}
+
+func (c *conn) Rcreate(tag uint16, qid styxproto.Qid, iounit uint32) {
+	defer c.answered(tag)
+	c.Encoder.Rcreate(tag, qid, iounit)
+}
+
+func (c *conn) Rread(tag uint16, data []byte) (int, error) {
+	defer c.answered(tag)
+	return c.Encoder.Rread(tag, data)
+}
+
+func (c *conn) Rwrite(tag uint16, count int64) {
+	defer c.answered(tag)
+	c.Encoder.Rwrite(tag, count)
+}
+
+func (c *conn) Rclunk(tag uint16) {
+	defer c.answered(tag)
+	c.Encoder.Rclunk(tag)
+}
+
+func (c *conn) Rremove(tag uint16) {
+	defer c.answered(tag)
+	c.Encoder.Rremove(tag)
+}
+
+func (c *conn) Rstat(tag uint16, stat styxproto.Stat) {
+	defer c.answered(tag)
+	c.Encoder.Rstat(tag, stat)
+}
+
+func (c *conn) Rwstat(tag uint16) {
+	defer c.answered(tag)
+	c.Encoder.Rwstat(tag)
+}
+
+func (c *conn) Raw(m styxproto.RawMessage) {
+	defer c.answered(m.Tag())
+	c.Encoder.Raw(m)
+}
+
+// A slot is held by a request from the time it is dispatched
+// until all work on it is done, whether or not it is flushed in
+// the meantime. Each goroutine working on a request holds a
+// reference to its slot; see hold.
+type slot struct {
+	c    *conn
+	refs int32
+}
+
+type slotKey struct{}
+
+// A request that is waiting for a free slot. msg is a copy,
+// because the decoder's buffer is reused.
+type queuedMsg struct {
+	ctx context.Context
+	msg styxproto.Msg
+}
+
+// hold takes a reference to the slot held by the request with
+// context ctx, if any. The returned function drops it, and can
+// be called more than once. When the last reference is dropped,
+// the next queued request can be dispatched.
+func (c *conn) hold(ctx context.Context) func() {
+	sl, ok := ctx.Value(slotKey{}).(*slot)
+	if !ok {
+		return func() {}
+	}
+	atomic.AddInt32(&sl.refs, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if atomic.AddInt32(&sl.refs, -1) == 0 {
+				c.slotMu.Lock()
+				c.active--
+				c.slotMu.Unlock()
+				select {
+				case c.slotFreed <- struct{}{}:
+				default:
+				}
+			}
+		})
+	}
+}
+
+// acquire reports whether the request with context ctx may be
+// dispatched now, and returns the context to dispatch it with.
+// If the server's MaxInflight limit is reached, the request is
+// queued, and acquire returns false.
+func (c *conn) acquire(ctx context.Context, m styxproto.Msg) (context.Context, bool) {
+	if c.srv.MaxInflight <= 0 {
+		return ctx, true
+	}
+	c.slotMu.Lock()
+	full := c.active >= c.srv.MaxInflight || len(c.queue) > 0
+	if !full {
+		c.active++
+	}
+	c.slotMu.Unlock()
+
+	if full {
+		// Copying a Twrite reads its data from the connection,
+		// so do it without holding the lock. Only the serve
+		// goroutine adds to or removes from the queue.
+		q := queuedMsg{ctx, bufferMsg(m)}
+		c.slotMu.Lock()
+		c.queue = append(c.queue, q)
+		c.slotMu.Unlock()
+		return ctx, false
+	}
+	return context.WithValue(ctx, slotKey{}, &slot{c: c}), true
+}
+
+// dispatchQueued dispatches queued requests until the queue is
+// empty or there are no free slots. Requests that were flushed
+// while in the queue are dropped.
+func (c *conn) dispatchQueued() bool {
+	for {
+		c.slotMu.Lock()
+		if len(c.queue) == 0 || c.active >= c.srv.MaxInflight {
+			c.slotMu.Unlock()
+			return true
+		}
+		q := c.queue[0]
+		c.queue[0] = queuedMsg{}
+		c.queue = c.queue[1:]
+		if q.ctx.Err() != nil {
+			c.slotMu.Unlock()
+			continue
+		}
+		c.active++
+		c.slotMu.Unlock()
+
+		ctx := context.WithValue(q.ctx, slotKey{}, &slot{c: c})
+		if !c.dispatch(ctx, q.msg) {
+			return false
+		}
+	}
+}
+
+// bufferMsg returns a copy of m that does not refer to the
+// Decoder's buffer. The data of a Twrite message is read from
+// the connection.
+func bufferMsg(m styxproto.Msg) styxproto.Msg {
+	raw, err := rawBytes(m)
+	if err != nil {
+		return styxproto.BadMessage{Err: err}
+	}
+	cp, err := styxproto.Unmarshal(raw)
+	if err != nil {
+		return styxproto.BadMessage{Err: err}
+	}
+	return cp
+}
+
+// rawBytes returns a copy of the wire encoding of m.
+func rawBytes(m styxproto.Msg) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(int(m.Len()))
+	if _, err := styxproto.Write(&buf, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Rerror sends an Rerror message in the dialect negotiated
+// with the client.
+func (c *conn) Rerror(tag uint16, format string, v ...interface{}) {
+	c.rerror(tag, 0, format, v...)
+}
+
+func (c *conn) rerror(tag uint16, errno uint32, format string, v ...interface{}) {
+	defer c.answered(tag)
+	if c.dotu {
+		c.Encoder.Rerroru(tag, errno, format, v...)
+	} else {
+		c.Encoder.Rerror(tag, format, v...)
+	}
+}
+
+// Errors from the standard library that clients are likely to
+// act upon are sent with the error strings used by Plan 9 and,
+// for 9P2000.u clients, the matching unix errno.
+var wellKnownErrors = []struct {
+	err   error
+	ename string
+	errno uint32
+}{
+	{os.ErrNotExist, "file does not exist", 2},  // ENOENT
+	{os.ErrPermission, "permission denied", 13}, // EACCES
+	{os.ErrExist, "file already exists", 17},    // EEXIST
+	{errNotEmpty, "directory not empty", 39},    // ENOTEMPTY
+}
+
+// sendError sends err to the client in an Rerror message.
+// Errors that are (or wrap) os.ErrNotExist, os.ErrPermission,
+// or os.ErrExist are replaced with their canonical 9P error, as
+// is the error for removing a non-empty directory; all other
+// errors are sent unchanged.
+func (c *conn) sendError(tag uint16, err error) {
+	for _, known := range wellKnownErrors {
+		if errors.Is(err, known.err) {
+			c.rerror(tag, known.errno, "%s", known.ename)
+			return
+		}
+	}
+	c.rerror(tag, 0, "%s", err)
+}
+
+// Returns the parameters for Stat structures sent on this
+// connection.
+func (c *conn) statConfig() styxfile.StatConfig {
+	return styxfile.StatConfig{
+		Dotu: c.dotu,
+		Uid:  c.srv.DefaultUid,
+		Gid:  c.srv.DefaultGid,
+		Mode: c.srv.DefaultMode,
+
+		MtimeVersion: c.srv.QidVersion == QidVersionMtime,
+	}
+}
+
+// Reports an inconsistent response from the Handler. See
+// Server.Strict.
+func (c *conn) strictf(format string, v ...interface{}) {
+	if c.srv.Strict {
+		msg := fmt.Sprintf(format, v...)
+		c.srv.logf("strict: %s", msg)
+		panic("styx: " + msg)
+	}
+}
+
+// Fails all outstanding requests with err and closes the
+// connection.
+func (c *conn) abort(err error) {
+	c.abortOnce.Do(func() {
+		c.srv.logf("closing connection from %s: %v", c.remoteAddr(), err)
+		c.setErr(err)
+		close(c.aborted)
+		var tags []uint16
+		c.pendingReq.Do(func(m map[interface{}]interface{}) {
+			for tag := range m {
+				tags = append(tags, tag.(uint16))
+			}
+		})
+		for _, tag := range tags {
+			if c.clearTag(tag) {
+				c.Rerror(tag, "%v", err)
+			}
+		}
+		c.Flush()
+		c.rwc.Close()
+	})
+}
+
+// Flush writes any buffered responses to the connection. A failed
+// write may leave a message cut short, after which the client can
+// no longer find where messages begin, so the connection is closed.
+func (c *conn) Flush() error {
+	err := c.Encoder.Flush()
+	if err != nil {
+		c.setErr(err)
+		c.rwc.Close()
+	}
+	return err
+}
+
+// Records the reason the connection is ending. Only the
+// first error is kept.
+func (c *conn) setErr(err error) {
+	c.errMu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.errMu.Unlock()
+}
+
+func (c *conn) closeErr() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// Reports whether the connection has no requests in progress.
+func (c *conn) idle() bool {
+	n := 0
+	c.pendingReq.Do(func(m map[interface{}]interface{}) {
+		n = len(m)
+	})
+	return n == 0
+}
+
+// Returns the sessions established on the connection.
+func (c *conn) sessions() []*Session {
+	var sessions []*Session
+	c.sessionFid.Do(func(m map[interface{}]interface{}) {
+		seen := make(map[*Session]struct{}, len(m))
+		for _, v := range m {
+			s := v.(*Session)
+			if _, ok := seen[s]; !ok {
+				seen[s] = struct{}{}
+				sessions = append(sessions, s)
+			}
+		}
+	})
+	return sessions
+}
+
+func (c *conn) isAborted() bool {
+	select {
+	case <-c.aborted:
 		return true
+	default:
+		return false
 	}
-	return false
 }
 
 // runs in its own goroutine, one per connection.
@@ -182,24 +807,124 @@ func (c *conn) serve() {
 		return
 	}
 
-	for c.Next() && c.Encoder.Err() == nil {
-		if !c.handleMessage(c.Msg()) {
-			break
+	// Messages are read on their own goroutine, so that queued
+	// requests can be dispatched while we wait for input. A
+	// message is only valid until the next call to Next, so the
+	// reader waits for each one to be handled before moving on.
+	msgs := make(chan styxproto.Msg)
+	next := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(msgs)
+		for c.Next() {
+			select {
+			case msgs <- c.Msg():
+			case <-stop:
+				return
+			}
+			select {
+			case <-next:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// The idle timer is not reset for every message; when it
+	// fires, it is set again for the rest of the timeout after
+	// the last message.
+	clock, timeout := c.srv.clock(), c.srv.IdleTimeout
+	var idle <-chan time.Time
+	lastMsg := clock.Now()
+	if timeout > 0 {
+		idle = clock.After(timeout)
+	}
+
+loop:
+	for {
+		select {
+		case m, ok := <-msgs:
+			if !ok {
+				if err := c.Decoder.Err(); err != nil {
+					c.setErr(err)
+				}
+				break loop
+			}
+			lastMsg = clock.Now()
+			if c.Encoder.Err() != nil || !c.handleMessage(m) {
+				break loop
+			}
+			next <- struct{}{}
+		case <-c.slotFreed:
+			if !c.dispatchQueued() {
+				break loop
+			}
+		case now := <-idle:
+			wait := timeout - now.Sub(lastMsg)
+			if wait <= 0 && c.idle() {
+				c.srv.logf("closing idle connection from %s", c.remoteAddr())
+				c.setErr(errIdleTimeout)
+				break loop
+			} else if wait <= 0 {
+				wait = timeout
+			}
+			idle = clock.After(wait)
 		}
 	}
 	if err := c.Encoder.Err(); err != nil {
 		c.srv.logf("write error: %s", err)
+		c.setErr(err)
 	}
 	c.srv.logf("closed connection from %s", c.remoteAddr())
 }
 
+// Returns the path of the file that m's fid refers to, and the
+// user of its session, if any.
+func (c *conn) fidInfo(m styxproto.Msg) (name, user string) {
+	if m, ok := m.(fcall); ok {
+		if s, ok := c.sessionByFid(m.Fid()); ok {
+			if file, ok := s.fetchFile(m.Fid()); ok {
+				name = file.name
+			}
+			user = s.User
+		}
+	}
+	return name, user
+}
+
 func (c *conn) handleMessage(m styxproto.Msg) bool {
+	if c.tracer != nil {
+		name, user := c.fidInfo(m)
+		c.tracer.request(m, name, user)
+	}
 	if _, ok := c.pendingReq.Get(m.Tag()); ok {
 		c.srv.logf("fatal: client re-used existing tag %d", m.Tag())
+		c.setErr(errTagInUse)
 		return false
 	}
 	ctx, cancel := context.WithCancel(c.ctx)
 	c.pendingReq.Put(m.Tag(), cancel)
+	c.setState(StateActive)
+
+	// Clients must always be able to cancel requests or reset
+	// the connection, so Tflush and Tversion do not count
+	// against the limit.
+	switch m.(type) {
+	case styxproto.Tflush, styxproto.Tversion:
+	default:
+		var ok bool
+		if ctx, ok = c.acquire(ctx, m); !ok {
+			return true
+		}
+	}
+	return c.dispatch(ctx, m)
+}
+
+// dispatch handles a request that has been read from the
+// connection, or taken from the queue of waiting requests.
+func (c *conn) dispatch(ctx context.Context, m styxproto.Msg) bool {
+	defer c.hold(ctx)()
 
 	switch m := m.(type) {
 	case styxproto.Tauth:
@@ -210,6 +935,8 @@ func (c *conn) handleMessage(m styxproto.Msg) bool {
 		return c.handleTflush(ctx, m)
 	case fcall:
 		return c.handleFcall(ctx, m)
+	case styxproto.RawMessage:
+		return c.handleUnknown(ctx, m)
 	case styxproto.BadMessage:
 		c.srv.logf("got bad message from %s: %s", c.remoteAddr(), m.Err)
 		c.clearTag(m.Tag())
@@ -217,12 +944,36 @@ func (c *conn) handleMessage(m styxproto.Msg) bool {
 		c.Flush()
 		return true
 	default:
+		c.clearTag(m.Tag())
 		c.Rerror(m.Tag(), "unexpected %T message", m)
 		c.Flush()
 		return true
 	}
 }
 
+// Messages of unknown type are passed to Server.UnknownHandler.
+// Without one, they are treated as bad messages.
+func (c *conn) handleUnknown(ctx context.Context, m styxproto.RawMessage) bool {
+	if c.srv.UnknownHandler == nil {
+		c.srv.logf("got bad message from %s: unknown message type %d", c.remoteAddr(), m.Type())
+		c.clearTag(m.Tag())
+		c.Rerror(m.Tag(), "bad message: unknown message type %d", m.Type())
+		c.Flush()
+		return true
+	}
+	var s *Session
+	if body := m.Body(); len(body) >= 4 {
+		fid := uint32(body[0]) | uint32(body[1])<<8 | uint32(body[2])<<16 | uint32(body[3])<<24
+		s, _ = c.sessionByFid(fid)
+	}
+	c.srv.UnknownHandler(s, m)
+	if c.clearTag(m.Tag()) {
+		c.Rerror(m.Tag(), "unknown message type %d", m.Type())
+	}
+	c.Flush()
+	return true
+}
+
 // This is the first thing we do on a new connection. The first
 // message a client sends *must* be a Tversion message.
 func (c *conn) acceptTversion() bool {
@@ -230,9 +981,13 @@ func (c *conn) acceptTversion() bool {
 	c.Decoder.MaxSize = c.msize
 
 	for c.Next() && c.Encoder.Err() == nil {
+		c.setState(StateActive)
+		c.tracer.request(c.Msg(), "", "")
 		tver, ok := c.Msg().(styxproto.Tversion)
 		if !ok {
-			c.Rerror(tver.Tag(), "need Tversion")
+			// From version(5): the version request must be
+			// the first message sent on the connection.
+			c.Rerror(c.Msg().Tag(), "%s", errNoVersion)
 			break
 		}
 		msize := tver.Msize()
@@ -240,25 +995,62 @@ func (c *conn) acceptTversion() bool {
 			c.Rerror(tver.Tag(), "buffer too small")
 			break
 		}
-		if msize < c.msize {
-			c.msize = msize
-			c.Encoder.MaxSize = msize
-			c.Decoder.MaxSize = msize
-		}
-		if !bytes.HasPrefix(tver.Version(), []byte("9P2000")) {
-			c.Rversion(uint32(c.msize), "unknown")
-			c.Flush()
-		} else {
-			c.Rversion(uint32(c.msize), "9P2000")
+		version, ok := c.negotiate(tver)
+		if !ok {
+			c.Rversion(uint32(c.msize), version)
 			c.Flush()
-			return true
+			continue
 		}
+		c.version = version
+		c.dotu = version == "9P2000.u"
+		c.Rversion(uint32(c.msize), version)
+		c.Flush()
+		c.setState(StateIdle)
+		return true
 	}
 	c.Flush()
 	c.srv.logf("%s version negotiation failed", c.remoteAddr())
 	return false
 }
 
+// negotiate picks the response to a Tversion request, setting
+// c.msize. It returns the version string to send, and false if the
+// version was declined.
+func (c *conn) negotiate(tver styxproto.Tversion) (string, bool) {
+	msize := tver.Msize()
+	if c.srv.VersionFunc == nil {
+		if msize < c.msize {
+			c.setMsize(msize)
+		}
+		if !bytes.HasPrefix(tver.Version(), []byte("9P2000")) {
+			return "unknown", false
+		} else if string(tver.Version()) == "9P2000.u" {
+			return "9P2000.u", true
+		}
+		return "9P2000", true
+	}
+	version, max := c.srv.VersionFunc(string(tver.Version()), uint32(msize))
+	if int64(max) > msize {
+		max = uint32(msize)
+	}
+	if max < styxproto.MinBufSize {
+		c.srv.logf("%s: VersionFunc returned msize %d, below minimum %d",
+			c.remoteAddr(), max, styxproto.MinBufSize)
+		return "unknown", false
+	}
+	c.setMsize(int64(max))
+	if !strings.HasPrefix(version, "9P2000") {
+		return "unknown", false
+	}
+	return version, true
+}
+
+func (c *conn) setMsize(msize int64) {
+	c.msize = msize
+	c.Encoder.MaxSize = msize
+	c.Decoder.MaxSize = msize
+}
+
 // NOTE(droyo) consider a scenario where a malicious actor connects
 // to the server that repeatedly spams Tauth requests. It can quickly
 // use up resources on the server. Consider the following measures:
@@ -272,7 +1064,8 @@ func (c *conn) handleTauth(ctx context.Context, m styxproto.Tauth) bool {
 		err error
 	)
 	defer c.Flush()
-	if c.srv.Auth == nil {
+	auth := c.srv.authenticator()
+	if auth == nil {
 		c.clearTag(m.Tag())
 		c.Rerror(m.Tag(), "%s", errNotSupported)
 		return true
@@ -285,14 +1078,12 @@ func (c *conn) handleTauth(ctx context.Context, m styxproto.Tauth) bool {
 	s := newSession(c, m)
 
 	if c.srv.OpenAuth == nil {
-		var server net.Conn
-		f, server = net.Pipe()
-		ch := &Channel{
-			Context:         c.ctx,
-			ReadWriteCloser: server,
-		}
+		client, server := net.Pipe()
+		ctx, cancel := context.WithCancel(c.ctx)
+		f = authPipe{client, cancel}
 		go func() {
-			s.authC <- c.srv.Auth(ch, s.User, s.Access)
+			s.authC <- auth.Auth(ctx, server, s.User, s.Access)
+			cancel()
 			close(s.authC)
 		}()
 	} else {
@@ -309,7 +1100,7 @@ func (c *conn) handleTauth(ctx context.Context, m styxproto.Tauth) bool {
 		// This should never happen
 		panic(err)
 	}
-	s.files.Put(m.Afid(), file{rwc: rwc, auth: true})
+	s.files.Put(m.Afid(), file{rwc: rwc, auth: true, flag: os.O_RDWR, writes: new(writeQueue)})
 	c.sessionFid.Put(m.Afid(), s)
 	s.IncRef()
 	c.clearTag(m.Tag())
@@ -317,6 +1108,19 @@ func (c *conn) handleTauth(ctx context.Context, m styxproto.Tauth) bool {
 	return true
 }
 
+// The client's end of the pipe to an Authenticator. Closing it,
+// as when the client clunks the auth file, cancels the context
+// given to the Authenticator.
+type authPipe struct {
+	net.Conn
+	cancel context.CancelFunc
+}
+
+func (p authPipe) Close() error {
+	p.cancel()
+	return p.Conn.Close()
+}
+
 func (c *conn) handleTattach(ctx context.Context, m styxproto.Tattach) bool {
 	defer c.Flush()
 	var handler Handler = HandlerFunc(func(s *Session) {
@@ -326,58 +1130,131 @@ func (c *conn) handleTattach(ctx context.Context, m styxproto.Tattach) bool {
 	if c.srv.Handler != nil {
 		handler = c.srv.Handler
 	}
+	if _, ok := c.sessionFid.Get(m.Fid()); ok {
+		c.clearTag(m.Tag())
+		c.Rerror(m.Tag(), "%s", errFidInUse)
+		return true
+	}
 	var s *Session
-	if c.srv.Auth == nil {
+	if auth := c.srv.authenticator(); auth == nil {
+		// There are no auth files to refer to.
+		if m.Afid() != styxproto.NoFid {
+			c.clearTag(m.Tag())
+			c.Rerror(m.Tag(), "%s", errNoAuth)
+			return true
+		}
 		s = newSession(c, m)
+		if s.uname == "" || s.uname == "none" {
+			s.User = c.srv.anonymousUser()
+		}
 	} else {
-		var (
-			ok  bool
-			err error
-		)
-		s, ok = c.sessionByFid(m.Afid())
+		var err error
+		as, ok := c.sessionByFid(m.Afid())
 		if !ok {
 			c.clearTag(m.Tag())
 			c.Rerror(m.Tag(), "%s", errNoFid)
 			c.Flush()
 			return true
 		}
+		// A fid from an earlier Tattach or Twalk belongs to a
+		// session too, but carries no authentication.
+		if f, ok := as.fetchFile(m.Afid()); !ok || !f.auth {
+			c.clearTag(m.Tag())
+			c.Rerror(m.Tag(), "%s", errNotAuthFid)
+			return true
+		}
 		// From attach(5): The same validated afid may be used for
-		// multiple attach messages with the same uname and aname.
-		if s.User != string(m.Uname()) || s.Access != string(m.Aname()) {
+		// multiple attach messages. Each starts its own session,
+		// as the user who authenticated, but may be to another
+		// file tree; Server.Attach can refuse those.
+		if as.uname != string(m.Uname()) {
 			c.clearTag(m.Tag())
 			c.Rerror(m.Tag(), "afid mismatch for %s on %s", m.Uname(), m.Aname())
 			return true
 		}
 		if c.srv.OpenAuth == nil {
-			err = <-s.authC
+			err = as.authResult()
 		} else {
-			err = c.srv.Auth(&Channel{c.ctx, nil}, s.User, s.Access)
+			err = auth.Auth(c.ctx, nil, as.uname, string(m.Aname()))
 		}
 		if err != nil {
 			c.clearTag(m.Tag())
 			c.Rerror(m.Tag(), "auth failed: %s", err)
 			return true
 		}
+		s = newSession(c, m)
+		s.User = as.User
+	}
+	if c.srv.Attach != nil {
+		user, err := c.srv.Attach(&Channel{c.ctx, nil}, s.uname, s.Access)
+		if err != nil {
+			c.clearTag(m.Tag())
+			c.Rerror(m.Tag(), "attach failed: %s", err)
+			return true
+		}
+		if user != "" {
+			s.User = user
+		}
+	}
+	if c.srv.Root != nil {
+		s.root = path.Join("/", c.srv.Root(s.User, s.Access))
+	}
+	var qid styxproto.Qid
+	if c.srv.RootInfo == nil {
+		qid = c.qid(s.root, styxproto.QTDIR)
+	} else {
+		info, err := c.srv.RootInfo(s.User, s.Access)
+		if err != nil {
+			c.clearTag(m.Tag())
+			c.Rerror(m.Tag(), "attach failed: %s", err)
+			return true
+		}
+		s.rootInfo = info
+		qtype := styxfile.QidType(styxfile.Mode9P(info.Mode()))
+		qid = c.qidMtime(s.root, qtype, info.ModTime())
 	}
+	s.rootQid = append(styxproto.Qid(nil), qid...)
+	s.attached = true
 	go func() {
 		handler.Serve9P(s)
+		if c.isAborted() && !s.isClunked() {
+			// The connection is going away; don't leave
+			// the serve loop blocked on a dead handler.
+			for range s.requests {
+			}
+		}
 		s.cleanupHandler()
 	}()
 	c.sessionFid.Put(m.Fid(), s)
 	s.IncRef()
-	s.files.Put(m.Fid(), file{name: "/", rwc: nil})
+	s.files.Put(m.Fid(), file{name: s.root, rwc: nil})
 	c.clearTag(m.Tag())
-	c.Rattach(m.Tag(), c.qid("/", styxproto.QTDIR))
+	c.Rattach(m.Tag(), qid)
 	return true
 }
 
 func (c *conn) handleTflush(ctx context.Context, m styxproto.Tflush) bool {
-	c.clearTag(m.Oldtag())
-
-	if c.clearTag(m.Tag()) {
-		c.Rflush(m.Tag())
+	wait := c.flushTag(m.Oldtag())
+	tag := m.Tag()
+	if !c.clearTag(tag) {
+		return true
 	}
-	c.Flush()
+	if wait == nil {
+		c.Rflush(tag)
+		c.Flush()
+		return true
+	}
+	// The flushed request is being answered by another
+	// goroutine; its response must be written first.
+	go func() {
+		select {
+		case <-wait:
+		case <-c.ctx.Done():
+			return
+		}
+		c.Rflush(tag)
+		c.Flush()
+	}()
 	return true
 }
 
@@ -390,9 +1267,14 @@ func (c *conn) handleFcall(ctx context.Context, msg fcall) bool {
 		return true
 	}
 
+	// The fid may have been clunked by a concurrent request
+	// since we looked up its session.
 	file, ok := s.fetchFile(msg.Fid())
 	if !ok {
-		panic("bug: fid in session map, but no file associated")
+		c.clearTag(msg.Tag())
+		c.Rerror(msg.Tag(), "%s", errNoFid)
+		c.Flush()
+		return true
 	}
 
 	// NOTE(droyo) on security and anonymous users: On a server with
@@ -25,6 +25,12 @@ Serve9P method.  The HandlerFunc type allows regular functions to be used:
 	})
 	styx.ListenAndServe(":564", fs)
 
+Errors given to response methods such as Rwalk and Ropen are sent
+to the client in Rerror messages. Errors that match os.ErrNotExist,
+os.ErrPermission, or os.ErrExist, as reported by errors.Is, are sent
+with the canonical 9P error strings and, to 9P2000.u clients, the
+errno ENOENT, EACCES, or EEXIST. Other errors are sent unchanged.
+
 Multiple handlers can be overlaid using the Stack function.
 
 	echo := styx.HandlerFunc(func(s *styx.Session) {
@@ -0,0 +1,37 @@
+// +build linux,amd64 linux,arm64
+
+package styx_test
+
+import (
+	"log"
+	"net"
+	"syscall"
+
+	"aqwari.net/net/styx"
+)
+
+// The syscall package does not define SO_REUSEPORT on every
+// platform; golang.org/x/sys/unix does.
+const soReusePort = 0xf
+
+func ExampleServer_ListenConfig() {
+	// Allow a new process to bind the same port before the old
+	// one shuts down, so that no connections are refused while
+	// it is replaced.
+	reuseport := func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+	srv := styx.Server{
+		Addr:         ":564",
+		Handler:      styx.FileSystem(map[string][]byte{"version": []byte("2\n")}),
+		ListenConfig: &net.ListenConfig{Control: reuseport},
+	}
+	log.Fatal(srv.ListenAndServe())
+}
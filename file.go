@@ -4,6 +4,7 @@ import (
 	"os"
 
 	"aqwari.net/net/styx/internal/styxfile"
+	"aqwari.net/net/styx/styxproto"
 )
 
 type file struct {
@@ -12,6 +13,76 @@ type file struct {
 
 	// This is an afid, used for authentication
 	auth bool
+
+	// The file is an open directory
+	dir bool
+
+	// The flags the file was opened with.
+	flag int
+
+	// The file was opened with ORCLOSE, and is removed when
+	// its fid is clunked.
+	rclose bool
+
+	// Orders the Twrite requests on an open file. See
+	// handleTwriteAsync.
+	writes *writeQueue
+
+	// If not nil, called after each successful write to the
+	// file. See Cache.
+	wrote func()
+}
+
+func (f file) changed() {
+	if f.wrote != nil {
+		f.wrote()
+	}
+}
+
+// A writeQueue keeps the writes to a file in the order their
+// Twrite requests arrived, when they are made from separate
+// goroutines.
+type writeQueue struct {
+	last chan struct{}
+}
+
+// next registers a new write, and returns a channel that is
+// closed once the previous write is done, or nil if there is
+// none, and a function to call once the new write is done. It
+// must be called from the serve loop, in the order the Twrite
+// requests arrived.
+func (q *writeQueue) next() (prev <-chan struct{}, done func()) {
+	if q == nil {
+		return nil, func() {}
+	}
+	c := make(chan struct{})
+	prev, q.last = q.last, c
+	return prev, func() { close(c) }
+}
+
+type hasStat interface {
+	Stat() (os.FileInfo, error)
+}
+
+// A createdFile reports the attributes given to Tcreate.RcreateInfo
+// for a file that cannot report its own.
+type createdFile struct {
+	styxfile.Interface
+	info os.FileInfo
+}
+
+func (f createdFile) Stat() (os.FileInfo, error) { return f.info, nil }
+
+const accmode = os.O_RDONLY | os.O_WRONLY | os.O_RDWR
+
+func readable(flag int) bool { return flag&accmode != os.O_WRONLY }
+func writable(flag int) bool { return flag&accmode != os.O_RDONLY }
+
+// validRange reports whether a read or write of count bytes at
+// offset stays within styxproto.MaxOffset. Offsets are unsigned
+// on the wire, so one past MaxOffset is negative here.
+func validRange(offset, count int64) bool {
+	return offset >= 0 && offset <= styxproto.MaxOffset-count
 }
 
 // The styx package will attempt to determine the ownership of a file by
@@ -21,7 +92,8 @@ type file struct {
 // a file's owner. Gid should return the primary group of the file. Muid,
 // if implemented, should return the name of the user who last modified the
 // file. If Muid is not implemented, the styx package will always return
-// the owner of the file for its Muid.
+// the owner of the file for its Muid. If no owner or group can be
+// determined, the Server's DefaultUid and DefaultGid are used.
 //
 // Usage of this interface is opportunistic; a type can implement all or
 // some of the methods.
@@ -31,6 +103,20 @@ type OwnerInfo interface {
 	Muid() string
 }
 
+// Files whose mode includes os.ModeSymlink are presented to 9P2000.u
+// clients as symbolic links. If an os.FileInfo value for such a file
+// implements the Symlink interface, its Symlink method should return
+// the target of the link, which is sent in the extension field of
+// the file's Stat structure. Clients speaking plain 9P2000 see the
+// link as a regular file.
+//
+// Clients cannot create symbolic links; the extension field of a
+// 9P2000.u Tcreate request is ignored, and the new file is created
+// as though DMSYMLINK were not set.
+type Symlink interface {
+	Symlink() string
+}
+
 // In the 9P protocol, a directory is simply a file that returns zero or more
 // styxproto.Stat structures when read. Types that implement the Directory
 // interface can avoid marshalling styxproto.Stat methods in the Read methods.
@@ -42,3 +128,44 @@ type OwnerInfo interface {
 type Directory interface {
 	Readdir(n int) ([]os.FileInfo, error)
 }
+
+// The DirReader interface is an alternative to the Directory interface
+// for directories that are too large, or too expensive, to list all at
+// once. Each call to Next should return the next entry in the directory,
+// or io.EOF once there are none left. Next is only called as the client
+// reads the directory, for as many entries as fit in each Tread; the
+// styx package keeps track of the client's position.
+type DirReader interface {
+	Next() (os.FileInfo, error)
+}
+
+// An open file may implement the WriteChecker interface to refuse
+// a Twrite request before its data is read from the connection,
+// such as one that would exceed a quota. CheckWrite is called
+// with the offset and size of each write to the file; if it
+// returns an error, the error is sent to the client, and the data
+// is discarded as it is read, without being held in memory. See
+// Topen.Ropen for when the data of a write is buffered.
+type WriteChecker interface {
+	CheckWrite(offset, count int64) error
+}
+
+// Returns the WriteChecker of an open file, if it has one.
+func writeChecker(rwc styxfile.Interface) (WriteChecker, bool) {
+	if f, ok := rwc.(createdFile); ok {
+		rwc = f.Interface
+	}
+	wc, ok := styxfile.Unwrap(rwc).(WriteChecker)
+	return wc, ok
+}
+
+// Returns the directory listing provided by v, if any.
+func directory(v interface{}) (styxfile.Directory, bool) {
+	switch v := v.(type) {
+	case Directory:
+		return v, true
+	case DirReader:
+		return styxfile.Entries(v), true
+	}
+	return nil, false
+}
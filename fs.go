@@ -0,0 +1,158 @@
+package styx
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// FileSystem returns a Handler that serves a read-only file tree
+// built from files. Each key in files is a slash-separated path to
+// a file, and its value the file's contents. Directories are created
+// for every parent of a file; if a path is both a file and the parent
+// of another file, it is served as a directory. Clients may read,
+// stat, and list the files, but any attempt to modify the tree is
+// refused. The contents of files must not be modified while the
+// Handler is in use.
+//
+// FileSystem is meant for demonstrations, debugging, and tests,
+// where writing a Serve9P method is more trouble than it is worth.
+func FileSystem(files map[string][]byte) Handler {
+	now := time.Now()
+	tree := memTree{"/": &memNode{name: "/", dir: true, mtime: now}}
+	for name, data := range files {
+		name = path.Clean("/" + name)
+		if name == "/" {
+			continue
+		}
+		if node, ok := tree[name]; !ok {
+			tree[name] = &memNode{name: path.Base(name), data: data, mtime: now}
+		} else if !node.dir {
+			node.data = data
+		}
+		// Create the parent directories, if necessary.
+		for child := name; child != "/"; child = path.Dir(child) {
+			parent := path.Dir(child)
+			dir, ok := tree[parent]
+			if !ok {
+				dir = &memNode{name: path.Base(parent), mtime: now}
+				tree[parent] = dir
+			}
+			if !dir.dir {
+				dir.dir, dir.data = true, nil
+			}
+			if !dir.hasChild(path.Base(child)) {
+				dir.children = append(dir.children, path.Base(child))
+			}
+		}
+	}
+	for _, node := range tree {
+		sort.Strings(node.children)
+	}
+	return tree
+}
+
+// A memTree maps the absolute paths of files to their contents.
+type memTree map[string]*memNode
+
+type memNode struct {
+	name     string
+	data     []byte
+	dir      bool
+	children []string
+	mtime    time.Time
+}
+
+func (n *memNode) hasChild(name string) bool {
+	for _, c := range n.children {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// os.FileInfo
+func (n *memNode) Name() string       { return n.name }
+func (n *memNode) Size() int64        { return int64(len(n.data)) }
+func (n *memNode) ModTime() time.Time { return n.mtime }
+func (n *memNode) IsDir() bool        { return n.dir }
+func (n *memNode) Sys() interface{}   { return nil }
+
+func (n *memNode) Mode() os.FileMode {
+	if n.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// memReader and memDir are open files and directories. Tstat
+// requests for open files are answered by their Stat methods.
+type memReader struct {
+	*bytes.Reader
+	node *memNode
+}
+
+func (f memReader) Stat() (os.FileInfo, error) { return f.node, nil }
+
+// A memDir lists the entries of a directory once.
+type memDir struct {
+	tree    memTree
+	path    string
+	node    *memNode
+	entries []string
+}
+
+func (d *memDir) Stat() (os.FileInfo, error) { return d.node, nil }
+
+func (d *memDir) Readdir(n int) ([]os.FileInfo, error) {
+	var files []os.FileInfo
+	for len(d.entries) > 0 && (n <= 0 || len(files) < n) {
+		files = append(files, d.tree[path.Join(d.path, d.entries[0])])
+		d.entries = d.entries[1:]
+	}
+	if len(d.entries) == 0 {
+		return files, io.EOF
+	}
+	return files, nil
+}
+
+func (tree memTree) Serve9P(s *Session) {
+	for s.Next() {
+		req := s.Request()
+		node, ok := tree[req.Path()]
+
+		// Requests that would modify the tree are left
+		// unanswered, and get their default response,
+		// "permission denied".
+		switch req := req.(type) {
+		case Twalk:
+			if !ok {
+				req.Rwalk(nil, os.ErrNotExist)
+			} else {
+				req.Rwalk(node, nil)
+			}
+		case Topen:
+			switch {
+			case !ok:
+				req.Ropen(nil, os.ErrNotExist)
+			case req.Writable() || req.Flag&os.O_TRUNC != 0:
+				req.Ropen(nil, os.ErrPermission)
+			case node.dir:
+				entries := append([]string(nil), node.children...)
+				req.Ropen(&memDir{tree: tree, path: req.Path(), node: node, entries: entries}, nil)
+			default:
+				req.Ropen(memReader{bytes.NewReader(node.data), node}, nil)
+			}
+		case Tstat:
+			if !ok {
+				req.Rstat(nil, os.ErrNotExist)
+			} else {
+				req.Rstat(node, nil)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package styx
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	"context"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+func TestFileSystem(t *testing.T) {
+	files := map[string][]byte{
+		"hello.txt":  []byte("hello, world"),
+		"/dir/a":     []byte("a"),
+		"dir/sub/b":  []byte("b"),
+		"dir/../top": []byte("top"),
+	}
+	c := testClient(t, &Server{Handler: FileSystem(files)})
+	ctx := context.Background()
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readAll := func(fid uint32) []byte {
+		var data []byte
+		buf := make([]byte, 8192)
+		for {
+			n, err := c.Read(ctx, fid, buf, int64(len(data)))
+			data = append(data, buf[:n]...)
+			if n == 0 || err == io.EOF {
+				return data
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	open := func(mode uint8, names ...string) (uint32, error) {
+		fid, _, err := c.Walk(ctx, root, names...)
+		if err != nil {
+			t.Fatalf("walk %v: %s", names, err)
+		}
+		_, _, err = c.Open(ctx, fid, mode)
+		return fid, err
+	}
+
+	for name, want := range map[string]string{"hello.txt": "hello, world", "top": "top"} {
+		fid, err := open(styxproto.OREAD, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := readAll(fid); string(data) != want {
+			t.Errorf("read %q from %s, wanted %q", data, name, want)
+		}
+		stat, err := c.Stat(ctx, fid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Length() != int64(len(want)) || stat.Mode()&styxproto.DMDIR != 0 {
+			t.Errorf("bad stat for %s: %s", name, stat)
+		}
+	}
+
+	fid, err := open(styxproto.OREAD, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for data := readAll(fid); len(data) > 0; {
+		size := int(data[0]) | int(data[1])<<8 + 2
+		names = append(names, string(styxproto.Stat(data[:size]).Name()))
+		data = data[size:]
+	}
+	if want := []string{"a", "sub"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("dir lists %q, wanted %q", names, want)
+	}
+	if stat, err := c.Stat(ctx, fid); err != nil {
+		t.Fatal(err)
+	} else if stat.Mode()&styxproto.DMDIR == 0 {
+		t.Errorf("bad stat for dir: %s", stat)
+	}
+
+	if _, _, err := c.Walk(ctx, root, "dir", "nonexistent"); err == nil {
+		t.Error("walked to a file that does not exist")
+	}
+	for _, mode := range []uint8{styxproto.OWRITE, styxproto.ORDWR, styxproto.OREAD | styxproto.OTRUNC} {
+		if _, err := open(mode, "hello.txt"); err == nil {
+			t.Errorf("opened file with mode %#x", mode)
+		}
+	}
+}
+
+func TestFileSystemReadOnly(t *testing.T) {
+	srv := testServer{test: t}
+	srv.handler = FileSystem(map[string][]byte{"file": []byte("data")})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch req.(type) {
+		case styxproto.Tcreate, styxproto.Tremove, styxproto.Twstat:
+			if _, ok := rsp.(styxproto.Rerror); !ok {
+				t.Errorf("got %s response to %s", rsp, req)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1)
+		enc.Tcreate(1, 1, "new", 0666, styxproto.OWRITE)
+		enc.Twalk(1, 0, 2, "file")
+		enc.Twstat(1, 2, blankStat("renamed", "", ""))
+		enc.Tremove(1, 2)
+	})
+}
@@ -46,6 +46,33 @@ func (p *Pool) Put(name string, qtype uint8) styxproto.Qid {
 	return qid
 }
 
+// SetVersion replaces the Qid associated with name, if any, with
+// a Qid of the same type and path, and the given version. The new
+// Qid is returned, along with whether there was a Qid for name.
+func (p *Pool) SetVersion(name string, version uint32) (styxproto.Qid, bool) {
+	return p.update(name, func(uint32) uint32 { return version })
+}
+
+// IncVersion increments the version of the Qid associated with
+// name, if any, as SetVersion does.
+func (p *Pool) IncVersion(name string) (styxproto.Qid, bool) {
+	return p.update(name, func(v uint32) uint32 { return v + 1 })
+}
+
+func (p *Pool) update(name string, fn func(uint32) uint32) (qid styxproto.Qid, ok bool) {
+	p.m.Do(func(m map[interface{}]interface{}) {
+		var v interface{}
+		if v, ok = m[name]; !ok {
+			return
+		}
+		old := v.(styxproto.Qid)
+		buf := make([]byte, styxproto.QidLen)
+		qid, _, _ = styxproto.NewQid(buf, old.Type(), fn(old.Version()), old.Path())
+		m[name] = qid
+	})
+	return qid, ok
+}
+
 // Del removes a Qid from a Pool. Once a Qid is removed from a pool, it
 // will never be used again.
 func (p *Pool) Del(name string) {
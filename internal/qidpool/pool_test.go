@@ -41,3 +41,26 @@ func TestQidpool(t *testing.T) {
 		t.Error("subsequent Put replaced old qid")
 	}
 }
+
+func TestQidVersion(t *testing.T) {
+	pool := New()
+	if _, ok := pool.IncVersion("/foo"); ok {
+		t.Error("IncVersion succeeded for a file with no qid")
+	}
+	orig := pool.Put("/foo", styxproto.QTAPPEND)
+	pool.IncVersion("/foo")
+	q, ok := pool.IncVersion("/foo")
+	if !ok || q.Version() != 2 {
+		t.Errorf("got %v after two IncVersion calls, wanted version 2", q)
+	}
+	if q.Type() != orig.Type() || q.Path() != orig.Path() {
+		t.Errorf("IncVersion changed %v to %v", orig, q)
+	}
+	if orig.Version() != 0 {
+		t.Errorf("IncVersion modified the original qid %v", orig)
+	}
+	pool.SetVersion("/foo", 1234)
+	if q, _ := pool.Get("/foo"); q.Version() != 1234 {
+		t.Errorf("got %v after SetVersion(1234)", q)
+	}
+}
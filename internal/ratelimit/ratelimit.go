@@ -0,0 +1,80 @@
+// Package ratelimit implements a token bucket for limiting the
+// rate at which bytes pass through a connection.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"context"
+)
+
+// A Limiter allows up to a fixed number of bytes per second, with
+// bursts of up to one second's worth. A nil *Limiter imposes no
+// limit.
+type Limiter struct {
+	rate  float64 // bytes per second
+	clock Clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// A Clock is the Limiter's source of time. It is satisfied by
+// styx.Clock.
+type Clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+}
+
+// New creates a Limiter allowing rate bytes per second, as
+// measured by clock. If rate is not positive, New returns nil.
+func New(rate int64, clock Clock) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   float64(rate),
+		clock:  clock,
+		tokens: float64(rate),
+		last:   clock.Now(),
+	}
+}
+
+// Wait blocks until n bytes may pass through the Limiter, or ctx
+// is cancelled. Requests for more than a burst's worth of bytes
+// are allowed, but delay subsequent callers accordingly. If ctx is
+// cancelled before the bytes are allowed, Wait returns ctx.Err()
+// and the bytes are not counted against the limit.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-l.clock.After(delay):
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
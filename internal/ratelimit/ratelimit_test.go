@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"context"
+)
+
+type sysClock struct{}
+
+func (sysClock) Now() time.Time                         { return time.Now() }
+func (sysClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func TestNil(t *testing.T) {
+	if l := New(0, sysClock{}); l != nil {
+		t.Errorf("New(0, sysClock{}) returned a limiter")
+	}
+	var l *Limiter
+	if err := l.Wait(context.Background(), 1<<30); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	const rate = 10000
+	l := New(rate, sysClock{})
+	ctx := context.Background()
+
+	start := time.Now()
+	if err := l.Wait(ctx, rate); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("initial burst took %v", elapsed)
+	}
+	start = time.Now()
+	for i := 0; i < 4; i++ {
+		if err := l.Wait(ctx, rate/10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("sent %d bytes in %v, faster than %d bytes/s", 4*rate/10, elapsed, rate)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	l := New(100, sysClock{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	l.Wait(ctx, 100)
+	start := time.Now()
+	if err := l.Wait(ctx, 1000); err != context.DeadlineExceeded {
+		t.Errorf("got %v, wanted %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Wait ignored cancellation for %v", elapsed)
+	}
+}
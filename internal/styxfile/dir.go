@@ -8,7 +8,6 @@ import (
 	"sync"
 
 	"aqwari.net/net/styx/internal/qidpool"
-	"aqwari.net/net/styx/internal/sys"
 	"aqwari.net/net/styx/styxproto"
 )
 
@@ -25,37 +24,247 @@ type Directory interface {
 	Readdir(n int) ([]os.FileInfo, error)
 }
 
+// An EntryReader yields the entries of a directory one at a time,
+// returning io.EOF after the last one.
+type EntryReader interface {
+	Next() (os.FileInfo, error)
+}
+
+// Entries creates a Directory whose Readdir method calls r.Next only
+// as many times as necessary. If r implements io.Closer, so does the
+// returned Directory.
+func Entries(r EntryReader) Directory {
+	return entryDir{r}
+}
+
+type entryDir struct {
+	EntryReader
+}
+
+func (d entryDir) Readdir(n int) ([]os.FileInfo, error) {
+	var files []os.FileInfo
+	for n <= 0 || len(files) < n {
+		fi, err := d.Next()
+		if err != nil {
+			return files, err
+		}
+		files = append(files, fi)
+	}
+	return files, nil
+}
+
+func (d entryDir) Close() error {
+	if c, ok := d.EntryReader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Filter creates a Directory whose Readdir method returns only the
+// entries of dir for which keep returns true. If dir implements
+// io.Closer or io.Seeker, so does the returned Directory.
+func Filter(dir Directory, keep func(os.FileInfo) bool) Directory {
+	return filterDir{dir, keep}
+}
+
+type filterDir struct {
+	Directory
+	keep func(os.FileInfo) bool
+}
+
+// Readdir returns at least one entry, unless dir returns an error,
+// so that a run of hidden entries is not mistaken for the end of
+// the listing.
+func (d filterDir) Readdir(n int) ([]os.FileInfo, error) {
+	for {
+		files, err := d.Directory.Readdir(n)
+
+		// files may belong to the Directory, which can
+		// return the same slice to every caller.
+		kept := make([]os.FileInfo, 0, len(files))
+		for _, fi := range files {
+			if d.keep(fi) {
+				kept = append(kept, fi)
+			}
+		}
+		if len(kept) > 0 || err != nil || n <= 0 || len(files) == 0 {
+			return kept, err
+		}
+	}
+}
+
+func (d filterDir) Close() error {
+	if c, ok := d.Directory.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (d filterDir) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := d.Directory.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, ErrNoSeek
+}
+
 // NewDir creates a new Interface that converts the return
 // value of a Directory's Readdir method into 9P Stat structures.
-func NewDir(dir Directory, abspath string, pool *qidpool.Pool) Interface {
+// The Stat structures are produced according to c.
+func NewDir(dir Directory, abspath string, pool *qidpool.Pool, c StatConfig) Interface {
+	return NewDirCache(dir, abspath, pool, c, 0)
+}
+
+// NewDirCache is like NewDir, but the returned Interface retains
+// up to limit bytes of the most recently read Stat structures, so
+// that they can be read again at an earlier offset. Reads before
+// the retained bytes, including a read at offset 0 to start the
+// listing over, are only possible if dir implements io.Seeker, as
+// an *os.File does; dir is rewound to the beginning and read again
+// up to the requested offset.
+func NewDirCache(dir Directory, abspath string, pool *qidpool.Pool, c StatConfig, limit int) Interface {
 	return &dirReader{
 		Directory: dir,
 		pool:      pool,
 		path:      abspath,
+		config:    c,
+		limit:     limit,
 	}
 }
 
+// IsDir reports whether f was created by NewDir, and so
+// returns Stat structures when read.
+func IsDir(f Interface) bool {
+	_, ok := f.(*dirReader)
+	return ok
+}
+
 type dirReader struct {
 	Directory
 	offset    int64 // current offset in the byte stream
 	nextlen   int   // if non zero, the length of next stat structure cached in next.
 	nextshort bool  // whether a short read occured on next
-	next      [styxproto.MaxStatLen]byte
+	next      [styxproto.MaxStatLenU]byte
 	sync.Mutex
-	pool *qidpool.Pool
-	path string
+	pool   *qidpool.Pool
+	path   string
+	config StatConfig
+
+	// The Stat structures most recently read, starting at
+	// cacheStart and ending at offset, no more than limit
+	// bytes long.
+	limit      int
+	cache      []byte
+	cacheStart int64
 }
 
-func (d *dirReader) ReadAt(p []byte, offset int64) (written int, err error) {
+func (d *dirReader) ReadAt(p []byte, offset int64) (int, error) {
 	// see Plan 9 man read(5): read must return an integral number
 	// of stat structures.
 	d.Lock()
 	defer d.Unlock()
 
-	if offset != d.offset {
+	if offset < d.offset {
+		if d.limit > 0 && offset >= d.cacheStart {
+			return d.readCache(p, offset)
+		}
+		if err := d.rewind(offset); err != nil {
+			return 0, err
+		}
+	} else if offset > d.offset {
+		return 0, ErrNoSeek
+	}
+	n, err := d.readNext(p)
+	d.remember(p[:n])
+	return n, err
+}
+
+// statSize returns the length of the Stat structure at the
+// beginning of b.
+func statSize(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 + 2
+}
+
+// readCache reads Stat structures from the cache, starting at
+// offset, which must be the beginning of one.
+func (d *dirReader) readCache(p []byte, offset int64) (int, error) {
+	pos := 0
+	for int64(pos) < offset-d.cacheStart {
+		pos += statSize(d.cache[pos:])
+	}
+	if int64(pos) != offset-d.cacheStart {
 		return 0, ErrNoSeek
 	}
+	n := 0
+	for pos < len(d.cache) {
+		size := statSize(d.cache[pos:])
+		if n+size > len(p) {
+			break
+		}
+		n += copy(p[n:], d.cache[pos:pos+size])
+		pos += size
+	}
+	if n == 0 {
+		return 0, ErrSmallRead
+	}
+	return n, nil
+}
+
+// remember adds stats to the cache, discarding the oldest
+// entries if it grows past the limit.
+func (d *dirReader) remember(stats []byte) {
+	if d.limit <= 0 || len(stats) == 0 {
+		return
+	}
+	d.cache = append(d.cache, stats...)
+	drop := 0
+	for len(d.cache)-drop > d.limit {
+		drop += statSize(d.cache[drop:])
+	}
+	if drop > 0 {
+		// The kept entries are moved to the front, so that
+		// the cache's array is reused once it has grown to
+		// the limit.
+		d.cacheStart += int64(drop)
+		d.cache = d.cache[:copy(d.cache, d.cache[drop:])]
+	}
+}
+
+// rewind starts the listing over, if the Directory supports
+// it, and skips ahead to offset.
+func (d *dirReader) rewind(offset int64) error {
+	seeker, ok := d.Directory.(io.Seeker)
+	if !ok {
+		return ErrNoSeek
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	d.offset, d.nextlen, d.nextshort = 0, 0, false
+	d.cache, d.cacheStart = nil, 0
 
+	buf := make([]byte, 8*styxproto.MaxStatLenU)
+	for d.offset < offset {
+		chunk := buf
+		if rest := offset - d.offset; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		n, err := d.readNext(chunk)
+		d.remember(chunk[:n])
+		if n == 0 {
+			if err != nil && err != io.EOF {
+				return err
+			}
+			// offset is past the end of the listing, or
+			// in the middle of a Stat structure.
+			return ErrNoSeek
+		}
+	}
+	return nil
+}
+
+// readNext reads the Stat structures following the current
+// offset.
+func (d *dirReader) readNext(p []byte) (written int, err error) {
 	// We accept one short read
 	if d.nextlen > 0 {
 		if len(p) < d.nextlen {
@@ -77,27 +286,29 @@ func (d *dirReader) ReadAt(p []byte, offset int64) (written int, err error) {
 		}
 	}
 
+	maxstat := styxproto.MaxStatLen
+	if d.config.Dotu {
+		maxstat = styxproto.MaxStatLenU
+	}
 	for len(p) > 0 {
-		nstats := len(p) / styxproto.MaxStatLen
+		nstats := len(p) / maxstat
 		if nstats == 0 {
 			nstats = 1
 		}
 		files, rerr := d.Readdir(nstats)
 		for _, fi := range files {
 			// Create 9p stat blob
-			uid, gid, muid := sys.FileOwner(fi)
-			stat, _, err := styxproto.NewStat(d.next[:], fi.Name(), uid, gid, muid)
+			stat, err := d.config.FileStat(d.next[:], fi.Name(), fi)
 			if err != nil {
 				return written, err
 			}
-			mode := Mode9P(fi.Mode())
-			qtype := QidType(mode)
-
-			stat.SetMtime(uint32(fi.ModTime().Unix()))
-			stat.SetAtime(stat.Mtime())
-			stat.SetLength(fi.Size())
-			stat.SetMode(mode)
-			stat.SetQid(d.pool.Put(path.Join(d.path, fi.Name()), qtype))
+			qtype := QidType(StatMode(fi.Mode(), d.config.Dotu))
+			name := path.Join(d.path, fi.Name())
+			qid := d.pool.Put(name, qtype)
+			if d.config.MtimeVersion && qid.Version() != stat.Mtime() {
+				qid, _ = d.pool.SetVersion(name, stat.Mtime())
+			}
+			stat.SetQid(qid)
 
 			if len(stat) > len(p) {
 				if nstats != 1 {
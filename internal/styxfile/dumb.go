@@ -18,6 +18,7 @@ var ErrNoSeek = errors.New("file does not support seeking")
 type dumbPipe struct {
 	rwc    interface{}
 	offset int64
+	eof    bool // the last read reached the end of rwc
 	sync.Mutex
 }
 
@@ -29,12 +30,20 @@ func (dp *dumbPipe) ReadAt(p []byte, offset int64) (int, error) {
 	dp.Lock()
 	defer dp.Unlock()
 
+	// Once the end of the stream is reached, we know where
+	// the file ends, and reads past it are not seeks.
+	if dp.eof && offset >= dp.offset {
+		return 0, io.EOF
+	}
 	if dp.offset != offset {
 		return 0, ErrNoSeek
 	}
 
 	n, err := io.ReadFull(r, p)
 	dp.offset += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		dp.eof = true
+	}
 	return n, err
 }
 
@@ -59,6 +59,8 @@ func New(rwc interface{}) (Interface, error) {
 		return nopCloser{rwc}, nil
 	case io.Seeker:
 		return &seekerAt{rwc: rwc}, nil
+	case io.ReaderAt:
+		return readerAt{rwc}, nil
 	case io.ReadWriter:
 		return &dumbPipe{rwc: rwc}, nil
 	case io.Reader:
@@ -70,33 +72,128 @@ func New(rwc interface{}) (Interface, error) {
 	}
 }
 
-// SetDeadline sets read/write deadlines for a file, if the type supports it.
-func SetDeadline(file Interface, t time.Time) error {
-	var real interface{}
+// Unwrap returns the value that file was created from, if file
+// is one of the wrapper types returned by New or NewDir, and
+// file itself otherwise.
+func Unwrap(file Interface) interface{} {
+	return unwrap(file)
+}
+
+func unwrap(file Interface) interface{} {
 	switch v := file.(type) {
 	case *seekerAt:
-		real = v.rwc
+		return v.rwc
+	case readerAt:
+		return v.ReaderAt
 	case *dumbPipe:
-		real = v.rwc
+		return v.rwc
+	case nopCloser:
+		return v.interfaceWithoutClose
 	case *dirReader:
-		real = v.Directory
-	default:
-		real = v
+		return v.Directory
+	case *readAhead:
+		return unwrap(v.Interface)
 	}
+	return file
+}
+
+// SetDeadline sets read/write deadlines for a file, if the type supports it.
+func SetDeadline(file Interface, t time.Time) error {
 	type deadline interface {
 		SetDeadline(time.Time) error
 	}
-	if v, ok := real.(deadline); ok {
+	if v, ok := unwrap(file).(deadline); ok {
 		return v.SetDeadline(t)
 	}
 	return ErrNotSupported
 }
 
-// Stat produces a styxproto.Stat from an open file. If the value
-// provides a Stat method matching that of os.File, that is used.
+// NewStat creates a new styxproto.Stat in buf. If dotu is true, the
+// Stat includes the fields added by 9P2000.u, with the extension
+// string ext. Otherwise ext is ignored.
+func NewStat(buf []byte, name, uid, gid, muid, ext string, dotu bool) (styxproto.Stat, error) {
+	var (
+		stat styxproto.Stat
+		err  error
+	)
+	if dotu {
+		stat, _, err = styxproto.NewStatU(buf, name, uid, gid, muid, ext)
+	} else {
+		stat, _, err = styxproto.NewStat(buf, name, uid, gid, muid)
+	}
+	return stat, err
+}
+
+// A StatConfig controls how Stat structures are produced from
+// os.FileInfo values.
+type StatConfig struct {
+	// If true, Stat structures include the fields added
+	// by 9P2000.u.
+	Dotu bool
+
+	// The owner and group of files whose ownership cannot
+	// be determined.
+	Uid, Gid string
+
+	// The permission bits of files whose mode has none.
+	Mode os.FileMode
+
+	// If true, the version of the Qids of directory entries is
+	// set to their modification time.
+	MtimeVersion bool
+}
+
+// FileStat creates a styxproto.Stat in buf describing fi, under the
+// given name. The Qid of the Stat is left for the caller to set.
+func (c StatConfig) FileStat(buf []byte, name string, fi os.FileInfo) (styxproto.Stat, error) {
+	uid, gid, muid := sys.FileOwner(fi)
+	if uid == "" {
+		uid = c.Uid
+	}
+	if gid == "" {
+		gid = c.Gid
+	}
+	if muid == "" {
+		muid = uid
+	}
+	mode := fi.Mode()
+	if mode&os.ModePerm == 0 {
+		mode |= c.Mode & os.ModePerm
+	}
+	stat, err := NewStat(buf, name, uid, gid, muid, Extension(fi), c.Dotu)
+	if err != nil {
+		return nil, err
+	}
+	stat.SetLength(fi.Size())
+	stat.SetMode(StatMode(mode, c.Dotu))
+	stat.SetAtime(uint32(fi.ModTime().Unix()))
+	stat.SetMtime(uint32(fi.ModTime().Unix()))
+	return stat, nil
+}
+
+// DirSize returns the number of bytes a client must read to
+// receive the Stat structures for files, as produced by FileStat.
+func (c StatConfig) DirSize(files []os.FileInfo) (int64, error) {
+	var (
+		buf  [styxproto.MaxStatLenU]byte
+		size int64
+	)
+	for _, fi := range files {
+		stat, err := c.FileStat(buf[:], fi.Name(), fi)
+		if err != nil {
+			return 0, err
+		}
+		size += int64(len(stat))
+	}
+	return size, nil
+}
+
+// Stat produces a styxproto.Stat from an open file. If the value,
+// or the value it was created from by New or NewDir, provides a
+// Stat method matching that of os.File, that is used.
 // Otherwise, the styxfile package determines the file's attributes
 // based on other characteristics.
-func Stat(buf []byte, file Interface, name string, qid styxproto.Qid) (styxproto.Stat, error) {
+func Stat(buf []byte, file Interface, name string, qid styxproto.Qid, c StatConfig) (styxproto.Stat, error) {
 	var (
 		fi  os.FileInfo
 		err error
@@ -104,7 +201,7 @@ func Stat(buf []byte, file Interface, name string, qid styxproto.Qid) (styxproto
 	type hasStat interface {
 		Stat() (os.FileInfo, error)
 	}
-	if v, ok := file.(hasStat); ok {
+	if v, ok := unwrap(file).(hasStat); ok {
 		fi, err = v.Stat()
 		if err != nil {
 			return nil, err
@@ -112,19 +209,57 @@ func Stat(buf []byte, file Interface, name string, qid styxproto.Qid) (styxproto
 	} else {
 		fi = statGuess{file, name, qid.Type()}
 	}
-	uid, gid, muid := sys.FileOwner(fi)
-	stat, _, err := styxproto.NewStat(buf, fi.Name(), uid, gid, muid)
+	stat, err := c.FileStat(buf, fi.Name(), fi)
 	if err != nil {
 		return nil, err
 	}
-	stat.SetLength(fi.Size())
-	stat.SetMode(Mode9P(fi.Mode()))
-	stat.SetAtime(uint32(fi.ModTime().Unix()))
-	stat.SetMtime(uint32(fi.ModTime().Unix()))
+	// Reads are answered by the open file, so its size, if
+	// known, wins over whatever its Stat method reported.
+	if qid.Type()&styxproto.QTDIR == 0 {
+		if size, ok := Size(file); ok {
+			stat.SetLength(size)
+		}
+	}
 	stat.SetQid(qid)
 	return stat, nil
 }
 
+// Size returns the size of file, if it can be determined without
+// reading it: from a Size method, such as that of *bytes.Reader
+// or *io.SectionReader, or failing that, by seeking to the end of
+// a file that was adapted from an io.Seeker.
+func Size(file Interface) (int64, bool) {
+	type hasSize interface {
+		Size() int64
+	}
+	if v, ok := unwrap(file).(hasSize); ok {
+		return v.Size(), true
+	}
+	if s, ok := file.(*seekerAt); ok {
+		return s.size()
+	}
+	return 0, false
+}
+
+// HasModTime reports whether Stat can find the modification time
+// of file, from a Stat method matching that of os.File, or from a
+// ModTime method. Otherwise, the time Stat reports is meaningless.
+func HasModTime(file Interface) bool {
+	switch unwrap(file).(type) {
+	case interface {
+		Stat() (os.FileInfo, error)
+	}:
+		return true
+	case interface {
+		ModTime() time.Time
+	}:
+		return true
+	}
+	return false
+}
+
+// A statGuess describes an open file from the methods of the
+// value it was made from, which is unwrapped by each method.
 type statGuess struct {
 	file  Interface
 	name  string
@@ -135,18 +270,15 @@ func (sg statGuess) Name() string {
 	type hasName interface {
 		Name() string
 	}
-	if v, ok := sg.file.(hasName); ok {
+	if v, ok := unwrap(sg.file).(hasName); ok {
 		return v.Name()
 	}
 	return sg.name
 }
 
 func (sg statGuess) Size() int64 {
-	type hasSize interface {
-		Size() int64
-	}
-	if v, ok := sg.file.(hasSize); ok {
-		return v.Size()
+	if size, ok := Size(sg.file); ok {
+		return size
 	}
 	return -1
 }
@@ -155,7 +287,7 @@ func (sg statGuess) Mode() os.FileMode {
 	type hasMode interface {
 		Mode() os.FileMode
 	}
-	if v, ok := sg.file.(hasMode); ok {
+	if v, ok := unwrap(sg.file).(hasMode); ok {
 		return v.Mode()
 	}
 	return ModeOS(uint32(sg.qtype)<<24) | 0777
@@ -165,7 +297,7 @@ func (sg statGuess) IsDir() bool {
 	type hasDir interface {
 		IsDir() bool
 	}
-	if v, ok := sg.file.(hasDir); ok {
+	if v, ok := unwrap(sg.file).(hasDir); ok {
 		return v.IsDir()
 	}
 	return sg.Mode().IsDir()
@@ -175,12 +307,12 @@ func (sg statGuess) ModTime() time.Time {
 	type hasTime interface {
 		ModTime() time.Time
 	}
-	if v, ok := sg.file.(hasTime); ok {
+	if v, ok := unwrap(sg.file).(hasTime); ok {
 		return v.ModTime()
 	}
 	return time.Time{}
 }
 
 func (sg statGuess) Sys() interface{} {
-	return sg.file
+	return unwrap(sg.file)
 }
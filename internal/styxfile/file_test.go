@@ -2,10 +2,12 @@ package styxfile
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"aqwari.net/net/styx/internal/qidpool"
 	"aqwari.net/net/styx/styxproto"
@@ -90,7 +92,7 @@ func TestDirectory(t *testing.T) {
 		return
 	}
 
-	dir := NewDir(fd, dirname, qidpool.New())
+	dir := NewDir(fd, dirname, qidpool.New(), StatConfig{})
 
 	// We know that we can read a single Stat by only
 	// asking for 1 * MaxStatLen bytes. This is an implementation
@@ -112,3 +114,213 @@ func TestDirectory(t *testing.T) {
 		t.Logf("%s", stat)
 	}
 }
+
+type entry string
+
+func (e entry) Name() string       { return string(e) }
+func (e entry) Size() int64        { return 0 }
+func (e entry) Mode() os.FileMode  { return 0644 }
+func (e entry) ModTime() time.Time { return time.Unix(0, 0) }
+func (e entry) IsDir() bool        { return false }
+func (e entry) Sys() interface{}   { return nil }
+
+// A seekDir lists its entries, and can be rewound.
+type seekDir struct {
+	entries []os.FileInfo
+	pos     int
+	rewinds int
+}
+
+func (d *seekDir) Readdir(n int) ([]os.FileInfo, error) {
+	if d.pos == len(d.entries) {
+		return nil, io.EOF
+	}
+	end := len(d.entries)
+	if n > 0 && d.pos+n < end {
+		end = d.pos + n
+	}
+	files := d.entries[d.pos:end]
+	d.pos = end
+	return files, nil
+}
+
+func (d *seekDir) Seek(offset int64, whence int) (int64, error) {
+	d.pos = 0
+	d.rewinds++
+	return 0, nil
+}
+
+func TestDirCache(t *testing.T) {
+	var entries []os.FileInfo
+	for i := 0; i < 20; i++ {
+		entries = append(entries, entry(fmt.Sprintf("file%02d", i)))
+	}
+	// readAll returns the listing, and the offset of each
+	// Stat structure in it.
+	readAll := func(dir Interface) (data []byte, offsets []int64) {
+		buf := make([]byte, styxproto.MaxStatLen)
+		for {
+			n, err := dir.ReadAt(buf, int64(len(data)))
+			data = append(data, buf[:n]...)
+			if err == io.EOF || n == 0 && err == nil {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for off := 0; off < len(data); off += statSize(data[off:]) {
+			offsets = append(offsets, int64(off))
+		}
+		return data, offsets
+	}
+	readAt := func(dir Interface, offset int64) []byte {
+		buf := make([]byte, styxproto.MaxStatLen)
+		n, err := dir.ReadAt(buf, offset)
+		if n == 0 && err != nil {
+			t.Fatalf("ReadAt %d: %s", offset, err)
+		}
+		return buf[:n]
+	}
+
+	// Each Stat structure is about 60 bytes long.
+	for _, tt := range []struct {
+		limit   int
+		rewinds int
+	}{{0, 3}, {100, 2}, {1 << 16, 0}} {
+		d := &seekDir{entries: entries}
+		dir := NewDirCache(d, "/", qidpool.New(), StatConfig{}, tt.limit)
+		want, offsets := readAll(dir)
+		if len(offsets) != len(entries) {
+			t.Fatalf("read %d stats, wanted %d", len(offsets), len(entries))
+		}
+		last, mid := offsets[len(offsets)-1], offsets[len(offsets)/2]
+		for _, off := range []int64{last, mid, 0} {
+			if got := readAt(dir, off); len(got) == 0 || !bytes.HasPrefix(want[off:], got) {
+				t.Errorf("limit %d: re-read at %d got %x", tt.limit, off, got)
+			}
+		}
+		if d.rewinds != tt.rewinds {
+			t.Errorf("limit %d: directory rewound %d times, wanted %d", tt.limit, d.rewinds, tt.rewinds)
+		}
+		if _, err := dir.ReadAt(make([]byte, 1000), mid+1); err == nil {
+			t.Errorf("limit %d: read in the middle of a Stat succeeded", tt.limit)
+		}
+	}
+
+	// Without io.Seeker, only the cached entries can be read again.
+	dir := NewDirCache(Entries(&entryList{entries}), "/", qidpool.New(), StatConfig{}, 100)
+	_, offsets := readAll(dir)
+	if _, err := dir.ReadAt(make([]byte, 1000), 0); err != ErrNoSeek {
+		t.Errorf("read from start of unseekable directory returned %v, wanted ErrNoSeek", err)
+	}
+	readAt(dir, offsets[len(offsets)-1])
+}
+
+type entryList struct {
+	entries []os.FileInfo
+}
+
+func (l *entryList) Next() (os.FileInfo, error) {
+	if len(l.entries) == 0 {
+		return nil, io.EOF
+	}
+	fi := l.entries[0]
+	l.entries = l.entries[1:]
+	return fi, nil
+}
+
+func TestSize(t *testing.T) {
+	type readSeeker struct{ io.ReadSeeker }
+	for _, tt := range []struct {
+		rwc  interface{}
+		size int64
+		ok   bool
+	}{
+		{bytes.NewReader([]byte("hello, world!")), 13, true},
+		{readSeeker{bytes.NewReader([]byte("hello"))}, 5, true},
+		{io.NewSectionReader(bytes.NewReader(make([]byte, 100)), 10, 20), 20, true},
+		{new(bytes.Buffer), 0, false},
+	} {
+		file, err := New(tt.rwc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size, ok := Size(file); size != tt.size || ok != tt.ok {
+			t.Errorf("Size(%T) = %d, %v, wanted %d, %v", tt.rwc, size, ok, tt.size, tt.ok)
+		}
+	}
+}
+
+// A timedSeeker has a name and modification time, but no Stat
+// method, so New wraps it.
+type timedSeeker struct {
+	io.ReadSeeker
+	mtime time.Time
+}
+
+func (f timedSeeker) Name() string       { return "timed" }
+func (f timedSeeker) ModTime() time.Time { return f.mtime }
+
+func TestStatWrapped(t *testing.T) {
+	mtime := time.Unix(1234567890, 0)
+	file, err := New(timedSeeker{bytes.NewReader([]byte("hello")), mtime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := file.(*seekerAt); !ok {
+		t.Fatalf("New returned %T, wanted *seekerAt", file)
+	}
+	if !HasModTime(file) {
+		t.Error("HasModTime reports false for a value with a ModTime method")
+	}
+	buf := make([]byte, styxproto.MaxStatLen)
+	qid := qidpool.New().Put("/timed", 0)
+	stat, err := Stat(buf, file, "default", qid, StatConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mtime() != uint32(mtime.Unix()) {
+		t.Errorf("Stat reports mtime %d, wanted %d", stat.Mtime(), mtime.Unix())
+	}
+	if string(stat.Name()) != "timed" {
+		t.Errorf("Stat reports name %q, wanted %q", stat.Name(), "timed")
+	}
+	if stat.Length() != 5 {
+		t.Errorf("Stat reports length %d, wanted 5", stat.Length())
+	}
+}
+
+// The benchmarks list a directory of 10,000 entries with long
+// names, in reads of the given size. The buffer for each read is
+// as large as the read, as it is for a Tread, so long names only
+// cost more reads.
+func benchmarkDirRead(b *testing.B, count, limit int) {
+	var entries []os.FileInfo
+	for i := 0; i < 10000; i++ {
+		entries = append(entries, entry(fmt.Sprintf("%0200d", i)))
+	}
+	buf := make([]byte, count)
+	var size int64
+	for i := 0; i < b.N; i++ {
+		dir := NewDirCache(&seekDir{entries: entries}, "/", qidpool.New(), StatConfig{}, limit)
+		var offset int64
+		for {
+			n, err := dir.ReadAt(buf, offset)
+			offset += int64(n)
+			if err == io.EOF || n == 0 {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		size = offset
+	}
+	b.SetBytes(size)
+}
+
+func BenchmarkDirRead8K(b *testing.B)        { benchmarkDirRead(b, 8192, 0) }
+func BenchmarkDirRead64K(b *testing.B)       { benchmarkDirRead(b, 65536, 0) }
+func BenchmarkDirRead8KCached(b *testing.B)  { benchmarkDirRead(b, 8192, 1<<16) }
+func BenchmarkDirRead64KCached(b *testing.B) { benchmarkDirRead(b, 65536, 1<<16) }
@@ -6,41 +6,73 @@ import (
 	"aqwari.net/net/styx/styxproto"
 )
 
-// FileMode converts a 9P mode mask to an os.FileMode.
+// ModeOS converts a 9P mode mask to an os.FileMode.
 func ModeOS(perm uint32) os.FileMode {
-	var mode os.FileMode
-	if perm&styxproto.DMDIR != 0 {
-		mode = os.ModeDir
+	return styxproto.ModeToFileMode(perm)
+}
+
+// Mode9P converts an os.FileMode to a 9P mode mask
+func Mode9P(mode os.FileMode) uint32 {
+	return styxproto.FileModeToMode(mode)
+}
+
+// StatMode converts an os.FileMode to a 9P mode mask suitable for a
+// Stat structure. Unless dotu is true, bits that are only defined by
+// 9P2000.u are cleared.
+func StatMode(mode os.FileMode, dotu bool) uint32 {
+	perm := Mode9P(mode)
+	if !dotu {
+		perm &^= styxproto.DMSYMLINK
 	}
-	if perm&styxproto.DMAPPEND != 0 {
-		mode |= os.ModeAppend
+	return perm
+}
+
+// Extension returns the 9P2000.u extension string for a file. For
+// symbolic links whose os.FileInfo has a Symlink method, this is the
+// target of the link. For all other files it is empty.
+func Extension(fi os.FileInfo) string {
+	type hasSymlink interface {
+		Symlink() string
 	}
-	if perm&styxproto.DMEXCL != 0 {
-		mode |= os.ModeExclusive
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return ""
 	}
-	if perm&styxproto.DMTMP != 0 {
-		mode |= os.ModeTemporary
+	if v, ok := fi.(hasSymlink); ok {
+		return v.Symlink()
 	}
-	mode |= (os.FileMode(perm) & os.ModePerm)
-	return mode
+	return ""
 }
 
-// Mode9P converts an os.FileMode to a 9P mode mask
-func Mode9P(mode os.FileMode) uint32 {
-	var perm uint32
-	if mode&os.ModeDir != 0 {
-		perm |= styxproto.DMDIR
+// OpenFlagL converts the flags of a 9P2000.L Tlopen or Tlcreate
+// request to a combination of the flag constants in the os package,
+// such as os.O_RDWR or os.O_APPEND. Flags with no equivalent in the
+// os package are dropped.
+func OpenFlagL(flags uint32) int {
+	var flag int
+	switch flags & styxproto.LACCMODE {
+	case styxproto.LWRONLY:
+		flag = os.O_WRONLY
+	case styxproto.LRDWR:
+		flag = os.O_RDWR
+	default:
+		flag = os.O_RDONLY
+	}
+	if flags&styxproto.LCREAT != 0 {
+		flag |= os.O_CREATE
+		if flags&styxproto.LEXCL != 0 {
+			flag |= os.O_EXCL
+		}
 	}
-	if mode&os.ModeAppend != 0 {
-		perm |= styxproto.DMAPPEND
+	if flags&styxproto.LTRUNC != 0 {
+		flag |= os.O_TRUNC
 	}
-	if mode&os.ModeExclusive != 0 {
-		perm |= styxproto.DMEXCL
+	if flags&styxproto.LAPPEND != 0 {
+		flag |= os.O_APPEND
 	}
-	if mode&os.ModeTemporary != 0 {
-		perm |= styxproto.DMTMP
+	if flags&styxproto.LSYNC == styxproto.LSYNC {
+		flag |= os.O_SYNC
 	}
-	return perm | uint32(mode&os.ModePerm)
+	return flag
 }
 
 // QidType selects the first byte of a 9P mode mask,
@@ -46,3 +46,26 @@ func TestPerm(t *testing.T) {
 		t.Error("ModePerm")
 	}
 }
+
+func TestOpenFlagL(t *testing.T) {
+	tests := []struct {
+		flags uint32
+		want  int
+	}{
+		{styxproto.LRDONLY, os.O_RDONLY},
+		{styxproto.LWRONLY | styxproto.LTRUNC, os.O_WRONLY | os.O_TRUNC},
+		{styxproto.LRDWR | styxproto.LAPPEND, os.O_RDWR | os.O_APPEND},
+		{styxproto.LWRONLY | styxproto.LCREAT, os.O_WRONLY | os.O_CREATE},
+		{styxproto.LRDWR | styxproto.LCREAT | styxproto.LEXCL, os.O_RDWR | os.O_CREATE | os.O_EXCL},
+		// O_EXCL is undefined without O_CREAT
+		{styxproto.LRDONLY | styxproto.LEXCL, os.O_RDONLY},
+		{styxproto.LWRONLY | styxproto.LSYNC, os.O_WRONLY | os.O_SYNC},
+		{styxproto.LRDONLY | styxproto.LNONBLOCK, os.O_RDONLY},
+		{styxproto.LACCMODE, os.O_RDONLY},
+	}
+	for _, tt := range tests {
+		if got := OpenFlagL(tt.flags); got != tt.want {
+			t.Errorf("OpenFlagL(%#o) = %#x, want %#x", tt.flags, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package styxfile
+
+import "sync"
+
+// ReadAhead returns a file that, after each successful read of a
+// stream, starts reading the bytes that follow, of the same
+// length, in the background, so that the next sequential read can
+// be answered without waiting on rwc. Only files created by New
+// from a type that implements io.Reader, but not io.ReaderAt or
+// io.Seeker, are streams; other files are returned as-is.
+//
+// The returned file must only be read from. Reads of a different
+// length than the last are still answered in full: a shorter read
+// leaves the rest of the data read ahead for the read after, and a
+// longer one reads what is missing from rwc.
+func ReadAhead(file Interface) Interface {
+	if _, ok := file.(*dumbPipe); ok {
+		return &readAhead{Interface: file}
+	}
+	return file
+}
+
+type readAhead struct {
+	Interface
+
+	// Held for the duration of each read, as the stream
+	// can only be read in order.
+	mu   sync.Mutex
+	next *prefetch
+}
+
+// A prefetch is a read started ahead of the request for it.
+type prefetch struct {
+	offset int64
+	buf    []byte
+	n      int
+	err    error
+	done   chan struct{}
+}
+
+func (r *readAhead) prefetch(offset int64, size int) {
+	pf := &prefetch{offset: offset, buf: make([]byte, size), done: make(chan struct{})}
+	go func() {
+		pf.n, pf.err = r.Interface.ReadAt(pf.buf, offset)
+		close(pf.done)
+	}()
+	r.next = pf
+}
+
+func (r *readAhead) ReadAt(p []byte, offset int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if pf := r.next; pf != nil {
+		<-pf.done
+		if pf.offset != offset && pf.n > 0 {
+			// The stream has moved past pf.offset, so
+			// reading from anywhere else is a seek.
+			return 0, ErrNoSeek
+		}
+		if pf.offset != offset {
+			// Nothing was read ahead, so the stream
+			// is where it was.
+			r.next = nil
+			return r.read(p, offset, len(p))
+		}
+		n := copy(p, pf.buf[:pf.n])
+		if n < pf.n {
+			pf.offset += int64(n)
+			pf.buf = pf.buf[n:]
+			pf.n -= n
+			return n, nil
+		}
+		r.next = nil
+		if pf.err != nil {
+			return n, pf.err
+		}
+		if n < len(p) {
+			// Fill the rest, as the stream would have
+			// been read without read-ahead.
+			m, err := r.read(p[n:], offset+int64(n), len(p))
+			return n + m, err
+		}
+		r.prefetch(offset+int64(n), len(p))
+		return n, nil
+	}
+
+	return r.read(p, offset, len(p))
+}
+
+// read reads from the stream, then reads size more bytes ahead.
+func (r *readAhead) read(p []byte, offset int64, size int) (int, error) {
+	n, err := r.Interface.ReadAt(p, offset)
+	if err == nil && n > 0 {
+		r.prefetch(offset+int64(n), size)
+	}
+	return n, err
+}
@@ -0,0 +1,102 @@
+package styxfile
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestReadAhead(t *testing.T) {
+	const data = "hello, world! this is a stream."
+	// OneByteReader makes short reads, which ReadAt must hide.
+	file, err := New(iotest.OneByteReader(strings.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file = ReadAhead(file)
+	if _, ok := file.(*readAhead); !ok {
+		t.Fatalf("ReadAhead returned %T for a stream", file)
+	}
+	var got []byte
+	for _, size := range []int{5, 5, 3, 10, 1, 100} {
+		buf := make([]byte, size)
+		n, err := file.ReadAt(buf, int64(len(got)))
+		got = append(got, buf[:n]...)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.Fatalf("read %d bytes at %d: %s", size, len(got)-n, err)
+		}
+		if n > size {
+			t.Fatalf("read %d bytes into a buffer of %d", n, size)
+		}
+	}
+	if string(got) != data {
+		t.Errorf("read %q, wanted %q", got, data)
+	}
+	if n, err := file.ReadAt(make([]byte, 10), int64(len(data))); n != 0 || err != io.EOF {
+		t.Errorf("read at end returned %d, %v, wanted 0, EOF", n, err)
+	}
+
+	file, _ = New(strings.NewReader(data))
+	if _, ok := ReadAhead(file).(*readAhead); ok {
+		t.Error("ReadAhead wrapped a file that supports ReadAt")
+	}
+
+	file, _ = New(iotest.OneByteReader(strings.NewReader(data)))
+	file = ReadAhead(file)
+	buf := make([]byte, 5)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.ReadAt(buf, 0); err != ErrNoSeek {
+		t.Errorf("re-read at 0 returned %v, wanted ErrNoSeek", err)
+	}
+	if n, err := file.ReadAt(buf, 5); err != nil || string(buf[:n]) != data[5:10] {
+		t.Errorf("read at 5 returned %q, %v after a bad seek", buf[:n], err)
+	}
+	if Unwrap(file) == file {
+		t.Error("Unwrap did not see through the read-ahead file")
+	}
+}
+
+// A slowReader waits before each Read, like a reader fetching
+// data over a network.
+type slowReader struct {
+	delay time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+// The benchmarks read a stream whose reads take as long as the
+// time between one read and the next, such as the time taken to
+// send a response and receive the next request. With read-ahead,
+// the two overlap, and throughput doubles.
+func benchmarkReadAhead(b *testing.B, ahead bool) {
+	const (
+		latency = time.Millisecond
+		size    = 8192
+	)
+	file, _ := New(slowReader{latency})
+	if ahead {
+		file = ReadAhead(file)
+	}
+	buf := make([]byte, size)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := file.ReadAt(buf, int64(i)*size); err != nil {
+			b.Fatal(err)
+		}
+		time.Sleep(latency)
+	}
+}
+
+func BenchmarkReadAheadOff(b *testing.B) { benchmarkReadAhead(b, false) }
+func BenchmarkReadAheadOn(b *testing.B)  { benchmarkReadAhead(b, true) }
@@ -16,6 +16,11 @@ type seekerAt struct {
 }
 
 func (s *seekerAt) ReadAt(p []byte, offset int64) (int, error) {
+	// Types such as *bytes.Reader can be read at an offset
+	// without moving their position, and without the lock.
+	if r, ok := s.rwc.(io.ReaderAt); ok {
+		return r.ReadAt(p, offset)
+	}
 	r, ok := s.rwc.(io.Reader)
 	if !ok {
 		return 0, ErrNotSupported
@@ -43,9 +48,36 @@ func (s *seekerAt) WriteAt(p []byte, offset int64) (int, error) {
 	return w.Write(p)
 }
 
+// size seeks to the end of the file to find its size. The
+// position does not matter, since every read or write seeks
+// first.
+func (s *seekerAt) size() (int64, bool) {
+	s.Lock()
+	defer s.Unlock()
+	size, err := s.rwc.Seek(0, io.SeekEnd)
+	return size, err == nil
+}
+
 func (s *seekerAt) Close() error {
 	if c, ok := s.rwc.(io.Closer); ok {
 		return c.Close()
 	}
 	return nil
 }
+
+// A readerAt is a file that can only be read from, at any
+// offset.
+type readerAt struct {
+	io.ReaderAt
+}
+
+func (readerAt) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, ErrNotSupported
+}
+
+func (r readerAt) Close() error {
+	if c, ok := r.ReaderAt.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
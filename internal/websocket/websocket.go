@@ -0,0 +1,399 @@
+// Package websocket implements just enough of the WebSocket
+// protocol (RFC 6455) to carry binary messages, or a byte stream
+// over binary frames.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Control frames may not carry more than 125 bytes of payload.
+const maxControlPayload = 125
+
+var (
+	errBadHandshake = errors.New("bad websocket handshake")
+	errLongControl  = errors.New("websocket control frame too long")
+	errUnmasked     = errors.New("websocket client frame not masked")
+	errNoHijack     = errors.New("http.ResponseWriter does not support Hijack")
+	errBadOrigin    = errors.New("websocket origin not allowed")
+	errClosing      = errors.New("websocket connection is closing")
+	errTooLong      = errors.New("websocket message too long")
+)
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+acceptGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SameOrigin reports whether the Origin header of r, if any,
+// names the host that r was sent to. Browsers send an Origin
+// header with every WebSocket handshake; other clients usually
+// do not.
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// Upgrade completes the server side of the WebSocket opening
+// handshake, and returns the resulting connection. If checkOrigin
+// is not nil, it must return true for the handshake to proceed;
+// otherwise, SameOrigin is used. If the handshake fails, an
+// appropriate HTTP error is sent to the client.
+func Upgrade(w http.ResponseWriter, r *http.Request, checkOrigin func(*http.Request) bool) (*Conn, error) {
+	if checkOrigin == nil {
+		checkOrigin = SameOrigin
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if r.Method != "GET" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-Websocket-Version") != "13" || key == "" {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, errBadHandshake
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "websocket origin not allowed", http.StatusForbidden)
+		return nil, errBadOrigin
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errNoHijack
+	}
+	nc, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", acceptKey(key))
+	if err := rw.Flush(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &Conn{Conn: nc, br: rw.Reader}, nil
+}
+
+// Dial opens a WebSocket connection to the ws:// URL rawurl.
+func Dial(rawurl string) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+	nc, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Client(nc, u)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Client performs the client side of the WebSocket opening
+// handshake for u over nc.
+func Client(nc net.Conn, u *url.URL) (*Conn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       u.Host,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-Websocket-Key":     {key},
+			"Sec-Websocket-Version": {"13"},
+		},
+	}
+	if err := req.Write(nc); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(nc)
+	rsp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusSwitchingProtocols ||
+		rsp.Header.Get("Sec-Websocket-Accept") != acceptKey(key) {
+		return nil, errBadHandshake
+	}
+	return &Conn{Conn: nc, br: br, client: true}, nil
+}
+
+// A Conn is a net.Conn that sends each Write as a single binary
+// WebSocket frame, and presents the payload of all received data
+// frames as a contiguous stream. Alternatively, ReadMessage reads
+// whole messages. The two ways of reading should not be mixed.
+// Ping frames are answered automatically. Read returns io.EOF once
+// a close frame is received.
+type Conn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool
+
+	rmu       sync.Mutex
+	remaining int64 // unread bytes of payload in current frame
+	data      bool  // current frame is a data frame
+	fin       bool  // current frame is the last of its message
+	masked    bool
+	mask      [4]byte
+	maskpos   int
+	closed    bool
+
+	wmu       sync.Mutex
+	sentClose bool
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for c.remaining == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= int64(n)
+	return n, err
+}
+
+func (c *Conn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.mask[c.maskpos%4]
+		c.maskpos++
+	}
+}
+
+// ReadMessage reads the next data message, which may be split
+// across several frames. Messages longer than max bytes are an
+// error. ReadMessage returns io.EOF once a close frame is
+// received.
+func (c *Conn) ReadMessage(max int64) ([]byte, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	var msg []byte
+	for {
+		if c.closed {
+			if len(msg) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return nil, err
+		}
+		if !c.data {
+			continue
+		}
+		if int64(len(msg))+c.remaining > max {
+			return nil, errTooLong
+		}
+		start := len(msg)
+		msg = append(msg, make([]byte, c.remaining)...)
+		if _, err := io.ReadFull(c.br, msg[start:]); err != nil {
+			return nil, err
+		}
+		c.unmask(msg[start:])
+		c.remaining = 0
+		if c.fin {
+			return msg, nil
+		}
+	}
+}
+
+// reads the next frame header, and handles control frames.
+func (c *Conn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	opcode := hdr[0] & 0x0f
+	c.fin = hdr[0]&0x80 != 0
+	c.data = false
+	c.masked = hdr[1]&0x80 != 0
+	length := int64(hdr[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]) &^ (1 << 63))
+	}
+	if !c.client && !c.masked {
+		return errUnmasked
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.maskpos = 0
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remaining = length
+		c.data = true
+		return nil
+	}
+	if length > maxControlPayload {
+		return errLongControl
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	c.unmask(payload)
+	switch opcode {
+	case opPing:
+		return c.writeFrame(opPong, payload)
+	case opClose:
+		// RFC 6455, section 5.5.1: reply with a close frame,
+		// unless we have already sent one.
+		c.closed = true
+		c.writeFrame(opClose, payload)
+	}
+	return nil
+}
+
+// WriteMessage sends p as a single binary message.
+func (c *Conn) WriteMessage(p []byte) error {
+	return c.writeFrame(opBinary, p)
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Conn) writeFrame(opcode byte, p []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	// No frames may follow a close frame, including
+	// another close frame.
+	if c.sentClose {
+		if opcode == opClose {
+			return nil
+		}
+		return errClosing
+	}
+	if opcode == opClose {
+		c.sentClose = true
+	}
+
+	hdr := make([]byte, 2, 14)
+	hdr[0] = 0x80 | opcode
+	switch n := len(p); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = hdr[:4]
+		binary.BigEndian.PutUint16(hdr[2:], uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = hdr[:10]
+		binary.BigEndian.PutUint64(hdr[2:], uint64(n))
+	}
+	payload := p
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		hdr[1] |= 0x80
+		hdr = append(hdr, mask[:]...)
+		payload = make([]byte, len(p))
+		for i := range p {
+			payload[i] = p[i] ^ mask[i%4]
+		}
+	}
+	if _, err := c.Conn.Write(append(hdr, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close sends a close frame to the peer, if one has not been
+// sent already, before closing the underlying connection.
+func (c *Conn) Close() error {
+	c.writeFrame(opClose, nil)
+	return c.Conn.Close()
+}
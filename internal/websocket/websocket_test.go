@@ -0,0 +1,108 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// Example from RFC 6455, section 1.3
+	const want = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != want {
+		t.Errorf("acceptKey = %q, wanted %q", got, want)
+	}
+}
+
+func TestUpgradeRequired(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := Upgrade(w, r, nil); err == nil {
+			t.Error("upgraded a plain HTTP request")
+		}
+	}))
+	defer hs.Close()
+	rsp, err := http.Get(hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d, wanted %d", rsp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}))
+	defer hs.Close()
+
+	c, err := Dial("ws" + strings.TrimPrefix(hs.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// exercise the 16-bit length encoding and a ping
+	// in the middle of the data.
+	msg := bytes.Repeat([]byte("0123456789"), 100)
+	if _, err := c.Write(msg[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeFrame(opPing, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(msg[10:]); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("echo mismatch: got %q", got)
+	}
+}
+
+func TestUnmaskedClient(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &Conn{Conn: server, br: bufio.NewReader(server)}
+	go client.Write([]byte{0x82, 0x01, 'x'})
+	if _, err := c.Read(make([]byte, 1)); err != errUnmasked {
+		t.Errorf("got %v, wanted %v", err, errUnmasked)
+	}
+}
+
+func TestCloseReply(t *testing.T) {
+	server, client := net.Pipe()
+	c := &Conn{Conn: server, br: bufio.NewReader(server)}
+
+	// The peer's frames after the close frame, up to EOF.
+	got := make(chan []byte)
+	go func() {
+		// masked close frame with an empty payload
+		client.Write([]byte{0x88, 0x80, 1, 2, 3, 4})
+		b, _ := ioutil.ReadAll(client)
+		got <- b
+	}()
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after close frame got %v, wanted EOF", err)
+	}
+	c.Close()
+	if b := <-got; !bytes.Equal(b, []byte{0x88, 0x00}) {
+		t.Errorf("sent % x in reply to a close frame, wanted a single close frame", b)
+	}
+}
@@ -0,0 +1,281 @@
+package styx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"context"
+)
+
+// RecordConn and ReplayServer capture the 9P traffic of a
+// connection, so that a problem seen with one client can be
+// reproduced against a server elsewhere. A recording is a sequence
+// of records, one for each call to the connection's Read or Write
+// method that transferred data:
+//
+// 	dir[1] time[8] n[4] data[n]
+//
+// dir is 'r' for data read from the connection, and 'w' for data
+// written to it. time is the time of the call, in nanoseconds since
+// the Unix epoch; reads are recorded when they return, and writes
+// when they are made. Integers are little-endian, as in 9P.
+const (
+	recordRead  = 'r'
+	recordWrite = 'w'
+
+	recordHeaderLen = 13
+)
+
+// RecordConn returns a net.Conn that reads from and writes to conn,
+// and writes a copy of all data read and written, along with the
+// time it was transferred, to w. To capture requests from a client,
+// wrap the server's side of the connection before passing it to
+// ServeConn; the recording can then be given to ReplayServer.
+//
+// Writes to w are serialized. An error writing to w does not affect
+// the connection, but nothing is recorded after it.
+func RecordConn(conn net.Conn, w io.Writer) net.Conn {
+	return &recordConn{Conn: conn, w: w}
+}
+
+type recordConn struct {
+	net.Conn
+
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+	buf []byte
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.record(recordRead, p[:n])
+	return n, err
+}
+
+// Data is recorded before it is written, so that it precedes
+// any data read in response to it.
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.record(recordWrite, p)
+	return c.Conn.Write(p)
+}
+
+func (c *recordConn) record(dir byte, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.buf = append(c.buf[:0], make([]byte, recordHeaderLen)...)
+	c.buf[0] = dir
+	binary.LittleEndian.PutUint64(c.buf[1:9], uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint32(c.buf[9:13], uint32(len(data)))
+	c.buf = append(c.buf, data...)
+	_, c.err = c.w.Write(c.buf)
+}
+
+// ReplayServer serves the requests in a recording made by
+// RecordConn, as they were read by the server, to a new Server
+// with h as its Handler. Requests are sent as fast as the Server
+// will take them, rather than at their recorded times, but a
+// request that was read after the server had sent some number of
+// responses is held back until the new Server has sent as many, so
+// that, for instance, a Topen is not sent before the Twalk for its
+// fid has been answered. The responses are discarded. ReplayServer
+// returns once every request has been answered, or once the Server
+// closes the connection, with any error reading the recording.
+func ReplayServer(r io.Reader, h Handler) error {
+	srv := &Server{Handler: h}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	rc := &replayConn{
+		Conn:  local,
+		r:     r,
+		eof:   make(chan struct{}),
+		wrote: make(chan struct{}, 1),
+		idle: func() bool {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			for c := range srv.conns {
+				return c.idle()
+			}
+			return true
+		},
+	}
+	done := make(chan struct{})
+	go func() {
+		srv.ServeConn(rc)
+		close(done)
+	}()
+	select {
+	case <-rc.eof:
+		// The server only asks for more data once it has
+		// dispatched every request before it, so they are all
+		// in progress. Shutdown waits for them to finish.
+		srv.Shutdown(context.Background())
+	case <-done:
+	}
+	<-done
+	return rc.err
+}
+
+// A replayConn is a net.Conn whose Read method returns the data
+// read by the server in a recording. Once the recording is
+// exhausted, Read blocks until the connection is closed. Data
+// written to a replayConn is discarded.
+type replayConn struct {
+	net.Conn
+	r    io.Reader
+	eof  chan struct{}
+	done bool // eof is closed
+	err  error
+	left int // bytes remaining in the current record
+
+	// The number of messages sent in the recording so far,
+	// and by the server.
+	want msgCounter
+	mu   sync.Mutex
+	got  msgCounter
+
+	// Receives a value when the server writes a message.
+	wrote chan struct{}
+
+	// Reports whether the server has no requests in progress.
+	idle func() bool
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if c.done {
+			return c.Conn.Read(p)
+		}
+		if err := c.next(); err == io.EOF {
+			c.done = true
+			close(c.eof)
+			// Blocks until the connection is closed.
+			return c.Conn.Read(p)
+		} else if err != nil {
+			c.err = err
+			return 0, err
+		}
+		c.wait()
+	}
+	if len(p) > c.left {
+		p = p[:c.left]
+	}
+	n, err := io.ReadFull(c.r, p)
+	c.left -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// next finds the next record of data read by the server,
+// counting the messages it wrote before then.
+func (c *replayConn) next() error {
+	var hdr [recordHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(c.r, hdr[:]); err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("truncated record header")
+		} else if err != nil {
+			return err
+		}
+		n := int64(binary.LittleEndian.Uint32(hdr[9:13]))
+		switch hdr[0] {
+		case recordRead:
+			c.left = int(n)
+			return nil
+		case recordWrite:
+			if _, err := io.CopyN(&c.want, c.r, n); err != nil {
+				return fmt.Errorf("truncated record: %v", err)
+			}
+		default:
+			return fmt.Errorf("bad record direction %#x", hdr[0])
+		}
+	}
+}
+
+// wait waits until the server has written as many messages as it
+// had in the recording. It gives up if the server is idle, as
+// it may have good reason not to answer a request, such as a
+// Tflush.
+func (c *replayConn) wait() {
+	for {
+		c.mu.Lock()
+		n := c.got.n
+		c.mu.Unlock()
+		if n >= c.want.n {
+			return
+		}
+		select {
+		case <-c.wrote:
+		case <-time.After(shutdownPollInterval):
+			if c.idle() {
+				return
+			}
+		}
+	}
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.got.Write(p)
+	c.mu.Unlock()
+	select {
+	case c.wrote <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// A msgCounter counts the 9P messages in the data written to it.
+type msgCounter struct {
+	n    int64
+	size []byte // partial size field of the next message
+	left int64  // bytes remaining in the current message
+}
+
+func (m *msgCounter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		if m.left == 0 {
+			need := 4 - len(m.size)
+			if need > len(p) {
+				need = len(p)
+			}
+			m.size = append(m.size, p[:need]...)
+			p = p[need:]
+			if len(m.size) < 4 {
+				break
+			}
+			m.left = int64(binary.LittleEndian.Uint32(m.size)) - 4
+			m.size = m.size[:0]
+			if m.left <= 0 {
+				// Mangled; count it and carry on.
+				m.n++
+				m.left = 0
+				continue
+			}
+		}
+		n := int64(len(p))
+		if n > m.left {
+			n = m.left
+		}
+		p = p[n:]
+		if m.left -= n; m.left == 0 {
+			m.n++
+		}
+	}
+	return total, nil
+}
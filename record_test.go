@@ -0,0 +1,93 @@
+package styx
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"context"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+func TestRecordReplay(t *testing.T) {
+	const contents = "hello, world"
+	var (
+		mu   sync.Mutex
+		seen []string
+	)
+	handler := HandlerFunc(func(s *Session) {
+		for s.Next() {
+			req := s.Request()
+			mu.Lock()
+			seen = append(seen, req.Kind()+" "+req.Path())
+			mu.Unlock()
+			switch req := req.(type) {
+			case Twalk:
+				req.Rwalk(ownedFile{name: "hello", mode: 0644}, nil)
+			case Topen:
+				req.Ropen(strings.NewReader(contents), nil)
+			}
+		}
+	})
+	requests := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		r := seen
+		seen = nil
+		return r
+	}
+
+	var rec bytes.Buffer
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	srv := &Server{Handler: handler, ErrorLog: testLogger{t}}
+	go func() {
+		srv.ServeConn(RecordConn(server, &rec))
+		close(done)
+	}()
+	ctx := context.Background()
+	c, err := NewClient(ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, _, err := c.Walk(ctx, root, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Open(ctx, fid, styxproto.OREAD); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	if n, _ := c.Read(ctx, fid, buf, 0); string(buf[:n]) != contents {
+		t.Errorf("read %q, wanted %q", buf[:n], contents)
+	}
+	c.Close()
+	<-done
+
+	want := requests()
+	if len(want) == 0 {
+		t.Fatal("handler received no requests")
+	}
+	if err := ReplayServer(bytes.NewReader(rec.Bytes()), handler); err != nil {
+		t.Fatal(err)
+	}
+	if got := requests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("replay sent %q, wanted %q", got, want)
+	}
+
+	// A truncated recording is reported.
+	if err := ReplayServer(bytes.NewReader(rec.Bytes()[:rec.Len()-3]), handler); err == nil {
+		t.Error("no error replaying a truncated recording")
+	}
+	if err := ReplayServer(strings.NewReader("x"+strings.Repeat("\x00", 12)), handler); err == nil {
+		t.Error("no error replaying a bad record")
+	}
+}
@@ -1,13 +1,16 @@
 package styx
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path"
+	"sync/atomic"
 
 	"context"
 
 	"aqwari.net/net/styx/internal/styxfile"
-	"aqwari.net/net/styx/internal/sys"
 	"aqwari.net/net/styx/styxproto"
 )
 
@@ -19,7 +22,11 @@ type Request interface {
 	// Context is used to implement cancellation and request timeouts. If
 	// an operation is going to take a long time to complete, you can
 	// allow for the client to cancel the request by receiving on the
-	// channel returned by the Context's Done method.
+	// channel returned by the Context's Done method. The Context is
+	// also cancelled when the connection to the client is closed.
+	// A response to a request whose client has gone, which may be
+	// sent from any goroutine, even after the Handler has returned,
+	// is discarded, and any file given to it is closed.
 	Context() context.Context
 
 	// WithContext returns a copy of the request with a new Context. It
@@ -35,6 +42,20 @@ type Request interface {
 	// Path returns the Path of the file being operated on.
 	Path() string
 
+	// Tag returns the tag the client gave the request. Requests
+	// made up from a single Twstat share its tag.
+	Tag() uint16
+
+	// Fid returns the fid the request operates on. For a Twalk,
+	// that is the fid walked from.
+	Fid() uint32
+
+	// Kind returns the name of the request's type, such as
+	// "Topen" or "Trename". It does not change between releases,
+	// and can be used to tell requests apart without a type
+	// switch.
+	Kind() string
+
 	// For the programmer's convenience, each request type has a default
 	// response. Programmers can choose to ignore requests of a given
 	// type and have the styx package send default responses to them.
@@ -46,6 +67,10 @@ type Request interface {
 	// Used for nested request handlers to swap a request between
 	// sub-sessions.
 	setSession(*Session)
+
+	// The wire bytes of the message that caused the request.
+	// See Session.RawRequest.
+	rawRequest() []byte
 }
 
 // common fields among all requests. Some may be nil for
@@ -55,16 +80,24 @@ type reqInfo struct {
 	tag     uint16
 	fid     uint32
 	session *Session
-	msg     styxproto.Msg
+	raw     []byte
 	path    string
+
+	// drops the request's reference to its in-flight slot.
+	// See conn.hold.
+	done func()
 }
 
 func (info reqInfo) setSession(new *Session) {
 	info.session = new
 }
 
+func (info reqInfo) rawRequest() []byte {
+	return info.raw
+}
+
 func (info reqInfo) handled() bool {
-	return !info.session.unhandled
+	return atomic.LoadInt32(&info.session.unhandled) == 0
 }
 
 func (info reqInfo) defaultResponse() {
@@ -81,28 +114,73 @@ func (t reqInfo) Path() string {
 	return t.path
 }
 
+// Tag returns the tag of the request.
+func (t reqInfo) Tag() uint16 {
+	return t.tag
+}
+
+// Fid returns the fid the request operates on.
+func (t reqInfo) Fid() uint32 {
+	return t.fid
+}
+
 // Rerror sends an error to the client.
 func (t reqInfo) Rerror(format string, args ...interface{}) {
-	t.session.unhandled = false
-	if t.session.conn.clearTag(t.tag) {
+	t.session.setHandled()
+	if t.clearTag() {
 		t.session.conn.Rerror(t.tag, format, args...)
 	}
 }
 
+// sendError sends err to the client. See conn.sendError.
+func (t reqInfo) sendError(err error) {
+	t.session.setHandled()
+	if t.clearTag() {
+		t.session.conn.sendError(t.tag, err)
+	}
+}
+
+// passOn reports whether a request that failed with err should be
+// left unanswered, for the next layer of a Union to try.
+func (t reqInfo) passOn(err error) bool {
+	union, _ := t.ctx.Value(unionKey{}).(bool)
+	return union && errors.Is(err, os.ErrNotExist)
+}
+
 func newReqInfo(ctx context.Context, s *Session, msg fcall, filepath string) reqInfo {
+	// msg refers to the Decoder's buffer, which is reused once
+	// the request is dispatched, so the raw bytes are copied.
+	raw, err := rawBytes(msg)
+	if err != nil {
+		s.conn.srv.logf("%s: could not copy message %s: %s", s.conn.remoteAddr(), msg, err)
+	}
 	return reqInfo{
 		session: s,
 		tag:     msg.Tag(),
 		fid:     msg.Fid(),
 		ctx:     ctx,
-		msg:     msg,
+		raw:     raw,
 		path:    filepath,
+		done:    s.conn.hold(ctx),
 	}
 }
 
+// clearTag is called by response methods before they send
+// their response. It reports false if the request was
+// flushed, and releases the request's slot either way.
+func (t reqInfo) clearTag() bool {
+	t.done()
+	return t.session.conn.clearTag(t.tag)
+}
+
 // A Topen message is sent when a client wants to open a file for I/O
 // Use the Ropen method to provide the opened file.
 //
+// If the client asks for the file to be truncated, Flag includes
+// os.O_TRUNC, and the Topen request is preceded by a Ttruncate
+// request with a Size of 0. The Topen request is only delivered,
+// and the file only opened, if the Ttruncate request succeeds.
+//
 // The default response to a Topen message to send an Rerror message
 // saying "permssion denied".
 type Topen struct {
@@ -110,6 +188,16 @@ type Topen struct {
 	// in the os package, such as O_RDWR, O_APPEND etc.
 	Flag int
 	reqInfo
+
+	// The client asked for the file to be removed when
+	// the fid is clunked, with ORCLOSE.
+	rclose bool
+
+	// If not nil, the request was made to find out if a
+	// directory is empty before removing it, and the result
+	// is sent here rather than opening the fid. See
+	// Server.EnforceRmdirEmpty.
+	empty chan error
 }
 
 func (t Topen) WithContext(ctx context.Context) Request {
@@ -117,15 +205,67 @@ func (t Topen) WithContext(ctx context.Context) Request {
 	return t
 }
 
+func (t Topen) Kind() string { return "Topen" }
+
+func (t Topen) Rerror(format string, args ...interface{}) {
+	if t.empty != nil {
+		t.Ropen(nil, fmt.Errorf(format, args...))
+	} else {
+		t.reqInfo.Rerror(format, args...)
+	}
+}
+
+func (t Topen) defaultResponse() {
+	t.Rerror("permission denied.")
+}
+
+// Readable and Writable report whether the client asked to open
+// the file for reading and writing, respectively. They reflect the
+// mode of the Topen request, not the file's permissions.
+//
+// Tread and Twrite requests are not passed to the Handler; they go
+// straight to the value given to Ropen, so the open mode is only
+// visible here. Once the file is open, the styx package rejects
+// Tread requests on a fid that is not readable, and Twrite requests
+// on a fid that is not writable, without consulting the opened
+// file. A Handler that needs stricter rules can give Ropen a value
+// that only supports the operations it allows.
+func (t Topen) Readable() bool { return readable(t.Flag) }
+func (t Topen) Writable() bool { return writable(t.Flag) }
+
 // The Ropen method signals to the client that a file has succesfully
 // been opened and is ready for I/O. After Ropen returns, future reads
 // and writes to the opened file handle will pass through rwc.
 //
 // The value rwc must implement some of the interfaces in the io package
-// for reading and writing. If the type implements io.Seeker or io.ReaderAt
-// and io.WriterAt, clients may read or write at arbitrary offsets within
-// the file. Types that only implement Read or Write operations will return
-// errors on writes and reads, respectively.
+// for reading and writing. If the type implements io.Seeker, io.ReaderAt,
+// or io.ReaderAt and io.WriterAt, clients may read or write at arbitrary
+// offsets within the file. Each read is passed along to rwc as it
+// arrives; nothing is buffered. Types that only implement Read or Write
+// operations will return errors on writes and reads, respectively.
+//
+// The length sent in response to a Tstat request for the open file is
+// taken from rwc's Size method, if it has one, as *bytes.Reader and
+// *io.SectionReader do. Failing that, an io.Seeker's length is found by
+// seeking to its end. This way, the length a client sees matches what it
+// can read, even if rwc's Stat method says otherwise.
+//
+// A Tread at or past the end of the file is answered with an Rread
+// of zero bytes, as long as rwc reports the end of the file with
+// io.EOF. A Twrite past the end of the file is passed along to rwc
+// like any other; rwc may fill the gap, as a sparse file would, or
+// return an error, which is sent to the client.
+//
+// If the file is a directory, rwc should implement the Directory or
+// DirReader interface, so that its contents can be listed.
+//
+// The data of a Twrite request is copied from the connection to rwc
+// as it is read, unless Server.WriteLimit or Server.OutOfOrder is set,
+// or the request had to wait for Server.MaxInflight; then the data is
+// read into memory in full before it is written. rwc may implement the
+// WriteChecker interface to refuse a write before its data is read
+// into memory; only the data of a request that waited for
+// Server.MaxInflight is read in full regardless.
 //
 // If rwc implements the Stat method of os.File, that will be used to
 // answer Tstat requests. Otherwise, the styx package will assemble Rstat
@@ -140,8 +280,15 @@ func (t Topen) Ropen(rwc interface{}, err error) {
 		file file
 		f    styxfile.Interface
 	)
+	if t.passOn(err) {
+		return
+	}
+	if t.empty != nil {
+		t.listed(rwc, err)
+		return
+	}
 	if err != nil {
-		t.Rerror("%s", err)
+		t.sendError(err)
 		return
 	}
 	// The type of the file (regular or directory) will have been
@@ -149,10 +296,17 @@ func (t Topen) Ropen(rwc interface{}, err error) {
 	qid := t.session.conn.qid(t.Path(), 0)
 	mode := styxfile.ModeOS(uint32(qid.Type()) << 24)
 
-	if dir, ok := rwc.(Directory); ok && mode.IsDir() {
-		f = styxfile.NewDir(dir, t.Path(), t.session.conn.qidpool)
+	if dir, ok := directory(rwc); ok && mode.IsDir() {
+		dir = t.session.filterDir(dir)
+		f = styxfile.NewDirCache(dir, t.Path(), t.session.conn.qidpool, t.session.conn.statConfig(), t.session.conn.srv.DirCacheLimit)
 	} else {
+		if mode.IsDir() {
+			t.session.conn.strictf("Ropen %s: %T is not a Directory", t.Path(), rwc)
+		}
 		f, err = styxfile.New(rwc)
+		if err == nil && t.session.conn.srv.ReadAhead && !writable(t.Flag) {
+			f = styxfile.ReadAhead(f)
+		}
 	}
 
 	if err != nil {
@@ -163,17 +317,50 @@ func (t Topen) Ropen(rwc interface{}, err error) {
 		t.Rerror("open failed")
 		return
 	}
-	t.session.files.Update(t.fid, &file, func() {
+	ok := t.session.files.Update(t.fid, &file, func() {
 		file.rwc = f
+		file.dir = mode.IsDir()
+		file.flag = t.Flag
+		file.rclose = t.rclose
+		file.writes = new(writeQueue)
+		file.wrote = t.cacheWrite(t.path)
 	})
-	t.session.unhandled = false
-	if t.session.conn.clearTag(t.tag) {
+	if !ok {
+		t.session.discard(t.path, f)
+		t.Rerror("%s", errNoFid)
+		return
+	}
+	t.session.setHandled()
+	if t.clearTag() {
 		t.session.conn.Ropen(t.tag, qid, 0)
 	}
 }
 
+// listed reports whether the directory opened for a Topen made by
+// the styx package has any entries. See Server.EnforceRmdirEmpty.
+func (t Topen) listed(rwc interface{}, err error) {
+	t.session.setHandled()
+	if err == nil {
+		if dir, ok := directory(rwc); !ok {
+			err = fmt.Errorf("%T is not a Directory", rwc)
+		} else if files, rerr := dir.Readdir(1); len(files) > 0 {
+			err = errNotEmpty
+		} else if rerr != io.EOF {
+			err = rerr
+		}
+		if c, ok := rwc.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	select {
+	case t.empty <- err:
+	default:
+	}
+}
+
 // A Tstat message is sent when a client wants metadata about a file.
 // A client should have read access to the file's containing directory.
+// A client need not open a file before sending a Tstat request for it.
 // Call the Rstat method for a succesful request.
 //
 // The default response for a Tstat message is an Rerror message
@@ -187,37 +374,107 @@ func (t Tstat) WithContext(ctx context.Context) Request {
 	return t
 }
 
+func (t Tstat) Kind() string { return "Tstat" }
+
 // Rstat responds to a succesful Tstat request. The styx package will
 // translate the os.FileInfo value into the appropriate 9P structure. Rstat
 // will attempt to resolve the names of the file's owner and group. If
-// that cannot be done, an empty string is sent. If err is non-nil, and error
+// that cannot be done, an empty string is sent. If info describes a
+// symbolic link, see the Symlink interface. If err is non-nil, and error
 // is sent to the client instead.
+//
+// The length of a directory is advisory; 9P clients read a directory
+// until they receive a short read, and most ignore its size. By
+// default, Rstat reports whatever info.Size returns. If info describes
+// a directory and also implements the Directory interface, Rstat calls
+// its Readdir method once, with n <= 0, and reports the exact number
+// of bytes a client will read from the directory.
 func (t Tstat) Rstat(info os.FileInfo, err error) {
+	if t.passOn(err) {
+		return
+	}
+	if err != nil {
+		t.sendError(err)
+		return
+	}
+	stat, err := t.session.fileStat(t.Path(), info)
 	if err != nil {
-		t.Rerror("%s", err)
+		t.sendError(err)
 		return
 	}
-	buf := make([]byte, styxproto.MaxStatLen)
-	uid, gid, muid := sys.FileOwner(info)
+	t.cacheStat(info)
+	t.session.setHandled()
+	if t.clearTag() {
+		t.session.conn.Rstat(t.tag, stat)
+	}
+}
+
+// discard closes f, given to a response for a fid that the session
+// no longer has. The fid is gone if the session ended, such as when
+// the client disconnected, or if it was clunked, while the request
+// was being handled.
+func (s *Session) discard(name string, f styxfile.Interface) {
+	if err := f.Close(); err != nil {
+		s.conn.srv.logf("close %s: %v", name, err)
+	}
+}
+
+// filterDir applies Server.DirFilter, if set, to the entries of
+// a directory listed in the session.
+func (s *Session) filterDir(dir styxfile.Directory) styxfile.Directory {
+	filter := s.conn.srv.DirFilter
+	if filter == nil {
+		return dir
+	}
+	user := s.User
+	return styxfile.Filter(dir, func(fi os.FileInfo) bool {
+		return filter(user, fi)
+	})
+}
+
+// fileStat translates info, describing the file at filepath,
+// into a 9P stat structure. See Tstat.Rstat.
+func (s *Session) fileStat(filepath string, info os.FileInfo) (styxproto.Stat, error) {
+	buf := make([]byte, styxproto.MaxStatLenU)
 	name := info.Name()
 	if name == "/" {
 		name = "."
 	}
-	stat, _, err := styxproto.NewStat(buf, name, uid, gid, muid)
+	config := s.conn.statConfig()
+	stat, err := config.FileStat(buf, name, info)
 	if err != nil {
-		// should never happen
-		panic(err)
+		return nil, err
 	}
-	mode := styxfile.Mode9P(info.Mode())
-	stat.SetLength(info.Size())
-	stat.SetMode(mode)
-	stat.SetAtime(uint32(info.ModTime().Unix())) // TODO: get atime
-	stat.SetMtime(uint32(info.ModTime().Unix()))
-	stat.SetQid(t.session.conn.qid(t.Path(), styxfile.QidType(mode)))
-	t.session.unhandled = false
-	if t.session.conn.clearTag(t.tag) {
-		t.session.conn.Rstat(t.tag, stat)
+	s.conn.notePerm(filepath, info)
+	if dir, ok := info.(Directory); ok && info.IsDir() {
+		files, err := s.filterDir(dir).Readdir(-1)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		size, err := config.DirSize(files)
+		if err != nil {
+			return nil, err
+		}
+		stat.SetLength(size)
+	}
+	mode := stat.Mode()
+	qid := s.conn.qidMtime(filepath, styxfile.QidType(mode), info.ModTime())
+
+	// The client has already seen the qid, so if the handler
+	// changed its mind about the file type, the qid wins.
+	isdir := qid.Type()&styxproto.QTDIR != 0
+	if isdir != (mode&styxproto.DMDIR != 0) {
+		s.conn.strictf("Rstat %s: mode %v does not match qid type %#x",
+			filepath, info.Mode(), qid.Type())
+		if isdir {
+			mode |= styxproto.DMDIR
+		} else {
+			mode &^= styxproto.DMDIR
+		}
 	}
+	stat.SetMode(mode)
+	stat.SetQid(qid)
+	return stat, nil
 }
 
 // A Tcreate message is sent when a client wants to create a new file
@@ -225,6 +482,12 @@ func (t Tstat) Rstat(info os.FileInfo, err error) {
 // message returns the absolute path of the containing directory. A user
 // must have write permissions in the directory to create a file.
 //
+// If the client sets the DMDIR bit, Mode has os.ModeDir set, and a
+// directory should be created; Rcreate must then be given a value
+// that can be listed, as for Ropen, and the client is sent a Qid
+// of type QTDIR. With Server.EnforceRemovePerm, the permission bits
+// of Mode have already been masked by those of the directory.
+//
 // The default response to a Tcreate message is an Rerror message
 // saying "permission denied".
 type Tcreate struct {
@@ -232,6 +495,9 @@ type Tcreate struct {
 	Mode os.FileMode // permissions and file type to create
 	Flag int         // flags to open the new file with
 	reqInfo
+
+	// See Topen.
+	rclose bool
 }
 
 func (t Tcreate) WithContext(ctx context.Context) Request {
@@ -239,6 +505,17 @@ func (t Tcreate) WithContext(ctx context.Context) Request {
 	return t
 }
 
+func (t Tcreate) Kind() string { return "Tcreate" }
+
+// IsDir reports whether the client asked to create a directory.
+func (t Tcreate) IsDir() bool { return t.Mode.IsDir() }
+
+// Readable and Writable report whether the client asked to open the
+// new file for reading and writing, respectively. See the Readable
+// and Writable methods of Topen.
+func (t Tcreate) Readable() bool { return readable(t.Flag) }
+func (t Tcreate) Writable() bool { return writable(t.Flag) }
+
 // NewPath joins the path for the Tcreate's containing directory
 // with its Name field, returning the absolute path to the new file.
 func (t Tcreate) NewPath() string {
@@ -257,34 +534,85 @@ func (t Tcreate) Path() string {
 // rwc must meet the same criteria listed for the Ropen method of a Topen
 // request.
 func (t Tcreate) Rcreate(rwc interface{}, err error) {
+	t.RcreateInfo(rwc, nil, err)
+}
+
+// RcreateInfo is like Rcreate, but also reports the attributes of
+// the new file, as determined by the handler. The type of the Qid
+// sent to the client is derived from info's mode, and, unless rwc
+// provides a Stat method like that of os.File, future Tstat requests
+// on the new fid are answered with info. If info is nil, RcreateInfo
+// is equivalent to Rcreate.
+func (t Tcreate) RcreateInfo(rwc interface{}, info os.FileInfo, err error) {
 	var (
 		f styxfile.Interface
 	)
 	if err != nil {
-		t.Rerror("%s", err)
+		t.sendError(err)
 		return
 	}
 
-	if dir, ok := rwc.(Directory); t.Mode.IsDir() && ok {
-		f = styxfile.NewDir(dir, path.Join(t.Path(), t.Name), t.session.conn.qidpool)
+	if dir, ok := directory(rwc); t.Mode.IsDir() && ok {
+		dir = t.session.filterDir(dir)
+		f = styxfile.NewDirCache(dir, path.Join(t.Path(), t.Name), t.session.conn.qidpool, t.session.conn.statConfig(), t.session.conn.srv.DirCacheLimit)
 	} else {
+		if t.Mode.IsDir() {
+			t.session.conn.strictf("Rcreate %s: %T is not a Directory", t.NewPath(), rwc)
+		}
 		f, err = styxfile.New(rwc)
+		if err == nil && t.session.conn.srv.ReadAhead && !writable(t.Flag) {
+			f = styxfile.ReadAhead(f)
+		}
 	}
 	if err != nil {
 		t.session.conn.srv.logf("create %s failed: %s", t.Name, err)
 		t.Rerror("create failed")
 		return
 	}
-	file := file{name: path.Join(t.Path(), t.Name), rwc: f}
+	mode := styxfile.StatMode(t.Mode, t.session.conn.dotu)
+	if info != nil {
+		if _, ok := f.(hasStat); !ok {
+			f = createdFile{f, info}
+		}
+		// The file is opened according to the Tcreate
+		// request, so its directory bit must agree.
+		imode := styxfile.StatMode(info.Mode(), t.session.conn.dotu)
+		if (imode&styxproto.DMDIR != 0) != t.Mode.IsDir() {
+			t.session.conn.strictf("Rcreate %s: mode %v does not match requested mode %v",
+				t.NewPath(), info.Mode(), t.Mode)
+			imode = imode&^styxproto.DMDIR | mode&styxproto.DMDIR
+		}
+		mode = imode
+	}
+	file := file{name: path.Join(t.Path(), t.Name), rwc: f, dir: t.Mode.IsDir(), flag: t.Flag, rclose: t.rclose, writes: new(writeQueue)}
+	file.wrote = t.cacheWrite(file.name)
 
 	// fid for parent directory is now the fid for the new file,
 	// so there is no increase in references to this session.
-	t.session.files.Put(t.fid, file)
+	prev := file
+	if !t.session.files.Update(t.fid, &prev, func() { prev = file }) {
+		t.session.discard(file.name, f)
+		t.Rerror("%s", errNoFid)
+		return
+	}
 
-	qtype := styxfile.QidType(styxfile.Mode9P(t.Mode))
-	qid := t.session.conn.qid(file.name, qtype)
-	t.session.unhandled = false
-	if t.session.conn.clearTag(t.tag) {
+	qtype := styxfile.QidType(mode)
+	if old, ok := t.session.conn.qidpool.Get(file.name); ok && old.Type() != qtype {
+		// The name belonged to a file of another type, removed
+		// other than through this connection. The new file
+		// gets a Qid of its own, so that a directory created
+		// with DMDIR is seen as one.
+		t.session.conn.qidpool.Del(file.name)
+	}
+	t.session.conn.noteCreated(file.name, t.session.User, info, t.Mode)
+	var qid styxproto.Qid
+	if info != nil {
+		qid = t.session.conn.qidMtime(file.name, qtype, info.ModTime())
+	} else {
+		qid = t.session.conn.qid(file.name, qtype)
+	}
+	t.session.setHandled()
+	if t.clearTag() {
 		t.session.conn.Rcreate(t.tag, qid, 0)
 	}
 }
@@ -293,10 +621,18 @@ func (t Tcreate) Rcreate(rwc interface{}, err error) {
 // from the server. The Rremove method should be called once the
 // file has been succesfully deleted.
 //
+// If a file opened with ORCLOSE is clunked, the styx package makes
+// a Tremove request for it. The client has already given up the fid,
+// and is not told whether the remove succeeded.
+//
 // The default response to a Tremove message is an Rerror message
 // saying "permission denied".
 type Tremove struct {
 	reqInfo
+
+	// If not nil, the request was made for an ORCLOSE file,
+	// and its result is sent here rather than to the client.
+	status chan error
 }
 
 func (t Tremove) WithContext(ctx context.Context) Request {
@@ -304,6 +640,8 @@ func (t Tremove) WithContext(ctx context.Context) Request {
 	return t
 }
 
+func (t Tremove) Kind() string { return "Tremove" }
+
 // Rremove signals to the client that a file has been succesfully
 // removed. The file handle for the file is no longer valid, and may be
 // re-used for other files. Whether or not any other file handles associated
@@ -314,11 +652,22 @@ func (t Tremove) WithContext(ctx context.Context) Request {
 // If err is non-nil, an Rerror message is sent to the client. Regardless, the
 // file handle is no longer valid.
 func (t Tremove) Rremove(err error) {
+	if t.status != nil {
+		t.session.setHandled()
+		if err == nil {
+			t.session.conn.qidpool.Del(t.Path())
+		}
+		select {
+		case t.status <- err:
+		default:
+		}
+		return
+	}
 	t.session.conn.sessionFid.Del(t.fid)
 	t.session.files.Del(t.fid)
 
-	t.session.unhandled = false
-	if !t.session.conn.clearTag(t.tag) {
+	t.session.setHandled()
+	if !t.clearTag() {
 		// cancelled, do not send response
 		return
 	}
@@ -329,7 +678,7 @@ func (t Tremove) Rremove(err error) {
 	// qid until *all* references to it are removed. We'll need to implement
 	// reference counting for that :\
 	if err != nil {
-		t.session.conn.Rerror(t.tag, "%s", err)
+		t.session.conn.sendError(t.tag, err)
 	} else {
 		t.session.conn.qidpool.Del(t.Path())
 		t.session.conn.Rremove(t.tag)
@@ -339,3 +688,16 @@ func (t Tremove) Rremove(err error) {
 		t.session.close()
 	}
 }
+
+// Rerror is like Rremove with a non-nil error.
+func (t Tremove) Rerror(format string, args ...interface{}) {
+	if t.status != nil {
+		t.Rremove(fmt.Errorf(format, args...))
+	} else {
+		t.reqInfo.Rerror(format, args...)
+	}
+}
+
+func (t Tremove) defaultResponse() {
+	t.Rerror("permission denied.")
+}
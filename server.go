@@ -2,10 +2,19 @@ package styx
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"sync"
 	"time"
 
+	"context"
+
 	"aqwari.net/net/styx/internal/util"
+	"aqwari.net/net/styx/styxproto"
 	"aqwari.net/retry"
 )
 
@@ -28,15 +37,85 @@ type Server struct {
 	// maximum wait before timing out write of the response.
 	WriteTimeout time.Duration
 
-	// maximum wait before closing an idle connection.
+	// maximum wait before closing an idle connection, one
+	// with no requests in progress. If zero, there is no
+	// limit. Requests themselves have no time limit; a Tread
+	// of a file that blocks until some event occurs keeps its
+	// connection from being idle for as long as it takes.
 	IdleTimeout time.Duration
 
+	// Clock is the source of time for IdleTimeout, ReadLimit,
+	// WriteLimit, and the logs. If nil, the system clock is
+	// used.
+	Clock Clock
+
 	// maximum size of a 9P message, DefaultMsize if unset.
 	MaxSize int64
 
+	// VersionFunc, if not nil, decides the response to a
+	// client's Tversion request, given the version string and
+	// maximum message size the client asked for, in place of the
+	// default negotiation. Returning the version "unknown", or
+	// anything not beginning with "9P2000", declines the
+	// request. If version is "9P2000.u", the 9P2000.u extensions
+	// are used. The returned msize may be above or below
+	// MaxSize, but is lowered to the client's msize if it is
+	// greater, as version(5) requires, and negotiation fails if
+	// it is below the minimum a connection can work with.
+	VersionFunc func(clientVersion string, clientMsize uint32) (version string, msize uint32)
+
+	// maximum rate, in bytes per second, at which each connection
+	// may read file data with Tread requests, and write it with
+	// Twrite requests, respectively. Requests wait, subject to
+	// cancellation, until their data is allowed through. If zero,
+	// there is no limit.
+	ReadLimit, WriteLimit int64
+
+	// If true, files opened read-only whose Ropen or Rcreate
+	// value is an io.Reader, but not an io.ReaderAt or
+	// io.Seeker, are read ahead: once a Tread is answered, the
+	// same number of bytes that follow are read in the
+	// background, so that a client reading sequentially does
+	// not wait on the reader after each response. This helps
+	// readers with high latency, at the cost of reading data
+	// the client may never ask for.
+	ReadAhead bool
+
+	// If true, Twrite requests are written to their files from
+	// their own goroutines, as Tread requests always are, and
+	// answered as soon as each is done, so that a slow write
+	// does not hold up other requests on the connection. Writes
+	// to the same fid are still made in the order they arrive.
+	// The data of each write is held in memory until it can be
+	// written. Requests passed to a Handler are unaffected;
+	// they are delivered to each Session in order, but requests
+	// in different sessions are handled concurrently.
+	OutOfOrder bool
+
+	// maximum number of requests a single connection may have
+	// in progress at once. Once the limit is reached, further
+	// requests are queued until the work on an earlier request
+	// is done. A flushed request counts against the limit until
+	// its handler has returned. Tflush and Tversion messages are
+	// not counted, and are never queued. If zero, there is no
+	// limit.
+	MaxInflight int
+
 	// optional TLS config, used by ListenAndServeTLS
 	TLSConfig *tls.Config
 
+	// optional configuration for the listeners created by
+	// ListenAndServe and ListenAndServeTLS. Its Control function
+	// can be used to set socket options, such as SO_REUSEPORT,
+	// so that several processes can share a port while one
+	// hands off to the next. If nil, net.Listen is used.
+	ListenConfig *net.ListenConfig
+
+	// optional origin check for WebSocketHandler. If nil, a
+	// browser may only connect from a page served by the same
+	// host.
+	CheckOrigin func(r *http.Request) bool
+
 	// Handler to invoke for each session
 	Handler Handler
 
@@ -44,14 +123,250 @@ type Server struct {
 	// authentication is disabled.
 	Auth AuthFunc
 
+	// Authenticator is used to authenticate user sessions,
+	// in place of Auth. See Authenticator.
+	Authenticator Authenticator
+
 	// OpenAuth is used to open file to authentication agent
 	OpenAuth AuthOpenFunc
 
+	// If not nil, Attach is called for each Tattach request,
+	// and may reject it or choose the user that the session
+	// runs as. See AttachFunc.
+	Attach AttachFunc
+
+	// AnonymousUser is the User of a session whose client
+	// attaches with an empty user name, or the name "none", when
+	// authentication is disabled. It defaults to "none". Attach,
+	// if set, is given the name sent by the client, and may
+	// still choose another user.
+	AnonymousUser string
+
+	// If not nil, Root is called when a client attaches to the
+	// server, and should return the path that the root of the
+	// session's file tree maps to. The paths of all requests in
+	// the session, as returned by their Path methods, are
+	// within this path. Clients cannot walk above it using "..".
+	Root func(user, aname string) string
+
+	// If not nil, RootInfo is called when a client attaches to
+	// the server, after Attach and Root, and returns information
+	// about the root of the session's file tree. The Qid of the
+	// root, sent in the Rattach response, is derived from it, and
+	// Tstat requests for the root, unless it is open, are answered
+	// with it instead of being passed to the Handler. If RootInfo
+	// returns an error, the attach is rejected. If RootInfo is nil,
+	// the root is a directory whose Tstat requests are passed to
+	// the Handler.
+	RootInfo func(user, aname string) (os.FileInfo, error)
+
 	// If not nil, ErrorLog will be used to log unexpected
 	// errors accepting or handling connections. TraceLog,
-	// if not nil, will receive detailed protocol tracing
-	// information.
+	// if not nil, will receive a line for each completed
+	// request, containing the request type, tag, fid, file
+	// path, the time taken to respond, and the response.
 	ErrorLog, TraceLog Logger
+
+	// If true, responses from the Handler are checked for
+	// inconsistencies, such as a directory opened with a
+	// value that cannot list its contents, or a stat whose
+	// mode disagrees with the file's Qid. Inconsistencies are
+	// logged and cause a panic in the Handler's goroutine.
+	// Strict is meant for development and testing; if it is
+	// false, such responses are tolerated, and corrected where
+	// possible.
+	Strict bool
+
+	// If true, every 9P message sent or received is also
+	// written to TraceLog, in full.
+	TraceMessages bool
+
+	// If not nil, AccessLog receives a line for each completed
+	// request, in the format of Plan 9's syslog(2): the system
+	// name, the time, the user, the client's address, the request
+	// type, the file path, and "ok" or the error sent to the
+	// client. Lines are buffered, and written to AccessLog when
+	// a connection has no requests in progress or is closed, and
+	// when the Server is shut down. Writes to AccessLog are
+	// serialized.
+	AccessLog io.Writer
+
+	// DefaultUid and DefaultGid are the owner and group sent
+	// for files whose ownership cannot be determined. A file's
+	// ownership is taken, in order of precedence, from the
+	// OwnerInfo methods of its os.FileInfo value, the OwnerInfo
+	// methods of the value returned by its Sys method, and the
+	// host operating system. Only if all of these are empty
+	// are the defaults used. If no Muid can be determined, the
+	// file's owner is sent in its place.
+	DefaultUid, DefaultGid string
+
+	// The permission bits of DefaultMode are sent for files
+	// whose mode has no permission bits set. Other bits are
+	// ignored. A file's own permissions, if any, always win.
+	DefaultMode os.FileMode
+
+	// If true, a Tremove request is rejected, without being
+	// passed to the Handler, if the user does not have write
+	// permission on the file's parent directory. The mode and
+	// owner of the directory are those last given to Rwalk or
+	// Rstat for it; if neither has been called, the Handler
+	// decides. The styx package does not know which groups a
+	// user belongs to, so the group write bit is taken to
+	// grant permission to everyone. Handlers with their own
+	// policies should leave this false.
+	//
+	// The same permissions are used to mask the Mode of a
+	// Tcreate request by that of its directory, as described
+	// in open(5), before it is passed to the Handler.
+	EnforceRemovePerm bool
+
+	// If true, a Tremove request for a directory is preceded
+	// by a Topen request for it, made by the styx package,
+	// and rejected with the error "directory not empty" if
+	// the Directory given to Ropen lists any entries, even
+	// those hidden by DirFilter. For 9P2000.u clients, the
+	// error carries the errno ENOTEMPTY. If the Handler does
+	// not open the directory, or gives Ropen a value that
+	// cannot be listed, the Tremove request is passed to the
+	// Handler as usual, which must then decide for itself.
+	EnforceRmdirEmpty bool
+
+	// DirCacheLimit is the number of bytes of directory listing
+	// kept for each open directory, so that clients can read
+	// it again from an earlier offset, such as 0 to start the
+	// listing over. Nothing else of a listing is kept by the
+	// styx package; entries are requested from the Directory
+	// passed to Ropen as the client reads. To read from before
+	// the retained bytes, the Directory must implement
+	// io.Seeker; it is rewound and read again from the start,
+	// so a small limit saves memory at the cost of listing the
+	// directory again. Otherwise, such reads fail. If zero,
+	// nothing is kept.
+	DirCacheLimit int
+
+	// If not nil, DirFilter is called for each entry of a
+	// directory listed by a session, with the session's User,
+	// before the entry is sent to the client. Entries for which
+	// it returns false are left out of the listing, and out of
+	// the length of the directory reported by Rstat, so a
+	// client cannot tell they are there. Offsets into the
+	// listing count only the entries that are sent. DirFilter
+	// does not prevent a client from walking to a hidden file
+	// by name; the Handler must refuse such walks itself.
+	DirFilter func(user string, e os.FileInfo) bool
+
+	// QidVersion selects how the version of each file's Qid is
+	// determined. Clients use the version to decide when their
+	// cached copy of a file is stale. The default is
+	// QidVersionZero.
+	QidVersion QidVersion
+
+	// If not nil, UnknownHandler is called for each message
+	// whose type is not part of the 9P2000 protocol, such as a
+	// message from a vendor extension, instead of rejecting it
+	// as invalid. Messages that begin, like most 9P messages,
+	// with a fid are passed along with the session that the fid
+	// belongs to; s is nil if there is no such session. The
+	// message is only valid until UnknownHandler returns, and
+	// no other requests on the connection are read in the
+	// meantime. UnknownHandler may answer the message with the
+	// RespondRaw method of s; if it does not, the client is sent
+	// an Rerror.
+	UnknownHandler func(s *Session, msg styxproto.RawMessage)
+
+	// If not nil, OnDrain is called by Shutdown for each active
+	// session, before any connections are closed, so its Handler
+	// can save state or warn the client that the server is going
+	// away. OnDrain is called from the goroutine that called
+	// Shutdown, and requests continue to be served while it runs.
+	OnDrain func(*Session)
+
+	// If not nil, ConnState is called each time a connection
+	// changes state. See the ConnState type. The calls for a
+	// connection are made in order, and hold up the connection
+	// until they return.
+	ConnState func(net.Conn, ConnState)
+
+	accessOnce sync.Once
+	access     *accessLog
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	draining  bool
+	vars      *serverVars
+}
+
+// A QidVersion is a strategy for setting the version field of
+// the Qids sent to clients. Qids are tracked for each connection,
+// so a version only reflects what the server has seen on that
+// connection.
+type QidVersion int
+
+const (
+	// The version is always zero. This suits files whose
+	// contents never change, or clients that do not cache.
+	QidVersionZero QidVersion = iota
+
+	// The version starts at zero, and is incremented each time
+	// the file is successfully written to with Twrite, or
+	// truncated with a Twstat or an Topen with OTRUNC.
+	QidVersionWrite
+
+	// The version is the modification time of the file, in
+	// seconds since the Unix epoch, as reported by the
+	// os.FileInfo values given to Rwalk, Rstat and RcreateInfo,
+	// or by the Stat method of an open file.
+	QidVersionMtime
+)
+
+// A ConnState is the state of a connection to a Server, as
+// reported to its ConnState hook.
+type ConnState int
+
+const (
+	// The connection has been accepted, and the client has
+	// not yet sent a message.
+	StateNew ConnState = iota
+
+	// At least one 9P message is being processed, or its
+	// response is being written.
+	StateActive
+
+	// Every message received has been answered, and the
+	// server is waiting for the next. Connections start out
+	// idle after version negotiation.
+	StateIdle
+
+	// The connection is closed. This is the last state a
+	// connection is in.
+	StateClosed
+)
+
+var connStateName = [...]string{
+	StateNew:    "new",
+	StateActive: "active",
+	StateIdle:   "idle",
+	StateClosed: "closed",
+}
+
+func (s ConnState) String() string {
+	if s >= 0 && int(s) < len(connStateName) {
+		return connStateName[s]
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// All connections share one buffer for AccessLog.
+func (srv *Server) accessLog() *accessLog {
+	if srv.AccessLog == nil {
+		return nil
+	}
+	srv.accessOnce.Do(func() {
+		srv.access = newAccessLog(srv.AccessLog, srv.clock())
+	})
+	return srv.access
 }
 
 // Types implementing the Handler interface can receive and respond to 9P
@@ -98,6 +413,32 @@ type Handler interface {
 	Serve9P(*Session)
 }
 
+// Types implementing the HandlerErr interface can stop serving a
+// session by returning a non-nil error, signalling an unrecoverable
+// problem with the connection. Use CloseOnError to convert a
+// HandlerErr into a Handler.
+type HandlerErr interface {
+	Serve9P(*Session) error
+}
+
+// CloseOnError returns a Handler that calls h.Serve9P. If h returns
+// a non-nil error, the error is logged, every outstanding request
+// on the session's connection is answered with an Rerror message
+// containing it, and the connection is closed.
+func CloseOnError(h HandlerErr) Handler {
+	return errHandler{h}
+}
+
+type errHandler struct {
+	HandlerErr
+}
+
+func (h errHandler) Serve9P(s *Session) {
+	if err := h.HandlerErr.Serve9P(s); err != nil {
+		s.conn.abort(err)
+	}
+}
+
 // The HandlerFunc provides a convenient adapter type that allows for normal
 // functions to handle 9P sessions.
 type HandlerFunc func(s *Session)
@@ -107,17 +448,35 @@ func (fn HandlerFunc) Serve9P(s *Session) {
 	fn(s)
 }
 
+// ErrServerClosed is returned by a Server's Serve, ListenAndServe,
+// and ListenAndServeTLS methods after a call to Shutdown.
+var ErrServerClosed = errors.New("styx: server closed")
+
 // Serve accepts connections on the listener l, creating a new service
 // goroutine for each. The service goroutines read requests and relays
-// them to the appropriate Handler goroutines.
+// them to the appropriate Handler goroutines. Serve always returns a
+// non-nil error; after Shutdown, the error is ErrServerClosed.
+//
+// Any net.Listener may be used. Tests can control the connections
+// a Server sees, to check its handling of failing transports, with
+// the Listener of the styxtest package.
 func (srv *Server) Serve(l net.Listener) error {
 	backoff := retry.Exponential(time.Millisecond * 10).Max(time.Second)
 	try := 0
 
+	if !srv.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer srv.trackListener(l, false)
+
 	srv.logf("listening on %s", l.Addr())
 	for {
 		rwc, err := l.Accept()
 		if err != nil {
+			if srv.isDraining() {
+				return ErrServerClosed
+			}
 			if util.IsTempErr(err) {
 				try++
 				srv.logf("9p: Accept error: %v; retrying in %v", err, backoff(try))
@@ -129,10 +488,166 @@ func (srv *Server) Serve(l net.Listener) error {
 			try = 0
 		}
 
-		srv.logf("accepted connection from %s", rwc.RemoteAddr())
-		conn := newConn(srv, rwc)
-		go conn.serve()
+		go srv.ServeConn(rwc)
+	}
+}
+
+// ServeConn serves 9P requests on a single connection, rwc, and
+// returns once the connection is closed. It is useful for serving
+// 9P over transports that do not provide a net.Listener.
+func (srv *Server) ServeConn(rwc net.Conn) {
+	c := newConn(srv, rwc)
+	if !srv.trackConn(c, true) {
+		rwc.Close()
+		return
+	}
+	defer srv.trackConn(c, false)
+	srv.logf("accepted connection from %s", rwc.RemoteAddr())
+	c.setState(StateNew)
+	c.serve()
+	c.setState(StateClosed)
+}
+
+// How often Shutdown looks for idle connections.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown gracefully shuts down the server. It stops accepting new
+// connections, calls OnDrain for each active session, and then
+// closes each connection once it has no requests in progress. If
+// ctx is cancelled before every connection has been closed, the
+// remaining connections are closed immediately; their outstanding
+// requests are answered with an error, and Shutdown returns the
+// context's error. Otherwise, Shutdown returns nil.
+//
+// Once Shutdown has been called, the Server cannot be reused;
+// calls to Serve and ServeConn close their listener or
+// connection and return.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.draining = true
+	for l := range srv.listeners {
+		l.Close()
+	}
+	conns := make([]*conn, 0, len(srv.conns))
+	for c := range srv.conns {
+		conns = append(conns, c)
+	}
+	srv.mu.Unlock()
+
+	if srv.OnDrain != nil {
+		for _, c := range conns {
+			for _, s := range c.sessions() {
+				srv.OnDrain(s)
+			}
+		}
+	}
+
+	if access := srv.accessLog(); access != nil {
+		defer access.flush()
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.closeIdle() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			srv.mu.Lock()
+			conns = conns[:0]
+			for c := range srv.conns {
+				conns = append(conns, c)
+			}
+			srv.mu.Unlock()
+			for _, c := range conns {
+				c.abort(ErrServerClosed)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Closes all connections with no requests in progress. Reports
+// whether there were no connections left to close.
+func (srv *Server) closeIdle() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.conns {
+		if c.idle() {
+			c.rwc.Close()
+		}
+	}
+	return len(srv.conns) == 0
+}
+
+// Sessions returns the sessions established on the server's
+// connections at the time of the call. Sessions may begin and end
+// while Sessions is running; the returned slice is not updated
+// afterwards.
+func (srv *Server) Sessions() []*Session {
+	srv.mu.Lock()
+	conns := make([]*conn, 0, len(srv.conns))
+	for c := range srv.conns {
+		conns = append(conns, c)
+	}
+	srv.mu.Unlock()
+
+	var sessions []*Session
+	for _, c := range conns {
+		sessions = append(sessions, c.sessions()...)
 	}
+	return sessions
+}
+
+func (srv *Server) isDraining() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.draining
+}
+
+// trackListener and trackConn record the listeners and connections
+// that Shutdown must close. They return false if the server is
+// shutting down.
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !add {
+		delete(srv.listeners, l)
+		return true
+	}
+	if srv.draining {
+		return false
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	srv.listeners[l] = struct{}{}
+	return true
+}
+
+func (srv *Server) trackConn(c *conn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !add {
+		if _, ok := srv.conns[c]; ok && c.vars != nil {
+			c.vars.active.Add(-1)
+		}
+		delete(srv.conns, c)
+		return true
+	}
+	if srv.draining {
+		return false
+	}
+	if srv.conns == nil {
+		srv.conns = make(map[*conn]struct{})
+	}
+	srv.conns[c] = struct{}{}
+	if c.vars != nil {
+		c.vars.connections.Add(1)
+		c.vars.active.Add(1)
+	}
+	return true
 }
 
 // ListenAndServe listens on the specified TCP address, and then
@@ -160,7 +675,7 @@ func (srv *Server) ListenAndServe() error {
 	if addr == "" {
 		addr = ":9pfs"
 	}
-	ln, err := net.Listen("tcp", addr)
+	ln, err := srv.listen(addr)
 	if err != nil {
 		return err
 	}
@@ -187,7 +702,7 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 		}
 	}
 
-	ln, err := net.Listen("tcp", addr)
+	ln, err := srv.listen(addr)
 	if err != nil {
 		return err
 	}
@@ -195,6 +710,32 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	return srv.Serve(ln)
 }
 
+func (srv *Server) anonymousUser() string {
+	if srv.AnonymousUser != "" {
+		return srv.AnonymousUser
+	}
+	return "none"
+}
+
+// authenticator returns the Authenticator to use, or nil if
+// authentication is disabled.
+func (srv *Server) authenticator() Authenticator {
+	if srv.Authenticator != nil {
+		return srv.Authenticator
+	}
+	if srv.Auth != nil {
+		return srv.Auth
+	}
+	return nil
+}
+
+func (srv *Server) listen(addr string) (net.Listener, error) {
+	if srv.ListenConfig != nil {
+		return srv.ListenConfig.Listen(context.Background(), "tcp", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
 func (s *Server) logf(format string, v ...interface{}) {
 	if s.ErrorLog != nil {
 		s.ErrorLog.Printf(format, v...)
@@ -5,16 +5,23 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"reflect"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
-	"aqwari.net/net/styx/internal/netutil"
+	"context"
+
 	"aqwari.net/net/styx/styxproto"
+	"aqwari.net/net/styx/styxtest"
 )
 
 const (
@@ -34,6 +41,9 @@ type testServer struct {
 	callback func(req, rsp styxproto.Msg)
 	handler  Handler
 	test     *testing.T
+
+	// optional; used to configure the Server under test.
+	server *Server
 }
 
 func openfile(filename string) (*os.File, func()) {
@@ -107,18 +117,28 @@ func (d emptyDir) ModTime() time.Time { return time.Time{} }
 // styx.Directory
 func (d emptyDir) Readdir(int) ([]os.FileInfo, error) { return nil, nil }
 
-func chanServer(t *testing.T, handler Handler) (in, out chan styxproto.Msg) {
-	var ln netutil.PipeListener
-	// last for one session
-	srv := Server{
-		Handler:  handler,
-		ErrorLog: testLogger{t},
-	}
-	go srv.Serve(&ln)
-	conn, err := ln.Dial()
-	if err != nil {
-		panic(err)
+// serveConn serves 9P on one end of a pipe, and returns the other.
+// The test does not end until the server is done with the
+// connection, so the server cannot log to a finished test.
+func serveConn(t *testing.T, srv *Server) net.Conn {
+	if srv.ErrorLog == nil {
+		srv.ErrorLog = testLogger{t}
 	}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		srv.ServeConn(server)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+func chanServer(t *testing.T, srv *Server) (in, out chan styxproto.Msg) {
+	conn := serveConn(t, srv)
 
 	// NOTE(droyo) by buffering the channel we allow the server to take
 	// in multiple requests without being blocked on sending their responses.
@@ -131,7 +151,12 @@ func chanServer(t *testing.T, handler Handler) (in, out chan styxproto.Msg) {
 	go func() {
 		for req := range in {
 			if _, err := styxproto.Write(conn, req); err != nil {
-				t.Error(err)
+				// The connection is closed when the test ends,
+				// which may interrupt a write the server did
+				// not need to read.
+				if err != io.ErrClosedPipe {
+					t.Error(err)
+				}
 				break
 			}
 		}
@@ -147,19 +172,19 @@ func chanServer(t *testing.T, handler Handler) (in, out chan styxproto.Msg) {
 	return in, out
 }
 
+// copyMsg reads all of msg, including the data of a Twrite or
+// Rread message, so that the copy stays valid after the Decoder
+// that produced msg moves on.
 func copyMsg(msg styxproto.Msg) styxproto.Msg {
-	var err error
-
-	rd, wr := io.Pipe()
-	d := styxproto.NewDecoder(rd)
-	go func() {
-		_, err = styxproto.Write(wr, msg)
-		wr.CloseWithError(err)
-	}()
-	for d.Next() {
-		return d.Msg()
+	var buf bytes.Buffer
+	if _, err := styxproto.Write(&buf, msg); err != nil {
+		panic(fmt.Errorf("failed to copy %T message: %s", msg, err))
+	}
+	m, err := styxproto.Unmarshal(buf.Bytes())
+	if err != nil {
+		panic(fmt.Errorf("failed to copy %T message: %s", msg, err))
 	}
-	panic(fmt.Errorf("failed to copy %T message: %s", msg, d.Err()))
+	return m
 }
 
 func messagesFrom(t *testing.T, r io.Reader) chan styxproto.Msg {
@@ -186,7 +211,12 @@ func (s testServer) run(r io.Reader) {
 		s.callback = func(q, r styxproto.Msg) {}
 	}
 	pending := make(map[uint16]styxproto.Msg)
-	requests, responses := chanServer(s.test, s.handler)
+	srv := s.server
+	if srv == nil {
+		srv = new(Server)
+	}
+	srv.Handler = s.handler
+	requests, responses := chanServer(s.test, srv)
 
 Loop:
 	for msg := range messagesFrom(s.test, r) {
@@ -224,6 +254,11 @@ Remaining:
 			if req, ok := pending[rsp.Tag()]; ok {
 				s.callback(req, rsp)
 				delete(pending, req.Tag())
+				if flush, ok := req.(styxproto.Tflush); ok {
+					if _, ok := rsp.(styxproto.Rflush); ok {
+						delete(pending, flush.Oldtag())
+					}
+				}
 			} else {
 				s.test.Errorf("got %T response for unused tag %d", rsp, rsp.Tag())
 			}
@@ -385,6 +420,8 @@ func TestTwstat(t *testing.T) {
 	srv.handler = HandlerFunc(func(s *Session) {
 		for s.Next() {
 			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(&slowFile{}, nil)
 			case Trename:
 				seen["Trename"] = struct{}{}
 				req.Rrename(nil)
@@ -412,7 +449,7 @@ func TestTwstat(t *testing.T) {
 			statrename = blankStat("newname", "", "")
 			statchown  = blankStat("", "newuser", "newgroup")
 		)
-		enc.Twalk(1, 0, 1)
+		enc.Twalk(1, 0, 1, "file")
 		{
 			// Tutimes
 			statblank.SetAtime(uint32(time.Now().Unix()))
@@ -488,6 +525,66 @@ func TestWalk(t *testing.T) {
 	}
 }
 
+func TestPartialWalk(t *testing.T) {
+	tree := map[string]os.FileInfo{
+		"/a":   emptyDir("a"),
+		"/a/b": emptyDir("b"),
+	}
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				if fi, ok := tree[req.Path()]; ok {
+					req.Rwalk(fi, nil)
+				} else {
+					req.Rerror("no such file")
+				}
+			case Tstat:
+				if req.Path() != "/a" {
+					t.Errorf("fid moved to %s by a partial walk", req.Path())
+				}
+				req.Rstat(emptyDir("a"), nil)
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch req := req.(type) {
+		case styxproto.Twalk:
+			rwalk, ok := rsp.(styxproto.Rwalk)
+			switch {
+			case req.Newfid() == 1 || req.Fid() == 2:
+				// [a b nonexistent] and the fid at /a walked
+				// in place with [b nonexistent]
+				want := int(req.Nwname()) - 1
+				if !ok || rwalk.Nwqid() != want {
+					t.Errorf("got %s response to %s, wanted %d qids", rsp, req, want)
+				}
+			case req.Newfid() == 3:
+				if ok {
+					t.Errorf("got %s response to %s, wanted Rerror", rsp, req)
+				}
+			}
+		case styxproto.Tstat:
+			_, ok := rsp.(styxproto.Rstat)
+			if req.Fid() == 1 && ok {
+				t.Errorf("fid 1 was established by a partial walk: %s", rsp)
+			}
+			if req.Fid() == 2 && !ok {
+				t.Errorf("fid 2 lost by a partial walk: %s", rsp)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "a", "b", "nonexistent")
+		enc.Tstat(1, 1)
+		enc.Twalk(1, 0, 2, "a")
+		enc.Twalk(1, 2, 2, "b", "nonexistent")
+		enc.Tstat(1, 2)
+		enc.Twalk(1, 0, 3, "nonexistent", "a")
+	})
+}
+
 func blankQid() styxproto.Qid {
 	buf := make([]byte, styxproto.QidLen)
 	qid, _, err := styxproto.NewQid(buf, 0, 0, 0)
@@ -566,3 +663,4298 @@ func TestRootQid(t *testing.T) {
 		t.Error("test cases did not fire")
 	}
 }
+
+// A file whose reads take some time to complete, recording
+// the maximum number of concurrent reads.
+type busyFile struct {
+	mu           sync.Mutex
+	active, peak int
+}
+
+func (f *busyFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	f.active++
+	if f.active > f.peak {
+		f.peak = f.active
+	}
+	f.mu.Unlock()
+
+	time.Sleep(time.Millisecond * 50)
+
+	f.mu.Lock()
+	f.active--
+	f.mu.Unlock()
+	return len(p), nil
+}
+
+// waits for any reads in progress to finish, and returns
+// the most reads that were ever in progress at once.
+func (f *busyFile) maxActive() int {
+	for {
+		f.mu.Lock()
+		active, peak := f.active, f.peak
+		f.mu.Unlock()
+		if active == 0 {
+			return peak
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func (f *busyFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("read-only file")
+}
+
+func (f *busyFile) Close() error { return nil }
+
+func TestMaxInflight(t *testing.T) {
+	file := new(busyFile)
+	srv := testServer{test: t, server: &Server{MaxInflight: 2}}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(&slowFile{}, nil)
+			case Topen:
+				req.Ropen(file, nil)
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch req.(type) {
+		case styxproto.Tflush:
+			if _, ok := rsp.(styxproto.Rflush); !ok {
+				t.Errorf("got %T response to %T", rsp, req)
+			}
+		case styxproto.Tread:
+			if _, ok := rsp.(styxproto.Rread); !ok {
+				t.Errorf("got %T response to %T", rsp, req)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "file")
+		enc.Topen(1, 1, styxproto.OREAD)
+
+		// Reusing tag 1 waits for the Ropen.
+		for tag := uint16(1); tag < 8; tag++ {
+			enc.Tread(tag, 1, 0, 10)
+		}
+		enc.Flush()
+		time.Sleep(time.Millisecond * 20)
+
+		// The limit has been reached; Tflush must still
+		// get through.
+		enc.Tread(8, 1, 0, 10)
+		enc.Tread(9, 1, 0, 10)
+		enc.Tflush(10, 9)
+	})
+	if peak := file.maxActive(); peak > 2 {
+		t.Errorf("%d concurrent reads with MaxInflight = 2", peak)
+	}
+}
+
+func TestMaxInflightFlush(t *testing.T) {
+	file := new(busyFile)
+	srv := testServer{test: t, server: &Server{MaxInflight: 1}}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(&slowFile{}, nil)
+			case Topen:
+				req.Ropen(file, nil)
+			case Tstat:
+				// blocks until flushed
+				<-req.Context().Done()
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch req.(type) {
+		case styxproto.Tflush:
+			if _, ok := rsp.(styxproto.Rflush); !ok {
+				t.Errorf("got %T response to %T", rsp, req)
+			}
+		case styxproto.Tstat, styxproto.Tread:
+			t.Errorf("got %T response to flushed %T", rsp, req)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "file")
+		enc.Topen(1, 1, styxproto.OREAD)
+
+		// The second request waits for the first to be
+		// flushed, and must not keep the Tflush messages
+		// from being read.
+		enc.Tstat(1, 0)
+		enc.Tstat(2, 0)
+		enc.Tflush(3, 1)
+		enc.Tflush(4, 2)
+
+		// A flushed read keeps its slot until the
+		// ReadAt call returns.
+		enc.Tread(5, 1, 0, 10)
+		enc.Tread(6, 1, 0, 10)
+		enc.Tflush(7, 5)
+		enc.Tflush(8, 6)
+	})
+	if peak := file.maxActive(); peak > 1 {
+		t.Errorf("%d concurrent reads with MaxInflight = 1", peak)
+	}
+}
+
+// Counts calls to Close, and fails them.
+type closeCounter struct {
+	mu     sync.Mutex
+	closed int
+}
+
+func (f *closeCounter) ReadAt(p []byte, off int64) (int, error)  { return 0, io.EOF }
+func (f *closeCounter) WriteAt(p []byte, off int64) (int, error) { return len(p), nil }
+func (f *closeCounter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed++
+	return errors.New("close failed")
+}
+
+// A handler may still hold a request when the client goes away;
+// responding to it then must be harmless.
+func TestLateResponse(t *testing.T) {
+	var (
+		opened  = make(chan struct{})
+		ctxErr  = make(chan error, 1)
+		late    = make(chan Topen, 1)
+		ended   = make(chan struct{})
+		inside  = new(closeCounter)
+		outside = new(closeCounter)
+	)
+	c := testClient(t, &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			defer close(ended)
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(ownedFile{name: "file", mode: 0644}, nil)
+				case Topen:
+					close(opened)
+					<-req.Context().Done()
+					ctxErr <- req.Context().Err()
+					req.Ropen(inside, nil)
+					late <- req
+				}
+			}
+		}),
+	})
+	ctx := context.Background()
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, _, err := c.Walk(ctx, root, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Open(ctx, fid, styxproto.OREAD)
+	<-opened
+	c.Close()
+
+	select {
+	case err := <-ctxErr:
+		if err != context.Canceled {
+			t.Errorf("request context has error %v after disconnect", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request context not cancelled after disconnect")
+	}
+	req := <-late
+	<-ended
+	func() {
+		defer func() {
+			if v := recover(); v != nil {
+				t.Errorf("late response panicked: %v", v)
+			}
+		}()
+		req.Ropen(outside, nil)
+		req.Rerror("too late")
+	}()
+	for _, f := range []*closeCounter{inside, outside} {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			f.mu.Lock()
+			n := f.closed
+			f.mu.Unlock()
+			if n == 1 {
+				break
+			} else if n > 1 || time.Now().After(deadline) {
+				t.Errorf("file given to a late Ropen closed %d times, wanted once", n)
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestClunkUnread(t *testing.T) {
+	file := new(closeCounter)
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(&slowFile{}, nil)
+			case Topen:
+				req.Ropen(file, nil)
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if _, ok := req.(styxproto.Tclunk); ok {
+			if _, ok := rsp.(styxproto.Rclunk); !ok {
+				t.Errorf("got %T response to %T", rsp, req)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "file")
+		enc.Topen(1, 1, styxproto.OREAD)
+		enc.Tclunk(1, 1)
+		enc.Tclunk(1, 0)
+	})
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if file.closed != 1 {
+		t.Errorf("opened file closed %d times, want 1", file.closed)
+	}
+}
+
+// Collects log lines for inspection.
+type bufLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *bufLogger) Printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestTraceLog(t *testing.T) {
+	var trace bufLogger
+	srv := testServer{test: t, server: &Server{TraceLog: &trace}}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(emptyDir("dir"), nil)
+			case Tstat:
+				req.Rerror("no stat for you")
+			}
+		}
+	})
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		// re-using the tag ensures the walk completes first
+		enc.Twalk(1, 0, 1, "dir")
+		enc.Tstat(1, 1)
+	})
+
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	want := []string{
+		`001 Twalk fid=0 path="/" `,
+		`001 Tstat fid=1 path="/dir" `,
+	}
+	for _, prefix := range want {
+		var line string
+		for _, l := range trace.lines {
+			if strings.HasPrefix(l, prefix) {
+				line = l
+			}
+		}
+		if line == "" {
+			t.Errorf("no trace line beginning with %q in %q", prefix, trace.lines)
+		}
+	}
+	for _, l := range trace.lines {
+		if strings.HasPrefix(l, "001 Tstat") && !strings.HasSuffix(l, `Rerror "no stat for you"`) {
+			t.Errorf("trace line %q does not record error", l)
+		}
+		if strings.HasPrefix(l, "001 Twalk") && !strings.HasSuffix(l, "Rwalk") {
+			t.Errorf("trace line %q does not record response", l)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var access bytes.Buffer
+	c := testClient(t, &Server{
+		AccessLog: &access,
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(emptyDir("dir"), nil)
+				case Tstat:
+					req.Rerror("no stat for you")
+				}
+			}
+		}),
+	})
+	ctx := context.Background()
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, _, err := c.Walk(ctx, root, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat(ctx, fid); err == nil {
+		t.Fatal("Tstat succeeded")
+	}
+
+	// The log is flushed before the last response is sent.
+	want := []string{
+		" glenda pipe Tattach - ok",
+		" glenda pipe Twalk / ok",
+		" glenda pipe Tstat /dir no stat for you",
+	}
+	lines := strings.Split(strings.TrimSuffix(access.String(), "\n"), "\n")
+	if len(lines) < len(want) {
+		t.Fatalf("got access log %q, wanted %d lines", access.String(), len(want))
+	}
+	// Tversion is logged first, without a user.
+	lines = lines[len(lines)-len(want):]
+	for i, line := range lines {
+		// sysname Jan _2 15:04:05 message
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			t.Errorf("malformed access log line %q", line)
+			continue
+		}
+		stamp := strings.TrimLeft(fields[1], " ")[:len(time.Stamp)]
+		if _, err := time.Parse(time.Stamp, stamp); err != nil {
+			t.Errorf("access log line %q: %s", line, err)
+		}
+		if !strings.HasSuffix(line, want[i]) {
+			t.Errorf("got access log line %q, wanted suffix %q", line, want[i])
+		}
+	}
+}
+
+// Lines buffered while a request is pending are written when the
+// connection is closed.
+func TestAccessLogClose(t *testing.T) {
+	var access bytes.Buffer
+	stalled := make(chan struct{})
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		srv := &Server{
+			AccessLog: &access,
+			ErrorLog:  testLogger{t},
+			Handler: HandlerFunc(func(s *Session) {
+				for s.Next() {
+					switch req := s.Request().(type) {
+					case Twalk:
+						req.Rwalk(emptyDir("dir"), nil)
+					case Tstat:
+						close(stalled)
+						<-req.Context().Done()
+					}
+				}
+			}),
+		}
+		srv.ServeConn(server)
+		close(done)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := NewClient(ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Stat(ctx, root)
+	<-stalled
+
+	// The stalled session's handler is busy, so the walk is
+	// made in another.
+	other, _, err := c.Attach(ctx, styxproto.NoFid, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Walk(ctx, other, "dir"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	client.Close()
+	<-done
+	if !strings.Contains(access.String(), " glenda pipe Twalk / ok\n") {
+		t.Errorf("access log %q does not record the Twalk", access.String())
+	}
+}
+
+// Serves a single directory, "dir", opened with the value returned
+// by open.
+func dirServer(t *testing.T, open func() interface{}) testServer {
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(emptyDir("dir"), nil)
+			case Topen:
+				req.Ropen(open(), nil)
+			}
+		}
+	})
+	return srv
+}
+
+func expectRerror(t *testing.T, mtype string) func(req, rsp styxproto.Msg) {
+	return func(req, rsp styxproto.Msg) {
+		if msgType(req) != mtype {
+			return
+		}
+		if _, ok := rsp.(styxproto.Rerror); !ok {
+			t.Errorf("got %T response to %T, wanted Rerror", rsp, req)
+		}
+	}
+}
+
+func TestWriteDir(t *testing.T) {
+	srv := dirServer(t, func() interface{} { return emptyDir("dir") })
+	srv.callback = expectRerror(t, "Topen")
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "dir")
+		enc.Topen(1, 1, styxproto.OWRITE)
+		enc.Topen(1, 1, styxproto.ORDWR)
+		enc.Topen(1, 1, styxproto.OREAD|styxproto.OTRUNC)
+	})
+
+	// A directory created for writing can be opened, but
+	// not written to.
+	srv = testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			if req, ok := s.Request().(Tcreate); ok {
+				req.Rcreate(emptyDir(req.Name), nil)
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if _, ok := req.(styxproto.Twrite); !ok {
+			return
+		}
+		rerror, ok := rsp.(styxproto.Rerror)
+		if !ok || !strings.Contains(string(rerror.Ename()), "directory") {
+			t.Errorf("got %s response to Twrite on a directory", rsp)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1)
+		enc.Tcreate(1, 1, "dir", 0777|styxproto.DMDIR, styxproto.OWRITE)
+		enc.Twrite(1, 1, 0, []byte("hello"))
+	})
+}
+
+func TestReadDirOffset(t *testing.T) {
+	srv := dirServer(t, func() interface{} { return emptyDir("dir") })
+	srv.callback = expectRerror(t, "Tread")
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "dir")
+		enc.Topen(1, 1, styxproto.OREAD)
+		enc.Tread(1, 1, 100, 1000)
+	})
+}
+
+func TestReadDirNoListing(t *testing.T) {
+	srv := dirServer(t, func() interface{} { return strings.NewReader("not a stat") })
+	srv.callback = expectRerror(t, "Tread")
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "dir")
+		enc.Topen(1, 1, styxproto.OREAD)
+		enc.Tread(1, 1, 0, 1000)
+	})
+}
+
+func TestRoot(t *testing.T) {
+	tree := map[string]os.FileInfo{
+		"/home/alice":   emptyDir("alice"),
+		"/home/alice/a": emptyDir("a"),
+		"/home/bob":     emptyDir("bob"),
+		"/home/bob/b":   emptyDir("b"),
+	}
+	srv := testServer{test: t}
+	srv.server = &Server{
+		Root: func(user, aname string) string { return "/home/" + user },
+	}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			req := s.Request()
+			if !strings.HasPrefix(req.Path(), "/home/"+s.User) {
+				t.Errorf("%s: path %s outside of root", s.User, req.Path())
+			}
+			switch req := req.(type) {
+			case Twalk:
+				if fi, ok := tree[req.Path()]; ok {
+					req.Rwalk(fi, nil)
+				} else {
+					req.Rerror("no such file")
+				}
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		walk, ok := req.(styxproto.Twalk)
+		if !ok {
+			return
+		}
+		rwalk, found := rsp.(styxproto.Rwalk)
+		switch walk.Tag() {
+		case 3:
+			if !found || rwalk.Nwqid() != 1 {
+				t.Errorf("alice could not walk to her own file: %s", rsp)
+			}
+		case 4:
+			if found {
+				t.Errorf("bob walked to alice's file: %s", rsp)
+			}
+		case 5:
+			if found && rwalk.Nwqid() == walk.Nwname() {
+				t.Errorf("alice escaped her root: %s", rsp)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Tattach(1, 10, styxproto.NoFid, "alice", "")
+		enc.Tattach(2, 20, styxproto.NoFid, "bob", "")
+		enc.Twalk(3, 10, 11, "a")
+		enc.Twalk(4, 20, 21, "a")
+		enc.Twalk(5, 10, 12, "..", "..", "bob", "b")
+	})
+}
+
+func TestRootCreate(t *testing.T) {
+	srv := testServer{test: t}
+	srv.server = &Server{
+		Root: func(user, aname string) string { return "/home/" + user },
+	}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(emptyDir(path.Base(req.Path())), nil)
+			case Tcreate:
+				t.Errorf("handler received Tcreate for %s", req.NewPath())
+				req.Rerror("denied")
+			case Trename:
+				t.Errorf("handler received Trename %s -> %s", req.OldPath, req.NewPath)
+				req.Rrename(errors.New("denied"))
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch req.(type) {
+		case styxproto.Tcreate, styxproto.Twstat:
+			if _, ok := rsp.(styxproto.Rerror); !ok {
+				t.Errorf("%s was not rejected: %s", req, rsp)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Tattach(1, 10, styxproto.NoFid, "alice", "")
+		enc.Twalk(1, 10, 11, "a")
+		enc.Twalk(1, 10, 12)
+		enc.Tcreate(1, 12, "../bob/evil", 0666, styxproto.OWRITE)
+		enc.Tcreate(1, 12, "..", 0777|styxproto.DMDIR, styxproto.OREAD)
+		enc.Tcreate(1, 12, ".", 0777|styxproto.DMDIR, styxproto.OREAD)
+		enc.Twstat(1, 11, blankStat("..", "", ""))
+		enc.Twstat(1, 10, blankStat("bob", "", ""))
+	})
+}
+
+func TestCreateName(t *testing.T) {
+	names := []string{"/", ".", "..", "", "a/b", "/etc", "dir/"}
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			if req, ok := s.Request().(Tcreate); ok {
+				t.Errorf("handler received Tcreate for %q", req.Name)
+				req.Rerror("denied")
+			}
+		}
+	})
+	seen := 0
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if _, ok := req.(styxproto.Tcreate); !ok {
+			return
+		}
+		seen++
+		rerror, ok := rsp.(styxproto.Rerror)
+		if !ok || !strings.HasPrefix(string(rerror.Ename()), "invalid file name") {
+			t.Errorf("%s was not rejected as an invalid name: %s", req, rsp)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1)
+		for _, name := range names {
+			enc.Tcreate(1, 1, name, 0666, styxproto.OWRITE)
+		}
+	})
+	if seen != len(names) {
+		t.Errorf("got %d responses to Tcreate, wanted %d", seen, len(names))
+	}
+}
+
+type handlerErrFunc func(*Session) error
+
+func (fn handlerErrFunc) Serve9P(s *Session) error { return fn(s) }
+
+func TestCloseOnError(t *testing.T) {
+	errBackend := errors.New("backend is gone")
+	c := testClient(t, &Server{
+		Handler: CloseOnError(handlerErrFunc(func(s *Session) error {
+			for s.Next() {
+				if _, ok := s.Request().(Tstat); ok {
+					return errBackend
+				}
+			}
+			return nil
+		})),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "gopher", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat(ctx, root); err == nil || err.Error() != errBackend.Error() {
+		t.Errorf("got error %v, wanted %v", err, errBackend)
+	}
+	if _, err := c.Stat(ctx, root); err == nil {
+		t.Error("connection still usable after handler error")
+	} else if err == context.DeadlineExceeded {
+		t.Error("connection was not closed")
+	}
+}
+
+// Runs the requests in script against a handler that calls fn
+// for each request, and reports whether fn panicked.
+func strictPanics(t *testing.T, strict bool, fn func(Request), script func(*styxproto.Encoder)) bool {
+	var (
+		mu       sync.Mutex
+		panicked bool
+	)
+	srv := testServer{test: t, server: &Server{Strict: strict}}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			func() {
+				defer func() {
+					if v := recover(); v != nil {
+						t.Logf("recovered: %v", v)
+						mu.Lock()
+						panicked = true
+						mu.Unlock()
+					}
+				}()
+				fn(s.Request())
+			}()
+		}
+	})
+	srv.runMsg(script)
+	mu.Lock()
+	defer mu.Unlock()
+	return panicked
+}
+
+func TestStrict(t *testing.T) {
+	file := memFile{"a", bytes.NewReader(nil)}
+	tests := []struct {
+		name   string
+		fn     func(Request)
+		script func(*styxproto.Encoder)
+	}{
+		{
+			name: "open directory without listing",
+			fn: func(req Request) {
+				switch req := req.(type) {
+				case Twalk:
+					req.Rwalk(emptyDir("a"), nil)
+				case Topen:
+					req.Ropen(strings.NewReader("junk"), nil)
+				}
+			},
+			script: func(enc *styxproto.Encoder) {
+				enc.Twalk(1, 0, 1, "a")
+				enc.Topen(1, 1, styxproto.OREAD)
+			},
+		},
+		{
+			name: "create directory without listing",
+			fn: func(req Request) {
+				if req, ok := req.(Tcreate); ok {
+					req.Rcreate(strings.NewReader("junk"), nil)
+				}
+			},
+			script: func(enc *styxproto.Encoder) {
+				enc.Tcreate(1, 0, "a", styxproto.DMDIR|0755, styxproto.OREAD)
+			},
+		},
+		{
+			name: "walk changes file type",
+			fn: func(req Request) {
+				if req, ok := req.(Twalk); ok {
+					if req.walk.newfid == 1 {
+						req.Rwalk(emptyDir("a"), nil)
+					} else {
+						req.Rwalk(file, nil)
+					}
+				}
+			},
+			script: func(enc *styxproto.Encoder) {
+				enc.Twalk(1, 0, 1, "a")
+				enc.Twalk(1, 0, 2, "a")
+			},
+		},
+		{
+			name: "stat disagrees with qid",
+			fn: func(req Request) {
+				switch req := req.(type) {
+				case Twalk:
+					req.Rwalk(emptyDir("a"), nil)
+				case Tstat:
+					req.Rstat(file, nil)
+				}
+			},
+			script: func(enc *styxproto.Encoder) {
+				enc.Twalk(1, 0, 1, "a")
+				enc.Tstat(1, 1)
+			},
+		},
+	}
+	for _, tt := range tests {
+		if !strictPanics(t, true, tt.fn, tt.script) {
+			t.Errorf("%s: not caught in strict mode", tt.name)
+		}
+		if strictPanics(t, false, tt.fn, tt.script) {
+			t.Errorf("%s: panicked in non-strict mode", tt.name)
+		}
+	}
+}
+
+func TestStatModeCoerced(t *testing.T) {
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(emptyDir("a"), nil)
+			case Tstat:
+				req.Rstat(memFile{"a", bytes.NewReader(nil)}, nil)
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if rstat, ok := rsp.(styxproto.Rstat); ok {
+			stat := rstat.Stat()
+			if stat.Mode()&styxproto.DMDIR == 0 {
+				t.Errorf("mode %o of directory stat lacks DMDIR", stat.Mode())
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "a")
+		enc.Tstat(1, 1)
+	})
+}
+
+func TestStatBeforeOpen(t *testing.T) {
+	var (
+		qids   []styxproto.Qid
+		stated bool
+	)
+	file := memFile{"a", bytes.NewReader([]byte("contents"))}
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(file, nil)
+			case Tstat:
+				stated = true
+				req.Rstat(file, nil)
+			case Topen:
+				req.Ropen(file, nil)
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch rsp := rsp.(type) {
+		case styxproto.Rwalk:
+			qids = append(qids, rsp.Wqid(0))
+		case styxproto.Rstat:
+			qids = append(qids, rsp.Stat().Qid())
+		case styxproto.Ropen:
+			qids = append(qids, rsp.Qid())
+		case styxproto.Rerror:
+			t.Errorf("got error response to %s: %s", req, rsp)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "a")
+		enc.Tstat(1, 1)
+		enc.Topen(1, 1, styxproto.OREAD)
+	})
+	if !stated {
+		t.Error("Tstat on unopened fid was not passed to handler")
+	}
+	if len(qids) != 3 {
+		t.Fatalf("got %d qids, wanted 3", len(qids))
+	}
+	for _, qid := range qids[1:] {
+		if !qid.Equal(qids[0]) {
+			t.Errorf("qid %s does not match walked qid %s", qid, qids[0])
+		}
+	}
+}
+
+func TestDotu(t *testing.T) {
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			if req, ok := s.Request().(Tstat); ok {
+				req.Rstat(emptyDir("/"), nil)
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch rsp := rsp.(type) {
+		case styxproto.Rversion:
+			if string(rsp.Version()) != "9P2000.u" {
+				t.Errorf("negotiated version %q", rsp.Version())
+			}
+		case styxproto.Rstat:
+			if !rsp.Stat().Dotu() {
+				t.Errorf("Rstat is missing 9P2000.u fields: %s", rsp.Stat())
+			}
+		case styxproto.Rerror:
+			// ename[s] is followed by errno[4]
+			if want := int64(9 + len(rsp.Ename()) + 4); rsp.Len() != want {
+				t.Errorf("Rerror is %d bytes long, wanted %d", rsp.Len(), want)
+			}
+		}
+	}
+	rd, wr := io.Pipe()
+	go func() {
+		enc := styxproto.NewEncoder(wr)
+		enc.Tversion(styxproto.DefaultMaxSize, "9P2000.u")
+		enc.Tattach(0, 0, styxproto.NoFid, "", "")
+		enc.Tstat(1, 0)
+		enc.Tstat(2, 99)
+		enc.Flush()
+		wr.Close()
+	}()
+	srv.run(rd)
+}
+
+func TestVersionFunc(t *testing.T) {
+	tests := []struct {
+		maxSize      int64
+		version      string
+		msize        uint32
+		wantVersion  string
+		wantMsize    uint32
+		wantAccepted bool
+	}{
+		{0, "9P2000.exact", 8192, "9P2000.exact", 8192, true},
+		{0, "unknown", 8192, "unknown", 0, false},
+		{0, "9P3000", 8192, "unknown", 0, false},
+		// Raised above MaxSize, but not above the client's msize.
+		{styxproto.MinBufSize, "9P2000", 1 << 30, "9P2000", 65536, true},
+		{0, "9P2000", 10, "unknown", 0, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		var (
+			mu         sync.Mutex
+			gotVersion string
+			gotMsize   uint32
+			attached   bool
+		)
+		srv := testServer{test: t}
+		srv.server = &Server{
+			MaxSize: tt.maxSize,
+			VersionFunc: func(version string, msize uint32) (string, uint32) {
+				mu.Lock()
+				gotVersion, gotMsize = version, msize
+				mu.Unlock()
+				return tt.version, tt.msize
+			},
+		}
+		srv.callback = func(req, rsp styxproto.Msg) {
+			if _, ok := rsp.(styxproto.Rattach); ok {
+				attached = true
+			}
+			rver, ok := rsp.(styxproto.Rversion)
+			if !ok {
+				return
+			}
+			if string(rver.Version()) != tt.wantVersion {
+				t.Errorf("VersionFunc returned %q, Rversion has %q", tt.version, rver.Version())
+			}
+			if tt.wantAccepted && rver.Msize() != int64(tt.wantMsize) {
+				t.Errorf("VersionFunc returned msize %d, Rversion has %d, wanted %d",
+					tt.msize, rver.Msize(), tt.wantMsize)
+			}
+		}
+		rd, wr := io.Pipe()
+		go func() {
+			enc := styxproto.NewEncoder(wr)
+			enc.Tversion(65536, "9P2000.L")
+			enc.Flush()
+			enc.Tattach(0, 0, styxproto.NoFid, "", "")
+			enc.Flush()
+			wr.Close()
+		}()
+		srv.run(rd)
+		mu.Lock()
+		if gotVersion != "9P2000.L" || gotMsize != 65536 {
+			t.Errorf("VersionFunc called with %q, %d", gotVersion, gotMsize)
+		}
+		mu.Unlock()
+		if attached != tt.wantAccepted {
+			t.Errorf("VersionFunc returned %q, %d: attached = %v", tt.version, tt.msize, attached)
+		}
+	}
+}
+
+type symlink struct {
+	name, target string
+}
+
+func (l symlink) Mode() os.FileMode  { return os.ModeSymlink | 0777 }
+func (l symlink) IsDir() bool        { return false }
+func (l symlink) Name() string       { return l.name }
+func (l symlink) Sys() interface{}   { return nil }
+func (l symlink) Size() int64        { return int64(len(l.target)) }
+func (l symlink) ModTime() time.Time { return time.Time{} }
+func (l symlink) Symlink() string    { return l.target }
+
+func TestSymlink(t *testing.T) {
+	link := symlink{"link", "/usr/lib/target"}
+	for _, version := range []string{"9P2000.u", "9P2000"} {
+		dotu := version == "9P2000.u"
+		srv := testServer{test: t}
+		srv.handler = HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(link, nil)
+				case Tstat:
+					req.Rstat(link, nil)
+				}
+			}
+		})
+		srv.callback = func(req, rsp styxproto.Msg) {
+			switch rsp := rsp.(type) {
+			case styxproto.Rwalk:
+				if rsp.Nwqid() != 1 {
+					t.Fatalf("%s: walk to symlink failed: %s", version, rsp)
+				}
+				if islink := rsp.Wqid(0).Type()&styxproto.QTLINK != 0; islink != dotu {
+					t.Errorf("%s: QTLINK is %v in walk qid %s", version, islink, rsp.Wqid(0))
+				}
+			case styxproto.Rstat:
+				stat := rsp.Stat()
+				if islink := stat.Mode()&styxproto.DMSYMLINK != 0; islink != dotu {
+					t.Errorf("%s: DMSYMLINK is %v in %s", version, islink, stat)
+				}
+				if islink := stat.Qid().Type()&styxproto.QTLINK != 0; islink != dotu {
+					t.Errorf("%s: QTLINK is %v in %s", version, islink, stat)
+				}
+				if dotu && string(stat.Extension()) != link.target {
+					t.Errorf("%s: got symlink target %q, wanted %q",
+						version, stat.Extension(), link.target)
+				}
+			case styxproto.Rerror:
+				t.Errorf("%s: %s", version, rsp.Ename())
+			}
+		}
+		rd, wr := io.Pipe()
+		go func() {
+			enc := styxproto.NewEncoder(wr)
+			enc.Tversion(styxproto.DefaultMaxSize, version)
+			enc.Tattach(0, 0, styxproto.NoFid, "", "")
+			enc.Twalk(1, 0, 1, "link")
+			enc.Flush()
+			enc.Tstat(1, 1)
+			enc.Flush()
+			wr.Close()
+		}()
+		srv.run(rd)
+	}
+}
+
+func TestOpenTrunc(t *testing.T) {
+	for _, allow := range []bool{true, false} {
+		data := []byte("hello, world")
+		opened := false
+		srv := testServer{test: t}
+		srv.handler = HandlerFunc(func(s *Session) {
+			for s.Next() {
+				file := memFile{"file", bytes.NewReader(data)}
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(file, nil)
+				case Ttruncate:
+					if allow {
+						data = data[:req.Size]
+						req.Rtruncate(nil)
+					}
+				case Topen:
+					if req.Flag&os.O_TRUNC == 0 {
+						t.Errorf("O_TRUNC not set in Topen flag %#x", req.Flag)
+					}
+					opened = true
+					req.Ropen(file, nil)
+				case Tstat:
+					req.Rstat(file, nil)
+				}
+			}
+		})
+		srv.callback = func(req, rsp styxproto.Msg) {
+			switch rsp := rsp.(type) {
+			case styxproto.Ropen:
+				if !allow {
+					t.Errorf("open succeeded despite failed truncate")
+				}
+			case styxproto.Rstat:
+				if size := rsp.Stat().Length(); allow && size != 0 {
+					t.Errorf("file is %d bytes after OTRUNC open", size)
+				}
+			case styxproto.Rerror:
+				if allow {
+					t.Errorf("%s", rsp.Ename())
+				}
+			}
+		}
+		srv.runMsg(func(enc *styxproto.Encoder) {
+			enc.Twalk(1, 0, 1, "file")
+			enc.Topen(1, 1, styxproto.OWRITE|styxproto.OTRUNC)
+			enc.Twalk(1, 0, 2, "file")
+			enc.Tstat(1, 2)
+		})
+		if opened != allow {
+			t.Errorf("Topen delivered to handler: %v, wanted %v", opened, allow)
+		}
+		if allow && len(data) != 0 {
+			t.Errorf("file contains %q after OTRUNC open", data)
+		}
+	}
+}
+
+// The Ttruncate made for an OTRUNC open must not stop the server
+// from reading the Tflush for the open.
+func TestOpenTruncFlush(t *testing.T) {
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(ownedFile{"file", 0666, "", ""}, nil)
+			case Ttruncate:
+				<-req.Context().Done()
+			case Topen:
+				t.Errorf("%s delivered after its truncate was flushed", req.Path())
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch req.(type) {
+		case styxproto.Tflush:
+			if _, ok := rsp.(styxproto.Rflush); !ok {
+				t.Errorf("got %T response to %T", rsp, req)
+			}
+		case styxproto.Topen:
+			t.Errorf("got %T response to flushed %T", rsp, req)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "file")
+		enc.Topen(1, 1, styxproto.OWRITE|styxproto.OTRUNC)
+		enc.Tflush(2, 1)
+	})
+}
+
+// Every request referencing a fid that was never established,
+// or that is not in the right state, should get an Rerror.
+func TestUnknownFid(t *testing.T) {
+	// requests that use fid
+	requests := func(enc *styxproto.Encoder, fid uint32) {
+		stat, _, err := styxproto.NewStat(make([]byte, styxproto.MaxStatLen), "", "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc.Twalk(1, fid, fid+1, "a")
+		enc.Twalk(1, fid, fid+1)
+		enc.Topen(1, fid, styxproto.OREAD)
+		enc.Tcreate(1, fid, "a", 0666, styxproto.ORDWR)
+		enc.Tread(1, fid, 0, 100)
+		enc.Twrite(1, fid, 0, []byte("hello"))
+		enc.Tstat(1, fid)
+		enc.Twstat(1, fid, stat)
+		enc.Tremove(1, fid)
+		enc.Tclunk(1, fid)
+	}
+	attached := 0
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			t.Errorf("unexpected %T request reached handler", s.Request())
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch rsp := rsp.(type) {
+		case styxproto.Rversion, styxproto.Rerror:
+		case styxproto.Rattach:
+			if attached++; attached > 1 {
+				t.Errorf("attached to fid %d twice", req.(styxproto.Tattach).Fid())
+			}
+		default:
+			t.Errorf("%s got %s, wanted Rerror", req, rsp)
+		}
+	}
+	rd, wr := io.Pipe()
+	go func() {
+		enc := styxproto.NewEncoder(wr)
+		enc.Tversion(styxproto.DefaultMaxSize, "9P2000")
+		requests(enc, 0)
+		enc.Tattach(1, 0, styxproto.NoFid, "", "")
+		enc.Tattach(1, 0, styxproto.NoFid, "", "")
+		enc.Tread(1, 0, 0, 100)
+		enc.Twrite(1, 0, 0, []byte("hello"))
+		requests(enc, 99)
+		requests(enc, styxproto.NoFid)
+		enc.Flush()
+		wr.Close()
+	}()
+	srv.run(rd)
+	if attached != 1 {
+		t.Errorf("got %d Rattach responses, wanted 1", attached)
+	}
+}
+
+type ownedFile struct {
+	name     string
+	mode     os.FileMode
+	uid, gid string
+}
+
+func (f ownedFile) Name() string       { return f.name }
+func (f ownedFile) Mode() os.FileMode  { return f.mode }
+func (f ownedFile) IsDir() bool        { return f.mode.IsDir() }
+func (f ownedFile) Sys() interface{}   { return nil }
+func (f ownedFile) Size() int64        { return 0 }
+func (f ownedFile) ModTime() time.Time { return time.Time{} }
+func (f ownedFile) Uid() string        { return f.uid }
+func (f ownedFile) Gid() string        { return f.gid }
+
+func TestCreateInfo(t *testing.T) {
+	mtime := time.Unix(1234567890, 0)
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			if req, ok := s.Request().(Tcreate); ok {
+				info := timedFile{ownedFile{req.Name, 0640 | os.ModeAppend, "alice", "staff"}, mtime}
+				req.RcreateInfo(strings.NewReader(""), info, nil)
+			}
+		}
+	})
+	seen := 0
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch rsp := rsp.(type) {
+		case styxproto.Rcreate:
+			if rsp.Qid().Type()&styxproto.QTAPPEND == 0 {
+				t.Errorf("qid %s is not append-only", rsp.Qid())
+			}
+		case styxproto.Rstat:
+			seen++
+			stat := rsp.Stat()
+			if string(stat.Uid()) != "alice" || string(stat.Gid()) != "staff" ||
+				stat.Mtime() != uint32(mtime.Unix()) {
+				t.Errorf("got %s, wanted uid=alice gid=staff mtime=%d", stat, mtime.Unix())
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1)
+		enc.Tcreate(1, 1, "log", 0640|styxproto.DMAPPEND, styxproto.OWRITE)
+		enc.Tstat(1, 1)
+	})
+	if seen != 1 {
+		t.Errorf("got %d Rstat responses, wanted 1", seen)
+	}
+}
+
+type timedFile struct {
+	ownedFile
+	mtime time.Time
+}
+
+func (f timedFile) ModTime() time.Time { return f.mtime }
+
+func TestCreateDir(t *testing.T) {
+	files := map[string]ownedFile{
+		"/": {"/", os.ModeDir | 0750, "alice", ""},
+	}
+	srv := testServer{test: t}
+	srv.server = &Server{EnforceRemovePerm: true}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Tstat:
+				req.Rstat(files[req.Path()], nil)
+			case Twalk:
+				if f, ok := files[req.Path()]; ok {
+					req.Rwalk(f, nil)
+				} else {
+					req.Rwalk(nil, os.ErrNotExist)
+				}
+			case Tcreate:
+				files[req.NewPath()] = ownedFile{req.Name, req.Mode, s.User, ""}
+				if req.IsDir() {
+					req.Rcreate(emptyDir(req.Name), nil)
+				} else {
+					req.Rcreate(strings.NewReader(""), nil)
+				}
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		var isDir, wantDir bool
+		switch rsp := rsp.(type) {
+		case styxproto.Rcreate:
+			isDir = rsp.Qid().Type()&styxproto.QTDIR != 0
+			wantDir = req.(styxproto.Tcreate).Fid() == 1
+		case styxproto.Rwalk:
+			if rsp.Nwqid() == 0 {
+				return
+			}
+			isDir = rsp.Wqid(0).Type()&styxproto.QTDIR != 0
+			wantDir = true
+		default:
+			return
+		}
+		if isDir != wantDir {
+			t.Errorf("got %s response to %s", rsp, req)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		// The root's permissions are learned from its Rstat.
+		enc.Tstat(1, 0)
+		enc.Twalk(1, 0, 1)
+		enc.Tcreate(1, 1, "dir", 0777|styxproto.DMDIR, styxproto.OREAD)
+		enc.Twalk(1, 0, 2, "dir")
+		enc.Tcreate(1, 2, "file", 0666, styxproto.OWRITE)
+	})
+	want := map[string]os.FileMode{
+		"/dir":      os.ModeDir | 0750,
+		"/dir/file": 0640,
+	}
+	for name, mode := range want {
+		if f, ok := files[name]; !ok {
+			t.Errorf("%s was not created", name)
+		} else if f.mode != mode {
+			t.Errorf("%s created with mode %v, wanted %v", name, f.mode, mode)
+		}
+	}
+}
+
+func TestStatDefaults(t *testing.T) {
+	files := map[string]ownedFile{
+		"/synthetic": {"synthetic", 0, "", ""},
+		"/explicit":  {"explicit", 0600, "alice", "staff"},
+		"/partial":   {"partial", 0, "bob", ""},
+	}
+	want := map[string]struct {
+		uid, gid, muid string
+		mode           uint32
+	}{
+		"synthetic": {"glenda", "sys", "glenda", 0444},
+		"explicit":  {"alice", "staff", "alice", 0600},
+		"partial":   {"bob", "sys", "bob", 0444},
+	}
+	srv := testServer{test: t}
+	srv.server = &Server{
+		DefaultUid:  "glenda",
+		DefaultGid:  "sys",
+		DefaultMode: os.ModeDir | 0444,
+	}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(files[req.Path()], nil)
+			case Tstat:
+				req.Rstat(files[req.Path()], nil)
+			}
+		}
+	})
+	seen := 0
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if rsp, ok := rsp.(styxproto.Rstat); ok {
+			seen++
+			stat := rsp.Stat()
+			w := want[string(stat.Name())]
+			if string(stat.Uid()) != w.uid || string(stat.Gid()) != w.gid ||
+				string(stat.Muid()) != w.muid || stat.Mode() != w.mode {
+				t.Errorf("got %s, wanted uid=%s gid=%s muid=%s mode=%o",
+					stat, w.uid, w.gid, w.muid, w.mode)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		fid := uint32(1)
+		for name := range files {
+			enc.Twalk(1, 0, fid, name[1:])
+			enc.Tstat(1, fid)
+			fid++
+		}
+	})
+	if seen != len(files) {
+		t.Errorf("got %d Rstat responses, wanted %d", seen, len(files))
+	}
+}
+
+// generates an endless directory, counting the entries
+// requested.
+type entryGen struct {
+	calls *int
+	limit int
+}
+
+func (g entryGen) Next() (os.FileInfo, error) {
+	if *g.calls == g.limit {
+		return nil, io.EOF
+	}
+	*g.calls++
+	return emptyDir(fmt.Sprintf("%d", *g.calls-1)), nil
+}
+
+func TestDirReader(t *testing.T) {
+	for _, limit := range []int{5, 1000000} {
+		calls := 0
+		c := testClient(t, &Server{
+			Handler: HandlerFunc(func(s *Session) {
+				for s.Next() {
+					switch req := s.Request().(type) {
+					case Twalk:
+						req.Rwalk(emptyDir("dir"), nil)
+					case Topen:
+						req.Ropen(entryGen{&calls, limit}, nil)
+					}
+				}
+			}),
+		})
+		ctx := context.Background()
+		root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fid, _, err := c.Walk(ctx, root, "dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.Open(ctx, fid, styxproto.OREAD); err != nil {
+			t.Fatal(err)
+		}
+		var offset int64
+		entries := 0
+		buf := make([]byte, 8192)
+		for i := 0; i < 3; i++ {
+			n, err := c.Read(ctx, fid, buf, offset)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			offset += int64(n)
+			for data := buf[:n]; len(data) > 0; entries++ {
+				size := int(data[0]) | int(data[1])<<8 + 2
+				stat := styxproto.Stat(data[:size])
+				if name := fmt.Sprint(entries); string(stat.Name()) != name {
+					t.Errorf("entry %d is named %q", entries, stat.Name())
+				}
+				data = data[size:]
+			}
+		}
+		if entries == 0 || entries > limit {
+			t.Errorf("read %d entries from a directory of %d", entries, limit)
+		}
+		if limit == 5 && entries != 5 {
+			t.Errorf("read %d entries, wanted all 5", entries)
+		}
+		// we may read one entry ahead that did not fit
+		if calls > entries+1 {
+			t.Errorf("read %d entries, but generated %d", entries, calls)
+		}
+	}
+}
+
+// A directory that lists the same entries every time it is
+// stat'd. A listCursor reads its entries once.
+type listDir []string
+
+func (d listDir) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (d listDir) IsDir() bool        { return true }
+func (d listDir) Name() string       { return "dir" }
+func (d listDir) Sys() interface{}   { return nil }
+func (d listDir) Size() int64        { return 4096 }
+func (d listDir) ModTime() time.Time { return time.Time{} }
+
+func (d listDir) Readdir(int) ([]os.FileInfo, error) {
+	var files []os.FileInfo
+	for _, name := range d {
+		files = append(files, emptyDir(name))
+	}
+	return files, io.EOF
+}
+
+type listCursor struct{ listDir }
+
+func (c *listCursor) Readdir(n int) ([]os.FileInfo, error) {
+	files, err := c.listDir.Readdir(n)
+	if n > 0 && n < len(files) {
+		c.listDir = c.listDir[n:]
+		return files[:n], nil
+	}
+	c.listDir = nil
+	return files, err
+}
+
+func TestDirSize(t *testing.T) {
+	dir := listDir{"a", "bb", "a-much-longer-name"}
+	c := testClient(t, &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(dir, nil)
+				case Topen:
+					req.Ropen(&listCursor{dir}, nil)
+				case Tstat:
+					req.Rstat(dir, nil)
+				}
+			}
+		}),
+	})
+	ctx := context.Background()
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, _, err := c.Walk(ctx, root, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := c.Stat(ctx, fid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Open(ctx, fid, styxproto.OREAD); err != nil {
+		t.Fatal(err)
+	}
+	var offset int64
+	buf := make([]byte, 8192)
+	for {
+		n, err := c.Read(ctx, fid, buf, offset)
+		offset += int64(n)
+		if n == 0 || err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stat.Length() != offset {
+		t.Errorf("directory length is %d, but read %d bytes", stat.Length(), offset)
+	}
+}
+
+func TestDirFilter(t *testing.T) {
+	dir := listDir{"public", "secret", "other"}
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(dir, nil)
+				case Topen:
+					req.Ropen(&listCursor{dir}, nil)
+				case Tstat:
+					req.Rstat(dir, nil)
+				}
+			}
+		}),
+		DirFilter: func(user string, e os.FileInfo) bool {
+			return e.Name() != "secret" || user == "alice"
+		},
+	}
+	c := testClient(t, srv)
+	ctx := context.Background()
+	list := func(user string) []string {
+		root, _, err := c.Attach(ctx, styxproto.NoFid, user, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fid, _, err := c.Walk(ctx, root, "dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat, err := c.Stat(ctx, fid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.Open(ctx, fid, styxproto.OREAD); err != nil {
+			t.Fatal(err)
+		}
+		// Small enough that each read holds one entry.
+		var (
+			names  []string
+			offset int64
+		)
+		buf := make([]byte, 64)
+		for {
+			n, err := c.Read(ctx, fid, buf, offset)
+			for data := buf[:n]; len(data) > 0; {
+				size := int(data[0]) | int(data[1])<<8 + 2
+				names = append(names, string(styxproto.Stat(data[:size]).Name()))
+				data = data[size:]
+			}
+			offset += int64(n)
+			if n == 0 || err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if stat.Length() != offset {
+			t.Errorf("%s: directory length is %d, but read %d bytes", user, stat.Length(), offset)
+		}
+		return names
+	}
+	if names := list("alice"); !reflect.DeepEqual(names, []string{"public", "secret", "other"}) {
+		t.Errorf("alice sees %q", names)
+	}
+	if names := list("bob"); !reflect.DeepEqual(names, []string{"public", "other"}) {
+		t.Errorf("bob sees %q", names)
+	}
+}
+
+// A childDir returns its own list of children from every call to
+// Readdir, as handlers that keep their tree in memory do.
+type childDir struct {
+	listDir
+	children []os.FileInfo
+}
+
+func (d childDir) Readdir(int) ([]os.FileInfo, error) { return d.children, io.EOF }
+
+func TestDirFilterShared(t *testing.T) {
+	dir := childDir{children: []os.FileInfo{emptyDir("secret"), emptyDir("public")}}
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(dir, nil)
+				case Topen:
+					req.Ropen(dir, nil)
+				case Tstat:
+					req.Rstat(dir, nil)
+				}
+			}
+		}),
+		DirFilter: func(user string, e os.FileInfo) bool {
+			return e.Name() != "secret" || user == "alice"
+		},
+	}
+	c := testClient(t, srv)
+	ctx := context.Background()
+	list := func(user string) []string {
+		root, _, err := c.Attach(ctx, styxproto.NoFid, user, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fid, _, err := c.Walk(ctx, root, "dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Stat(ctx, fid); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.Open(ctx, fid, styxproto.OREAD); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1024)
+		n, err := c.Read(ctx, fid, buf, 0)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		var names []string
+		for data := buf[:n]; len(data) > 0; {
+			size := int(data[0]) | int(data[1])<<8 + 2
+			names = append(names, string(styxproto.Stat(data[:size]).Name()))
+			data = data[size:]
+		}
+		return names
+	}
+	if names := list("bob"); !reflect.DeepEqual(names, []string{"public"}) {
+		t.Errorf("bob sees %q", names)
+	}
+	// Filtering bob's listing must not change the handler's list.
+	if names := list("alice"); !reflect.DeepEqual(names, []string{"secret", "public"}) {
+		t.Errorf("alice sees %q after bob", names)
+	}
+	if got := []string{dir.children[0].Name(), dir.children[1].Name()}; got[0] != "secret" || got[1] != "public" {
+		t.Errorf("handler's children changed to %q", got)
+	}
+}
+
+type devZero struct{}
+
+func (devZero) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (devZero) WriteAt(p []byte, off int64) (int, error) { return len(p), nil }
+
+func TestRateLimit(t *testing.T) {
+	const rate = 20000
+	for _, write := range []bool{false, true} {
+		srv := &Server{
+			Handler: HandlerFunc(func(s *Session) {
+				for s.Next() {
+					switch req := s.Request().(type) {
+					case Twalk:
+						req.Rwalk(ownedFile{"zero", 0666, "", ""}, nil)
+					case Topen:
+						req.Ropen(devZero{}, nil)
+					}
+				}
+			}),
+		}
+		if write {
+			srv.WriteLimit = rate
+		} else {
+			srv.ReadLimit = rate
+		}
+		c := testClient(t, srv)
+		ctx := context.Background()
+		root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fid, _, err := c.Walk(ctx, root, "zero")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.Open(ctx, fid, styxproto.ORDWR); err != nil {
+			t.Fatal(err)
+		}
+		// The first second's worth passes immediately, the
+		// rest should take half a second.
+		buf := make([]byte, rate/2)
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			if write {
+				_, err = c.Write(ctx, fid, buf, 0)
+			} else {
+				_, err = c.Read(ctx, fid, buf, 0)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+			t.Errorf("write=%v: moved %d bytes in %v, faster than %d bytes/s",
+				write, 3*len(buf), elapsed, rate)
+		}
+	}
+}
+
+func TestRateLimitFlush(t *testing.T) {
+	srv := testServer{test: t, server: &Server{WriteLimit: 10}}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(ownedFile{"zero", 0666, "", ""}, nil)
+			case Topen:
+				req.Ropen(devZero{}, nil)
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch req.(type) {
+		case styxproto.Tflush:
+			if _, ok := rsp.(styxproto.Rflush); !ok {
+				t.Errorf("got %T response to %T", rsp, req)
+			}
+		case styxproto.Twrite:
+			t.Errorf("got %T response to flushed %T", rsp, req)
+		}
+	}
+	start := time.Now()
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "zero")
+		enc.Topen(1, 1, styxproto.OWRITE)
+
+		// Takes 9 seconds to get through the limit.
+		enc.Twrite(1, 1, 0, make([]byte, 100))
+		enc.Tflush(2, 1)
+	})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("flushing a throttled Twrite took %v", elapsed)
+	}
+}
+
+func TestSessionErr(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  func(enc *styxproto.Encoder, conn net.Conn)
+		wantErr bool
+	}{
+		{"clunk", func(enc *styxproto.Encoder, conn net.Conn) {
+			enc.Tclunk(1, 0)
+			enc.Flush()
+		}, false},
+		{"hangup", func(enc *styxproto.Encoder, conn net.Conn) {
+			conn.Close()
+		}, false},
+		{"tag reuse", func(enc *styxproto.Encoder, conn net.Conn) {
+			enc.Twalk(5, 0, 1, "a")
+			enc.Twalk(5, 0, 2, "b")
+			enc.Flush()
+		}, true},
+	}
+	for _, tt := range tests {
+		errc := make(chan error, 1)
+		srv := &Server{
+			Handler: HandlerFunc(func(s *Session) {
+				for s.Next() {
+					// hold walks open until the connection ends
+					if req, ok := s.Request().(Twalk); ok {
+						<-req.Context().Done()
+					}
+				}
+				errc <- s.Err()
+			}),
+		}
+		conn := serveConn(t, srv)
+		enc := styxproto.NewEncoder(conn)
+		go func() {
+			enc.Tversion(styxproto.DefaultMaxSize, "9P2000")
+			enc.Tattach(0, 0, styxproto.NoFid, "", "")
+			enc.Flush()
+		}()
+		// wait for the session to start
+		dec := styxproto.NewDecoder(conn)
+		for dec.Next() {
+			if _, ok := dec.Msg().(styxproto.Rattach); ok {
+				break
+			}
+		}
+		go io.Copy(ioutil.Discard, conn)
+		tt.script(enc, conn)
+
+		select {
+		case err := <-errc:
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: Session.Err() = %v", tt.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: session did not end", tt.name)
+		}
+		conn.Close()
+	}
+}
+
+func TestOpenMode(t *testing.T) {
+	tests := []struct {
+		mode            uint8
+		readOK, writeOK bool
+	}{
+		{styxproto.OREAD, true, false},
+		{styxproto.OWRITE, false, true},
+		{styxproto.ORDWR, true, true},
+		{styxproto.OEXEC, true, false},
+		{styxproto.OWRITE | styxproto.OTRUNC, false, true},
+	}
+	for _, tt := range tests {
+		srv := testServer{test: t}
+		srv.handler = HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(ownedFile{"file", 0666, "", ""}, nil)
+				case Ttruncate:
+					req.Rtruncate(nil)
+				case Topen:
+					if req.Readable() != tt.readOK || req.Writable() != tt.writeOK {
+						t.Errorf("mode %#o: Topen Readable=%v Writable=%v",
+							tt.mode, req.Readable(), req.Writable())
+					}
+					req.Ropen(devZero{}, nil)
+				}
+			}
+		})
+		srv.callback = func(req, rsp styxproto.Msg) {
+			_, failed := rsp.(styxproto.Rerror)
+			switch req.(type) {
+			case styxproto.Tread:
+				if failed == tt.readOK {
+					t.Errorf("mode %#o: got %s for Tread", tt.mode, rsp)
+				}
+			case styxproto.Twrite:
+				if failed == tt.writeOK {
+					t.Errorf("mode %#o: got %s for Twrite", tt.mode, rsp)
+				}
+			}
+		}
+		srv.runMsg(func(enc *styxproto.Encoder) {
+			enc.Twalk(1, 0, 1, "file")
+			enc.Topen(1, 1, tt.mode)
+			enc.Tread(1, 1, 0, 10)
+			enc.Twrite(1, 1, 0, []byte("hello"))
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	drained := make(chan string, 1)
+	srv := &Server{
+		ErrorLog: testLogger{t},
+		OnDrain:  func(s *Session) { drained <- s.User },
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(emptyDir("dir"), nil)
+				case Tstat:
+					select {
+					case <-release:
+						req.Rstat(emptyDir("dir"), nil)
+					case <-req.Context().Done():
+					}
+				}
+			}
+		}),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	ctx := context.Background()
+	c := testClient(t, srv)
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := make(chan error, 1)
+	go func() {
+		_, err := c.Stat(ctx, root)
+		stat <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(ctx) }()
+	if user := <-drained; user != "glenda" {
+		t.Errorf("OnDrain called for session of %q, wanted glenda", user)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, wanted ErrServerClosed", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a request in progress", err)
+	case <-time.After(3 * shutdownPollInterval):
+	}
+	close(release)
+	if err := <-stat; err != nil {
+		t.Errorf("request in progress failed during Shutdown: %s", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	if _, err := c.Stat(ctx, root); err == nil {
+		t.Error("connection still open after Shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				if req, ok := s.Request().(Tstat); ok {
+					<-req.Context().Done()
+				}
+			}
+		}),
+	}
+	ctx := context.Background()
+	c := testClient(t, srv)
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := make(chan error, 1)
+	go func() {
+		_, err := c.Stat(ctx, root)
+		stat <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	timeout, cancel := context.WithTimeout(ctx, 2*shutdownPollInterval)
+	defer cancel()
+	if err := srv.Shutdown(timeout); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, wanted %v", err, context.DeadlineExceeded)
+	}
+	if err := <-stat; err == nil {
+		t.Error("request in progress succeeded after Shutdown timed out")
+	}
+
+	// New connections are refused.
+	client, server := net.Pipe()
+	defer client.Close()
+	srv.ServeConn(server)
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("connection accepted after Shutdown")
+	}
+}
+
+// Builds a message of type mtype, with a fid as its first field.
+func rawMsg(mtype uint8, tag uint16, fid uint32, payload string) styxproto.RawMessage {
+	size := 4 + 1 + 2 + 4 + len(payload)
+	m := []byte{
+		byte(size), byte(size >> 8), byte(size >> 16), byte(size >> 24),
+		mtype, byte(tag), byte(tag >> 8),
+		byte(fid), byte(fid >> 8), byte(fid >> 16), byte(fid >> 24),
+	}
+	return append(m, payload...)
+}
+
+func TestUnknownHandler(t *testing.T) {
+	const (
+		Tping = 150
+		Rpong = 151
+	)
+	srv := testServer{test: t}
+	srv.server = &Server{
+		UnknownHandler: func(s *Session, msg styxproto.RawMessage) {
+			if s == nil || msg.Type() != Tping {
+				return
+			}
+			pong := rawMsg(Rpong, msg.Tag(), 0, string(msg.Body()[4:]))
+			s.RespondRaw(pong)
+		},
+	}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+		}
+	})
+	seen := 0
+	srv.callback = func(req, rsp styxproto.Msg) {
+		raw, ok := req.(styxproto.RawMessage)
+		if !ok {
+			return
+		}
+		seen++
+		fid := raw.Body()[0]
+		switch rsp := rsp.(type) {
+		case styxproto.RawMessage:
+			if fid != 0 || rsp.Type() != Rpong || string(rsp.Body()[4:]) != "hello" {
+				t.Errorf("got %s response to %s", rsp, raw)
+			}
+		case styxproto.Rerror:
+			if fid == 0 {
+				t.Errorf("got %s response to %s", rsp, raw)
+			}
+		default:
+			t.Errorf("got %s response to %s", rsp, raw)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Raw(rawMsg(Tping, 1, 0, "hello"))
+		enc.Raw(rawMsg(Tping, 1, 99, "nobody"))
+	})
+	if seen != 2 {
+		t.Errorf("got %d responses to unknown messages, wanted 2", seen)
+	}
+
+	// Without an UnknownHandler, unknown messages are
+	// rejected, but the connection stays up.
+	srv.server = nil
+	seen = 0
+	srv.callback = func(req, rsp styxproto.Msg) {
+		seen++
+		switch req.(type) {
+		case styxproto.RawMessage:
+			if _, ok := rsp.(styxproto.Rerror); !ok {
+				t.Errorf("got %s response to %s", rsp, req)
+			}
+		case styxproto.Tclunk:
+			if _, ok := rsp.(styxproto.Rclunk); !ok {
+				t.Errorf("got %s response to %s", rsp, req)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Raw(rawMsg(Tping, 1, 0, "hello"))
+		enc.Tclunk(1, 0)
+	})
+	if seen != 4 {
+		t.Errorf("got %d responses, wanted 4", seen)
+	}
+}
+
+func TestFidInUse(t *testing.T) {
+	const contents = "hello, world"
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(&slowFile{}, nil)
+			case Topen:
+				req.Ropen(memFile{"file", bytes.NewReader([]byte(contents))}, nil)
+			case Tstat:
+				if req.Path() != "/" {
+					t.Errorf("attached fid moved to %s", req.Path())
+				}
+				req.Rstat(emptyDir("/"), nil)
+			}
+		}
+	})
+	var reclaimed bool
+	srv.callback = func(req, rsp styxproto.Msg) {
+		_, rerror := rsp.(styxproto.Rerror)
+		switch req := req.(type) {
+		case styxproto.Tattach:
+			if req.Tag() == 1 && !rerror {
+				t.Errorf("got %s response to %s on a busy fid", rsp, req)
+			}
+		case styxproto.Twalk:
+			if req.Fid() != req.Newfid() && req.Tag() == 2 && !rerror {
+				t.Errorf("got %s response to %s on a busy fid", rsp, req)
+			}
+			if req.Tag() == 3 {
+				reclaimed = !rerror
+			}
+		case styxproto.Tread:
+			rread, ok := rsp.(styxproto.Rread)
+			if !ok {
+				t.Errorf("got %s response to %s", rsp, req)
+				break
+			}
+			if data, _ := ioutil.ReadAll(rread); string(data) != contents {
+				t.Errorf("read %q from open file, wanted %q", data, contents)
+			}
+		case styxproto.Tstat:
+			if rerror {
+				t.Errorf("got %s response to %s", rsp, req)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "file")
+		enc.Topen(1, 1, styxproto.OREAD)
+		enc.Tattach(1, 1, styxproto.NoFid, "", "")
+		enc.Tattach(1, 0, styxproto.NoFid, "", "")
+		enc.Twalk(2, 0, 1, "other")
+		enc.Twalk(2, 0, 1)
+		enc.Tread(1, 1, 0, 100)
+		enc.Tstat(1, 0)
+
+		// Once clunked, the fid can be used again.
+		enc.Tclunk(1, 1)
+		enc.Twalk(3, 0, 1, "other")
+	})
+	if !reclaimed {
+		t.Error("fid could not be reused after Tclunk")
+	}
+}
+
+// A statBuffer is an open file that reports info to Tstat requests.
+type statBuffer struct {
+	*bytes.Buffer
+	info os.FileInfo
+}
+
+func (f statBuffer) Stat() (os.FileInfo, error) { return f.info, nil }
+
+func TestQidVersion(t *testing.T) {
+	mtime := time.Unix(1234567890, 0)
+	info := timedFile{ownedFile{"file", 0644, "", ""}, mtime}
+	tests := []struct {
+		strategy QidVersion
+		walk     uint32
+		stats    []uint32
+	}{
+		{QidVersionZero, 0, []uint32{0, 0, 0}},
+		{QidVersionWrite, 0, []uint32{1, 2, 3}},
+		{QidVersionMtime, uint32(mtime.Unix()), []uint32{uint32(mtime.Unix()), uint32(mtime.Unix()), uint32(mtime.Unix())}},
+	}
+	for _, tt := range tests {
+		srv := testServer{test: t}
+		srv.server = &Server{QidVersion: tt.strategy}
+		srv.handler = HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(info, nil)
+				case Topen:
+					req.Ropen(statBuffer{new(bytes.Buffer), info}, nil)
+				case Ttruncate:
+					req.Rtruncate(nil)
+				}
+			}
+		})
+		var stats []uint32
+		srv.callback = func(req, rsp styxproto.Msg) {
+			switch rsp := rsp.(type) {
+			case styxproto.Rwalk:
+				if n := rsp.Nwqid(); n > 0 && rsp.Wqid(n-1).Version() != tt.walk {
+					t.Errorf("strategy %d: walk qid %s, wanted version %d", tt.strategy, rsp.Wqid(n-1), tt.walk)
+				}
+			case styxproto.Rstat:
+				stats = append(stats, rsp.Stat().Qid().Version())
+			case styxproto.Rerror:
+				t.Errorf("got %s response to %s", rsp, req)
+			}
+		}
+		truncate := blankStat("", "", "")
+		truncate.SetLength(0)
+		srv.runMsg(func(enc *styxproto.Encoder) {
+			enc.Twalk(1, 0, 1, "file")
+			enc.Topen(1, 1, styxproto.OWRITE)
+			enc.Twrite(1, 1, 0, []byte("hello"))
+			enc.Tstat(1, 1)
+			enc.Twrite(1, 1, 5, []byte(", world"))
+			enc.Tstat(1, 1)
+			enc.Twstat(1, 1, truncate)
+			enc.Tstat(1, 1)
+		})
+		if !reflect.DeepEqual(stats, tt.stats) {
+			t.Errorf("strategy %d: got versions %v, wanted %v", tt.strategy, stats, tt.stats)
+		}
+	}
+}
+
+func TestRawRequest(t *testing.T) {
+	var want bytes.Buffer
+	expect := styxproto.NewEncoder(&want)
+	expect.Twalk(1, 0, 1, "a", "b")
+	expect.Twalk(1, 0, 1, "a", "b")
+	expect.Tstat(1, 1)
+	expect.Flush()
+
+	var got []byte
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			got = append(got, s.RawRequest()...)
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(emptyDir(req.Path()), nil)
+			case Tstat:
+				req.Rstat(emptyDir(path.Base(req.Path())), nil)
+			}
+		}
+		if s.RawRequest() != nil {
+			t.Error("RawRequest is not nil after the session ended")
+		}
+	})
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "a", "b")
+		enc.Tstat(1, 1)
+	})
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("RawRequest returned\n%x, wanted\n%x", got, want.Bytes())
+	}
+}
+
+// A fixedFile is a file that refuses writes past its end, unless
+// sparse is set, in which case the gap is filled with zeros.
+type fixedFile struct {
+	data   []byte
+	sparse bool
+}
+
+func (f *fixedFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(f.data).ReadAt(p, off)
+}
+
+func (f *fixedFile) WriteAt(p []byte, off int64) (int, error) {
+	if off > int64(len(f.data)) {
+		if !f.sparse {
+			return 0, errors.New("offset beyond end of file")
+		}
+		f.data = append(f.data, make([]byte, int(off)-len(f.data))...)
+	}
+	f.data = append(f.data[:off], p...)
+	return len(p), nil
+}
+
+func TestPastEOF(t *testing.T) {
+	const contents = "hello"
+	srv := testServer{test: t}
+	sparse := &fixedFile{sparse: true}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(ownedFile{path.Base(req.Path()), 0666, "", ""}, nil)
+			case Topen:
+				switch req.Path() {
+				case "/readerat":
+					req.Ropen(strings.NewReader(contents), nil)
+				case "/stream":
+					req.Ropen(struct{ io.Reader }{strings.NewReader(contents)}, nil)
+				case "/fixed":
+					req.Ropen(&fixedFile{data: []byte(contents)}, nil)
+				case "/sparse":
+					req.Ropen(sparse, nil)
+				}
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch req := req.(type) {
+		case styxproto.Tread:
+			rread, ok := rsp.(styxproto.Rread)
+			if !ok {
+				t.Errorf("got %s response to %s", rsp, req)
+			} else if req.Offset() >= int64(len(contents)) && rread.Count() != 0 {
+				t.Errorf("read %d bytes past end of file", rread.Count())
+			}
+		case styxproto.Twrite:
+			_, rerror := rsp.(styxproto.Rerror)
+			if wantErr := req.Fid() == 3; rerror != wantErr {
+				t.Errorf("got %s response to %s", rsp, req)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "readerat")
+		enc.Topen(1, 1, styxproto.OREAD)
+		enc.Tread(1, 1, 100, 10)
+		enc.Twalk(1, 0, 2, "stream")
+		enc.Topen(1, 2, styxproto.OREAD)
+		enc.Tread(1, 2, 0, 100)
+		enc.Tread(1, 2, 5, 100)
+		enc.Tread(1, 2, 100, 100)
+
+		enc.Twalk(1, 0, 3, "fixed")
+		enc.Topen(1, 3, styxproto.OWRITE)
+		enc.Twrite(1, 3, 100, []byte("x"))
+		enc.Twalk(1, 0, 4, "sparse")
+		enc.Topen(1, 4, styxproto.OWRITE)
+		enc.Twrite(1, 4, 3, []byte("x"))
+	})
+	if want := "\x00\x00\x00x"; string(sparse.data) != want {
+		t.Errorf("sparse file contains %q, wanted %q", sparse.data, want)
+	}
+}
+
+func TestAttachToken(t *testing.T) {
+	var users []string
+	srv := testServer{test: t}
+	srv.server = &Server{
+		Attach: func(ch *Channel, user, access string) (string, error) {
+			if _, ok := ch.Conn().(net.Conn); !ok {
+				t.Errorf("Channel.Conn returned %T, wanted a net.Conn", ch.Conn())
+			}
+			if access != "token=secret" {
+				return "", errors.New("invalid token")
+			}
+			return "svc-" + user, nil
+		},
+	}
+	srv.handler = HandlerFunc(func(s *Session) {
+		users = append(users, s.User)
+		for s.Next() {
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if req, ok := req.(styxproto.Tattach); ok {
+			_, rerror := rsp.(styxproto.Rerror)
+			if valid := string(req.Aname()) == "token=secret"; rerror == valid {
+				t.Errorf("got %s response to %s", rsp, req)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Tattach(1, 1, styxproto.NoFid, "alice", "token=secret")
+		enc.Tattach(1, 2, styxproto.NoFid, "mallory", "token=guess")
+		enc.Tclunk(1, 1)
+	})
+	if want := []string{"svc-alice"}; !reflect.DeepEqual(users, want) {
+		t.Errorf("sessions were started for %q, wanted %q", users, want)
+	}
+}
+
+func TestAnonymousUser(t *testing.T) {
+	attach := func(srv *Server, uname string) string {
+		users := make(chan string, 1)
+		srv.Handler = HandlerFunc(func(s *Session) {
+			users <- s.User
+			for s.Next() {
+			}
+		})
+		c := testClient(t, srv)
+		ctx := context.Background()
+		afid := styxproto.NoFid
+		if srv.Auth != nil {
+			var err error
+			if afid, _, err = c.Auth(ctx, uname, "none"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := c.Attach(ctx, afid, uname, "none"); err != nil {
+			t.Fatal(err)
+		}
+		return <-users
+	}
+	for _, tt := range []struct {
+		anon, uname, want string
+	}{
+		{"", "", "none"},
+		{"", "none", "none"},
+		{"", "alice", "alice"},
+		{"guest", "", "guest"},
+		{"guest", "none", "guest"},
+		{"guest", "alice", "alice"},
+	} {
+		if got := attach(&Server{AnonymousUser: tt.anon}, tt.uname); got != tt.want {
+			t.Errorf("AnonymousUser %q: attach as %q ran session as %q, wanted %q",
+				tt.anon, tt.uname, got, tt.want)
+		}
+	}
+
+	// Sessions that must authenticate are not anonymous.
+	srv := &Server{Auth: func(rwc *Channel, user, access string) error { return nil }}
+	if got := attach(srv, ""); got != "" {
+		t.Errorf("authenticated attach ran session as %q, wanted the name given", got)
+	}
+}
+
+// A slowWriter takes delay to complete each write, or, if delay
+// is zero, waits for release to be closed.
+type slowWriter struct {
+	delay   time.Duration
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (w *slowWriter) ReadAt(p []byte, off int64) (int, error) { return 0, io.EOF }
+func (w *slowWriter) WriteAt(p []byte, off int64) (int, error) {
+	select {
+	case w.entered <- struct{}{}:
+	default:
+	}
+	if w.delay > 0 {
+		time.Sleep(w.delay)
+	} else {
+		<-w.release
+	}
+	return len(p), nil
+}
+
+// slowWriteHandler serves the slow file at /slow, and, at
+// any other path, a stream that can only be written in order.
+func slowWriteHandler(slow *slowWriter, stream io.Writer) Handler {
+	return HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(ownedFile{path.Base(req.Path()), 0666, "", ""}, nil)
+			case Topen:
+				if req.Path() == "/slow" {
+					req.Ropen(slow, nil)
+				} else {
+					req.Ropen(struct{ io.Writer }{stream}, nil)
+				}
+			case Tstat:
+				req.Rstat(emptyDir("/"), nil)
+			}
+		}
+	})
+}
+
+func TestOutOfOrder(t *testing.T) {
+	slow := &slowWriter{release: make(chan struct{})}
+	var stream bytes.Buffer
+	srv := testServer{test: t}
+	srv.server = &Server{OutOfOrder: true}
+	srv.handler = slowWriteHandler(slow, &stream)
+	var rwrites int
+	var slowDone bool
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch rsp := rsp.(type) {
+		case styxproto.Rstat:
+			if slowDone {
+				t.Error("Tstat was answered after the slow Twrite")
+			}
+			close(slow.release)
+		case styxproto.Rwrite:
+			rwrites++
+			slowDone = slowDone || req.(styxproto.Twrite).Fid() == 1
+		case styxproto.Rerror:
+			t.Errorf("got %s response to %s", rsp, req)
+		}
+	}
+	var want string
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "slow")
+		enc.Topen(1, 1, styxproto.OWRITE)
+		enc.Twalk(1, 0, 2, "stream")
+		enc.Topen(1, 2, styxproto.OWRITE)
+		enc.Twrite(2, 1, 0, []byte("slow"))
+		enc.Tstat(3, 0)
+
+		// Writes to a stream fail if they are made out of order.
+		for i := 0; i < 20; i++ {
+			data := fmt.Sprintf("%02d", i)
+			enc.Twrite(uint16(10+i), 2, int64(len(want)), []byte(data))
+			want += data
+		}
+	})
+	if rwrites != 21 {
+		t.Errorf("got %d Rwrite responses, wanted 21", rwrites)
+	}
+	if stream.String() != want {
+		t.Errorf("stream contains %q, wanted %q", stream.String(), want)
+	}
+}
+
+// BenchmarkOutOfOrder measures the time taken to answer a Tstat
+// request while a slow Twrite is in progress.
+func BenchmarkOutOfOrder(b *testing.B) {
+	for _, outOfOrder := range []bool{false, true} {
+		b.Run(fmt.Sprintf("OutOfOrder=%v", outOfOrder), func(b *testing.B) {
+			slow := &slowWriter{delay: time.Millisecond, entered: make(chan struct{})}
+			srv := &Server{OutOfOrder: outOfOrder, Handler: slowWriteHandler(slow, ioutil.Discard)}
+			client, server := net.Pipe()
+			go srv.ServeConn(server)
+			defer client.Close()
+
+			ctx := context.Background()
+			c, err := NewClient(ctx, client)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+			if err != nil {
+				b.Fatal(err)
+			}
+			fid, _, err := c.Walk(ctx, root, "slow")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := c.Open(ctx, fid, styxproto.OWRITE); err != nil {
+				b.Fatal(err)
+			}
+			var stat time.Duration
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				done := make(chan error, 1)
+				go func() {
+					_, err := c.Write(ctx, fid, []byte("x"), 0)
+					done <- err
+				}()
+				<-slow.entered
+				start := time.Now()
+				if _, err := c.Stat(ctx, root); err != nil {
+					b.Fatal(err)
+				}
+				stat += time.Since(start)
+				if err := <-done; err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(stat.Nanoseconds())/float64(b.N), "stat-ns/op")
+		})
+	}
+}
+
+func TestSessionAttach(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		infos = make(map[string]AttachInfo)
+	)
+	srv := testServer{test: t}
+	srv.server = &Server{
+		Root: func(user, aname string) string {
+			return path.Join("/home", user, aname)
+		},
+	}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			if req, ok := s.Request().(Tstat); ok {
+				mu.Lock()
+				infos[s.User] = s.Attach()
+				mu.Unlock()
+				req.Rstat(emptyDir("/"), nil)
+			}
+		}
+	})
+	var qid styxproto.Qid
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if rsp, ok := rsp.(styxproto.Rattach); ok && req.(styxproto.Tattach).Fid() == 1 {
+			qid = append(qid, rsp.Qid()...)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Tattach(1, 1, styxproto.NoFid, "alice", "src")
+		enc.Tstat(1, 0)
+		enc.Tstat(1, 1)
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(infos) != 2 {
+		t.Fatalf("started %d sessions, wanted 2", len(infos))
+	}
+	got := infos["alice"]
+	if got.Aname != "src" || got.Root != "/home/alice/src" {
+		t.Errorf("got aname %q root %q, wanted aname %q root %q",
+			got.Aname, got.Root, "src", "/home/alice/src")
+	}
+	if !bytes.Equal(got.Qid, qid) || got.Qid.Type() != styxproto.QTDIR {
+		t.Errorf("got root qid %s, wanted %s sent in Rattach", got.Qid, qid)
+	}
+	if infos["none"].Root != "/home/none" {
+		t.Errorf("anonymous session is rooted at %q, wanted /home/none", infos["none"].Root)
+	}
+}
+
+func TestEnforceRemovePerm(t *testing.T) {
+	files := map[string]ownedFile{
+		"/ro":       {"ro", os.ModeDir | 0555, "alice", "staff"},
+		"/ro/file":  {"file", 0666, "alice", "staff"},
+		"/own":      {"own", os.ModeDir | 0755, "alice", "staff"},
+		"/own/file": {"file", 0444, "alice", "staff"},
+	}
+	var removed []string
+	srv := testServer{test: t}
+	srv.server = &Server{EnforceRemovePerm: true}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(files[req.Path()], nil)
+			case Tremove:
+				removed = append(removed, req.Path())
+				req.Rremove(nil)
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if req, ok := req.(styxproto.Tremove); ok {
+			_, rerror := rsp.(styxproto.Rerror)
+			if wantErr := req.Fid() != 3; rerror != wantErr {
+				t.Errorf("got %s response to %s", rsp, req)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Tattach(1, 1, styxproto.NoFid, "alice", "")
+		enc.Tattach(1, 2, styxproto.NoFid, "bob", "")
+		enc.Twalk(1, 1, 3, "own", "file")
+		enc.Twalk(1, 1, 4, "ro", "file")
+		enc.Twalk(1, 2, 5, "own", "file")
+		enc.Tremove(1, 3)
+		enc.Tremove(1, 4)
+		enc.Tremove(1, 5)
+
+		// The fid is clunked even though the remove failed.
+		enc.Tremove(1, 4)
+	})
+	if want := []string{"/own/file"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("handler removed %q, wanted %q", removed, want)
+	}
+}
+
+func TestEnforceRmdirEmpty(t *testing.T) {
+	var removed []string
+	srv := testServer{test: t}
+	srv.server = &Server{EnforceRmdirEmpty: true}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(emptyDir(path.Base(req.Path())), nil)
+			case Topen:
+				switch req.Path() {
+				case "/full":
+					req.Ropen(&listCursor{listDir{"a", "b"}}, nil)
+				case "/empty":
+					req.Ropen(emptyDir("empty"), nil)
+				case "/unlisted":
+					req.Ropen(strings.NewReader(""), nil)
+				}
+			case Tremove:
+				removed = append(removed, req.Path())
+				req.Rremove(nil)
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if _, ok := req.(styxproto.Tremove); !ok {
+			return
+		}
+		rerror, isErr := rsp.(styxproto.Rerror)
+		if wantErr := req.(styxproto.Tremove).Fid() == 1; isErr != wantErr {
+			t.Errorf("got %s response to %s", rsp, req)
+		} else if isErr && (string(rerror.Ename()) != "directory not empty" || rerror.Errno() != 39) {
+			t.Errorf("got %s, wanted \"directory not empty\" with errno ENOTEMPTY", rsp)
+		}
+	}
+	rd, wr := io.Pipe()
+	go func() {
+		enc := styxproto.NewEncoder(wr)
+		enc.Tversion(styxproto.DefaultMaxSize, "9P2000.u")
+		enc.Tattach(0, 0, styxproto.NoFid, "", "")
+		for fid, name := range []string{1: "full", 2: "empty", 3: "unlisted", 4: "unopened"} {
+			if name == "" {
+				continue
+			}
+			enc.Twalk(1, 0, uint32(fid), name)
+			enc.Tremove(1, uint32(fid))
+		}
+		enc.Flush()
+		wr.Close()
+	}()
+	srv.run(rd)
+
+	// Directories the handler cannot list are its to decide.
+	if want := []string{"/empty", "/unlisted", "/unopened"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("handler removed %q, wanted %q", removed, want)
+	}
+}
+
+// Listing a directory before it is removed must not stop the
+// server from reading the Tflush for the remove.
+func TestEnforceRmdirEmptyFlush(t *testing.T) {
+	srv := testServer{test: t}
+	srv.server = &Server{EnforceRmdirEmpty: true}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(emptyDir("dir"), nil)
+			case Topen:
+				<-req.Context().Done()
+			case Tremove:
+				t.Errorf("%s removed after its listing was flushed", req.Path())
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch req.(type) {
+		case styxproto.Tflush:
+			if _, ok := rsp.(styxproto.Rflush); !ok {
+				t.Errorf("got %T response to %T", rsp, req)
+			}
+		case styxproto.Tremove:
+			t.Errorf("got %T response to flushed %T", rsp, req)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "dir")
+		enc.Tremove(1, 1)
+		enc.Tflush(2, 1)
+	})
+}
+
+func TestOversizeWrite(t *testing.T) {
+	const msgTwrite = 118
+
+	// twrite builds a Twrite for fid 1 that claims to hold
+	// count bytes, and holds data.
+	twrite := func(tag uint16, count int, data []byte) styxproto.RawMessage {
+		payload := make([]byte, 12, 12+len(data))
+		payload[8], payload[9], payload[10], payload[11] = byte(count), byte(count>>8), byte(count>>16), byte(count>>24)
+		return rawMsg(msgTwrite, tag, 1, string(append(payload, data...)))
+	}
+	conn := serveConn(t, &Server{
+		MaxSize: styxproto.MinBufSize + 1024,
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(ownedFile{"file", 0666, "", ""}, nil)
+				case Topen:
+					req.Ropen(&fixedFile{sparse: true}, nil)
+				}
+			}
+		}),
+	})
+	big := make([]byte, 2*styxproto.MinBufSize)
+	opened := make(chan struct{})
+	go func() {
+		// The test harness in runMsg does not pass along
+		// malformed messages, so they are written directly.
+		enc := styxproto.NewEncoder(conn)
+		enc.Tversion(styxproto.DefaultMaxSize, "9P2000")
+		enc.Tattach(1, 0, styxproto.NoFid, "", "")
+		enc.Twalk(2, 0, 1, "file")
+		enc.Flush()
+		<-opened
+
+		// The message is larger than the msize.
+		enc.Raw(twrite(4, len(big), big))
+		enc.Twrite(5, 1, 0, []byte("still here"))
+
+		// The count is larger than the msize, and the message.
+		enc.Raw(twrite(6, len(big), []byte("short")))
+		enc.Twrite(7, 1, 0, []byte("still here"))
+		enc.Flush()
+	}()
+
+	dec := styxproto.NewDecoder(conn)
+	got := make(map[uint16]styxproto.Msg)
+	for len(got) < 8 && dec.Next() {
+		got[dec.Msg().Tag()] = copyMsg(dec.Msg())
+		switch dec.Msg().(type) {
+		case styxproto.Rwalk:
+			enc := styxproto.NewEncoder(conn)
+			enc.Topen(3, 1, styxproto.OWRITE)
+			enc.Flush()
+		case styxproto.Ropen:
+			close(opened)
+		}
+	}
+	if err := dec.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []uint16{4, 6} {
+		rerror, ok := got[tag].(styxproto.Rerror)
+		if !ok || !strings.Contains(string(rerror.Ename()), "write exceeds message size") {
+			t.Errorf("got %v in response to oversize Twrite %d", got[tag], tag)
+		}
+	}
+	for _, tag := range []uint16{5, 7} {
+		if _, ok := got[tag].(styxproto.Rwrite); !ok {
+			t.Errorf("got %v in response to Twrite %d after an oversize Twrite", got[tag], tag)
+		}
+	}
+}
+
+func TestWellKnownErrors(t *testing.T) {
+	errs := map[string]error{
+		"noent":  fmt.Errorf("lookup: %w", os.ErrNotExist),
+		"perm":   &os.PathError{Op: "stat", Path: "perm", Err: os.ErrPermission},
+		"exist":  os.ErrExist,
+		"custom": errors.New("out of cheese"),
+	}
+	want := []struct {
+		ename string
+		errno uint32
+	}{
+		1: {"file does not exist", 2},
+		2: {"permission denied", 13},
+		3: {"file already exists", 17},
+		4: {"out of cheese", 0},
+	}
+	for _, version := range []string{"9P2000.u", "9P2000"} {
+		dotu := version == "9P2000.u"
+		srv := testServer{test: t}
+		srv.handler = HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(emptyDir(path.Base(req.Path())), nil)
+				case Tstat:
+					req.Rstat(nil, errs[path.Base(req.Path())])
+				}
+			}
+		})
+		answered := 0
+		srv.callback = func(req, rsp styxproto.Msg) {
+			tstat, ok := req.(styxproto.Tstat)
+			if !ok {
+				return
+			}
+			answered++
+			rerror, ok := rsp.(styxproto.Rerror)
+			if !ok {
+				t.Errorf("%s: got %s response to %s", version, rsp, req)
+				return
+			}
+			w := want[tstat.Fid()]
+			if string(rerror.Ename()) != w.ename {
+				t.Errorf("%s: got error %q, wanted %q", version, rerror.Ename(), w.ename)
+			}
+			if errno := rerror.Errno(); dotu && errno != w.errno {
+				t.Errorf("%s: got errno %d for %q, wanted %d", version, errno, rerror.Ename(), w.errno)
+			}
+		}
+		rd, wr := io.Pipe()
+		go func() {
+			enc := styxproto.NewEncoder(wr)
+			enc.Tversion(styxproto.DefaultMaxSize, version)
+			enc.Tattach(0, 0, styxproto.NoFid, "", "")
+			for fid, name := range []string{1: "noent", 2: "perm", 3: "exist", 4: "custom"} {
+				if name == "" {
+					continue
+				}
+				enc.Twalk(1, 0, uint32(fid), name)
+				enc.Tstat(1, uint32(fid))
+			}
+			enc.Flush()
+			wr.Close()
+		}()
+		srv.run(rd)
+		if answered != 4 {
+			t.Errorf("%s: got %d responses to Tstat, wanted 4", version, answered)
+		}
+	}
+}
+
+func TestClunkAll(t *testing.T) {
+	files := map[string]*closeCounter{"a": new(closeCounter), "b": new(closeCounter)}
+	exited := make(chan struct{})
+
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		defer close(exited)
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(ownedFile{name: path.Base(req.Path())}, nil)
+			case Topen:
+				req.Ropen(files[path.Base(req.Path())], nil)
+			case Tstat:
+				// logging out
+				s.ClunkAll()
+				req.Rstat(ownedFile{name: "logout"}, nil)
+			}
+		}
+	})
+	loggedOut := false
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if _, ok := rsp.(styxproto.Rstat); ok {
+			loggedOut = true
+			return
+		}
+		if !loggedOut {
+			return
+		}
+		if rerror, ok := rsp.(styxproto.Rerror); !ok {
+			t.Errorf("got %s response to %s after ClunkAll", rsp, req)
+		} else if string(rerror.Ename()) != errNoFid.Error() {
+			t.Errorf("got error %q for %s, wanted %q", rerror.Ename(), req, errNoFid)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "a")
+		enc.Topen(1, 1, styxproto.OREAD)
+		enc.Twalk(1, 0, 2, "b")
+		enc.Topen(1, 2, styxproto.OREAD)
+		enc.Twalk(1, 0, 3, "c")
+		enc.Tstat(1, 3)
+		enc.Tread(1, 1, 0, 10)
+		enc.Tclunk(1, 2)
+		enc.Twalk(1, 0, 4, "a")
+	})
+	if !loggedOut {
+		t.Error("no response to Tstat")
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve9P did not return after ClunkAll")
+	}
+	for name, file := range files {
+		file.mu.Lock()
+		if file.closed != 1 {
+			t.Errorf("%s closed %d times, wanted 1", name, file.closed)
+		}
+		file.mu.Unlock()
+	}
+}
+
+func TestListenConfig(t *testing.T) {
+	controlled := make(chan string, 1)
+	srv := &Server{
+		Addr:     "127.0.0.1:0",
+		Handler:  FileSystem(nil),
+		ErrorLog: testLogger{t},
+		ListenConfig: &net.ListenConfig{
+			Control: func(network, address string, c syscall.RawConn) error {
+				controlled <- address
+				return nil
+			},
+		},
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe() }()
+	select {
+	case addr := <-controlled:
+		t.Logf("Control called for %s", addr)
+	case err := <-done:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenConfig.Control was not called")
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("ListenAndServe returned %v, wanted %v", err, ErrServerClosed)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Tstat:
+				s.SetReadOnly(true)
+				req.Rstat(ownedFile{name: "lock"}, nil)
+			case Twalk:
+				req.Rwalk(ownedFile{name: path.Base(req.Path()), mode: 0666}, nil)
+			case Topen:
+				req.Ropen(strings.NewReader("data"), nil)
+			case Tcreate:
+				req.Rcreate(strings.NewReader(""), nil)
+			case Tremove:
+				req.Rremove(nil)
+			case Ttruncate:
+				req.Rtruncate(nil)
+			case Tchmod:
+				req.Rchmod(nil)
+			case Trename:
+				req.Rrename(nil)
+			}
+		}
+	})
+	denied := 0
+	readOnly := false
+	srv.callback = func(req, rsp styxproto.Msg) {
+		rerror, failed := rsp.(styxproto.Rerror)
+		switch req := req.(type) {
+		case styxproto.Tstat:
+			if !readOnly {
+				readOnly = !failed
+			} else if !failed || string(rerror.Ename()) != errNoFid.Error() {
+				// after the Tremove, the fid is gone
+				t.Errorf("got %s response to %s after Tremove", rsp, req)
+			}
+			return
+		case styxproto.Topen:
+			if !readOnly || req.Mode() == styxproto.OREAD {
+				if failed {
+					t.Errorf("got %s response to %s", rsp, req)
+				}
+				return
+			}
+		case styxproto.Tcreate, styxproto.Tremove, styxproto.Twstat, styxproto.Twrite:
+		default:
+			if failed {
+				t.Errorf("got %s response to %s", rsp, req)
+			}
+			return
+		}
+		if !failed {
+			t.Errorf("got %s response to %s in read-only session", rsp, req)
+		} else if string(rerror.Ename()) != "permission denied" {
+			t.Errorf("got error %q for %s, wanted permission denied", rerror.Ename(), req)
+		} else {
+			denied++
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "file")
+		enc.Topen(1, 1, styxproto.OWRITE)
+		enc.Twalk(1, 0, 4, "lock")
+		enc.Tstat(1, 4)
+
+		enc.Twrite(1, 1, 0, []byte("hello"))
+		enc.Twalk(1, 0, 5, "file")
+		enc.Topen(1, 5, styxproto.OWRITE)
+		enc.Topen(1, 5, styxproto.OREAD|styxproto.OTRUNC)
+		enc.Topen(1, 5, styxproto.OREAD)
+		enc.Twalk(1, 0, 2, "dir")
+		enc.Tcreate(1, 2, "new", 0666, styxproto.OREAD)
+		enc.Twalk(1, 0, 3, "file")
+		enc.Twstat(1, 3, blankStat("renamed", "", ""))
+		enc.Tremove(1, 3)
+		enc.Tstat(1, 3)
+	})
+	if denied != 6 {
+		t.Errorf("%d requests denied, wanted 6", denied)
+	}
+}
+
+// If a request is answered before its Tflush takes effect, its
+// response must reach the client before the Rflush. Race many
+// flushes against concurrent reads to check that they never
+// arrive out of order.
+func TestFlushOrder(t *testing.T) {
+	const n, lag = 500, 1
+	data := make([]byte, 8000)
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(ownedFile{name: "file", mode: 0444}, nil)
+				case Topen:
+					req.Ropen(&fixedFile{data: data}, nil)
+				}
+			}
+		}),
+	}
+	conn := serveConn(t, srv)
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	enc := styxproto.NewEncoder(conn)
+	dec := styxproto.NewDecoder(conn)
+
+	// Each setup request must be answered before the next
+	// is sent, since they depend on one another.
+	go func() {
+		enc.Tversion(styxproto.DefaultMaxSize, "9P2000")
+		enc.Tattach(0, 0, styxproto.NoFid, "", "")
+		enc.Flush()
+	}()
+	for _, send := range []func(){
+		nil,
+		func() { enc.Twalk(1, 0, 1, "file") },
+		func() { enc.Topen(1, 1, styxproto.OREAD) },
+	} {
+		if send != nil {
+			go func() {
+				send()
+				enc.Flush()
+			}()
+		}
+		for dec.Next() {
+			if _, ok := dec.Msg().(styxproto.Rversion); ok {
+				continue
+			}
+			if _, ok := dec.Msg().(styxproto.Rerror); ok {
+				t.Fatal(dec.Msg())
+			}
+			break
+		}
+		if err := dec.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		for i := uint16(1); i <= n+lag; i++ {
+			if i <= n {
+				enc.Tread(i, 1, 0, int64(len(data)))
+			}
+			if i > lag {
+				enc.Tflush(i-lag+n, i-lag)
+			}
+			enc.Flush()
+		}
+	}()
+
+	reads := 0
+	flushed := make(map[uint16]bool)
+	for len(flushed) < n && dec.Next() {
+		time.Sleep(50 * time.Microsecond)
+		switch m := dec.Msg().(type) {
+		case styxproto.Rflush:
+			if m.Tag() <= n || flushed[m.Tag()-n] {
+				t.Fatalf("unexpected %s", m)
+			}
+			flushed[m.Tag()-n] = true
+		case styxproto.Rread:
+			if flushed[m.Tag()] {
+				t.Fatalf("%s sent after the Rflush for it", m)
+			}
+			reads++
+		case styxproto.Rerror:
+			t.Fatal(m)
+		}
+	}
+	if err := dec.Err(); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%d of %d reads answered before they were flushed", reads, n)
+}
+
+// A client that skips version negotiation gets an error, and
+// the connection is closed.
+func TestNoVersion(t *testing.T) {
+	conn := serveConn(t, &Server{Handler: HandlerFunc(func(s *Session) {
+		t.Error("session started without Tversion")
+	})})
+	go func() {
+		enc := styxproto.NewEncoder(conn)
+		enc.Tattach(1, 0, styxproto.NoFid, "", "")
+		enc.Flush()
+	}()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	dec := styxproto.NewDecoder(conn)
+	if !dec.Next() {
+		t.Fatalf("no response to Tattach: %v", dec.Err())
+	}
+	rerror, ok := dec.Msg().(styxproto.Rerror)
+	if !ok {
+		t.Fatalf("got %s in response to Tattach, wanted Rerror", dec.Msg())
+	}
+	if rerror.Tag() != 1 {
+		t.Errorf("Rerror has tag %d, wanted 1", rerror.Tag())
+	}
+	if got, want := string(rerror.Ename()), errNoVersion.Error(); got != want {
+		t.Errorf("got error %q, wanted %q", got, want)
+	}
+	if dec.Next() {
+		t.Errorf("got %s after failed version negotiation", dec.Msg())
+	} else if err := dec.Err(); err != nil && err != io.EOF {
+		t.Errorf("connection not closed: %v", err)
+	}
+}
+
+// A fakeClock only moves when it is advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	when time.Time
+	c    chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeTimer{c.now.Add(d), ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, firing any timers that
+// come due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.when.After(c.now) {
+			waiters = append(waiters, w)
+		} else {
+			w.c <- c.now
+		}
+	}
+	c.waiters = waiters
+}
+
+// wait blocks until there are n timers waiting on the clock.
+func (c *fakeClock) wait(t *testing.T, n int) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		waiting := len(c.waiters)
+		c.mu.Unlock()
+		if waiting == n {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %d timers", n)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	clock := newFakeClock()
+	srv := &Server{
+		IdleTimeout: time.Minute,
+		Clock:       clock,
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				if req, ok := s.Request().(Tstat); ok {
+					req.Rstat(emptyDir("/"), nil)
+				}
+			}
+		}),
+	}
+	conn := serveConn(t, srv)
+	enc := styxproto.NewEncoder(conn)
+	dec := styxproto.NewDecoder(conn)
+	rpc := func(send func()) {
+		go func() {
+			send()
+			enc.Flush()
+		}()
+		for dec.Next() {
+			switch dec.Msg().(type) {
+			case styxproto.Rattach, styxproto.Rstat:
+				return
+			case styxproto.Rerror:
+				t.Fatal(dec.Msg())
+			}
+		}
+		t.Fatalf("connection closed early: %v", dec.Err())
+	}
+	rpc(func() {
+		enc.Tversion(styxproto.DefaultMaxSize, "9P2000")
+		enc.Tattach(0, 0, styxproto.NoFid, "", "")
+	})
+	clock.wait(t, 1)
+
+	clock.Advance(59 * time.Second)
+	rpc(func() { enc.Tstat(1, 0) })
+
+	// The timer fires, but a message was received since it
+	// was set.
+	clock.Advance(time.Second)
+	clock.wait(t, 1)
+	rpc(func() { enc.Tstat(1, 0) })
+	clock.Advance(59 * time.Second)
+	clock.wait(t, 1)
+
+	clock.Advance(time.Second)
+	if dec.Next() {
+		t.Errorf("got %s, wanted connection to close", dec.Msg())
+	}
+}
+
+// An eventFile blocks reads until an event is sent. It
+// signals reading when a read begins.
+type eventFile struct {
+	reading chan struct{}
+	events  chan string
+}
+
+func (f eventFile) ReadAt(p []byte, off int64) (int, error) {
+	f.reading <- struct{}{}
+	return copy(p, <-f.events), nil
+}
+
+func TestBlockingRead(t *testing.T) {
+	clock := newFakeClock()
+	events := eventFile{make(chan struct{}), make(chan string)}
+	srv := &Server{
+		IdleTimeout: time.Minute,
+		Clock:       clock,
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(ownedFile{name: "events", mode: 0444}, nil)
+				case Topen:
+					req.Ropen(events, nil)
+				}
+			}
+		}),
+	}
+	conn := serveConn(t, srv)
+	enc := styxproto.NewEncoder(conn)
+	dec := styxproto.NewDecoder(conn)
+	next := func() styxproto.Msg {
+		if !dec.Next() {
+			t.Fatalf("connection closed early: %v", dec.Err())
+		}
+		if m, ok := dec.Msg().(styxproto.Rerror); ok {
+			t.Fatal(m)
+		}
+		return dec.Msg()
+	}
+	rpc := func(send func()) {
+		go func() {
+			send()
+			enc.Flush()
+		}()
+		next()
+	}
+	rpc(func() { enc.Tversion(styxproto.DefaultMaxSize, "9P2000") })
+	rpc(func() { enc.Tattach(0, 0, styxproto.NoFid, "", "") })
+	rpc(func() { enc.Twalk(0, 0, 1, "events") })
+	rpc(func() { enc.Topen(0, 1, styxproto.OREAD) })
+	go func() {
+		enc.Tread(1, 1, 0, 100)
+		enc.Flush()
+	}()
+	<-events.reading
+
+	// The read blocks for ten times the idle timeout, but the
+	// connection is not idle while it is in progress.
+	for i := 0; i < 10; i++ {
+		clock.wait(t, 1)
+		clock.Advance(time.Minute)
+	}
+	clock.wait(t, 1)
+	events.events <- "event"
+	if m, ok := next().(styxproto.Rread); !ok {
+		t.Errorf("got %v, wanted Rread", m)
+	} else if data, _ := ioutil.ReadAll(m); string(data) != "event" {
+		t.Errorf("read %q, wanted %q", data, "event")
+	}
+
+	clock.Advance(time.Minute)
+	if dec.Next() {
+		t.Errorf("got %s, wanted connection to close", dec.Msg())
+	}
+}
+
+func TestConnState(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		states []ConnState
+	)
+	closed := make(chan struct{})
+	current := func() ConnState {
+		mu.Lock()
+		defer mu.Unlock()
+		return states[len(states)-1]
+	}
+	waitFor := func(want ConnState) {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+			if current() == want {
+				return
+			}
+		}
+		t.Fatalf("connection is %s, wanted %s", current(), want)
+	}
+	unblock := make(chan struct{})
+	srv := &Server{
+		ConnState: func(_ net.Conn, state ConnState) {
+			mu.Lock()
+			states = append(states, state)
+			mu.Unlock()
+			if state == StateClosed {
+				close(closed)
+			}
+		},
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				if req, ok := s.Request().(Tstat); ok {
+					<-unblock
+					req.Rstat(emptyDir("/"), nil)
+				}
+			}
+		}),
+	}
+	c := testClient(t, srv)
+	ctx := context.Background()
+	waitFor(StateIdle)
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(StateIdle)
+
+	done := make(chan error)
+	go func() {
+		_, err := c.Stat(ctx, root)
+		done <- err
+	}()
+	waitFor(StateActive)
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(StateIdle)
+
+	c.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("StateClosed not reported")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if states[0] != StateNew {
+		t.Errorf("first state is %s, wanted %s", states[0], StateNew)
+	}
+	for i := 1; i < len(states); i++ {
+		if states[i] == states[i-1] || states[i] == StateNew {
+			t.Errorf("bad transition from %s to %s in %v", states[i-1], states[i], states)
+		}
+	}
+}
+
+// A patternFile is a large, read-only file whose contents are
+// generated as they are read. It can only be read through its
+// Read and Seek methods.
+type patternFile struct {
+	size, off int64
+}
+
+func patternByte(off int64) byte { return byte(off % 251) }
+
+func (f *patternFile) Read(p []byte) (int, error) {
+	if f.off >= f.size {
+		return 0, io.EOF
+	}
+	if rest := f.size - f.off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	for i := range p {
+		p[i] = patternByte(f.off + int64(i))
+	}
+	f.off += int64(len(p))
+	return len(p), nil
+}
+
+func (f *patternFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// patternReaderAt has only a ReadAt method.
+type patternReaderAt struct{ size int64 }
+
+func (f patternReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	file := patternFile{size: f.size, off: off}
+	n, err := io.ReadFull(&file, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func TestSeekableOpen(t *testing.T) {
+	const size = 1 << 30
+	c := testClient(t, &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(ownedFile{name: path.Base(req.Path()), mode: 0444}, nil)
+				case Topen:
+					if path.Base(req.Path()) == "seeker" {
+						req.Ropen(&patternFile{size: size}, nil)
+					} else {
+						req.Ropen(patternReaderAt{size: size}, nil)
+					}
+				}
+			}
+		}),
+	})
+	ctx := context.Background()
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"seeker", "readerat"} {
+		fid, _, err := c.Walk(ctx, root, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.Open(ctx, fid, styxproto.OREAD); err != nil {
+			t.Fatal(err)
+		}
+		for _, off := range []int64{size / 2, 12345, size - 10} {
+			buf := make([]byte, 100)
+			n, err := c.Read(ctx, fid, buf, off)
+			if err != nil {
+				t.Fatalf("%s: read at %d: %v", name, off, err)
+			}
+			if want := int64(100); off+want > size {
+				want = size - off
+				if int64(n) != want {
+					t.Errorf("%s: read %d bytes at %d, wanted %d", name, n, off, want)
+				}
+			}
+			for i, b := range buf[:n] {
+				if b != patternByte(off+int64(i)) {
+					t.Fatalf("%s: wrong byte %d at offset %d", name, b, off+int64(i))
+				}
+			}
+		}
+		if name == "seeker" {
+			stat, err := c.Stat(ctx, fid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.Length() != size {
+				t.Errorf("%s: stat reports length %d, wanted %d", name, stat.Length(), size)
+			}
+		}
+	}
+}
+
+// quotaFile refuses writes that would make it larger than its
+// capacity.
+type quotaFile struct {
+	fixedFile
+	capacity int64
+}
+
+func (f *quotaFile) CheckWrite(offset, count int64) error {
+	if offset+count > f.capacity {
+		return errors.New("quota exceeded")
+	}
+	return nil
+}
+
+func (f *quotaFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func TestWriteCheck(t *testing.T) {
+	const size = 4 << 20
+	for _, outOfOrder := range []bool{false, true} {
+		file := &quotaFile{capacity: 100}
+		c := testClient(t, &Server{
+			OutOfOrder: outOfOrder,
+			Handler: HandlerFunc(func(s *Session) {
+				for s.Next() {
+					switch req := s.Request().(type) {
+					case Twalk:
+						req.Rwalk(ownedFile{name: "file", mode: 0666}, nil)
+					case Topen:
+						req.Ropen(file, nil)
+					}
+				}
+			}),
+		})
+		ctx := context.Background()
+		root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fid, _, err := c.Walk(ctx, root, "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.Open(ctx, fid, styxproto.OWRITE); err != nil {
+			t.Fatal(err)
+		}
+
+		big := make([]byte, size)
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		if _, err := c.Write(ctx, fid, big, 0); err == nil || !strings.Contains(err.Error(), "quota") {
+			t.Errorf("got error %v for write over quota", err)
+		}
+		runtime.ReadMemStats(&after)
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/4 {
+			t.Errorf("OutOfOrder=%v: rejected %d byte write allocated %d bytes", outOfOrder, size, alloc)
+		}
+
+		// The rejected data must not be taken for the
+		// next message.
+		if n, err := c.Write(ctx, fid, []byte("hello"), 0); err != nil || n != 5 {
+			t.Fatalf("write after rejected write: %d, %v", n, err)
+		}
+		if string(file.data) != "hello" {
+			t.Errorf("file contains %q", file.data)
+		}
+	}
+}
+
+func TestRequestAccessors(t *testing.T) {
+	type seen struct {
+		kind string
+		tag  uint16
+		fid  uint32
+	}
+	var got []seen
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			req := s.Request()
+			got = append(got, seen{req.Kind(), req.Tag(), req.Fid()})
+			switch req := req.(type) {
+			case Twalk:
+				req.Rwalk(emptyDir(path.Base(req.Path())), nil)
+			case Tstat:
+				req.Rstat(emptyDir(path.Base(req.Path())), nil)
+			}
+		}
+	})
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Tstat(5, 0)
+		enc.Twalk(1, 0, 1, "dir")
+		enc.Tremove(1, 1)
+		enc.Twalk(1, 0, 2, "file")
+		enc.Twstat(1, 2, blankStat("renamed", "", ""))
+	})
+	want := []seen{
+		{"Tstat", 5, 0},
+		{"Twalk", 1, 0},
+		{"Tremove", 1, 1},
+		{"Twalk", 1, 0},
+		{"Trename", 1, 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got requests %v, wanted %v", got, want)
+	}
+}
+
+func TestBadOffset(t *testing.T) {
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(ownedFile{name: "file", mode: 0666}, nil)
+			case Topen:
+				req.Ropen(&quotaFile{capacity: 1 << 62}, nil)
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch req.(type) {
+		case styxproto.Tread, styxproto.Twrite:
+			if rerror, ok := rsp.(styxproto.Rerror); !ok {
+				t.Errorf("got %s in response to %s", rsp, req)
+			} else if string(rerror.Ename()) != "bad offset" {
+				t.Errorf("got %s in response to %s", rerror, req)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "file")
+		enc.Topen(1, 1, styxproto.ORDWR)
+		for _, offset := range []uint64{^uint64(0), styxproto.MaxOffset - 1} {
+			enc.Tread(1, 1, int64(offset), 10)
+			enc.Twrite(1, 1, int64(offset), []byte("0123456789"))
+		}
+	})
+}
+
+func TestSessionClose(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		files = make(map[string]*closeCounter)
+	)
+	ended := make(chan string, 2)
+	srv := &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			file := new(closeCounter)
+			mu.Lock()
+			files[s.User] = file
+			mu.Unlock()
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(&slowFile{}, nil)
+				case Topen:
+					req.Ropen(file, nil)
+				}
+			}
+			ended <- s.User
+		}),
+	}
+	ctx := context.Background()
+	clients := make(map[string]*Client)
+	roots := make(map[string]uint32)
+	for _, user := range []string{"alice", "bob"} {
+		c := testClient(t, srv)
+		root, _, err := c.Attach(ctx, styxproto.NoFid, user, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fid, _, err := c.Walk(ctx, root, "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.Open(ctx, fid, styxproto.ORDWR); err != nil {
+			t.Fatal(err)
+		}
+		clients[user], roots[user] = c, root
+	}
+
+	sessions := srv.Sessions()
+	var alice *Session
+	for _, s := range sessions {
+		if s.User == "alice" {
+			alice = s
+		}
+	}
+	if len(sessions) != 2 || alice == nil {
+		t.Fatalf("Sessions returned %d sessions, wanted alice and bob", len(sessions))
+	}
+	alice.Close()
+	alice.Close()
+
+	select {
+	case user := <-ended:
+		if user != "alice" {
+			t.Fatalf("session of %s ended, wanted alice", user)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return after Close")
+	}
+	if _, _, err := clients["alice"].Walk(ctx, roots["alice"]); err == nil {
+		t.Error("walk succeeded on a closed session")
+	}
+	if _, _, err := clients["bob"].Walk(ctx, roots["bob"]); err != nil {
+		t.Errorf("walk on another session failed: %s", err)
+	}
+	closed := func(user string) int {
+		mu.Lock()
+		file := files[user]
+		mu.Unlock()
+		file.mu.Lock()
+		defer file.mu.Unlock()
+		return file.closed
+	}
+	// Files are closed once the handler returns.
+	for start := time.Now(); closed("alice") != 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("alice's file closed %d times, wanted 1", closed("alice"))
+		}
+	}
+	if n := closed("bob"); n != 0 {
+		t.Errorf("bob's file closed %d times, wanted 0", n)
+	}
+	if sessions := srv.Sessions(); len(sessions) != 1 || sessions[0].User != "bob" {
+		t.Errorf("Sessions returned %d sessions after Close, wanted bob's", len(sessions))
+	}
+	// Closing a session that has ended is harmless.
+	alice.Close()
+}
+
+// readCounter counts calls to ReadAt, and Readdir when it is
+// used as a directory.
+type readCounter struct {
+	mu    sync.Mutex
+	reads int
+}
+
+func (f *readCounter) count() {
+	f.mu.Lock()
+	f.reads++
+	f.mu.Unlock()
+}
+
+func (f *readCounter) ReadAt(p []byte, off int64) (int, error) {
+	f.count()
+	return 0, io.EOF
+}
+
+type readdirCounter struct {
+	emptyDir
+	*readCounter
+}
+
+func (d readdirCounter) Readdir(n int) ([]os.FileInfo, error) {
+	d.count()
+	return nil, io.EOF
+}
+
+func TestEmptyRead(t *testing.T) {
+	file := new(readCounter)
+	dir := readdirCounter{"dir", new(readCounter)}
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				if req.Path() == "/dir" {
+					req.Rwalk(dir, nil)
+				} else {
+					req.Rwalk(ownedFile{name: "file", mode: 0644}, nil)
+				}
+			case Topen:
+				if req.Path() == "/dir" {
+					req.Ropen(dir, nil)
+				} else {
+					req.Ropen(file, nil)
+				}
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if _, ok := req.(styxproto.Tread); !ok {
+			return
+		}
+		if r, ok := rsp.(styxproto.Rread); !ok || r.Count() != 0 {
+			t.Errorf("got %v in response to %v, wanted empty Rread", rsp, req)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "file")
+		enc.Topen(1, 1, styxproto.OREAD)
+		enc.Tread(1, 1, 0, 0)
+		enc.Tread(1, 1, 100, 0)
+		enc.Twalk(1, 0, 2, "dir")
+		enc.Topen(1, 2, styxproto.OREAD)
+		enc.Tread(1, 2, 0, 0)
+		enc.Tread(1, 2, 100, 0)
+	})
+	if file.reads != 0 || dir.reads != 0 {
+		t.Errorf("file read %d times and directory %d times, wanted 0", file.reads, dir.reads)
+	}
+}
+
+// timedDir is an empty directory with a modification time.
+type timedDir struct {
+	emptyDir
+	mtime time.Time
+}
+
+func (d timedDir) ModTime() time.Time { return d.mtime }
+
+func TestRootInfo(t *testing.T) {
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	handled := make(chan Request, 10)
+	srv := &Server{
+		RootInfo: func(user, aname string) (os.FileInfo, error) {
+			if aname == "missing" {
+				return nil, errors.New("no such tree")
+			}
+			return timedDir{"/", mtime}, nil
+		},
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				handled <- s.Request()
+			}
+		}),
+	}
+	c := testClient(t, srv)
+	ctx := context.Background()
+	if _, _, err := c.Attach(ctx, styxproto.NoFid, "", "missing"); err == nil {
+		t.Error("attach succeeded when RootInfo failed")
+	}
+	root, qid, err := c.Attach(ctx, styxproto.NoFid, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qid.Type()&styxproto.QTDIR == 0 {
+		t.Errorf("root qid %s is not a directory", qid)
+	}
+	stat, err := c.Stat(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Unix(int64(stat.Mtime()), 0); !got.Equal(mtime) {
+		t.Errorf("root mtime is %s, wanted %s", got, mtime)
+	}
+	if stat.Mode()&styxproto.DMDIR == 0 {
+		t.Errorf("root mode %o is not a directory", stat.Mode())
+	}
+	select {
+	case req := <-handled:
+		t.Errorf("handler received %s %s", req.Kind(), req.Path())
+	default:
+	}
+}
+
+func TestRemoveOnClunk(t *testing.T) {
+	var removed []string
+	gone := make(chan struct{})
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				// The last remove is made after its Tclunk is
+				// answered, so a walk in another session
+				// waits for it.
+				if req.Path() == "/last" {
+					select {
+					case <-gone:
+					case <-time.After(5 * time.Second):
+						t.Error("/new not removed")
+					}
+				}
+				req.Rwalk(ownedFile{name: path.Base(req.Path()), mode: 0644}, nil)
+			case Topen:
+				req.Ropen(new(closeCounter), nil)
+			case Tcreate:
+				req.Rcreate(new(closeCounter), nil)
+			case Tremove:
+				removed = append(removed, req.Path())
+				if req.Path() == "/busy" {
+					req.Rremove(errors.New("file is busy"))
+				} else {
+					req.Rremove(nil)
+				}
+				if req.Path() == "/new" {
+					close(gone)
+				}
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch req := req.(type) {
+		case styxproto.Tclunk:
+			if _, ok := rsp.(styxproto.Rclunk); !ok {
+				t.Errorf("got %v in response to %v", rsp, req)
+			}
+		case styxproto.Tstat:
+			if _, ok := rsp.(styxproto.Rerror); !ok {
+				t.Errorf("got %v for a clunked fid", rsp)
+			}
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "tmp")
+		enc.Topen(1, 1, styxproto.ORDWR|styxproto.ORCLOSE)
+		enc.Tclunk(1, 1)
+		enc.Tstat(1, 1)
+		enc.Twalk(1, 0, 2, "busy")
+		enc.Topen(1, 2, styxproto.OREAD|styxproto.ORCLOSE)
+		enc.Tclunk(1, 2)
+		enc.Twalk(1, 0, 3, "kept")
+		enc.Topen(1, 3, styxproto.OREAD)
+		enc.Tclunk(1, 3)
+		enc.Twalk(1, 0, 4)
+		enc.Tcreate(1, 4, "new", 0644, styxproto.OWRITE|styxproto.ORCLOSE)
+		enc.Tclunk(1, 4)
+		enc.Tattach(1, 5, styxproto.NoFid, "", "")
+		enc.Twalk(1, 5, 6, "last")
+	})
+	if want := []string{"/tmp", "/busy", "/new"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %q, wanted %q", removed, want)
+	}
+}
+
+// A Tclunk is answered without waiting for the remove it makes.
+func TestRemoveOnClunkAsync(t *testing.T) {
+	clunked := make(chan struct{})
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			switch req := s.Request().(type) {
+			case Twalk:
+				req.Rwalk(ownedFile{name: "tmp", mode: 0644}, nil)
+			case Topen:
+				req.Ropen(new(closeCounter), nil)
+			case Tremove:
+				select {
+				case <-clunked:
+				case <-time.After(5 * time.Second):
+					t.Error("Tclunk not answered before its remove")
+				}
+				req.Rremove(nil)
+			}
+		}
+	})
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if _, ok := rsp.(styxproto.Rclunk); ok {
+			close(clunked)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "tmp")
+		enc.Topen(1, 1, styxproto.ORDWR|styxproto.ORCLOSE)
+		enc.Tclunk(1, 1)
+	})
+}
+
+func TestWalkDot(t *testing.T) {
+	var walked []string
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			if req, ok := s.Request().(Twalk); ok {
+				walked = append(walked, req.Path())
+				switch req.Path() {
+				case "/a":
+					req.Rwalk(emptyDir("a"), nil)
+				case "/a/b":
+					req.Rwalk(ownedFile{name: "b", mode: 0644}, nil)
+				}
+			}
+		}
+	})
+	// The positions of each walk's "." elements, and the
+	// elements whose qids they should repeat.
+	same := [][2]int{{0, 1}, {1, 2}, {0, 1}}
+	var nwqid []int
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if _, ok := req.(styxproto.Twalk); !ok {
+			return
+		}
+		rwalk, ok := rsp.(styxproto.Rwalk)
+		if !ok {
+			t.Errorf("got %v in response to %v", rsp, req)
+			return
+		}
+		pair := same[len(nwqid)]
+		nwqid = append(nwqid, rwalk.Nwqid())
+		if rwalk.Nwqid() <= pair[1] {
+			return
+		}
+		if a, b := rwalk.Wqid(pair[0]), rwalk.Wqid(pair[1]); !bytes.Equal(a, b) {
+			t.Errorf("%v: qid for . is %s, wanted %s", req, b, a)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "a", ".", "b")
+		enc.Twalk(1, 0, 2, ".", "a", ".")
+		enc.Twalk(1, 0, 3, ".", ".")
+	})
+	if want := []int{3, 3, 2}; !reflect.DeepEqual(nwqid, want) {
+		t.Errorf("Rwalk had %v qids, wanted %v", nwqid, want)
+	}
+	if want := []string{"/a", "/a/b", "/a"}; !reflect.DeepEqual(walked, want) {
+		t.Errorf("handler walked %q, wanted %q", walked, want)
+	}
+}
+
+func TestWalkElementError(t *testing.T) {
+	var walked []string
+	srv := testServer{test: t}
+	srv.handler = HandlerFunc(func(s *Session) {
+		for s.Next() {
+			if req, ok := s.Request().(Twalk); ok {
+				walked = append(walked, req.Path())
+				switch path.Base(req.Path()) {
+				case "secret":
+					req.Rwalk(nil, os.ErrPermission)
+				case "file":
+					req.Rwalk(ownedFile{name: "file", mode: 0644}, nil)
+				case "sub":
+					if path.Dir(req.Path()) == "/file" {
+						req.Rerror("not a directory")
+						break
+					}
+					fallthrough
+				default:
+					req.Rwalk(emptyDir(path.Base(req.Path())), nil)
+				}
+			}
+		}
+	})
+	type result struct {
+		nwqid int
+		ename string
+	}
+	var got []result
+	srv.callback = func(req, rsp styxproto.Msg) {
+		switch rsp := rsp.(type) {
+		case styxproto.Rwalk:
+			got = append(got, result{nwqid: rsp.Nwqid()})
+		case styxproto.Rerror:
+			got = append(got, result{ename: string(rsp.Ename())})
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1, "secret", "a", "b")
+		enc.Twalk(1, 0, 1, "pub", "secret", "b")
+		enc.Twalk(1, 0, 1, "file", "sub")
+		enc.Twalk(1, 0, 1, "file")
+		enc.Twalk(1, 1, 2, "sub", "x")
+	})
+	want := []result{
+		{ename: "permission denied"},
+		{nwqid: 1},
+		{nwqid: 1},
+		{nwqid: 1},
+		{ename: "not a directory"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got responses %v, wanted %v", got, want)
+	}
+	// Nothing after a failed element is walked.
+	wantWalked := []string{"/secret", "/pub", "/pub/secret", "/file", "/file/sub", "/file", "/file/sub"}
+	if !reflect.DeepEqual(walked, wantWalked) {
+		t.Errorf("handler walked %q, wanted %q", walked, wantWalked)
+	}
+}
+
+func TestWalkOpenQid(t *testing.T) {
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	for _, version := range []QidVersion{QidVersionZero, QidVersionWrite, QidVersionMtime} {
+		var qids []styxproto.Qid
+		srv := testServer{test: t}
+		srv.server = &Server{QidVersion: version}
+		srv.handler = HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(timedFile{ownedFile{name: path.Base(req.Path()), mode: 0644}, mtime}, nil)
+				case Topen:
+					req.Ropen(new(closeCounter), nil)
+				case Tstat:
+					req.Rstat(timedFile{ownedFile{name: path.Base(req.Path()), mode: 0644}, mtime}, nil)
+				}
+			}
+		})
+		srv.callback = func(req, rsp styxproto.Msg) {
+			switch rsp := rsp.(type) {
+			case styxproto.Rwalk:
+				qids = append(qids, append(styxproto.Qid(nil), rsp.Wqid(rsp.Nwqid()-1)...))
+			case styxproto.Ropen:
+				qids = append(qids, append(styxproto.Qid(nil), rsp.Qid()...))
+			case styxproto.Rstat:
+				qids = append(qids, append(styxproto.Qid(nil), rsp.Stat().Qid()...))
+			case styxproto.Rerror:
+				t.Errorf("got %v in response to %v", rsp, req)
+			}
+		}
+		srv.runMsg(func(enc *styxproto.Encoder) {
+			enc.Twalk(1, 0, 1, "dir", "file")
+			enc.Tstat(1, 1)
+			enc.Topen(1, 1, styxproto.OREAD)
+			enc.Tstat(1, 1)
+			enc.Twalk(1, 0, 2, "dir", "file")
+		})
+		if len(qids) != 5 {
+			t.Fatalf("got %d qids, wanted 5", len(qids))
+		}
+		for _, qid := range qids[1:] {
+			if !bytes.Equal(qid, qids[0]) {
+				t.Errorf("QidVersion %d: walk, stat, open, stat, and walk gave qids %s", version, qids)
+				break
+			}
+		}
+	}
+}
+
+// A streamReader is an io.Reader that reports each call to Read.
+type streamReader struct {
+	r     io.Reader
+	reads chan int
+}
+
+func (s streamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.reads <- n
+	return n, err
+}
+
+func TestReadAhead(t *testing.T) {
+	const contents = "hello, world"
+	for _, ahead := range []bool{false, true} {
+		stream := streamReader{strings.NewReader(contents), make(chan int, 10)}
+		c := testClient(t, &Server{
+			ReadAhead: ahead,
+			Handler: HandlerFunc(func(s *Session) {
+				for s.Next() {
+					switch req := s.Request().(type) {
+					case Twalk:
+						req.Rwalk(ownedFile{name: "stream", mode: 0444}, nil)
+					case Topen:
+						req.Ropen(stream, nil)
+					}
+				}
+			}),
+		})
+		ctx := context.Background()
+		root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fid, _, err := c.Walk(ctx, root, "stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.Open(ctx, fid, styxproto.OREAD); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		var got []byte
+		for len(got) < 10 {
+			n, err := c.Read(ctx, fid, buf, int64(len(got)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, buf[:n]...)
+		}
+		if string(got) != contents[:10] {
+			t.Errorf("ReadAhead=%v: read %q, wanted %q", ahead, got, contents[:10])
+		}
+
+		// Two reads were asked for. With read-ahead, a third
+		// starts once the second is answered.
+		reads := 0
+		timeout := time.After(250 * time.Millisecond)
+	Wait:
+		for {
+			select {
+			case <-stream.reads:
+				reads++
+			case <-timeout:
+				break Wait
+			}
+			if reads == 3 {
+				break
+			}
+		}
+		if want := map[bool]int{false: 2, true: 3}[ahead]; reads != want {
+			t.Errorf("ReadAhead=%v: stream read %d times, wanted %d", ahead, reads, want)
+		}
+	}
+}
+
+func TestPartialWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	// Enough for the Rversion, and half an Rattach.
+	broken := styxtest.NewConn(server, styxtest.Faults{WriteLimit: 19 + 10})
+	srv := &Server{ErrorLog: testLogger{t}}
+	done := make(chan struct{})
+	go func() {
+		srv.ServeConn(broken)
+		close(done)
+	}()
+	go func() {
+		enc := styxproto.NewEncoder(client)
+		enc.Tversion(styxproto.DefaultMaxSize, "9P2000")
+		enc.Tattach(1, 0, styxproto.NoFid, "", "")
+		enc.Flush()
+	}()
+	// The client sends nothing more, so only the failed write
+	// can end the connection.
+	data := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(client)
+		data <- b
+	}()
+	select {
+	case b := <-data:
+		if len(b) != 29 {
+			t.Errorf("read %d bytes, wanted 29", len(b))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed after a failed write")
+	}
+	<-done
+}
@@ -1,11 +1,14 @@
 package styx
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"context"
 
@@ -25,6 +28,7 @@ type Session struct {
 	// User is the name of the user associated with the session.
 	// When establishing a session, the client provides a username, This
 	// may or may not be authenticated, depending on the Server in use.
+	// Anonymous clients are given Server.AnonymousUser.
 	User string
 
 	// Access is the name of the file tree requested by a client when
@@ -42,6 +46,19 @@ type Session struct {
 	requests chan Request
 	closeMu  sync.Mutex
 
+	// Guarded by closeMu. ended is set by endSession. senders
+	// is the number of calls to sendAsync in progress; the
+	// requests channel is closed once the session has ended
+	// and there are none. ending is closed when the session
+	// ends, to stop them.
+	ended   bool
+	senders int
+	ending  chan struct{}
+
+	// Closed by ClunkAll. Requests are no longer sent to the
+	// handler once it is closed.
+	clunked chan struct{}
+
 	// This is the most recent request processed. It must be cleaned
 	// up with each call to Next().
 	req Request
@@ -53,12 +70,17 @@ type Session struct {
 	// processing it. This channel coordinates that.
 	pipeline chan Request
 
-	// True when the current request is unanswered
-	unhandled bool
+	// Non-zero when the current request is unanswered. A
+	// response may be sent from another goroutine than the
+	// Handler's, so it is accessed atomically.
+	unhandled int32
 
 	// Sends nil once auth is successful, err otherwise.  Closed after
-	// authentication is complete, so can only be used once.
-	authC chan error
+	// authentication is complete, so can only be used once; see
+	// authResult.
+	authC    chan error
+	authOnce sync.Once
+	authErr  error
 
 	// Underlying connection this session takes place on.
 	*conn
@@ -70,6 +92,117 @@ type Session struct {
 
 	// Open (or unopened) files, indexed by fid.
 	files *threadsafe.Map
+
+	// The path that "/" refers to in this session. See
+	// Server.Root.
+	root string
+
+	// The reason Next returned false, if any. See Err.
+	err error
+
+	// The user name given by the client, which may differ
+	// from User. See Server.Attach.
+	uname string
+
+	// The Qid sent to the client in the Rattach message.
+	rootQid styxproto.Qid
+
+	// Information about the root, from Server.RootInfo. If
+	// not nil, it answers Tstat requests for the root.
+	rootInfo os.FileInfo
+
+	// Non-zero if the session is read-only. Shared with the
+	// copies of the Session made by Stack. See SetReadOnly.
+	readOnly *int32
+
+	// True if the session was started by a Tattach request,
+	// rather than a Tauth request. See Attached.
+	attached bool
+
+	// For the copies of a Session made by Stack, the Session
+	// registered with the conn. nil otherwise.
+	orig *Session
+}
+
+// An AttachInfo describes the Tattach request that started a
+// session, and the file tree it was given.
+type AttachInfo struct {
+	// The name of the file tree the client asked for, in the
+	// aname field of its Tattach request.
+	Aname string
+
+	// The path that the root of the session's file tree maps
+	// to, as chosen by Server.Root. It is "/" if Server.Root
+	// is nil.
+	Root string
+
+	// The Qid of the root, sent to the client in the Rattach
+	// response.
+	Qid styxproto.Qid
+}
+
+// Attach reports how the session was attached. It is meant for
+// logging and introspection, so that, for example, an admin can
+// see what each user's session is rooted at.
+func (s *Session) Attach() AttachInfo {
+	return AttachInfo{
+		Aname: s.Access,
+		Root:  s.root,
+		Qid:   s.rootQid,
+	}
+}
+
+// The Attached, Draining, Protocol, and Msize methods report the
+// state of a session, so that a Handler, or code inspecting the
+// sessions returned by Server.Sessions, can act on it. A session
+// moves through these states, and never returns to an earlier one:
+//
+// 	negotiated  The connection's Tversion request has been
+// 	            answered. Protocol and Msize report the result,
+// 	            and do not change. Every Session is at least
+// 	            this far along.
+// 	auth        The session was started by a Tauth request, and
+// 	            serves only the auth file. Attached is false.
+// 	            Tattach requests that use the auth file start
+// 	            sessions of their own.
+// 	attached    The Tattach request was accepted, and the
+// 	            Handler has been started. Attached is true.
+// 	draining    ClunkAll or Close has been called, the
+// 	            connection is closing, or the Server is shutting
+// 	            down. Draining is true; the requests in progress
+// 	            may still be answered, but Next returns false
+// 	            soon, if it has not already.
+
+// Attached reports whether the session was started by a Tattach
+// request. It is false for the session of an auth file, started
+// by a Tauth request.
+func (s *Session) Attached() bool {
+	return s.attached
+}
+
+// Draining reports whether the session is ending: ClunkAll or
+// Close has been called, the connection is closing, or the Server
+// is shutting down. A Handler may use it to avoid starting long
+// work for a client that is going away.
+func (s *Session) Draining() bool {
+	owner := s
+	if s.orig != nil {
+		owner = s.orig
+	}
+	return owner.isClunked() || s.conn.isAborted() ||
+		s.conn.ctx.Err() != nil || s.conn.srv.isDraining()
+}
+
+// Protocol returns the version of 9P negotiated for the session's
+// connection, such as "9P2000" or "9P2000.u".
+func (s *Session) Protocol() string {
+	return s.conn.version
+}
+
+// Msize returns the maximum size of a message on the session's
+// connection, as negotiated with the client.
+func (s *Session) Msize() int64 {
+	return s.conn.msize
 }
 
 // create a new session and register its fid in the conn.
@@ -83,23 +216,60 @@ func newSession(c *conn, m fattach) *Session {
 	s := &Session{
 		User:     string(m.Uname()),
 		Access:   string(m.Aname()),
+		uname:    string(m.Uname()),
 		conn:     c,
 		files:    threadsafe.NewMap(),
 		authC:    make(chan error, 1),
 		requests: make(chan Request),
+		clunked:  make(chan struct{}),
+		root:     "/",
+		readOnly: new(int32),
 	}
 	return s
 }
 
+// authResult waits for the Authenticator started by the session's
+// Tauth request, and returns its result. Unlike a receive from
+// authC, it can be called for every Tattach that uses the afid.
+func (s *Session) authResult() error {
+	s.authOnce.Do(func() {
+		s.authErr = <-s.authC
+	})
+	return s.authErr
+}
+
+// join resolves the path elements in elem relative to base,
+// such that the result never leaves the session's root.
+func (s *Session) join(base string, elem ...string) string {
+	rel := strings.TrimPrefix(base, s.root)
+	rel = path.Join("/", rel, strings.Join(elem, "/"))
+	return path.Join(s.root, rel)
+}
+
+// validName reports whether name may be given to a new file,
+// in a Tcreate request or a rename. From intro(5), a name may
+// not contain a slash, and "." and ".." are reserved.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// statName returns the name sent in the Stat structure for the
+// file at the absolute path name.
+func statName(name string) string {
+	if name = path.Base(name); name == "/" {
+		return "."
+	}
+	return name
+}
+
 func openFlag(mode uint8) int {
 	var flag int
-	if mode&styxproto.OWRITE != 0 {
+	switch mode & 3 {
+	case styxproto.OWRITE:
 		flag = os.O_WRONLY
-	}
-	if mode&styxproto.ORDWR != 0 {
+	case styxproto.ORDWR:
 		flag = os.O_RDWR
-	}
-	if mode&styxproto.OEXEC != 0 {
+	default: // OREAD, OEXEC
 		flag = os.O_RDONLY
 	}
 	if mode&styxproto.OTRUNC != 0 {
@@ -136,22 +306,254 @@ func (s *Session) Next() bool {
 			s.pipeline <- nil
 		}
 	}
-	if s.conn.Flush() != nil {
+	if err := s.conn.Flush(); err != nil {
+		s.err = err
+		return false
+	}
+	if s.isClunked() {
+		s.req = nil
 		return false
 	}
-	s.req, ok = <-s.requests
+	for {
+		select {
+		case s.req, ok = <-s.requests:
+		case <-s.clunked:
+			s.req = nil
+			return false
+		}
+		if t, walk := s.req.(Twalk); !ok || !walk || !t.skip() {
+			break
+		}
+	}
 	if ok {
-		s.unhandled = true
+		atomic.StoreInt32(&s.unhandled, 1)
+	} else {
+		s.err = s.conn.closeErr()
 	}
 	return ok
 }
 
+// ClunkAll closes and forgets every fid in the session, as though
+// the client had clunked them. The Close method of each open file
+// is called once. Later requests from the client that use any of
+// the fids fail with an unknown fid error, and because a session
+// ends when it has no fids left, Next returns false once ClunkAll
+// has been called. ClunkAll can be used to require a client to
+// attach, and authenticate, again, such as when a user logs out.
+func (s *Session) ClunkAll() {
+	var (
+		fids  []uint32
+		files []file
+	)
+	s.files.Do(func(m map[interface{}]interface{}) {
+		for fid, v := range m {
+			delete(m, fid)
+			fids = append(fids, fid.(uint32))
+			files = append(files, v.(file))
+		}
+	})
+
+	// Handlers combined with Stack are given a copy of the
+	// Session; the original is the one registered with the conn.
+	owner := s
+	for _, fid := range fids {
+		if v, ok := s.conn.sessionFid.Get(fid); ok {
+			owner = v.(*Session)
+		}
+		s.conn.sessionFid.Del(fid)
+	}
+	for _, file := range files {
+		if file.rwc != nil {
+			if err := file.rwc.Close(); err != nil {
+				s.conn.srv.logf("close %s: %v", file.name, err)
+			}
+		}
+	}
+	if owner.clunked != nil {
+		owner.closeMu.Lock()
+		if !owner.isClunked() {
+			close(owner.clunked)
+		}
+		owner.closeMu.Unlock()
+	}
+}
+
+// Close ends the session by closing the connection it takes place
+// on. Outstanding requests are answered with an error, Next returns
+// false, and the open files of every session on the connection are
+// closed once their handlers return. Calling Close on a session that
+// has already ended does nothing.
+func (s *Session) Close() {
+	s.conn.abort(errSessionClosed)
+}
+
+// SetReadOnly sets whether the session is read-only. The Twrite,
+// Tcreate, Tremove, and Twstat requests of a read-only session, and
+// its Topen requests that would write to or truncate a file, are
+// answered with a permission error, and never reach the Handler.
+// Writes to the auth file are still allowed. A Handler may call
+// SetReadOnly before its first call to Next to apply a policy
+// chosen when the user authenticated, such as one based on
+// the session's User.
+func (s *Session) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(s.readOnly, v)
+}
+
+// ReadOnly reports whether the session is read-only. See
+// SetReadOnly.
+func (s *Session) ReadOnly() bool {
+	return atomic.LoadInt32(s.readOnly) != 0
+}
+
+// denyReadOnly answers msg with a permission error, and reports
+// true, if the session is read-only.
+func (s *Session) denyReadOnly(msg styxproto.Msg) bool {
+	if !s.ReadOnly() {
+		return false
+	}
+	s.conn.clearTag(msg.Tag())
+	s.conn.sendError(msg.Tag(), os.ErrPermission)
+	s.conn.Flush()
+	return true
+}
+
+// setHandled records that the current request has been answered.
+func (s *Session) setHandled() {
+	atomic.StoreInt32(&s.unhandled, 0)
+}
+
+func (s *Session) isClunked() bool {
+	select {
+	case <-s.clunked:
+		return true
+	default:
+		return false
+	}
+}
+
+// send passes req to the session's handler. If ClunkAll has been
+// called, the handler is no longer reading requests, and req is
+// given its default response instead.
+func (s *Session) send(req Request) {
+	select {
+	case s.requests <- req:
+	case <-s.clunked:
+		req.defaultResponse()
+		s.conn.Flush()
+	}
+}
+
+// sendAsync is like send, for requests made by the styx package
+// from a goroutine other than the serve loop, which may run after
+// the session has ended. It reports false, without sending req or
+// answering it, if the session ends first.
+func (s *Session) sendAsync(req Request) bool {
+	s.closeMu.Lock()
+	if s.ended {
+		s.closeMu.Unlock()
+		return false
+	}
+	if s.ending == nil {
+		s.ending = make(chan struct{})
+	}
+	ending := s.ending
+	s.senders++
+	s.closeMu.Unlock()
+
+	sent := true
+	select {
+	case s.requests <- req:
+	case <-s.clunked:
+		req.defaultResponse()
+		s.conn.Flush()
+	case <-ending:
+		sent = false
+	}
+
+	s.closeMu.Lock()
+	if s.senders--; s.ended && s.senders == 0 {
+		close(s.requests)
+	}
+	s.closeMu.Unlock()
+	return sent
+}
+
+// goAsync runs fn on a new goroutine, for a request that must wait
+// for the handler to answer another, made by the styx package,
+// before it can be handled. Waiting in the serve loop would stop it
+// reading any other message, including a Tflush for the request.
+// The session is kept from ending, by the client clunking its last
+// fid, until fn returns.
+func (s *Session) goAsync(fn func()) {
+	s.IncRef()
+	go func() {
+		defer func() {
+			if !s.DecRef() {
+				s.endSession()
+			}
+		}()
+		fn()
+	}()
+}
+
+// forget removes fid from the session. It reports false if the
+// fid was already removed, such as by ClunkAll.
+func (s *Session) forget(fid uint32) bool {
+	var ok bool
+	s.files.Do(func(m map[interface{}]interface{}) {
+		_, ok = m[fid]
+		delete(m, fid)
+	})
+	return ok
+}
+
+// Err returns the error, if any, that ended the session. It is
+// only meaningful once Next has returned false. Err returns nil if
+// the session ended normally, because the client clunked all of its
+// fids or closed the connection. Otherwise, it returns the transport
+// or protocol error that ended the session, such as a failed write
+// to the connection, a client re-using a tag, or the error returned
+// by a HandlerErr passed to CloseOnError.
+func (s *Session) Err() error {
+	return s.err
+}
+
+// RespondRaw sends m to the client, in response to a message that
+// was passed to Server.UnknownHandler. m must be a complete 9P
+// message, with the same tag as the message it answers. RespondRaw
+// should only be called before UnknownHandler returns, and at most
+// once per message.
+func (s *Session) RespondRaw(m styxproto.RawMessage) {
+	if s.conn.clearTag(m.Tag()) {
+		s.conn.Raw(m)
+	}
+}
+
 // Request returns the last 9P message received by the Session. It is only
 // valid until the next call to Next.
 func (s *Session) Request() Request {
 	return s.req
 }
 
+// RawRequest returns the 9P message that produced the current
+// request, exactly as it was received from the client. The slice
+// is borrowed, and is only valid until the next call to Next; it
+// must be copied to be retained. A message that produces more than
+// one request, such as a Twalk of several path elements or a Twstat
+// changing several fields, is returned for each of its requests.
+// The result may be converted to a styxproto.RawMessage to read its
+// header. RawRequest returns nil if there is no current request.
+func (s *Session) RawRequest() []byte {
+	if s.req == nil {
+		return nil
+	}
+	return s.req.rawRequest()
+}
+
 // When multiple Handlers are combined together using Stack, a handler may
 // modify the incoming request using the UpdateRequest method.  The current
 // request will be overwritten with r, and reflected in calls to the Request
@@ -187,8 +589,13 @@ func (s *Session) handleTwalk(ctx context.Context, msg styxproto.Twalk, file fil
 	// side effects.
 	if msg.Nwname() == 0 {
 		if newfid != msg.Fid() {
+			if !s.conn.sessionFid.Add(newfid, s) {
+				s.conn.clearTag(msg.Tag())
+				s.conn.Rerror(msg.Tag(), "Twalk: fid %x already in use", newfid)
+				s.conn.Flush()
+				return true
+			}
 			s.files.Put(newfid, file)
-			s.conn.sessionFid.Put(newfid, s)
 			s.IncRef()
 		}
 		s.conn.clearTag(msg.Tag())
@@ -205,12 +612,20 @@ func (s *Session) handleTwalk(ctx context.Context, msg styxproto.Twalk, file fil
 	walker := newWalker(s, ctx, msg, file.name, elem...)
 
 	for i := range elem {
-		fullpath := path.Join(file.name, strings.Join(elem[:i+1], "/"))
-		s.requests <- Twalk{
+		if walker.dot[i] {
+			continue
+		}
+		// The elements are handled in order, so any that
+		// failed came before this one.
+		if atomic.LoadInt32(&walker.failed) != 0 {
+			break
+		}
+		fullpath := s.join(file.name, elem[:i+1]...)
+		s.send(Twalk{
 			index:   i,
 			walk:    walker,
 			reqInfo: newReqInfo(ctx, s, msg, fullpath),
-		}
+		})
 	}
 	return true
 }
@@ -223,14 +638,68 @@ func (s *Session) handleTopen(ctx context.Context, msg styxproto.Topen, file fil
 		return true
 	}
 	flag := openFlag(msg.Mode())
-	s.requests <- Topen{
+	if (writable(flag) || flag&os.O_TRUNC != 0) && s.denyReadOnly(msg) {
+		return true
+	}
+	info := newReqInfo(ctx, s, msg, file.name)
+
+	// open(5): it is illegal to write a directory or to
+	// truncate it.
+	qid := s.conn.qid(file.name, 0)
+	if qid.Type()&styxproto.QTDIR != 0 && (writable(flag) || flag&os.O_TRUNC != 0) {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "cannot open directory %s for writing", file.name)
+		s.conn.Flush()
+		return true
+	}
+
+	open := Topen{
 		Flag:    flag,
-		reqInfo: newReqInfo(ctx, s, msg, file.name),
+		reqInfo: info,
+		rclose:  msg.Mode()&styxproto.ORCLOSE != 0,
 	}
+	if flag&os.O_TRUNC == 0 {
+		s.send(open)
+		return true
+	}
+
+	// If OTRUNC is set, the file is to be truncated, which
+	// requires write permission. We reuse the handler's
+	// Ttruncate logic, and only open the file if it succeeds.
+	tag := msg.Tag()
+	s.goAsync(func() {
+		status := make(chan error, 1)
+		if !s.sendAsync(Ttruncate{
+			Size:   0,
+			twstat: twstat{status, make([]int32, 1), 0, info},
+		}) {
+			info.done()
+			return
+		}
+		select {
+		case err := <-status:
+			if err != nil {
+				if info.clearTag() {
+					s.conn.sendError(tag, err)
+					s.conn.Flush()
+				}
+				return
+			}
+		case <-ctx.Done():
+			info.done()
+			return
+		}
+		if !s.sendAsync(open) {
+			info.done()
+		}
+	})
 	return true
 }
 
 func (s *Session) handleTcreate(ctx context.Context, msg styxproto.Tcreate, file file) bool {
+	if s.denyReadOnly(msg) {
+		return true
+	}
 	qid := s.conn.qid(file.name, 0)
 	if qid.Type()&styxproto.QTDIR == 0 {
 		s.conn.clearTag(msg.Tag())
@@ -238,50 +707,140 @@ func (s *Session) handleTcreate(ctx context.Context, msg styxproto.Tcreate, file
 		s.conn.Flush()
 		return true
 	}
-	s.requests <- Tcreate{
+	if name := string(msg.Name()); !validName(name) {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "invalid file name %q", name)
+		s.conn.Flush()
+		return true
+	}
+	s.send(Tcreate{
 		Name:    string(msg.Name()),
-		Mode:    styxfile.ModeOS(msg.Perm()),
+		Mode:    s.conn.createPerm(file.name, styxfile.ModeOS(msg.Perm()&^styxproto.DMSYMLINK)),
 		Flag:    openFlag(msg.Mode()),
 		reqInfo: newReqInfo(ctx, s, msg, file.name),
-	}
+		rclose:  msg.Mode()&styxproto.ORCLOSE != 0,
+	})
 	return true
 }
 
 func (s *Session) handleTremove(ctx context.Context, msg styxproto.Tremove, file file) bool {
-	s.requests <- Tremove{
+	if s.ReadOnly() {
+		return s.removeFailed(msg.Tag(), msg.Fid(), file, os.ErrPermission)
+	}
+	if !s.conn.canRemove(file.name, s.User) {
+		return s.removeFailed(msg.Tag(), msg.Fid(), file, fmt.Errorf("permission denied: cannot write to %s", path.Dir(file.name)))
+	}
+	remove := Tremove{
 		reqInfo: newReqInfo(ctx, s, msg, file.name),
 	}
+	if !s.conn.srv.EnforceRmdirEmpty || s.conn.qid(file.name, 0).Type()&styxproto.QTDIR == 0 {
+		s.send(remove)
+		return true
+	}
+
+	// The directory is listed first, to see if it is empty.
+	info := newReqInfo(ctx, s, msg, file.name)
+	s.goAsync(func() {
+		status := make(chan error, 1)
+		if !s.sendAsync(Topen{
+			Flag:    os.O_RDONLY,
+			reqInfo: info,
+			empty:   status,
+		}) {
+			info.done()
+			remove.done()
+			return
+		}
+		select {
+		case err := <-status:
+			info.done()
+			if err == errNotEmpty {
+				remove.done()
+				s.removeFailed(remove.tag, remove.fid, file, err)
+				return
+			}
+		case <-ctx.Done():
+			info.done()
+			remove.done()
+			return
+		}
+		if !s.sendAsync(remove) {
+			remove.done()
+		}
+	})
+	return true
+}
+
+// removeFailed answers a Tremove request that is refused before
+// it reaches the Handler. As with Tclunk, the fid is gone even
+// though the remove failed. See remove(5). No response is sent if
+// the request has been flushed.
+func (s *Session) removeFailed(tag uint16, fid uint32, file file, err error) bool {
+	defer s.conn.Flush()
+	answer := s.conn.clearTag(tag)
+	if !s.forget(fid) {
+		if answer {
+			s.conn.Rerror(tag, "%s", errNoFid)
+		}
+		return true
+	}
+	s.conn.sessionFid.Del(fid)
+	if file.rwc != nil {
+		file.rwc.Close()
+	}
+	if answer {
+		s.conn.sendError(tag, err)
+	}
+	if !s.DecRef() {
+		s.endSession()
+	}
 	return true
 }
 
 func (s *Session) handleTstat(ctx context.Context, msg styxproto.Tstat, file file) bool {
-	buf := make([]byte, styxproto.MaxStatLen)
+	buf := make([]byte, styxproto.MaxStatLenU)
 	if file.auth {
-		stat, _, err := styxproto.NewStat(buf, "", "", "", "")
+		// The auth file belongs to the user authenticating,
+		// and has the Qid sent in the Rauth message.
+		stat, err := styxfile.NewStat(buf, "auth", s.User, s.User, s.User, "", s.conn.dotu)
+		s.conn.clearTag(msg.Tag())
 		if err != nil {
-			// input is not user-controlled, this should
-			// never happen
-			panic(err)
+			s.conn.sendError(msg.Tag(), err)
+		} else {
+			stat.SetMode(styxproto.DMAUTH | 0600)
+			stat.SetQid(s.conn.qid("auth", styxproto.QTAUTH))
+			s.conn.Rstat(msg.Tag(), stat)
 		}
-		stat.SetMode(styxproto.DMAUTH)
-		stat.SetQid(s.conn.qid("", styxproto.QTAUTH))
-		s.conn.clearTag(msg.Tag())
-		s.conn.Rstat(msg.Tag(), stat)
 		s.conn.Flush()
 	} else if file.rwc != nil {
 		s.conn.clearTag(msg.Tag())
 		if qid, ok := s.conn.qidpool.Get(file.name); !ok {
 			s.conn.Rerror(msg.Tag(), "qid for %s not found", file.name)
-		} else if stat, err := styxfile.Stat(buf, file.rwc, file.name, qid); err != nil {
-			s.conn.Rerror(msg.Tag(), "%s", err)
+		} else if stat, err := styxfile.Stat(buf, file.rwc, statName(file.name), qid, s.conn.statConfig()); err != nil {
+			s.conn.sendError(msg.Tag(), err)
+		} else {
+			// The file's Qid was established when it was walked
+			// to, and is only updated from a real mtime.
+			if styxfile.HasModTime(file.rwc) {
+				mtime := time.Unix(int64(stat.Mtime()), 0)
+				stat.SetQid(s.conn.qidMtime(file.name, qid.Type(), mtime))
+			}
+			s.conn.Rstat(msg.Tag(), stat)
+		}
+		s.conn.Flush()
+	} else if file.name == s.root && s.rootInfo != nil {
+		stat, err := s.fileStat(file.name, s.rootInfo)
+		s.conn.clearTag(msg.Tag())
+		if err != nil {
+			s.conn.sendError(msg.Tag(), err)
 		} else {
 			s.conn.Rstat(msg.Tag(), stat)
 		}
 		s.conn.Flush()
 	} else {
-		s.requests <- Tstat{
+		s.send(Tstat{
 			reqInfo: newReqInfo(ctx, s, msg, file.name),
-		}
+		})
 	}
 	return true
 }
@@ -295,22 +854,62 @@ func (s *Session) handleTread(ctx context.Context, msg styxproto.Tread, file fil
 		s.conn.Flush()
 		return true
 	}
+	if !readable(file.flag) {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "file %s is open write-only", file.name)
+		s.conn.Flush()
+		return true
+	}
+	if !validRange(msg.Offset(), msg.Count()) {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "bad offset")
+		s.conn.Flush()
+		return true
+	}
+	// Clients expect a directory read to return an integral
+	// number of Stat structures; anything else is garbage to
+	// them.
+	if file.dir && !styxfile.IsDir(file.rwc) {
+		s.conn.srv.logf("%s is a directory, but has no directory listing", file.name)
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "cannot read directory %s", file.name)
+		s.conn.Flush()
+		return true
+	}
+	// A read of zero bytes needs no I/O, so the file is left
+	// alone.
+	if msg.Count() == 0 {
+		if s.conn.clearTag(msg.Tag()) {
+			s.conn.Rread(msg.Tag(), nil)
+			s.conn.Flush()
+		}
+		return true
+	}
 
+	// msg is only valid until the next message is read from
+	// the connection, so copy what we need before returning.
+	tag, offset, count := msg.Tag(), msg.Offset(), msg.Count()
+	release := s.conn.hold(ctx)
 	go func() {
+		defer release()
 		// TODO(droyo) allocations could hurt here, come up with a better
 		// way to do this (after measuring the impact, of course). The tricky bit
 		// here is inherent to the 9P protocol; rather than using sentinel values,
 		// each message is prefixed with its length. While this is generally a Good
 		// Thing, this means we can't write directly to the connection, because
 		// we don't know how much we are going to write until it's too late.
-		buf := make([]byte, int(msg.Count()))
+		buf := make([]byte, int(count))
 
 		if t, ok := ctx.Deadline(); ok {
 			styxfile.SetDeadline(file.rwc, t)
 		}
+		// The ReadAt call may outlive a flush, and holds on
+		// to the request's slot until it returns.
+		releaseRead := s.conn.hold(ctx)
 		done := make(chan struct{})
 		go func() {
-			n, err = file.rwc.ReadAt(buf, msg.Offset())
+			defer releaseRead()
+			n, err = file.rwc.ReadAt(buf, offset)
 			close(done)
 		}()
 		select {
@@ -321,18 +920,30 @@ func (s *Session) handleTread(ctx context.Context, msg styxproto.Tread, file fil
 			// on a file will disrupt any current and future reads on the
 			// same fid. However, that is preferrable to leaking goroutines.
 			file.rwc.Close()
-			s.conn.clearTag(msg.Tag())
+			s.conn.dropTag(tag)
 			return
 		case <-done:
 		}
+		if s.conn.readLimit.Wait(ctx, n) != nil {
+			// flushed or the connection is closing
+			s.conn.dropTag(tag)
+			return
+		}
 
-		s.conn.clearTag(msg.Tag())
+		if !s.conn.clearTag(tag) {
+			return
+		}
 		if n > 0 {
-			s.conn.Rread(msg.Tag(), buf[:n])
+			s.conn.Rread(tag, buf[:n])
+		} else if file.dir && err == styxfile.ErrNoSeek {
+			// From read(5): reading a directory at any offset
+			// other than 0 or the end of the previous read is
+			// an error.
+			s.conn.Rerror(tag, "bad offset %d in directory read", offset)
 		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-			s.conn.Rerror(msg.Tag(), "%v", err)
+			s.conn.sendError(tag, err)
 		} else {
-			s.conn.Rread(msg.Tag(), buf[:n])
+			s.conn.Rread(tag, buf[:n])
 		}
 		s.conn.Flush()
 	}()
@@ -346,55 +957,189 @@ func (s *Session) handleTwrite(ctx context.Context, msg styxproto.Twrite, file f
 		s.conn.Flush()
 		return true
 	}
+	if !writable(file.flag) {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "file %q is open read-only", file.name)
+		s.conn.Flush()
+		return true
+	}
+	if !validRange(msg.Offset(), msg.Count()) {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "bad offset")
+		s.conn.Flush()
+		return true
+	}
+	if !file.auth && s.denyReadOnly(msg) {
+		return true
+	}
+	if file.dir {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "cannot write to directory")
+		s.conn.Flush()
+		return true
+	}
+	// The data has not been read yet; if the write is
+	// refused, the Decoder skips over it.
+	if wc, ok := writeChecker(file.rwc); ok {
+		if err := wc.CheckWrite(msg.Offset(), msg.Count()); err != nil {
+			s.conn.clearTag(msg.Tag())
+			s.conn.sendError(msg.Tag(), err)
+			s.conn.Flush()
+			return true
+		}
+	}
+
+	if s.conn.writeLimit != nil || s.conn.srv.OutOfOrder {
+		return s.handleTwriteAsync(ctx, msg, file)
+	}
 
 	// BUG(droyo): cancellation of write requests is not yet implemented.
 	w := util.NewSectionWriter(file.rwc, msg.Offset(), msg.Count())
 	n, err := io.Copy(w, msg)
 	s.conn.clearTag(msg.Tag())
 	if n == 0 && err != nil {
-		s.conn.Rerror(msg.Tag(), "%v", err)
+		s.conn.sendError(msg.Tag(), err)
 	} else {
+		s.conn.modified(file.name)
+		file.changed()
 		s.conn.Rwrite(msg.Tag(), n)
 	}
 	s.conn.Flush()
 	return true
 }
 
+// When Server.WriteLimit is set, a Twrite may have to wait for
+// its turn. We cannot wait in the serve loop, or a Tflush for
+// the write would never be read, so the data is read into memory
+// and written out from another goroutine. The same is done for
+// every Twrite when Server.OutOfOrder is set, so that a slow
+// write does not hold up the requests behind it. Writes to the
+// same fid are made one at a time, in the order they arrived.
+func (s *Session) handleTwriteAsync(ctx context.Context, msg styxproto.Twrite, file file) bool {
+	tag, offset := msg.Tag(), msg.Offset()
+	buf := make([]byte, int(msg.Count()))
+	if _, err := io.ReadFull(msg, buf); err != nil {
+		// The connection is broken; the serve loop will
+		// find out soon enough.
+		s.conn.dropTag(tag)
+		return true
+	}
+	release := s.conn.hold(ctx)
+	prev, done := file.writes.next()
+	go func() {
+		defer release()
+		defer done()
+		if prev != nil {
+			<-prev
+		}
+		if s.conn.writeLimit.Wait(ctx, len(buf)) != nil {
+			// flushed or the connection is closing
+			s.conn.dropTag(tag)
+			return
+		}
+		w := util.NewSectionWriter(file.rwc, offset, int64(len(buf)))
+		n, err := w.Write(buf)
+		if !s.conn.clearTag(tag) {
+			return
+		}
+		if n == 0 && err != nil {
+			s.conn.sendError(tag, err)
+		} else {
+			s.conn.modified(file.name)
+			file.changed()
+			s.conn.Rwrite(tag, int64(n))
+		}
+		s.conn.Flush()
+	}()
+	return true
+}
+
 func (s *Session) handleTclunk(ctx context.Context, msg styxproto.Tclunk, file file) bool {
 	defer s.conn.Flush()
+	if !s.forget(msg.Fid()) {
+		s.conn.clearTag(msg.Tag())
+		s.conn.Rerror(msg.Tag(), "%s", errNoFid)
+		return true
+	}
 	s.conn.sessionFid.Del(msg.Fid())
-	s.conn.clearTag(msg.Tag())
-	s.files.Del(msg.Fid())
+	// See clunk(5): even if the clunk returns an error, the fid
+	// is no longer valid, so there is little the client can do with
+	// a failure. Log it and tell the client it succeeded.
 	if file.rwc != nil {
 		if err := file.rwc.Close(); err != nil {
-			s.conn.Rerror(msg.Tag(), "close %s: %v", file.name, err)
-		} else {
-			s.conn.Rclunk(msg.Tag())
+			s.conn.srv.logf("close %s: %v", file.name, err)
 		}
-	} else {
+	}
+	if file.rclose {
+		s.removeOnClunk(ctx, msg, file)
+	}
+	if s.conn.clearTag(msg.Tag()) {
 		s.conn.Rclunk(msg.Tag())
 	}
-	s.conn.Flush()
 	if !s.DecRef() {
 		s.endSession()
 	}
 	return true
 }
 
+// removeOnClunk asks the handler to remove a file opened with
+// ORCLOSE, whose fid is being clunked. The Tclunk is answered
+// without waiting for the remove, which outlives it; failures
+// are logged, and the clunk succeeds regardless.
+func (s *Session) removeOnClunk(ctx context.Context, msg styxproto.Tclunk, file file) {
+	if s.ReadOnly() || !s.conn.canRemove(file.name, s.User) {
+		s.conn.srv.logf("remove %s on clunk: permission denied", file.name)
+		return
+	}
+	// The Tclunk's context is cancelled when it is answered, so
+	// the remove gets one that is cancelled only with the
+	// connection.
+	ctx, cancel := context.WithCancel(clunkContext{s.conn.ctx, ctx})
+	info := newReqInfo(ctx, s, msg, file.name)
+	s.goAsync(func() {
+		defer cancel()
+		defer info.done()
+		status := make(chan error, 1)
+		if !s.sendAsync(Tremove{reqInfo: info, status: status}) {
+			return
+		}
+		select {
+		case err := <-status:
+			if err != nil {
+				s.conn.srv.logf("remove %s on clunk: %v", file.name, err)
+			}
+		case <-ctx.Done():
+		}
+	})
+}
+
+// A clunkContext is done when its Context is, but has the values
+// of another.
+type clunkContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c clunkContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
+
 // Called when there are no more fids associated with this
 // session. The handler is still running and we must notify
 // it.
 func (s *Session) endSession() {
 	s.closeMu.Lock()
-	select {
-	case _, ok := <-s.requests:
-		if ok {
-			close(s.requests)
-		}
-	default:
+	defer s.closeMu.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+	if s.ending != nil {
+		close(s.ending)
+	}
+	if s.senders == 0 {
 		close(s.requests)
 	}
-	s.closeMu.Unlock()
 }
 
 // Called when Serve9P exits. Any in-flight requests
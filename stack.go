@@ -1,5 +1,7 @@
 package styx
 
+import "context"
+
 // Stack combines multiple handlers into one. When a new message is received
 // from the client, it is passed to each handler, from left to right, until a
 // response is sent. If no response is sent.  by any handlers in the stack,
@@ -14,7 +16,44 @@ func Stack(handlers ...Handler) Handler {
 
 type stack []Handler
 
+// Union combines multiple handlers into layers of one file tree,
+// like a union directory in Plan 9. Requests are passed to each
+// handler, from left to right, as with Stack, and in addition, a
+// handler's response to a Twalk, Topen or Tstat request with an
+// error matching os.ErrNotExist is discarded, and the request passed
+// to the next handler, unless it is the last. A file therefore
+// comes from the first layer that has it. Requests that modify the
+// tree go to the first layer that answers them, so read-only layers
+// such as FileSystem should leave them unanswered.
+//
+// Fids and Qids are kept by the Server, by path, so a file has the
+// same Qid whichever layer it is found in. A directory that exists
+// in several layers is listed by the first of them alone; its
+// entries are not merged.
+func Union(handlers ...Handler) Handler {
+	h := make([]Handler, len(handlers))
+	copy(h, handlers)
+	return union(h)
+}
+
+type union []Handler
+
+func (handlers union) Serve9P(s *Session) {
+	stack(handlers).serve(s, true)
+}
+
 func (handlers stack) Serve9P(s *Session) {
+	handlers.serve(s, false)
+}
+
+// The Context value of a request passed to a layer of a Union; true
+// for every layer but the last. See reqInfo.passOn.
+type unionKey struct{}
+
+// serve passes the requests of s through each handler in turn. If
+// union is true, all but the last handler pass on requests for files
+// they do not have.
+func (handlers stack) serve(s *Session, union bool) {
 	running := make([]Session, len(handlers))
 	for i, handler := range handlers {
 		sub := &running[i]
@@ -24,8 +63,14 @@ func (handlers stack) Serve9P(s *Session) {
 		sub.pipeline = make(chan Request)
 		sub.authC = s.authC
 		sub.conn = s.conn
-		sub.RefCount = s.RefCount
 		sub.files = s.files
+		sub.root = s.root
+		sub.readOnly = s.readOnly
+		sub.attached = s.attached
+		sub.orig = s
+		if s.orig != nil {
+			sub.orig = s.orig
+		}
 		go func(h Handler) {
 			h.Serve9P(sub)
 			close(sub.pipeline)
@@ -35,6 +80,10 @@ func (handlers stack) Serve9P(s *Session) {
 		req := s.Request()
 		for i := range running {
 			session := &running[i]
+			if union {
+				more := i < len(running)-1
+				req = req.WithContext(context.WithValue(req.Context(), unionKey{}, more))
+			}
 			req.setSession(session)
 			session.requests <- req
 			if next, ok := <-session.pipeline; !ok {
@@ -43,7 +92,7 @@ func (handlers stack) Serve9P(s *Session) {
 			} else if next == nil {
 				// The request has been handled, no point
 				// in passing it down the chain.
-				s.unhandled = false
+				s.setHandled()
 				break
 			} else {
 				req = next
@@ -0,0 +1,121 @@
+package styx
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"context"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+// A createLayer accepts Tcreate requests, and has no files.
+type createLayer struct {
+	created chan string
+}
+
+func (l createLayer) Serve9P(s *Session) {
+	for s.Next() {
+		switch req := s.Request().(type) {
+		case Twalk:
+			req.Rwalk(nil, os.ErrNotExist)
+		case Tcreate:
+			l.created <- req.NewPath()
+			req.Rcreate(memFile{req.Name, nil}, nil)
+		}
+	}
+}
+
+func TestUnion(t *testing.T) {
+	upper := FileSystem(map[string][]byte{
+		"only-upper": []byte("upper"),
+		"shared":     []byte("shared, from upper"),
+	})
+	lower := FileSystem(map[string][]byte{
+		"only-lower": []byte("lower"),
+		"shared":     []byte("shared, from lower"),
+		"dir/file":   []byte("lower dir"),
+	})
+	writable := createLayer{make(chan string, 1)}
+	c := testClient(t, &Server{Handler: Union(upper, lower, writable)})
+	ctx := context.Background()
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(names ...string) string {
+		fid, _, err := c.Walk(ctx, root, names...)
+		if err != nil {
+			t.Fatalf("walk %v: %s", names, err)
+		}
+		defer c.Clunk(ctx, fid)
+		if _, _, err := c.Open(ctx, fid, styxproto.OREAD); err != nil {
+			t.Fatalf("open %v: %s", names, err)
+		}
+		buf := make([]byte, 100)
+		n, err := c.Read(ctx, fid, buf, 0)
+		if err != nil && err != io.EOF {
+			t.Fatalf("read %v: %s", names, err)
+		}
+		return string(buf[:n])
+	}
+	for _, tt := range []struct {
+		names []string
+		want  string
+	}{
+		{[]string{"only-upper"}, "upper"},
+		{[]string{"only-lower"}, "lower"},
+		{[]string{"shared"}, "shared, from upper"},
+		{[]string{"dir", "file"}, "lower dir"},
+	} {
+		if got := read(tt.names...); got != tt.want {
+			t.Errorf("read %q from %v, wanted %q", got, tt.names, tt.want)
+		}
+	}
+
+	// Unopened files are stat'd by the layer they are in.
+	fid, qids, err := c.Walk(ctx, root, "only-lower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := c.Stat(ctx, fid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stat.Name()) != "only-lower" || stat.Length() != int64(len("lower")) {
+		t.Errorf("bad stat %s", stat)
+	}
+	if !stat.Qid().Equal(qids[0]) {
+		t.Errorf("stat has qid %s, walk had %s", stat.Qid(), qids[0])
+	}
+
+	if _, qids, err := c.Walk(ctx, root, "dir", "nonexistent"); err == nil {
+		t.Error("walked to a file in no layer")
+	} else if len(qids) != 1 {
+		t.Errorf("walk to dir/nonexistent returned %d qids, wanted 1", len(qids))
+	}
+
+	// The read-only layers leave Tcreate to the writable one.
+	srv := testServer{test: t, handler: Union(upper, lower, writable)}
+	srv.callback = func(req, rsp styxproto.Msg) {
+		if _, ok := req.(styxproto.Tcreate); !ok {
+			return
+		}
+		if _, ok := rsp.(styxproto.Rcreate); !ok {
+			t.Errorf("got %s in response to %s", rsp, req)
+		}
+	}
+	srv.runMsg(func(enc *styxproto.Encoder) {
+		enc.Twalk(1, 0, 1)
+		enc.Tcreate(1, 1, "new", 0644, styxproto.OWRITE)
+	})
+	select {
+	case got := <-writable.created:
+		if got != "/new" {
+			t.Errorf("created %q, wanted /new", got)
+		}
+	default:
+		t.Error("writable layer did not receive Tcreate")
+	}
+}
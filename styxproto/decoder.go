@@ -35,6 +35,34 @@ func NewDecoderSize(r io.Reader, bufsize int) *Decoder {
 	return &Decoder{r: r, br: bufio.NewReaderSize(r, bufsize), MaxSize: -1}
 }
 
+// Unmarshal parses a single, complete 9P message from data. It
+// is intended for message-oriented transports, where each frame
+// holds exactly one 9P message. If data holds less than the full
+// message, Unmarshal returns io.ErrUnexpectedEOF. If there are
+// bytes left over after the message, or the message is invalid,
+// a non-nil error is returned. A message of unknown type is
+// returned as a RawMessage. The returned Msg refers to data
+// and is only valid while data is not modified.
+func Unmarshal(data []byte) (Msg, error) {
+	if len(data) < minMsgSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	m := msg(data)
+	err := verifySizeAndType(m)
+	if err != nil && err != errInvalidMsgType {
+		return nil, err
+	}
+	if n := m.Len(); int64(len(data)) < n {
+		return nil, io.ErrUnexpectedEOF
+	} else if int64(len(data)) > n {
+		return nil, errTrailingData
+	}
+	if err == errInvalidMsgType {
+		return RawMessage(data), nil
+	}
+	return parseMsg(m.Type(), m, nil)
+}
+
 // A Decoder provides an interface for reading a stream of 9P
 // messages from an io.Reader. Successive calls to the Next
 // method of a Decoder will fetch and validate 9P messages
@@ -68,7 +96,11 @@ type Decoder struct {
 	err error
 }
 
-// Reset resets a Decoder with a new io.Reader.
+// Reset resets a Decoder with a new io.Reader, so that it can be
+// reused for another connection. Any data buffered from the old
+// reader, including a partially read message, is discarded, and
+// the Decoder's error and MaxSize are cleared, as if it had been
+// created by NewDecoder.
 func (s *Decoder) Reset(r io.Reader) {
 	s.MaxSize = -1
 	s.r = r
@@ -87,6 +119,7 @@ func (s *Decoder) Reset(r io.Reader) {
 //
 // Invalid messages are not considered errors, and are
 // represented in the Messages slice as values of type BadMessage.
+// Messages of unknown type are represented as a RawMessage.
 // Only problems with the underlying io.Reader are
 // considered errors.
 func (s *Decoder) Err() error {
@@ -192,7 +225,12 @@ func (s *Decoder) fill(n int) error {
 	if maxInt-n < s.pos {
 		return errFillOverflow
 	}
-	_, err := s.br.Peek(s.pos + n)
+	buf, err := s.br.Peek(s.pos + n)
+	if err == io.EOF && len(buf) > 0 {
+		// Messages are consumed from the buffer once
+		// read, so this is part of an incomplete message.
+		err = io.ErrUnexpectedEOF
+	}
 	return err
 }
 
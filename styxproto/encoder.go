@@ -18,13 +18,53 @@ type Encoder struct {
 
 // NewEncoder creates a new Encoder that writes 9P messages
 // to w. Encoders are safe to use from multiple goroutines.
-// An Encoder does not perform any buffering of messages.
+// Messages are buffered, and are only written to w when
+// Flush is called or the Encoder's buffer is full. A client
+// that pipelines several requests can encode them one after
+// another and call Flush once to send them in a single write.
+//
+// A message is only ever partly written to w if w returns an
+// error, after which the Encoder writes nothing more; see Err.
+// Short writes without an error are retried with the rest of the
+// data.
 func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{
-		w: bufio.NewWriterSize(w, MinBufSize),
+		w: bufio.NewWriterSize(fullWriter{w}, MinBufSize),
 	}
 }
 
+// A fullWriter retries short writes that did not return an
+// error. Writes that make no progress fail with io.ErrShortWrite.
+type fullWriter struct {
+	w io.Writer
+}
+
+func (fw fullWriter) Write(p []byte) (int, error) {
+	var written int
+	for written < len(p) {
+		n, err := fw.w.Write(p[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// Reset discards any unflushed data and any previous error, and
+// sets the Encoder to write to w, so that it can be reused for
+// another connection. MaxSize is cleared, as if the Encoder had
+// been created by NewEncoder.
+func (enc *Encoder) Reset(w io.Writer) {
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+	enc.MaxSize = 0
+	enc.w.Reset(fullWriter{w})
+}
+
 // Err returns the first error encountered by an Encoder
 // when writing data to its underlying io.Writer.
 func (enc *Encoder) Err() error {
@@ -154,6 +194,28 @@ func (enc *Encoder) Rerror(tag uint16, errfmt string, v ...interface{}) {
 	pstring(enc.w, ename)
 }
 
+// Rerroru writes a new 9P2000.u Rerror message to the underlying
+// io.Writer. In addition to the error string, a 9P2000.u Rerror
+// message carries a unix errno. An errno of 0 leaves it to the
+// client to interpret the error string.
+func (enc *Encoder) Rerroru(tag uint16, errno uint32, errfmt string, v ...interface{}) {
+	ename := errfmt
+	if len(v) > 0 {
+		ename = fmt.Sprintf(errfmt, v...)
+	}
+	if len(ename) > MaxErrorLen {
+		ename = ename[:MaxErrorLen]
+	}
+	size := uint32(minSizeLUT[msgRerror] + len(ename) + 4)
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	pheader(enc.w, size, msgRerror, tag)
+	pstring(enc.w, ename)
+	puint32(enc.w, errno)
+}
+
 // Tflush writes a new Tflush message to the underlying io.Writer.
 func (enc *Encoder) Tflush(tag, oldtag uint16) {
 	size := uint32(maxSizeLUT[msgTflush])
@@ -413,7 +475,7 @@ func (enc *Encoder) Tstat(tag uint16, fid uint32) {
 // If the Stat is larger than the maximum size allowed by
 // the NewStat function, a run-time panic occurs.
 func (enc *Encoder) Rstat(tag uint16, stat Stat) {
-	if len(stat) > MaxStatLen {
+	if len(stat) > MaxStatLenU {
 		panic(errLongStat)
 	}
 	if len(stat) < minStatLen {
@@ -432,7 +494,7 @@ func (enc *Encoder) Rstat(tag uint16, stat Stat) {
 // If the Stat is larger than the maximum size allowed by the
 // NewStat function, a run-time panic occurs.
 func (enc *Encoder) Twstat(tag uint16, fid uint32, stat Stat) {
-	if len(stat) > MaxStatLen {
+	if len(stat) > MaxStatLenU {
 		panic(errLongStat)
 	}
 	if len(stat) < minStatLen {
@@ -456,3 +518,12 @@ func (enc *Encoder) Rwstat(tag uint16) {
 
 	pheader(enc.w, size, msgRwstat, tag)
 }
+
+// Raw writes m, a complete message, to the underlying io.Writer,
+// as is. m is not checked for validity.
+func (enc *Encoder) Raw(m RawMessage) {
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	enc.w.Write(m)
+}
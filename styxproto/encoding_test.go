@@ -2,6 +2,8 @@ package styxproto
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
 	"reflect"
 	"testing"
 )
@@ -103,3 +105,358 @@ func TestEncode(t *testing.T) {
 	enc.Rwstat(7)
 	check(nil)
 }
+
+func TestUnmarshal(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.Twrite(1, 2, 0, []byte("hello, world"))
+	enc.Flush()
+	data := buf.Bytes()
+
+	msg, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twrite, ok := msg.(Twrite)
+	if !ok {
+		t.Fatalf("got %T, wanted Twrite", msg)
+	}
+	if twrite.Tag() != 1 || twrite.Fid() != 2 || twrite.Count() != 12 {
+		t.Errorf("bad Twrite: %s", twrite)
+	}
+	if _, err := Unmarshal(data[:len(data)-1]); err != io.ErrUnexpectedEOF {
+		t.Errorf("short buffer: got %v, wanted %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := Unmarshal(data[:3]); err != io.ErrUnexpectedEOF {
+		t.Errorf("short header: got %v, wanted %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := Unmarshal(append(data, 0)); err == nil {
+		t.Error("no error for trailing data")
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	// Tlopen from 9P2000.L: fid[4] flags[4]
+	tlopen := []byte{15, 0, 0, 0, 12, 1, 0, 2, 0, 0, 0, 0, 0, 0, 0}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.Raw(tlopen)
+	enc.Tclunk(2, 2)
+	enc.Flush()
+
+	d := NewDecoder(&buf)
+	if !d.Next() {
+		t.Fatal(d.Err())
+	}
+	raw, ok := d.Msg().(RawMessage)
+	if !ok {
+		t.Fatalf("got %T, wanted RawMessage", d.Msg())
+	}
+	if raw.Type() != 12 || raw.Tag() != 1 || !bytes.Equal(raw, tlopen) {
+		t.Errorf("got %s, wanted %x", raw, tlopen)
+	}
+	if !d.Next() {
+		t.Fatal(d.Err())
+	}
+	if _, ok := d.Msg().(Tclunk); !ok {
+		t.Errorf("got %T after RawMessage, wanted Tclunk", d.Msg())
+	}
+
+	msg, err := Unmarshal(tlopen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(RawMessage); !ok {
+		t.Errorf("Unmarshal returned %T, wanted RawMessage", msg)
+	}
+}
+
+func TestStatU(t *testing.T) {
+	const target = "/usr/share/zoneinfo/UTC"
+	var buf bytes.Buffer
+	stat, _, err := NewStatU(make([]byte, MaxStatLenU), "localtime", "root", "wheel", "root", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.Dotu() {
+		t.Fatal("NewStatU did not create a 9P2000.u stat")
+	}
+	stat.SetMode(DMSYMLINK | 0777)
+	stat.SetNUid(0)
+	stat.SetNGid(10)
+	stat.SetLength(int64(len(target)))
+
+	enc := NewEncoder(&buf)
+	enc.Rstat(1, stat)
+	enc.Flush()
+
+	dec := NewDecoder(&buf)
+	if !dec.Next() {
+		t.Fatal(dec.Err())
+	}
+	rstat, ok := dec.Msg().(Rstat)
+	if !ok {
+		t.Fatalf("got %T, wanted Rstat", dec.Msg())
+	}
+	got := rstat.Stat()
+	t.Logf("%s", got)
+	if !got.Equal(stat) {
+		t.Errorf("round trip changed stat: sent %s, got %s", stat, got)
+	}
+	if string(got.Extension()) != target {
+		t.Errorf("extension is %q, wanted %q", got.Extension(), target)
+	}
+	if got.NUid() != 0 || got.NGid() != 10 || got.NMuid() != NoUid {
+		t.Errorf("bad numeric ids %d %d %d", got.NUid(), got.NGid(), got.NMuid())
+	}
+
+	plain, _, _ := NewStat(make([]byte, MaxStatLen), "localtime", "root", "wheel", "root")
+	if plain.Dotu() || plain.Extension() != nil || plain.NUid() != NoUid {
+		t.Error("plain stat reports 9P2000.u fields")
+	}
+}
+
+func TestMinMsizeForStat(t *testing.T) {
+	stat, _, err := NewStatU(make([]byte, MaxStatLenU), "a-rather-long-file-name", "glenda", "sys", "glenda", "target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := int(guint16(stat[:2])) + 2; StatSize(stat) != size {
+		t.Errorf("StatSize is %d for a %d byte stat", StatSize(stat), size)
+	}
+	min := int(MinMsizeForStat(stat))
+	largest := 0
+	for _, encode := range []func(*Encoder){
+		func(enc *Encoder) { enc.Rstat(1, stat) },
+		func(enc *Encoder) { enc.Twstat(1, 1, stat) },
+		func(enc *Encoder) { enc.Rread(1, stat) },
+	} {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		encode(enc)
+		enc.Flush()
+		if buf.Len() > largest {
+			largest = buf.Len()
+		}
+	}
+	if largest != min {
+		t.Errorf("largest message with stat is %d bytes, MinMsizeForStat is %d", largest, min)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.Tclunk(1, 0)
+	enc.Tclunk(2, 0)
+	enc.Flush()
+
+	dec := NewDecoder(bytes.NewReader(buf.Bytes()))
+	for dec.Next() {
+	}
+	if err := dec.Err(); err != nil {
+		t.Errorf("complete stream: got %v, wanted nil", err)
+	}
+	dec = NewDecoder(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	n := 0
+	for ; dec.Next(); n++ {
+	}
+	if n != 1 {
+		t.Errorf("decoded %d messages from truncated stream, wanted 1", n)
+	}
+	if err := dec.Err(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated stream: got %v, wanted %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestDecoderReset(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.Tclunk(1, 0)
+	enc.Tclunk(2, 0)
+	enc.Flush()
+	first := buf.Bytes()[:buf.Len()-3]
+
+	// Stop while the second message is partially buffered.
+	dec := NewDecoder(bytes.NewReader(first))
+	dec.MaxSize = 100
+	if !dec.Next() {
+		t.Fatal(dec.Err())
+	}
+
+	buf.Reset()
+	enc.Tremove(3, 1)
+	enc.Flush()
+	dec.Reset(bytes.NewReader(buf.Bytes()))
+	if dec.MaxSize != -1 {
+		t.Errorf("MaxSize is %d after Reset, wanted -1", dec.MaxSize)
+	}
+	var got []Msg
+	for dec.Next() {
+		got = append(got, dec.Msg())
+	}
+	if err := dec.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("decoded %d messages after Reset, wanted 1", len(got))
+	}
+	if m, ok := got[0].(Tremove); !ok || m.Tag() != 3 {
+		t.Errorf("got %v after Reset, wanted Tremove with tag 3", got[0])
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+func TestEncoderReset(t *testing.T) {
+	var old, buf bytes.Buffer
+	enc := NewEncoder(&old)
+	enc.Tclunk(1, 0)
+	enc.Reset(&buf)
+	enc.Tremove(2, 0)
+	enc.Flush()
+	if old.Len() != 0 {
+		t.Errorf("unflushed data reached the old writer: % x", old.Bytes())
+	}
+	m, err := Unmarshal(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(Tremove); !ok {
+		t.Errorf("got %v after Reset, wanted Tremove", m)
+	}
+
+	enc = NewEncoder(errWriter{})
+	enc.Tclunk(1, 0)
+	enc.Flush()
+	if enc.Err() == nil {
+		t.Fatal("no error from failing writer")
+	}
+	enc.Reset(ioutil.Discard)
+	if err := enc.Err(); err != nil {
+		t.Errorf("error %v survived Reset", err)
+	}
+}
+
+// countWriter counts the calls to its Write method.
+type countWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestEncoderBatch(t *testing.T) {
+	var w countWriter
+	enc := NewEncoder(&w)
+	enc.Twalk(1, 0, 1, "a", "b")
+	enc.Topen(2, 1, OREAD)
+	enc.Tread(3, 1, 0, 8192)
+	if w.writes != 0 {
+		t.Fatalf("%d writes before Flush, wanted 0", w.writes)
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if w.writes != 1 {
+		t.Errorf("%d writes for three messages, wanted 1", w.writes)
+	}
+
+	// Messages are only valid until the next call to Next,
+	// so they are checked as they are decoded.
+	n := 0
+	dec := NewDecoder(bytes.NewReader(w.Bytes()))
+	for dec.Next() {
+		m := dec.Msg()
+		ok := false
+		switch n {
+		case 0:
+			m, isWalk := m.(Twalk)
+			ok = isWalk && m.Tag() == 1 && m.Nwname() == 2
+		case 1:
+			m, isOpen := m.(Topen)
+			ok = isOpen && m.Tag() == 2 && m.Mode() == OREAD
+		case 2:
+			m, isRead := m.(Tread)
+			ok = isRead && m.Tag() == 3 && m.Count() == 8192
+		}
+		if !ok {
+			t.Errorf("message %d is %v", n, m)
+		}
+		n++
+	}
+	if err := dec.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("decoded %d messages, wanted 3", n)
+	}
+}
+
+// A shortWriter writes at most max bytes per call, without
+// reporting an error, as some broken io.Writers do.
+type shortWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestEncoderShortWrite(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), MinBufSize-IOHeaderSize)
+	stat, _, err := NewStat(make([]byte, MaxStatLen), "file", "glenda", "glenda", "glenda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &shortWriter{max: 7}
+	enc := NewEncoder(w)
+	enc.Rread(1, data)
+	enc.Rstat(2, stat)
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	dec := NewDecoder(bytes.NewReader(w.Bytes()))
+	for dec.Next() {
+		switch m := dec.Msg().(type) {
+		case Rread:
+			got, err := ioutil.ReadAll(m)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("Rread has %d bytes, wanted %d (%v)", len(got), len(data), err)
+			}
+		case Rstat:
+			if string(m.Stat().Name()) != "file" {
+				t.Errorf("bad stat %s", m.Stat())
+			}
+		default:
+			t.Errorf("unexpected message %v", m)
+		}
+		n++
+	}
+	if err := dec.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("decoded %d messages, wanted 2", n)
+	}
+
+	// A writer that makes no progress is an error.
+	enc = NewEncoder(&shortWriter{max: 0})
+	enc.Rread(1, data[:10])
+	if err := enc.Flush(); err != io.ErrShortWrite {
+		t.Errorf("Flush to a stuck writer returned %v, wanted %v", err, io.ErrShortWrite)
+	}
+	if err := enc.Err(); err == nil {
+		t.Error("Encoder has no error after a failed write")
+	}
+}
@@ -55,6 +55,22 @@ const (
 	ORCLOSE = 64 // or'ed in, remove on close
 )
 
+// Flags for the flags field in the Tlopen and Tlcreate messages
+// of the 9P2000.L extension. These are the Linux open(2) flags,
+// which clients send as-is regardless of their own platform.
+const (
+	LRDONLY   = 00000000 // open read-only
+	LWRONLY   = 00000001 // open write-only
+	LRDWR     = 00000002 // open read-write
+	LACCMODE  = 00000003 // mask for the access mode
+	LCREAT    = 00000100 // create the file if it does not exist
+	LEXCL     = 00000200 // with LCREAT, fail if the file exists
+	LTRUNC    = 00001000 // truncate file first
+	LAPPEND   = 00002000 // all writes append to the file
+	LNONBLOCK = 00004000 // non-blocking I/O
+	LSYNC     = 04010000 // synchronous writes
+)
+
 // File modes
 const (
 	DMDIR    = 0x80000000 // mode bit for directories
@@ -73,3 +89,15 @@ const (
 	// Mask for the permissions bits
 	DMPERM = DMREAD | DMWRITE | DMEXEC
 )
+
+// File modes added by the 9P2000.u extension. The extension field
+// of a 9P2000.u Stat holds the target of a symbolic link, or the
+// type and numbers of a device file.
+const (
+	DMSYMLINK   = 0x02000000 // mode bit for symbolic links
+	DMDEVICE    = 0x00800000 // mode bit for device files
+	DMNAMEDPIPE = 0x00200000 // mode bit for named pipes
+	DMSOCKET    = 0x00100000 // mode bit for sockets
+	DMSETUID    = 0x00080000 // mode bit for setuid
+	DMSETGID    = 0x00040000 // mode bit for setgid
+)
@@ -0,0 +1,7 @@
+// +build !plan9
+
+package styxproto
+
+import "syscall"
+
+func errnoError(errno uint32) error { return syscall.Errno(errno) }
@@ -0,0 +1,4 @@
+package styxproto
+
+// Plan 9 has error strings, not error numbers.
+func errnoError(errno uint32) error { return nil }
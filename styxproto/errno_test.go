@@ -0,0 +1,51 @@
+// +build !plan9
+
+package styxproto
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestRerrorErr(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.Rerror(1, "file does not exist")
+	enc.Rerroru(2, uint32(syscall.ENOENT), "file does not exist")
+	enc.Rerroru(3, 0, "no errno")
+	enc.Flush()
+
+	dec := NewDecoder(&buf)
+	var errs []error
+	for dec.Next() {
+		rerror, ok := dec.Msg().(Rerror)
+		if !ok {
+			t.Fatalf("decoded %T, wanted Rerror", dec.Msg())
+		}
+		errs = append(errs, rerror.Err())
+	}
+	if err := dec.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 3 {
+		t.Fatalf("decoded %d messages, wanted 3", len(errs))
+	}
+	for _, err := range errs[:2] {
+		if err.Error() != "file does not exist" {
+			t.Errorf("got error %q, wanted %q", err, "file does not exist")
+		}
+	}
+	if errors.Is(errs[0], syscall.ENOENT) {
+		t.Errorf("9P2000 error %q has an errno", errs[0])
+	}
+	if !errors.Is(errs[1], syscall.ENOENT) || !errors.Is(errs[1], os.ErrNotExist) {
+		t.Errorf("9P2000.u error %q does not match ENOENT", errs[1])
+	}
+	var errno syscall.Errno
+	if errors.As(errs[2], &errno) {
+		t.Errorf("error %q with zero errno matches %v", errs[2], errno)
+	}
+}
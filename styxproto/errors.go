@@ -6,6 +6,10 @@ type parseError string
 
 func (p parseError) Error() string { return string(p) }
 
+// Is reports whether target is ErrMalformed, so that callers can
+// recognize parse errors without depending on their text.
+func (p parseError) Is(target error) bool { return target == ErrMalformed }
+
 var (
 	errContainsSlash  = parseError("slash in path element")
 	errInvalidMsgType = parseError("invalid message type")
@@ -13,6 +17,9 @@ var (
 	errInvalidUTF8    = parseError("string is not valid utf8")
 	errLongAname      = parseError("aname field too long")
 	errLongError      = parseError("error message too long")
+	errLongRead       = parseError("read exceeds message size")
+	errLongWrite      = parseError("write exceeds message size")
+	errLongExtension  = parseError("stat extension too long")
 	errLongFilename   = parseError("file name too long")
 	errLongSize       = parseError("size field is longer than actual message size")
 	errLongLength     = parseError("long length field in stat structure")
@@ -26,11 +33,28 @@ var (
 	errShortStat      = parseError("stat structure too short")
 	errTooBig         = parseError("message is too long")
 	errTooSmall       = parseError("message is too small")
+	errTrailingData   = parseError("trailing data after message")
 	errUnderSize      = parseError("empty space in message")
 	errZeroLen        = parseError("zero-length message")
 )
 
+// ErrMalformed matches, using errors.Is, the Err field of every
+// BadMessage that was produced because the message's contents were
+// invalid, such as a string or array whose length prefix claims
+// more bytes than the message holds.
+var ErrMalformed = errors.New("malformed message")
+
 // ErrMaxSize is returned during the parsing process if a message
 // exceeds the maximum size negotiated during the Tversion/Rversion
 // transaction.
 var ErrMaxSize = errors.New("message exceeds msize")
+
+// A remoteError is an error sent by a 9P2000.u server, along
+// with its unix error number.
+type remoteError struct {
+	ename string
+	errno error
+}
+
+func (e remoteError) Error() string { return e.ename }
+func (e remoteError) Unwrap() error { return e.errno }
@@ -63,8 +63,8 @@ var maxSizeLUT = [...]int{
 	msgTremove:  minSizeLUT[msgTremove],
 	msgRremove:  minSizeLUT[msgRremove],
 	msgTstat:    minSizeLUT[msgTstat],
-	msgRstat:    minSizeLUT[msgRstat] + MaxFilenameLen + (MaxUidLen * 3),
-	msgTwstat:   minSizeLUT[msgTwstat] + MaxFilenameLen + (MaxUidLen * 3),
+	msgRstat:    minSizeLUT[msgRstat] + (MaxStatLenU - minStatLen),
+	msgTwstat:   minSizeLUT[msgTwstat] + 2 + MaxStatLenU,
 	msgRwstat:   minSizeLUT[msgRwstat],
 }
 
@@ -126,6 +126,17 @@ const minStatLen = statFixedSize + (4 * 2) // name[s], uid[s], gid[s], muid[s]
 // MaxStatLen is the maximum size of a Stat structure.
 const MaxStatLen = minStatLen + MaxFilenameLen + (MaxUidLen * 3)
 
+// MaxExtensionLen is the maximum length (in bytes) of the extension
+// field in a 9P2000.u Stat structure.
+const MaxExtensionLen = 1024
+
+// 9P2000.u adds extension[s] n_uid[4] n_gid[4] n_muid[4] to the end
+// of the stat structure.
+const statDotuSize = 2 + 4 + 4 + 4
+
+// MaxStatLenU is the maximum size of a 9P2000.u Stat structure.
+const MaxStatLenU = MaxStatLen + statDotuSize + MaxExtensionLen
+
 const maxWalkLen = MaxWElem * MaxFilenameLen
 
 // largest possible message
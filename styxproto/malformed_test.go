@@ -1,6 +1,8 @@
 package styxproto
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
@@ -45,3 +47,82 @@ func testInvalidMsg(t *testing.T, r io.Reader) {
 		t.Logf("parsed %T", d.Msg())
 	}
 }
+
+// Builds a 9P message of the given type from the
+// concatenation of body.
+func rawMessage(mtype uint8, tag uint16, body ...[]byte) []byte {
+	var buf bytes.Buffer
+	size := 7
+	for _, b := range body {
+		size += len(b)
+	}
+	pheader(&buf, uint32(size), mtype, tag)
+	for _, b := range body {
+		buf.Write(b)
+	}
+	return buf.Bytes()
+}
+
+func TestMalformedLengths(t *testing.T) {
+	le16 := func(v int) []byte { return []byte{byte(v), byte(v >> 8)} }
+	fid := []byte{1, 0, 0, 0}
+
+	stat, _, err := NewStat(make([]byte, MaxStatLen), "file", "uid", "gid", "muid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(fn func(Stat)) []byte {
+		s := append(Stat(nil), stat...)
+		fn(s)
+		return append(le16(len(s)), s...)
+	}
+	longSize := corrupt(func(s Stat) { copy(s[:2], le16(len(s))) })
+	longUid := corrupt(func(s Stat) { copy(s[statFixedSize+2+len("file"):], le16(200)) })
+
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"Tcreate name", rawMessage(msgTcreate, 1, fid, le16(100), []byte("abc"), fid, []byte{0})},
+		{"Tcreate short", rawMessage(msgTcreate, 1, fid, le16(6), []byte("abcdef"))},
+		{"Twalk wname", rawMessage(msgTwalk, 1, fid, fid, le16(2), le16(1), []byte("a"), le16(40), []byte("b"))},
+		{"Twalk nwname", rawMessage(msgTwalk, 1, fid, fid, le16(3), le16(1), []byte("a"), le16(1), []byte("b"))},
+		{"Rstat n", rawMessage(msgRstat, 1, le16(len(stat)+10), stat)},
+		{"Rstat size", rawMessage(msgRstat, 1, longSize)},
+		{"Rstat uid", rawMessage(msgRstat, 1, longUid)},
+		{"Twstat size", rawMessage(msgTwstat, 1, fid, longSize)},
+		{"Twstat uid", rawMessage(msgTwstat, 1, fid, longUid)},
+		{"Twstat empty", rawMessage(msgTwstat, 1, fid)},
+		{"Rerror ename", rawMessage(msgRerror, 1, le16(30), []byte("no such file"))},
+	}
+	for _, tt := range tests {
+		// The message that follows must not be mistaken
+		// for part of the malformed one.
+		var next bytes.Buffer
+		enc := NewEncoder(&next)
+		enc.Tclunk(2, 9)
+		enc.Flush()
+		d := NewDecoder(io.MultiReader(bytes.NewReader(tt.msg), &next))
+
+		var got []Msg
+		for d.Next() {
+			got = append(got, d.Msg())
+		}
+		if err := d.Err(); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if len(got) != 2 {
+			t.Errorf("%s: decoded %d messages, wanted 2", tt.name, len(got))
+			continue
+		}
+		if bad, ok := got[0].(BadMessage); !ok {
+			t.Errorf("%s: decoded as %T %s", tt.name, got[0], got[0])
+		} else if !errors.Is(bad.Err, ErrMalformed) {
+			t.Errorf("%s: error %q is not ErrMalformed", tt.name, bad.Err)
+		}
+		if clunk, ok := got[1].(Tclunk); !ok || clunk.Fid() != 9 {
+			t.Errorf("%s: next message decoded as %T %s", tt.name, got[1], got[1])
+		}
+	}
+}
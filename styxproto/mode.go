@@ -0,0 +1,52 @@
+package styxproto
+
+import "os"
+
+// ModeToFileMode converts a 9P mode mask, as found in a Stat
+// structure or the perm field of a Tcreate message, to an
+// os.FileMode. The permission bits are kept as they are. Type
+// bits with no os.FileMode equivalent, such as DMAUTH and DMMOUNT,
+// are dropped.
+func ModeToFileMode(m uint32) os.FileMode {
+	var mode os.FileMode
+	if m&DMDIR != 0 {
+		mode |= os.ModeDir
+	}
+	if m&DMAPPEND != 0 {
+		mode |= os.ModeAppend
+	}
+	if m&DMEXCL != 0 {
+		mode |= os.ModeExclusive
+	}
+	if m&DMTMP != 0 {
+		mode |= os.ModeTemporary
+	}
+	if m&DMSYMLINK != 0 {
+		mode |= os.ModeSymlink
+	}
+	return mode | os.FileMode(m)&os.ModePerm
+}
+
+// FileModeToMode converts an os.FileMode to a 9P mode mask. It is
+// the inverse of ModeToFileMode for the directory, append-only,
+// exclusive, temporary and symbolic link bits and the permission
+// bits; all other bits of mode are dropped.
+func FileModeToMode(mode os.FileMode) uint32 {
+	var m uint32
+	if mode&os.ModeDir != 0 {
+		m |= DMDIR
+	}
+	if mode&os.ModeAppend != 0 {
+		m |= DMAPPEND
+	}
+	if mode&os.ModeExclusive != 0 {
+		m |= DMEXCL
+	}
+	if mode&os.ModeTemporary != 0 {
+		m |= DMTMP
+	}
+	if mode&os.ModeSymlink != 0 {
+		m |= DMSYMLINK
+	}
+	return m | uint32(mode&os.ModePerm)
+}
@@ -0,0 +1,43 @@
+package styxproto
+
+import (
+	"os"
+	"testing"
+)
+
+func TestModeRoundTrip(t *testing.T) {
+	tests := []struct {
+		m    uint32
+		mode os.FileMode
+	}{
+		{0, 0},
+		{0644, 0644},
+		{0777, 0777},
+		{DMDIR | 0755, os.ModeDir | 0755},
+		{DMDIR, os.ModeDir},
+		{DMAPPEND | 0600, os.ModeAppend | 0600},
+		{DMEXCL | 0600, os.ModeExclusive | 0600},
+		{DMTMP | 0400, os.ModeTemporary | 0400},
+		{DMSYMLINK | 0777, os.ModeSymlink | 0777},
+		{DMDIR | DMAPPEND | DMEXCL | DMTMP | 0700, os.ModeDir | os.ModeAppend | os.ModeExclusive | os.ModeTemporary | 0700},
+	}
+	for _, tt := range tests {
+		if mode := ModeToFileMode(tt.m); mode != tt.mode {
+			t.Errorf("ModeToFileMode(%#o) = %v, wanted %v", tt.m, mode, tt.mode)
+		}
+		if m := FileModeToMode(tt.mode); m != tt.m {
+			t.Errorf("FileModeToMode(%v) = %#o, wanted %#o", tt.mode, m, tt.m)
+		}
+		if m := FileModeToMode(ModeToFileMode(tt.m)); m != tt.m {
+			t.Errorf("%#o does not round-trip: got %#o", tt.m, m)
+		}
+	}
+
+	// Bits with no equivalent on the other side are dropped.
+	if mode := ModeToFileMode(DMAUTH | DMMOUNT | 0644); mode != 0644 {
+		t.Errorf("ModeToFileMode(DMAUTH|DMMOUNT|0644) = %v, wanted %v", mode, os.FileMode(0644))
+	}
+	if m := FileModeToMode(os.ModeSetuid | os.ModeSticky | 0755); m != 0755 {
+		t.Errorf("FileModeToMode(setuid|sticky|0755) = %#o, wanted 0755", m)
+	}
+}
@@ -56,12 +56,18 @@ func (s *Decoder) fetchMessage() (Msg, error) {
 	}
 
 	if err := verifySizeAndType(dot); err != nil {
+		if err == errInvalidMsgType {
+			return s.readRaw()
+		}
 		return s.badMessage(dot, err)
 	}
 
 	msgType := dot.Type()
 	msgSize := dot.Len()
 	if s.MaxSize > 0 && msgSize > s.MaxSize {
+		if streamed(msgType) {
+			return s.skipMessage(dot, errLongData(msgType))
+		}
 		return nil, ErrMaxSize
 	}
 
@@ -98,6 +104,28 @@ func (s *Decoder) readFixed() (Msg, error) {
 	return parsed, nil
 }
 
+// Messages of unknown type are passed along whole, if they fit
+// in the buffer.
+func (s *Decoder) readRaw() (Msg, error) {
+	dot := msg(s.dot())
+	msgSize := dot.Len()
+	if msgSize < minMsgSize {
+		return s.badMessage(dot, errTooSmall)
+	}
+	if s.MaxSize > 0 && msgSize > s.MaxSize {
+		return nil, ErrMaxSize
+	}
+	if msgSize > int64(s.br.Size()) {
+		return s.badMessage(dot, errInvalidMsgType)
+	}
+	raw, err := s.growdot(int(msgSize))
+	if err != nil {
+		return nil, err
+	}
+	s.mark()
+	return RawMessage(raw), nil
+}
+
 func (s *Decoder) readRW() (Msg, error) {
 	var err error
 
@@ -118,13 +146,42 @@ func (s *Decoder) readRW() (Msg, error) {
 	}
 
 	parsed, err := parseMsg(msgType, msg, s.r)
+	if err == errOverSize && s.MaxSize > 0 {
+		// size[4] type[1] tag[2] ... count[4]
+		n := minSizeLUT[msgType]
+		if count := int64(guint32(msg[n-4 : n])); count+int64(n) > s.MaxSize {
+			err = errLongData(msgType)
+		}
+	}
 	if err != nil {
-		return s.badMessage(msg, err)
+		return s.skipMessage(msg, err)
 	}
 	s.mark()
 	return parsed, nil
 }
 
+// Twrite and Rread messages carry file data, and are not
+// buffered in full.
+func streamed(msgType uint8) bool {
+	return msgType == msgTwrite || msgType == msgRread
+}
+
+func errLongData(msgType uint8) error {
+	if msgType == msgTwrite {
+		return errLongWrite
+	}
+	return errLongRead
+}
+
+// skipMessage is like badMessage, for Twrite and Rread messages,
+// which may be too large to buffer. As long as its size field can
+// be trusted, the rest of the message is discarded by the next call
+// to Next, without buffering it.
+func (s *Decoder) skipMessage(bad msg, reason error) (Msg, error) {
+	s.mark()
+	return BadMessage{Err: reason, tag: bad.Tag(), length: bad.Len()}, nil
+}
+
 func parseMsg(t uint8, m msg, r io.Reader) (Msg, error) {
 	return msgParseLUT[t](m, r)
 }
@@ -239,9 +239,39 @@ func (m Rerror) bytes() []byte { return m }
 // Ename is a UTF-8 string describing the error that occured.
 func (m Rerror) Ename() []byte { return nthField(m, 7, 0) }
 
+// Errno is the unix error number carried by a 9P2000.u Rerror
+// message. It is 0 if the message has no error number.
+func (m Rerror) Errno() uint32 {
+	rest := m[9+len(m.Ename()):]
+	if len(rest) != 4 {
+		return 0
+	}
+	return guint32(rest)
+}
+
 // Err creates a new value of type error using an Rerror message.
-func (m Rerror) Err() error     { return errors.New(string(m.Ename())) }
-func (m Rerror) String() string { return fmt.Sprintf("Rerror ename=%q", m.Ename()) }
+// Its Error method returns the Ename of the message. If the message
+// carries a non-zero Errno, the error wraps the equivalent
+// syscall.Errno, so that errors.Is(err, syscall.ENOENT) and
+// errors.Is(err, os.ErrNotExist) work as expected. There is no
+// syscall.Errno on Plan 9, so the errno is ignored there.
+func (m Rerror) Err() error {
+	err := remoteError{ename: string(m.Ename())}
+	if errno := m.Errno(); errno != 0 {
+		err.errno = errnoError(errno)
+	}
+	if err.errno == nil {
+		return errors.New(err.ename)
+	}
+	return err
+}
+
+func (m Rerror) String() string {
+	if errno := m.Errno(); errno != 0 {
+		return fmt.Sprintf("Rerror ename=%q errno=%d", m.Ename(), errno)
+	}
+	return fmt.Sprintf("Rerror ename=%q", m.Ename())
+}
 
 // When the response to a request is no longer needed, such as
 // when a user interrupts a process doing a read(2), a Tflush
@@ -606,6 +636,29 @@ func (m Rwstat) bytes() []byte { return m }
 
 func (m Rwstat) String() string { return "Rwstat" }
 
+// A RawMessage is a message whose type is not part of the 9P2000
+// protocol, such as a message from a vendor extension. It holds
+// the complete message, including its size, type and tag. A Decoder
+// produces a RawMessage for a message of unknown type only if the
+// message fits in its buffer; larger ones are reported as a
+// BadMessage.
+type RawMessage []byte
+
+func (m RawMessage) Tag() uint16   { return msg(m).Tag() }
+func (m RawMessage) Len() int64    { return msg(m).Len() }
+func (m RawMessage) nbytes() int64 { return msg(m).nbytes() }
+func (m RawMessage) bytes() []byte { return m }
+
+// Type returns the type of the message.
+func (m RawMessage) Type() uint8 { return msg(m).Type() }
+
+// Body returns the contents of the message following its tag.
+func (m RawMessage) Body() []byte { return msg(m).Body() }
+
+func (m RawMessage) String() string {
+	return fmt.Sprintf("type=%d body=%x", m.Type(), m.Body())
+}
+
 // BadMessage represents an invalid message.
 type BadMessage struct {
 	Err    error // the reason the message is invalid
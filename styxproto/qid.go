@@ -1,6 +1,7 @@
 package styxproto
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -45,6 +46,13 @@ func (q Qid) String() string {
 	return fmt.Sprintf("type=%d ver=%d path=%x", q.Type(), q.Version(), q.Path())
 }
 
+// Equal reports whether q and other identify the same version of
+// the same file; that is, whether their type, version, and path
+// fields are all equal.
+func (q Qid) Equal(other Qid) bool {
+	return len(q) >= 13 && len(other) >= 13 && bytes.Equal(q[:13], other[:13])
+}
+
 // A Qid's type field represents the type of a file (directory, etc.), represented
 // as a bit vector corresponding to the high 8 bits of the file's mode
 // word.
@@ -55,5 +63,6 @@ const (
 	QTMOUNT  = 0x10 // mounted channel
 	QTAUTH   = 0x08 // authentication file (afid)
 	QTTMP    = 0x04 // non-backed-up file
+	QTLINK   = 0x02 // symbolic link (9P2000.u)
 	QTFILE   = 0x00
 )
@@ -1,10 +1,15 @@
 package styxproto
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 )
 
+// NoUid is the value of the numeric user and group fields of a
+// 9P2000.u Stat structure when the numeric id is unknown.
+const NoUid = ^uint32(0)
+
 // The Stat structure describes a directory entry. It is contained in
 // Rstat and Twstat messages. Tread requests on directories return
 // a Stat structure for each directory entry. A Stat implements the
@@ -57,11 +62,107 @@ func (s Stat) Gid() []byte { return nthField(s, statFixedSize, 2) }
 // Muid returns the name of the user who last modified the file
 func (s Stat) Muid() []byte { return nthField(s, statFixedSize, 3) }
 
+// offset of the first byte past the muid field
+func (s Stat) dotuOffset() int {
+	offset := statFixedSize
+	for i := 0; i < 4; i++ {
+		offset += 2 + int(guint16(s[offset:offset+2]))
+	}
+	return offset
+}
+
+// Dotu reports whether s contains the fields added by the 9P2000.u
+// extension to the protocol: extension, n_uid, n_gid, and n_muid.
+func (s Stat) Dotu() bool {
+	offset := s.dotuOffset()
+	if len(s) < offset+statDotuSize {
+		return false
+	}
+	return len(s) >= offset+statDotuSize+int(guint16(s[offset:offset+2]))
+}
+
+// Extension returns the 9P2000.u extension field, which describes
+// special files, such as the target of a symbolic link. It returns
+// nil if s is not a 9P2000.u Stat.
+func (s Stat) Extension() []byte {
+	if !s.Dotu() {
+		return nil
+	}
+	return nthField(s, statFixedSize, 4)
+}
+
+// offset of the nth numeric id in a 9P2000.u Stat
+func (s Stat) nidOffset(n int) int {
+	offset := s.dotuOffset()
+	return offset + 2 + int(guint16(s[offset:offset+2])) + 4*n
+}
+
+func (s Stat) nid(n int) uint32 {
+	if !s.Dotu() {
+		return NoUid
+	}
+	off := s.nidOffset(n)
+	return guint32(s[off : off+4])
+}
+
+func (s Stat) setNid(n int, id uint32) {
+	if s.Dotu() {
+		off := s.nidOffset(n)
+		buint32(s[off:off+4], id)
+	}
+}
+
+// NUid, NGid, and NMuid return the numeric ids of the owner, group,
+// and last modifier of a file from a 9P2000.u Stat. They return NoUid
+// if s is not a 9P2000.u Stat. The corresponding Set methods have no
+// effect on a Stat that is not a 9P2000.u Stat.
+func (s Stat) NUid() uint32  { return s.nid(0) }
+func (s Stat) NGid() uint32  { return s.nid(1) }
+func (s Stat) NMuid() uint32 { return s.nid(2) }
+
+func (s Stat) SetNUid(id uint32)  { s.setNid(0, id) }
+func (s Stat) SetNGid(id uint32)  { s.setNid(1, id) }
+func (s Stat) SetNMuid(id uint32) { s.setNid(2, id) }
+
 func (s Stat) String() string {
-	return fmt.Sprintf("type=%x dev=%x qid=%q mode=%o atime=%d "+
+	str := fmt.Sprintf("type=%x dev=%x qid=%q mode=%o atime=%d "+
 		"mtime=%d length=%d name=%q uid=%q gid=%q muid=%q",
 		s.Type(), s.Dev(), s.Qid(), s.Mode(), s.Atime(), s.Mtime(),
 		s.Length(), s.Name(), s.Uid(), s.Gid(), s.Muid())
+	if s.Dotu() {
+		str += fmt.Sprintf(" extension=%q n_uid=%d n_gid=%d n_muid=%d",
+			s.Extension(), s.NUid(), s.NGid(), s.NMuid())
+	}
+	return str
+}
+
+// Equal reports whether s and other describe the same directory
+// entry. The type, dev, qid, mode, atime, mtime, length, name, uid,
+// gid, and muid fields are compared, along with the extension, n_uid,
+// n_gid, and n_muid fields of 9P2000.u Stats. The leading size field
+// and the length prefixes of the string fields are redundant, and
+// are not compared.
+func (s Stat) Equal(other Stat) bool {
+	if s.Dotu() != other.Dotu() {
+		return false
+	}
+	if s.Dotu() && !(bytes.Equal(s.Extension(), other.Extension()) &&
+		s.NUid() == other.NUid() &&
+		s.NGid() == other.NGid() &&
+		s.NMuid() == other.NMuid()) {
+		return false
+	}
+	return s.Type() == other.Type() &&
+		s.Dev() == other.Dev() &&
+		s.Qid().Equal(other.Qid()) &&
+		s.Mode() == other.Mode() &&
+		s.Atime() == other.Atime() &&
+		s.Mtime() == other.Mtime() &&
+		s.Length() == other.Length() &&
+		bytes.Equal(s.Name(), other.Name()) &&
+		bytes.Equal(s.Uid(), other.Uid()) &&
+		bytes.Equal(s.Gid(), other.Gid()) &&
+		bytes.Equal(s.Muid(), other.Muid())
 }
 
 // NewStat creates a new Stat structure. The name, uid, gid, and muid
@@ -100,6 +201,51 @@ func NewStat(buf []byte, name, uid, gid, muid string) (Stat, []byte, error) {
 	return Stat(buf[:length]), b, nil
 }
 
+// NewStatU creates a new 9P2000.u Stat structure. In addition to the
+// fields set by NewStat, a 9P2000.u Stat contains an extension string,
+// and numeric ids for the uid, gid, and muid fields, which are
+// initialized to NoUid. An error is returned if ext is more than
+// MaxExtensionLen bytes long.
+func NewStatU(buf []byte, name, uid, gid, muid, ext string) (Stat, []byte, error) {
+	if len(ext) > MaxExtensionLen {
+		return nil, buf, errLongExtension
+	}
+	_, b, err := NewStat(buf, name, uid, gid, muid)
+	if err != nil {
+		return nil, buf, err
+	}
+	if len(b) < statDotuSize+len(ext) {
+		return nil, buf, io.ErrShortBuffer
+	}
+	buint16(b, uint16(len(ext)))
+	b = b[2:]
+	b = b[copy(b, ext):]
+	for i := 0; i < 3; i++ {
+		buint32(b, NoUid)
+		b = b[4:]
+	}
+
+	length := len(buf) - len(b)
+	buint16(buf[:2], uint16(length-2))
+	return Stat(buf[:length]), b, nil
+}
+
+// StatSize returns the number of bytes s occupies in a 9P message,
+// including its leading size field.
+func StatSize(s Stat) int {
+	return len(s)
+}
+
+// MinMsizeForStat returns the smallest msize that can carry s in
+// each of the messages that contain a Stat: Rstat, Twstat, and the
+// Rread of a directory. Servers can use it to reject clients whose
+// msize is too small for their larger directory entries.
+func MinMsizeForStat(s Stat) uint32 {
+	// Twstat has the longest header:
+	// size[4] Twstat tag[2] fid[4] n[2] stat[n]
+	return uint32(minSizeLUT[msgTwstat] + 2 + StatSize(s))
+}
+
 // verifyStat ensures that a Stat structure is valid and safe to use
 // as a Stat. This *must* be called on all received Stats, otherwise
 // there is no guarantee that a bad actor threw in some illegal sizes
@@ -118,10 +264,16 @@ func verifyStat(data []byte) error {
 	// mtime[4] length[8] name[s] uid[s] gid[s] muid[s]
 	if len(data) < minStatLen {
 		return errShortStat
-	} else if len(data) > MaxStatLen {
+	} else if len(data) > MaxStatLenU {
 		return errLongStat
 	}
 
+	// The stat's own size field is used to step through
+	// directory listings, and must not point past its end.
+	if size := int(guint16(data[:2])); size+2 > len(data) {
+		return errLongSize
+	}
+
 	const sizeHeaders = 2 * 4 // name[s], uid[s], gid[s], muid[s], 2-byte length headers each
 	name, rest, err := verifyField(data[statFixedSize:], false, sizeHeaders-2)
 	if err != nil {
@@ -146,5 +298,15 @@ func verifyStat(data []byte) error {
 			return errOverSize
 		}
 	}
+	if stat := Stat(data); stat.Dotu() {
+		ext := stat.Extension()
+		if err := verifyString(ext); err != nil {
+			return err
+		} else if len(ext) > MaxExtensionLen {
+			return errLongExtension
+		}
+	} else if len(data) > MaxStatLen {
+		return errLongStat
+	}
 	return nil
 }
@@ -127,3 +127,37 @@ func testParseMsg(t *testing.T, r io.Reader) {
 		t.Error(err)
 	}
 }
+
+func TestQidEqual(t *testing.T) {
+	a, _, _ := NewQid(make([]byte, 13), QTDIR, 1, 0xfeed)
+	b, _, _ := NewQid(make([]byte, 20), QTDIR, 1, 0xfeed)
+	c, _, _ := NewQid(make([]byte, 13), QTDIR, 2, 0xfeed)
+	if !a.Equal(b) {
+		t.Errorf("qid %s != %s", a, b)
+	}
+	if a.Equal(c) {
+		t.Errorf("qid %s == %s", a, c)
+	}
+}
+
+func TestStatEqual(t *testing.T) {
+	newStat := func(name string, length int64) Stat {
+		stat, _, err := NewStat(make([]byte, 200), name, "uid", "gid", "muid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat.SetMode(0644)
+		stat.SetLength(length)
+		return stat
+	}
+	a, b := newStat("file", 10), newStat("file", 10)
+	if !a.Equal(b) {
+		t.Errorf("stat %s != %s", a, b)
+	}
+	if c := newStat("file", 11); a.Equal(c) {
+		t.Errorf("stat %s == %s", a, c)
+	}
+	if c := newStat("other", 10); a.Equal(c) {
+		t.Errorf("stat %s == %s", a, c)
+	}
+}
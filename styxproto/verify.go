@@ -52,6 +52,9 @@ func verifyPathElem(data []byte) error {
 // field (including 2-byte size) is expected to fill data, minus
 // padding.
 func verifyField(data []byte, fill bool, padding int) ([]byte, []byte, error) {
+	if len(data) < 2+padding {
+		return nil, nil, errOverSize
+	}
 	size := int(guint16(data[:2]))
 	if size+2 > len(data)-padding {
 		return nil, nil, errOverSize
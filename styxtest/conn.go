@@ -0,0 +1,114 @@
+package styxtest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrInjected is the error returned by a connection once it has
+// reached one of its limits, unless Faults.Err is set.
+var ErrInjected = errors.New("styxtest: injected error")
+
+// Faults describe how a connection made by NewConn misbehaves.
+// The zero value describes a connection with no faults.
+type Faults struct {
+	// If positive, the connection fails once this many bytes
+	// have been read from it. The Read that reaches the limit
+	// returns the bytes before it, without error; every Read
+	// after that fails.
+	ReadLimit int
+
+	// If positive, the connection fails once this many bytes
+	// have been written to it. The Write that would pass the
+	// limit writes the bytes before it, and returns an error
+	// along with their count; every Write after that fails.
+	WriteLimit int
+
+	// If true, the connection is closed when it fails, rather
+	// than returning Err, so that its peer sees the connection
+	// end, possibly in the middle of a message.
+	Close bool
+
+	// The error returned when the connection fails. If nil,
+	// ErrInjected is returned.
+	Err error
+
+	// If positive, no Write writes more than MaxWrite bytes.
+	// Longer writes are cut short and report no error. This
+	// breaks the contract of io.Writer, as some transports do.
+	MaxWrite int
+
+	// Every Read and Write waits this long before it is made.
+	ReadDelay, WriteDelay time.Duration
+}
+
+// NewConn returns a net.Conn that reads from and writes to conn,
+// with the faults f.
+func NewConn(conn net.Conn, f Faults) net.Conn {
+	return &faultConn{Conn: conn, f: f}
+}
+
+type faultConn struct {
+	net.Conn
+	f Faults
+
+	// Reads and writes are counted separately, so that a
+	// Read blocked waiting for data does not hold up a Write.
+	rmu, wmu        sync.Mutex
+	nread, nwritten int
+}
+
+// fail reports the failure of the connection.
+func (c *faultConn) fail() error {
+	if c.f.Close {
+		c.Conn.Close()
+	}
+	if c.f.Err != nil {
+		return c.f.Err
+	}
+	return ErrInjected
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	if c.f.ReadDelay > 0 {
+		time.Sleep(c.f.ReadDelay)
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if limit := c.f.ReadLimit; limit > 0 {
+		if c.nread >= limit {
+			return 0, c.fail()
+		}
+		if len(p) > limit-c.nread {
+			p = p[:limit-c.nread]
+		}
+	}
+	n, err := c.Conn.Read(p)
+	c.nread += n
+	return n, err
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	if c.f.WriteDelay > 0 {
+		time.Sleep(c.f.WriteDelay)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if max := c.f.MaxWrite; max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	limit := c.f.WriteLimit
+	if limit <= 0 || c.nwritten+len(p) <= limit {
+		n, err := c.Conn.Write(p)
+		c.nwritten += n
+		return n, err
+	}
+	var n int
+	if c.nwritten < limit {
+		n, _ = c.Conn.Write(p[:limit-c.nwritten])
+	}
+	c.nwritten += n
+	return n, c.fail()
+}
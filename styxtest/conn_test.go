@@ -0,0 +1,94 @@
+package styxtest
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestWriteLimit(t *testing.T) {
+	broken := errors.New("broken")
+	for _, f := range []Faults{
+		{WriteLimit: 5},
+		{WriteLimit: 5, Err: broken},
+		{WriteLimit: 5, Close: true},
+		{WriteLimit: 5, MaxWrite: 2},
+	} {
+		client, server := net.Pipe()
+		conn := NewConn(server, f)
+		data := make(chan []byte)
+		go func() {
+			b, _ := ioutil.ReadAll(client)
+			data <- b
+		}()
+		var written int
+		for i := 0; i < 10; i++ {
+			n, err := conn.Write([]byte("abc"))
+			written += n
+			if err != nil {
+				want := f.Err
+				if want == nil {
+					want = ErrInjected
+				}
+				if err != want {
+					t.Errorf("%+v: Write failed with %v, wanted %v", f, err, want)
+				}
+				break
+			} else if f.MaxWrite > 0 && n > f.MaxWrite {
+				t.Errorf("%+v: wrote %d bytes at once", f, n)
+			}
+		}
+		if written != 5 {
+			t.Errorf("%+v: wrote %d bytes before failing, wanted 5", f, written)
+		}
+		if !f.Close {
+			server.Close()
+		}
+		if b := <-data; string(b) != "abcab" && string(b) != "ababa" {
+			t.Errorf("%+v: peer read %q", f, b)
+		}
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewConn(server, Faults{ReadLimit: 4, Close: true})
+	go client.Write([]byte("hello, world"))
+	b, err := ioutil.ReadAll(conn)
+	if string(b) != "hell" || err != ErrInjected {
+		t.Errorf("read %q, %v; wanted %q, %v", b, err, "hell", ErrInjected)
+	}
+	// The peer sees the connection closed.
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("write to closed connection succeeded")
+	}
+}
+
+func TestListener(t *testing.T) {
+	var l Listener
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+	conn, err := l.Dial(Faults{ReadLimit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(conn); string(b) != "hello" || err != nil {
+		t.Errorf("read %q, %v from accepted connection", b, err)
+	}
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Error("Accept succeeded after Close")
+	}
+	if _, err := l.Dial(Faults{}); err == nil {
+		t.Error("Dial succeeded after Close")
+	}
+}
@@ -0,0 +1,80 @@
+package styxtest_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+
+	"aqwari.net/net/styx"
+	"aqwari.net/net/styx/styxproto"
+	"aqwari.net/net/styx/styxtest"
+)
+
+func ExampleListener() {
+	var l styxtest.Listener
+	srv := &styx.Server{}
+	go srv.Serve(&l)
+	defer srv.Shutdown(context.Background())
+
+	// A slow connection, whose writes are cut into pieces
+	// no bigger than a few bytes.
+	conn, err := l.Dial(styxtest.Faults{
+		MaxWrite:  3,
+		ReadDelay: time.Millisecond,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	c, err := styx.NewClient(ctx, conn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err := c.Attach(ctx, styxproto.NoFid, "", ""); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("attached")
+
+	// A connection the server stops reading from in the
+	// middle of a Tattach, right after the Tversion.
+	conn, err = l.Dial(styxtest.Faults{ReadLimit: 19 + 10})
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, err = styx.NewClient(ctx, conn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	_, _, err = c.Attach(ctx, styxproto.NoFid, "", "")
+	fmt.Println("attach failed:", err != nil)
+
+	// Output:
+	// attached
+	// attach failed: true
+}
+
+func ExampleNewConn() {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// The server's side of the connection fails after the
+	// Rversion and part of the Rattach have been written.
+	srv := &styx.Server{}
+	go srv.ServeConn(styxtest.NewConn(server, styxtest.Faults{WriteLimit: 19 + 10}))
+
+	go func() {
+		enc := styxproto.NewEncoder(client)
+		enc.Tversion(styxproto.DefaultMaxSize, "9P2000")
+		enc.Tattach(1, 0, styxproto.NoFid, "", "")
+		enc.Flush()
+	}()
+	data, _ := ioutil.ReadAll(client)
+	fmt.Println("read", len(data), "bytes before the server hung up")
+
+	// Output: read 29 bytes before the server hung up
+}
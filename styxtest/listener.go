@@ -0,0 +1,89 @@
+// Package styxtest provides network connections with faults that
+// can be set in advance, for testing how a 9P server or client
+// copes with a transport that fails, stalls, or cuts messages
+// short.
+//
+// Connections made with a Listener can be served with the Serve
+// method of a styx.Server, and any net.Conn can be wrapped with
+// NewConn and passed to ServeConn. Faults are counted in bytes,
+// not messages, so a test can stop a connection at any point in
+// the stream, such as the middle of a message.
+package styxtest
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var errClosed = errors.New("styxtest: listener closed")
+
+// A Listener is a net.Listener whose connections are made in
+// memory, with the Dial method, rather than over a network. It
+// needs no permission to bind to a port. The zero value is ready
+// to use.
+type Listener struct {
+	once     sync.Once
+	incoming chan net.Conn
+	shutdown chan struct{}
+}
+
+func (l *Listener) init() {
+	l.once.Do(func() {
+		l.incoming = make(chan net.Conn)
+		l.shutdown = make(chan struct{})
+	})
+}
+
+// Accept waits for a call to Dial, and returns the listening
+// side of the new connection, with the faults given to Dial.
+// Once the Listener is closed, Accept returns an error.
+func (l *Listener) Accept() (net.Conn, error) {
+	l.init()
+	select {
+	case c := <-l.incoming:
+		return c, nil
+	case <-l.shutdown:
+		return nil, errClosed
+	}
+}
+
+// Dial connects to the Listener, and returns the dialing side of
+// the connection. It blocks until the connection is accepted, or
+// the Listener is closed. The faults f apply to the listening
+// side, so that a server reading from or writing to it sees them.
+func (l *Listener) Dial(f Faults) (net.Conn, error) {
+	l.init()
+	server, client := net.Pipe()
+	select {
+	case <-l.shutdown:
+		server.Close()
+		client.Close()
+		return nil, errClosed
+	case l.incoming <- NewConn(server, f):
+		return client, nil
+	}
+}
+
+// Close stops the Listener. Connections already accepted are not
+// affected. The returned error is always nil.
+func (l *Listener) Close() error {
+	l.init()
+	select {
+	case <-l.shutdown:
+	default:
+		close(l.shutdown)
+	}
+	return nil
+}
+
+// Addr returns the address of the Listener, which is the same
+// for every Listener.
+func (l *Listener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "styxtest" }
@@ -0,0 +1,197 @@
+package styx
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+// A requestTracer correlates requests with their responses, so
+// that a single line can be logged to Server.TraceLog, and to
+// Server.AccessLog, for each completed request. It also keeps
+// the request and error counts for Server.Vars.
+type requestTracer struct {
+	log    Logger
+	access *accessLog
+	vars   *serverVars
+	remote string
+	clock  Clock
+
+	mu      sync.Mutex
+	pending map[uint16]traceEntry
+}
+
+type traceEntry struct {
+	start  time.Time
+	mtype  string
+	fid    string
+	path   string
+	user   string
+	oldtag uint16
+	flush  bool
+}
+
+// log and access may be nil.
+func newRequestTracer(log Logger, access *accessLog, remote net.Addr, clock Clock) *requestTracer {
+	t := &requestTracer{
+		log:     log,
+		access:  access,
+		remote:  "-",
+		clock:   clock,
+		pending: make(map[uint16]traceEntry),
+	}
+	if remote != nil {
+		t.remote = plan9Addr(remote.String())
+	}
+	return t
+}
+
+// Plan 9 separates the parts of a network address with "!".
+func plan9Addr(addr string) string {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		return host + "!" + port
+	}
+	return addr
+}
+
+func msgType(m styxproto.Msg) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", m), "styxproto.")
+}
+
+// request records the arrival of a request. path is the
+// path of the file the request's fid points to, if any, and
+// user the owner of the fid's session.
+func (t *requestTracer) request(m styxproto.Msg, path, user string) {
+	if t == nil {
+		return
+	}
+	e := traceEntry{
+		start: t.clock.Now(),
+		mtype: msgType(m),
+		fid:   "-",
+		path:  path,
+		user:  user,
+	}
+	switch m := m.(type) {
+	case styxproto.Tattach:
+		e.fid = fmt.Sprint(m.Fid())
+		e.path = string(m.Aname())
+		e.user = string(m.Uname())
+	case fcall:
+		e.fid = fmt.Sprint(m.Fid())
+	case styxproto.Tauth:
+		e.fid = fmt.Sprint(m.Afid())
+		e.path = string(m.Aname())
+		e.user = string(m.Uname())
+	case styxproto.Tflush:
+		e.oldtag = m.Oldtag()
+		e.flush = true
+	}
+	if t.vars != nil {
+		t.vars.requests.Add(e.mtype, 1)
+	}
+	t.mu.Lock()
+	t.pending[m.Tag()] = e
+	t.mu.Unlock()
+}
+
+// response logs the request that m is a response to, if any.
+// Requests that were cancelled by a successful Tflush are
+// logged as flushed.
+func (t *requestTracer) response(m styxproto.Msg) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	e, ok := t.pending[m.Tag()]
+	delete(t.pending, m.Tag())
+	old, flushed := t.pending[e.oldtag]
+	flushed = flushed && e.flush
+	if flushed {
+		delete(t.pending, e.oldtag)
+	}
+	idle := len(t.pending) == 0
+	t.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if flushed {
+		t.logf(e.oldtag, old, "flushed", "flushed")
+	}
+	outcome, result := msgType(m), "ok"
+	if rerror, ok := m.(styxproto.Rerror); ok {
+		outcome = fmt.Sprintf("Rerror %q", rerror.Ename())
+		result = string(rerror.Ename())
+		if t.vars != nil {
+			t.vars.errors.Add(e.mtype, 1)
+		}
+	}
+	t.logf(m.Tag(), e, outcome, result)
+
+	// Buffered lines are written out whenever the connection
+	// has nothing left to answer.
+	if idle && t.access != nil {
+		t.access.flush()
+	}
+}
+
+func (t *requestTracer) logf(tag uint16, e traceEntry, outcome, result string) {
+	if t.log != nil {
+		t.log.Printf("%03d %s fid=%s path=%q %v %s",
+			tag, e.mtype, e.fid, e.path, t.clock.Now().Sub(e.start), outcome)
+	}
+	if t.access != nil {
+		t.access.printf("%s %s %s %s %s", orDash(e.user), t.remote,
+			e.mtype, orDash(e.path), result)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// An accessLog writes lines in the format of the Plan 9 syslog(2)
+// function: the system name, the time, and the message. Lines are
+// buffered until flush is called, or the buffer fills. An accessLog
+// is shared by all of a Server's connections.
+type accessLog struct {
+	sysname string
+	clock   Clock
+
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func newAccessLog(w io.Writer, clock Clock) *accessLog {
+	sysname, err := os.Hostname()
+	if err != nil || sysname == "" {
+		sysname = "styx"
+	}
+	return &accessLog{sysname: sysname, clock: clock, w: bufio.NewWriter(w)}
+}
+
+func (l *accessLog) printf(format string, args ...interface{}) {
+	// format outside of the lock; only the copy is serialized.
+	line := fmt.Sprintf("%s %s "+format+"\n",
+		append([]interface{}{l.sysname, l.clock.Now().Format(time.Stamp)}, args...)...)
+	l.mu.Lock()
+	l.w.WriteString(line)
+	l.mu.Unlock()
+}
+
+func (l *accessLog) flush() {
+	l.mu.Lock()
+	l.w.Flush()
+	l.mu.Unlock()
+}
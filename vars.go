@@ -0,0 +1,90 @@
+package styx
+
+import (
+	"expvar"
+	"io"
+)
+
+// The variables published by Server.Vars.
+type serverVars struct {
+	m *expvar.Map
+
+	connections  *expvar.Int
+	active       *expvar.Int
+	requests     *expvar.Map
+	errors       *expvar.Map
+	bytesRead    *expvar.Int
+	bytesWritten *expvar.Int
+}
+
+func newServerVars() *serverVars {
+	v := &serverVars{
+		m:            new(expvar.Map).Init(),
+		connections:  new(expvar.Int),
+		active:       new(expvar.Int),
+		requests:     new(expvar.Map).Init(),
+		errors:       new(expvar.Map).Init(),
+		bytesRead:    new(expvar.Int),
+		bytesWritten: new(expvar.Int),
+	}
+	v.m.Set("connections", v.connections)
+	v.m.Set("active", v.active)
+	v.m.Set("requests", v.requests)
+	v.m.Set("errors", v.errors)
+	v.m.Set("bytes_read", v.bytesRead)
+	v.m.Set("bytes_written", v.bytesWritten)
+	return v
+}
+
+// Vars returns a map of counters describing the Server's traffic,
+// suitable for publishing with expvar.Publish. It contains:
+//
+// 	connections    connections accepted
+// 	active         connections currently open
+// 	requests       requests received, by message type ("Twalk")
+// 	errors         requests answered with Rerror, by message type
+// 	bytes_read     bytes read from all connections
+// 	bytes_written  bytes written to all connections
+//
+// Counting is off until Vars is first called, and only covers
+// connections accepted since then. The map is not published; call
+// expvar.Publish with a name of your choosing to serve it on
+// /debug/vars.
+func (srv *Server) Vars() *expvar.Map {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.vars == nil {
+		srv.vars = newServerVars()
+	}
+	return srv.vars.m
+}
+
+// serverVars returns the Server's counters, or nil if Vars has not
+// been called.
+func (srv *Server) serverVars() *serverVars {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.vars
+}
+
+type countReader struct {
+	io.Reader
+	n *expvar.Int
+}
+
+func (r countReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+type countWriter struct {
+	io.Writer
+	n *expvar.Int
+}
+
+func (w countWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
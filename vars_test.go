@@ -0,0 +1,107 @@
+package styx
+
+import (
+	"expvar"
+	"net"
+	"testing"
+	"time"
+
+	"context"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+func TestVars(t *testing.T) {
+	srv := &Server{
+		Handler:  FileSystem(map[string][]byte{"hello": []byte("hello, world")}),
+		ErrorLog: testLogger{t},
+	}
+	vars := srv.Vars()
+	if srv.Vars() != vars {
+		t.Error("Vars returned a different map on the second call")
+	}
+	get := func(name string) int64 {
+		v, ok := vars.Get(name).(*expvar.Int)
+		if !ok {
+			t.Fatalf("%s is %T, wanted *expvar.Int", name, vars.Get(name))
+		}
+		return v.Value()
+	}
+	count := func(name, key string) int64 {
+		m, ok := vars.Get(name).(*expvar.Map)
+		if !ok {
+			t.Fatalf("%s is %T, wanted *expvar.Map", name, vars.Get(name))
+		}
+		if v, ok := m.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		srv.ServeConn(server)
+		close(done)
+	}()
+	ctx := context.Background()
+	c, err := NewClient(ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Walk(ctx, root, "nonexistent"); err == nil {
+		t.Error("walked to a file that does not exist")
+	}
+	fid, _, err := c.Walk(ctx, root, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Open(ctx, fid, styxproto.OREAD); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, _ := c.Read(ctx, fid, buf, 0)
+
+	if n := get("active"); n != 1 {
+		t.Errorf("%d active connections, wanted 1", n)
+	}
+	for _, tt := range []struct {
+		name, key string
+		want      int64
+	}{
+		{"requests", "Tversion", 1},
+		{"requests", "Tattach", 1},
+		{"requests", "Twalk", 2},
+		{"requests", "Topen", 1},
+		{"requests", "Tread", 1},
+		{"errors", "Twalk", 1},
+		{"errors", "Topen", 0},
+	} {
+		if got := count(tt.name, tt.key); got != tt.want {
+			t.Errorf("%s[%s] = %d, wanted %d", tt.name, tt.key, got, tt.want)
+		}
+	}
+	if got := get("bytes_written"); got < int64(n) {
+		t.Errorf("bytes_written = %d, less than the %d bytes of file data read", got, n)
+	}
+	if get("bytes_read") == 0 {
+		t.Error("bytes_read is 0")
+	}
+
+	c.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	if n := get("connections"); n != 1 {
+		t.Errorf("%d connections, wanted 1", n)
+	}
+	if n := get("active"); n != 0 {
+		t.Errorf("%d active connections after close, wanted 0", n)
+	}
+}
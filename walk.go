@@ -3,8 +3,7 @@ package styx
 import (
 	"fmt"
 	"os"
-	"path"
-	"strings"
+	"sync/atomic"
 
 	"context"
 
@@ -18,7 +17,8 @@ import (
 //
 // 	- If the file exists: Rwalk with nwname qids
 // 	- If no elements in the path exist: Rerror
-// 	- If at least 1 element in the path exists: Rwalk with n(<nwname) qids
+// 	- If at least 1 element in the path exists: Rwalk with n(<nwname) qids,
+// 	  leaving newfid unaffected
 //
 // In addition, walks are relative to another file, so a server must track
 // that as well. The styx package attempts to hide this complexity from the
@@ -48,6 +48,23 @@ import (
 // The order that the program sees the path in is important, as it allows
 // certain synthetic file systems to create resources "on-demand", as the
 // client asks for them.
+//
+// The handler answers each element with Rwalk, and may give a
+// different error for each. The walk stops at the first element
+// that fails: the handler is not sent the elements after it, and
+// any it has already been sent are ignored. If the first element
+// fails, its error is sent to the client, as an Rerror; otherwise
+// the client is sent the Qids of the elements before it.
+//
+// An element of "." does not move the walk, so no Twalk request is made
+// for it. It is given the Qid of the element before it, or of the file
+// the walk started from.
+//
+// Symbolic links are not followed. If an element of the path is a
+// symlink, the walk continues beneath the link's own path, and it is
+// up to the Handler to decide what, if anything, lives there.
+// 9P2000.u clients are expected to read the link target from the
+// extension field of a Tstat response and resolve it themselves.
 type walkElem struct {
 	index int
 	qid   styxproto.Qid // nil if not present
@@ -57,15 +74,29 @@ type walkElem struct {
 type walker struct {
 	qids, found []styxproto.Qid
 	filled      []int32
+
+	// True for "." elements, which take the result of the
+	// element before them instead of going to the handler.
+	dot []bool
+
+	// The error given for each element that failed. failed is
+	// set once any element has failed, so that no more are
+	// sent to the handler.
+	errs   []error
+	failed int32
+
 	count       int
 	complete    chan struct{}
 	collect     chan walkElem
-	newfid      uint32
+	fid, newfid uint32
 	path        string
 
 	// for cancellation
 	ctx context.Context
 
+	// drops the walk's reference to its in-flight slot
+	done func()
+
 	session *Session
 	tag     uint16
 }
@@ -73,28 +104,70 @@ type walker struct {
 func newWalker(s *Session, ctx context.Context, msg styxproto.Twalk, base string, elem ...string) *walker {
 	qids := make([]styxproto.Qid, len(elem))
 	found := qids[:0]
-	newpath := path.Join(base, strings.Join(elem, "/"))
+	newpath := s.join(base, elem...)
 	w := &walker{
 		qids:     qids,
 		found:    found,
 		filled:   make([]int32, len(elem)),
+		dot:      make([]bool, len(elem)),
+		errs:     make([]error, len(elem)),
 		complete: make(chan struct{}),
 		collect:  make(chan walkElem),
 		session:  s,
+		fid:      msg.Fid(),
 		newfid:   msg.Newfid(),
 		path:     newpath,
 		tag:      msg.Tag(),
 		ctx:      ctx,
+		done:     s.conn.hold(ctx),
+	}
+	for i, name := range elem {
+		w.dot[i] = name == "."
+	}
+	// "." elements at the start of the walk refer to base, which
+	// the client has already seen, unless it has since been
+	// removed; then they are walked like any other element.
+	if qid, ok := s.conn.qidpool.Get(base); ok {
+		for i := 0; i < len(elem) && w.dot[i]; i++ {
+			w.fill(i, qid)
+		}
+	} else {
+		for i := 0; i < len(elem) && w.dot[i]; i++ {
+			w.dot[i] = false
+		}
 	}
 	go w.run()
 	return w
 }
 
+// fill records the result for the element at index i, and for
+// any "." elements following it.
+func (w *walker) fill(i int, qid styxproto.Qid) {
+	w.qids[i] = qid
+	w.count++
+	for i++; i < len(w.qids) && w.dot[i]; i++ {
+		w.qids[i] = qid
+		w.count++
+	}
+	for i := len(w.found); i < cap(w.found); i++ {
+		if w.qids[i] != nil {
+			w.found = w.found[:i+1]
+		}
+	}
+}
+
+// stopped reports whether the walk has reached the first element
+// that failed, with every element before it filled.
+func (w *walker) stopped() bool {
+	i := len(w.found)
+	return i < len(w.qids) && w.errs[i] != nil
+}
+
 // runs in its own goroutine
 func (w *walker) run() {
-	var err error
+	defer w.done()
 Loop:
-	for {
+	for w.count < len(w.qids) && !w.stopped() {
 		select {
 		case <-w.ctx.Done():
 			break Loop
@@ -102,19 +175,8 @@ Loop:
 			if !ok {
 				break Loop
 			}
-			if el.err != nil {
-				err = el.err
-			}
-			w.count++
-			w.qids[el.index] = el.qid
-			for i := len(w.found); i < cap(w.found); i++ {
-				if w.qids[i] != nil {
-					w.found = w.found[:i+1]
-				}
-			}
-			if w.count == len(w.qids) {
-				break Loop
-			}
+			w.errs[el.index] = el.err
+			w.fill(el.index, el.qid)
 		}
 	}
 	close(w.complete)
@@ -122,15 +184,27 @@ Loop:
 		return
 	}
 	if len(w.found) == 0 {
-		if err != nil {
-			w.session.conn.Rerror(w.tag, "%s", err)
+		if err := w.errs[0]; err != nil {
+			w.session.conn.sendError(w.tag, err)
 		} else {
 			w.session.conn.Rerror(w.tag, "No such file or directory")
 		}
 	} else {
-		w.session.files.Put(w.newfid, file{name: w.path})
-		w.session.conn.sessionFid.Put(w.newfid, w.session)
-		w.session.IncRef()
+		// The newfid is only established, or moved, if every
+		// element was walked. See walk(5).
+		if len(w.found) == len(w.qids) {
+			// Another walk may have claimed newfid while
+			// this one was in progress.
+			if w.newfid != w.fid {
+				if !w.session.conn.sessionFid.Add(w.newfid, w.session) {
+					w.session.conn.Rerror(w.tag, "Twalk: fid %x already in use", w.newfid)
+					w.session.conn.Flush()
+					return
+				}
+				w.session.IncRef()
+			}
+			w.session.files.Put(w.newfid, file{name: w.path})
+		}
 		if err := w.session.conn.Rwalk(w.tag, w.found...); err != nil {
 			panic(err) // should never happen
 		}
@@ -166,10 +240,23 @@ func (t Twalk) WithContext(ctx context.Context) Request {
 	return t
 }
 
+func (t Twalk) Kind() string { return "Twalk" }
+
 func (t Twalk) handled() bool {
 	return t.walk.filled[t.index] == 1
 }
 
+// skip reports whether an earlier element of t's walk has failed,
+// so that t need not be handled, releasing its slot if so.
+func (t Twalk) skip() bool {
+	if atomic.LoadInt32(&t.walk.failed) == 0 {
+		return false
+	}
+	t.done()
+	t.walk.filled[t.index] = 1
+	return true
+}
+
 // Rwalk signals to the client that the file named by the Twalk's
 // Path method exists and is of the given mode. The permission bits of
 // mode are ignored, and only the file type bits, such as os.ModeDir,
@@ -178,11 +265,25 @@ func (t Twalk) handled() bool {
 func (t Twalk) Rwalk(info os.FileInfo, err error) {
 	var qid styxproto.Qid
 	var mode os.FileMode
+	if t.passOn(err) {
+		return
+	}
+	t.done()
 	if err == nil {
 		mode = info.Mode()
-		qid = t.session.conn.qid(t.Path(), styxfile.QidType(styxfile.Mode9P(mode)))
+		qtype := styxfile.QidType(styxfile.StatMode(mode, t.session.conn.dotu))
+		if old, ok := t.session.conn.qidpool.Get(t.Path()); ok && old.Type() != qtype {
+			t.session.conn.strictf("Rwalk %s: mode %v does not match qid type %#x",
+				t.Path(), mode, old.Type())
+		}
+		qid = t.session.conn.qidMtime(t.Path(), qtype, info.ModTime())
+		t.session.conn.notePerm(t.Path(), info)
+		t.cacheStat(info)
 	}
 	t.walk.filled[t.index] = 1
+	if err != nil {
+		atomic.StoreInt32(&t.walk.failed, 1)
+	}
 	elem := walkElem{qid: qid, index: t.index, err: err}
 	select {
 	case t.walk.collect <- elem:
@@ -0,0 +1,225 @@
+package styx
+
+import (
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"context"
+
+	"aqwari.net/net/styx/styxproto"
+)
+
+// WebHandler returns an http.Handler that lets a web browser look
+// around the file tree served by h. A GET request for a directory
+// is answered with an HTML page linking to its entries, and a GET
+// request for a file with the file's contents. The tree cannot be
+// modified through the returned Handler.
+//
+// Requests are made through a Client connected to h within the
+// process; no socket is opened. The user name sent in the attach
+// request is empty.
+func WebHandler(h Handler) http.Handler {
+	return &webHandler{srv: &Server{Handler: h}}
+}
+
+type webHandler struct {
+	srv *Server
+
+	// The client is connected on first use, and again if
+	// the connection is lost.
+	mu     sync.Mutex
+	client *Client
+	root   uint32
+}
+
+var webDirTemplate = template.Must(template.New("dir").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Path}}</title></head>
+<body>
+<h1>{{.Path}}</h1>
+<ul>
+{{if ne .Path "/"}}<li><a href="../">../</a></li>
+{{end}}{{range .Entries}}<li><a href="{{.Href}}">{{.Name}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+type webEntry struct {
+	Name, Href string
+}
+
+// connect returns a Client and the fid of its root, connecting
+// to the Handler if there is no usable Client.
+func (w *webHandler) connect(ctx context.Context) (*Client, uint32, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.client != nil {
+		select {
+		case <-w.client.done:
+			w.client.Close()
+			w.client = nil
+		default:
+			return w.client, w.root, nil
+		}
+	}
+	rwc, srvside := net.Pipe()
+	go w.srv.ServeConn(srvside)
+	c, err := NewClient(ctx, rwc)
+	if err != nil {
+		rwc.Close()
+		return nil, 0, err
+	}
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "", "")
+	if err != nil {
+		c.Close()
+		return nil, 0, err
+	}
+	w.client, w.root = c, root
+	return c, root, nil
+}
+
+func (w *webHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	c, root, err := w.connect(ctx)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	upath := path.Clean("/" + r.URL.Path)
+	fid, err := w.walk(ctx, c, root, upath)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer c.Clunk(context.Background(), fid)
+
+	stat, err := c.Stat(ctx, fid)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	isdir := stat.Mode()&styxproto.DMDIR != 0
+	if isdir && !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(rw, r, path.Base(upath)+"/", http.StatusMovedPermanently)
+		return
+	}
+	if _, _, err := c.Open(ctx, fid, styxproto.OREAD); err != nil {
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+	if isdir {
+		w.serveDir(rw, r, c, fid, upath)
+	} else {
+		w.serveFile(rw, r, c, fid)
+	}
+}
+
+// walk walks from root to the file at upath, a clean, absolute
+// path, in as many Twalk requests as it takes.
+func (w *webHandler) walk(ctx context.Context, c *Client, root uint32, upath string) (uint32, error) {
+	var names []string
+	if upath != "/" {
+		names = strings.Split(upath[1:], "/")
+	}
+	fid, _, err := c.Walk(ctx, root)
+	if err != nil {
+		return styxproto.NoFid, err
+	}
+	for len(names) > 0 {
+		n := len(names)
+		if n > styxproto.MaxWElem {
+			n = styxproto.MaxWElem
+		}
+		next, _, err := c.Walk(ctx, fid, names[:n]...)
+		c.Clunk(context.Background(), fid)
+		if err != nil {
+			return styxproto.NoFid, err
+		}
+		fid, names = next, names[n:]
+	}
+	return fid, nil
+}
+
+func (w *webHandler) serveDir(rw http.ResponseWriter, r *http.Request, c *Client, fid uint32, upath string) {
+	var data []byte
+	buf := make([]byte, c.iounit())
+	for {
+		n, err := c.Read(r.Context(), fid, buf, int64(len(data)))
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	var entries []webEntry
+	for len(data) >= 2 {
+		size := int(data[0]) | int(data[1])<<8 + 2
+		if size > len(data) {
+			break
+		}
+		stat := styxproto.Stat(data[:size])
+		data = data[size:]
+		name := string(stat.Name())
+		href := url.PathEscape(name)
+		if stat.Mode()&styxproto.DMDIR != 0 {
+			name += "/"
+			href += "/"
+		}
+		entries = append(entries, webEntry{Name: name, Href: href})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == "HEAD" {
+		return
+	}
+	err := webDirTemplate.Execute(rw, struct {
+		Path    string
+		Entries []webEntry
+	}{upath, entries})
+	if err != nil {
+		w.srv.logf("web listing of %s: %v", upath, err)
+	}
+}
+
+func (w *webHandler) serveFile(rw http.ResponseWriter, r *http.Request, c *Client, fid uint32) {
+	if r.Method == "HEAD" {
+		return
+	}
+	buf := make([]byte, c.iounit())
+	for offset := int64(0); ; {
+		n, err := c.Read(r.Context(), fid, buf, offset)
+		if n > 0 {
+			if _, werr := rw.Write(buf[:n]); werr != nil {
+				return
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			// The status line may already have been sent, so
+			// all we can do is cut the response short.
+			if offset == 0 {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package styx
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebHandler(t *testing.T) {
+	hs := httptest.NewServer(WebHandler(FileSystem(map[string][]byte{
+		"hello.txt":   []byte("hello, world"),
+		"dir/a b":     []byte("a"),
+		"dir/sub/c":   []byte("c"),
+		"<script>.js": []byte("x"),
+	})))
+	defer hs.Close()
+
+	get := func(method, path string) (int, string) {
+		req, err := http.NewRequest(method, hs.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := hs.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		body, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp.StatusCode, string(body)
+	}
+
+	if code, body := get("GET", "/hello.txt"); code != 200 || body != "hello, world" {
+		t.Errorf("GET /hello.txt = %d %q", code, body)
+	}
+	code, body := get("GET", "/")
+	if code != 200 {
+		t.Fatalf("GET / = %d %q", code, body)
+	}
+	for _, want := range []string{`href="hello.txt"`, `href="dir/"`, `&lt;script&gt;.js`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("listing of / does not contain %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "<script>") {
+		t.Errorf("file name not escaped in listing:\n%s", body)
+	}
+
+	// Directories are redirected to their path with a trailing
+	// slash, so that relative links work.
+	code, body = get("GET", "/dir")
+	if code != 200 {
+		t.Fatalf("GET /dir = %d %q", code, body)
+	}
+	for _, want := range []string{`href="a%20b"`, `href="sub/"`, `href="../"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("listing of /dir does not contain %s:\n%s", want, body)
+		}
+	}
+	if code, body := get("GET", "/dir/a%20b"); code != 200 || body != "a" {
+		t.Errorf("GET /dir/a%%20b = %d %q", code, body)
+	}
+	if code, _ := get("GET", "/dir/nonexistent"); code != http.StatusNotFound {
+		t.Errorf("GET of missing file = %d, wanted %d", code, http.StatusNotFound)
+	}
+	if code, _ := get("POST", "/hello.txt"); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, wanted %d", code, http.StatusMethodNotAllowed)
+	}
+}
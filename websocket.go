@@ -0,0 +1,91 @@
+package styx
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"aqwari.net/net/styx/internal/websocket"
+	"aqwari.net/net/styx/styxproto"
+)
+
+// WebSocketHandler returns an http.Handler that upgrades each request
+// to a WebSocket connection, and serves 9P over it as if it were
+// accepted by the Serve method. Each 9P message is carried in a
+// single binary WebSocket message, in both directions. The handshake
+// is refused if srv.CheckOrigin rejects the request.
+func (srv *Server) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Upgrade(w, r, srv.CheckOrigin)
+		if err != nil {
+			srv.logf("websocket upgrade for %s failed: %v", r.RemoteAddr, err)
+			return
+		}
+		maxSize := srv.MaxSize
+		if maxSize <= 0 {
+			maxSize = styxproto.DefaultMaxSize
+		}
+		srv.ServeConn(newMsgConn(ws, maxSize))
+	})
+}
+
+// A msgConn presents a WebSocket connection carrying one 9P
+// message per WebSocket message as a byte stream, for use
+// with styxproto's Decoder and Encoder.
+type msgConn struct {
+	*websocket.Conn
+	maxSize int64
+
+	// unread part of the last message received
+	rbuf []byte
+
+	// partial message written so far
+	wmu  sync.Mutex
+	wbuf []byte
+}
+
+func newMsgConn(ws *websocket.Conn, maxSize int64) *msgConn {
+	return &msgConn{Conn: ws, maxSize: maxSize}
+}
+
+func (c *msgConn) Read(p []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		msg, err := c.ReadMessage(c.maxSize)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := styxproto.Unmarshal(msg); err != nil {
+			return 0, fmt.Errorf("bad websocket message: %v", err)
+		}
+		c.rbuf = msg
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// Write sends each complete 9P message in p, along with any
+// data from previous calls, as its own WebSocket message.
+func (c *msgConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf = append(c.wbuf, p...)
+	for len(c.wbuf) >= 4 {
+		size := int(uint32(c.wbuf[0]) | uint32(c.wbuf[1])<<8 |
+			uint32(c.wbuf[2])<<16 | uint32(c.wbuf[3])<<24)
+		if len(c.wbuf) < size {
+			break
+		}
+		if size < 4 {
+			return 0, fmt.Errorf("bad 9P message size %d", size)
+		}
+		if err := c.WriteMessage(c.wbuf[:size]); err != nil {
+			return 0, err
+		}
+		c.wbuf = c.wbuf[size:]
+	}
+	if len(c.wbuf) == 0 {
+		c.wbuf = nil
+	}
+	return len(p), nil
+}
@@ -0,0 +1,165 @@
+package styx
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"context"
+
+	"aqwari.net/net/styx/internal/websocket"
+	"aqwari.net/net/styx/styxproto"
+)
+
+// wsServer serves srv over WebSockets, and returns its URL. When
+// the test ends, the server side of each connection is closed,
+// and the test waits for srv to finish serving it.
+func wsServer(t *testing.T, srv *Server) string {
+	if srv.ErrorLog == nil {
+		srv.ErrorLog = testLogger{t}
+	}
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	h := srv.WebSocketHandler()
+	hs := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		h.ServeHTTP(w, r)
+	}))
+	hs.Config.ConnState = func(nc net.Conn, state http.ConnState) {
+		if state == http.StateHijacked {
+			mu.Lock()
+			conns = append(conns, nc)
+			mu.Unlock()
+		}
+	}
+	hs.Start()
+	t.Cleanup(func() {
+		mu.Lock()
+		for _, nc := range conns {
+			nc.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+		hs.Close()
+	})
+	return "ws" + strings.TrimPrefix(hs.URL, "http")
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	const contents = "hello over websockets"
+	url := wsServer(t, &Server{
+		Handler: HandlerFunc(func(s *Session) {
+			for s.Next() {
+				switch req := s.Request().(type) {
+				case Twalk:
+					req.Rwalk(memFile{"hello", nil}, nil)
+				case Topen:
+					req.Ropen(strings.NewReader(contents), nil)
+				}
+			}
+		}),
+	})
+	ws, err := websocket.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, err := NewClient(ctx, newMsgConn(ws, styxproto.DefaultMaxSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	root, _, err := c.Attach(ctx, styxproto.NoFid, "gopher", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, _, err := c.Walk(ctx, root, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Open(ctx, fid, styxproto.OREAD); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, err := c.Read(ctx, fid, buf, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], []byte(contents)) {
+		t.Errorf("read %q, wanted %q", buf[:n], contents)
+	}
+}
+
+func TestWebSocketOneMessagePerFrame(t *testing.T) {
+	url := wsServer(t, &Server{})
+	ws, err := websocket.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// Each reply must arrive in its own message.
+	var buf bytes.Buffer
+	enc := styxproto.NewEncoder(&buf)
+	enc.Tversion(styxproto.DefaultMaxSize, "9P2000")
+	enc.Flush()
+	if err := ws.WriteMessage(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ws.ReadMessage(styxproto.DefaultMaxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := styxproto.Unmarshal(msg); err != nil {
+		t.Fatal(err)
+	} else if _, ok := m.(styxproto.Rversion); !ok {
+		t.Fatalf("got %T, wanted Rversion", m)
+	}
+
+	// Two messages in one frame end the connection.
+	buf.Reset()
+	enc.Tattach(1, 0, styxproto.NoFid, "", "")
+	enc.Tattach(2, 1, styxproto.NoFid, "", "")
+	enc.Flush()
+	if err := ws.WriteMessage(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := ws.ReadMessage(styxproto.DefaultMaxSize); err == nil {
+		m, _ := styxproto.Unmarshal(msg)
+		t.Errorf("server accepted two messages in one frame, sent %v", m)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	url := wsServer(t, &Server{})
+	req, err := http.NewRequest("GET", "http"+strings.TrimPrefix(url, "ws"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Origin", "http://evil.example.com")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusForbidden {
+		t.Errorf("cross-origin handshake got status %d, wanted %d",
+			rsp.StatusCode, http.StatusForbidden)
+	}
+}
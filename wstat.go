@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"path"
 	"sync/atomic"
 	"time"
 
@@ -59,11 +60,21 @@ func (t twstat) handled() bool {
 	return atomic.LoadInt32(&t.filled[t.index]) == 1
 }
 
+// The response is collected with those of the other attributes,
+// rather than being sent to the client directly.
+func (t twstat) defaultResponse() {
+	t.Rerror("permission denied")
+}
+
 func (s *Session) handleTwstat(ctx context.Context, msg styxproto.Twstat, file file) bool {
 	// mode, atime+mtime, length, name, uid+gid, sync
 	// we will ignore muid
 	const numMutable = 6
 
+	if s.denyReadOnly(msg) {
+		return true
+	}
+
 	// By convention, sending a Twstat message with a stat structure consisting
 	// entirely of "don't touch" values indicates that the client wants the server
 	// to sync the file to disk.
@@ -72,6 +83,25 @@ func (s *Session) handleTwstat(ctx context.Context, msg styxproto.Twstat, file f
 
 	stat := msg.Stat()
 
+	// A rename must stay in the same directory, and the root
+	// of the session cannot be renamed, or the client could
+	// move files out from under the session's root.
+	name := string(stat.Name())
+	if name != "" && name != path.Base(file.name) {
+		var err string
+		if file.name == s.root {
+			err = "cannot rename the root directory"
+		} else if !validName(name) {
+			err = fmt.Sprintf("invalid file name %q", name)
+		}
+		if err != "" {
+			s.conn.clearTag(msg.Tag())
+			s.conn.Rerror(msg.Tag(), "%s", err)
+			s.conn.Flush()
+			return true
+		}
+	}
+
 	// We buffer the channel so that the response
 	// methods for each attribute do not block.
 	status := make(chan error, numMutable)
@@ -81,45 +111,45 @@ func (s *Session) handleTwstat(ctx context.Context, msg styxproto.Twstat, file f
 	atime, mtime := stat.Atime(), stat.Mtime()
 	if atime != math.MaxUint32 || mtime != math.MaxUint32 {
 		haveChanges = true
-		s.requests <- Tutimes{
+		s.send(Tutimes{
 			Atime:  time.Unix(int64(atime), 0),
 			Mtime:  time.Unix(int64(mtime), 0),
 			twstat: twstat{status, filled, messages, info},
-		}
+		})
 		messages++
 	}
 	if uid, gid := string(stat.Uid()), string(stat.Gid()); uid != "" || gid != "" {
 		haveChanges = true
-		s.requests <- Tchown{
+		s.send(Tchown{
 			User:   uid,
 			Group:  gid,
 			twstat: twstat{status, filled, messages, info},
-		}
+		})
 		messages++
 	}
-	if name := string(stat.Name()); name != "" && name != file.name {
+	if name != "" && name != path.Base(file.name) {
 		haveChanges = true
-		s.requests <- Trename{
+		s.send(Trename{
 			OldPath: file.name,
-			NewPath: name,
+			NewPath: path.Join(path.Dir(file.name), name),
 			twstat:  twstat{status, filled, messages, info},
-		}
+		})
 		messages++
 	}
 	if length := stat.Length(); length != -1 {
 		haveChanges = true
-		s.requests <- Ttruncate{
+		s.send(Ttruncate{
 			Size:   length,
 			twstat: twstat{status, filled, messages, info},
-		}
+		})
 		messages++
 	}
 	if stat.Mode() != math.MaxUint32 {
 		haveChanges = true
-		s.requests <- Tchmod{
+		s.send(Tchmod{
 			Mode:   styxfile.ModeOS(stat.Mode()),
 			twstat: twstat{status, filled, messages, info},
-		}
+		})
 		messages++
 	}
 	if len(stat.Muid()) != 0 {
@@ -128,13 +158,14 @@ func (s *Session) handleTwstat(ctx context.Context, msg styxproto.Twstat, file f
 		haveChanges = true
 	}
 	if !haveChanges {
-		s.requests <- Tsync{
+		s.send(Tsync{
 			twstat: twstat{status, filled, messages, info},
-		}
+		})
 		messages++
 	}
 
 	go func() {
+		defer info.done()
 		var (
 			success bool
 			err     error
@@ -154,7 +185,7 @@ func (s *Session) handleTwstat(ctx context.Context, msg styxproto.Twstat, file f
 		if success {
 			s.conn.Rwstat(msg.Tag())
 		} else {
-			s.conn.Rerror(msg.Tag(), "%s", err)
+			s.conn.sendError(msg.Tag(), err)
 		}
 		s.conn.Flush()
 	}()
@@ -168,6 +199,8 @@ func (s *Session) handleTwstat(ctx context.Context, msg styxproto.Twstat, file f
 // The default response for a Trename request is an Rerror message
 // saying "permission denied"
 type Trename struct {
+	// The absolute paths to the file before and after the
+	// rename. Both are in the same directory.
 	OldPath, NewPath string
 	twstat
 }
@@ -177,6 +210,8 @@ func (t Trename) WithContext(ctx context.Context) Request {
 	return t
 }
 
+func (t Trename) Kind() string { return "Trename" }
+
 // The Path method of a Trename request returns the current path
 // to the file, before a rename has taken place.
 func (t Trename) Path() string {
@@ -216,6 +251,8 @@ func (t Tchmod) WithContext(ctx context.Context) Request {
 	return t
 }
 
+func (t Tchmod) Kind() string { return "Tchmod" }
+
 // Rchmod, when called with a nil error, indicates that the permissions
 // of the file were updated. Future stat requests should reflect the new
 // file mode.
@@ -236,6 +273,8 @@ func (t Tutimes) WithContext(ctx context.Context) Request {
 	return t
 }
 
+func (t Tutimes) Kind() string { return "Tutimes" }
+
 // Rutimes, when called with a nil error, indicates that the file
 // times were succesfully updated. Future stat requests should reflect
 // the new access and modification times.
@@ -260,6 +299,8 @@ func (t Tchown) WithContext(ctx context.Context) Request {
 	return t
 }
 
+func (t Tchown) Kind() string { return "Tchown" }
+
 // Rchown, when called with a nil error, indicates that file and group
 // ownership attributes were updated for the given file. Future stat
 // requests for the same file should reflect the changes.
@@ -270,6 +311,9 @@ func (t Tchown) Rchown(err error) { t.respond(err) }
 //
 // The default response to a Ttruncate message is an Rerror message
 // saying "permission denied".
+//
+// A Ttruncate request with a Size of 0 is also sent when a client opens
+// a file with the OTRUNC flag; see the documentation for Topen.
 type Ttruncate struct {
 	Size int64
 	twstat
@@ -280,10 +324,17 @@ func (t Ttruncate) WithContext(ctx context.Context) Request {
 	return t
 }
 
+func (t Ttruncate) Kind() string { return "Ttruncate" }
+
 // Rtruncate, when called with a nil error, indicates that the file has been
 // updated to reflect Size. Future reads, writes and stats should reflect
 // the new file length.
-func (t Ttruncate) Rtruncate(err error) { t.respond(err) }
+func (t Ttruncate) Rtruncate(err error) {
+	if err == nil {
+		t.session.conn.modified(t.Path())
+	}
+	t.respond(err)
+}
 
 // A Tsync request is made by the client to indicate that the client would
 // like any changes made to the file to be flushed to durable storage. Use
@@ -300,6 +351,8 @@ func (t Tsync) WithContext(ctx context.Context) Request {
 	return t
 }
 
+func (t Tsync) Kind() string { return "Tsync" }
+
 // Rsync, when called with a nil error, indicates that the file has
 // been flushed to durable storage. Note that different servers will
 // have different definitions of what "durable" means, and provide